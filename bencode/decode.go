@@ -0,0 +1,443 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Unmarshaler is implemented by types that decode themselves. The data
+// passed in is the complete encoding of one value.
+type Unmarshaler interface {
+	UnmarshalBencode(data []byte) error
+}
+
+// SyntaxError describes malformed input.
+type SyntaxError struct {
+	Offset int
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+// UnmarshalTypeError describes a value that can't be stored in a Go type.
+type UnmarshalTypeError struct {
+	Value  string
+	Type   reflect.Type
+	Offset int
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// DefaultMaxDepth bounds list and dictionary nesting.
+const DefaultMaxDepth = 256
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// Unmarshal decodes the single bencoded value in data into v, which must be
+// a non-nil pointer. Trailing data is an error.
+func Unmarshal(data []byte, v any) error {
+	return unmarshal(data, v, false)
+}
+
+// UnmarshalStrict is like Unmarshal but only accepts canonical encodings:
+// dictionary keys must be sorted and unique, and integers and string
+// lengths must not have leading zeros or a negative zero.
+func UnmarshalStrict(data []byte, v any) error {
+	return unmarshal(data, v, true)
+}
+
+func unmarshal(data []byte, v any, strict bool) error {
+	return unmarshalWith(&decodeState{data: data, strict: strict, maxDepth: DefaultMaxDepth}, v)
+}
+
+func unmarshalWith(d *decodeState, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: Unmarshal needs a non-nil pointer, got %T", v)
+	}
+
+	if err := d.value(rv.Elem(), 0); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return d.syntaxError("trailing data")
+	}
+	return nil
+}
+
+type decodeState struct {
+	data     []byte
+	pos      int
+	strict   bool
+	maxDepth int
+}
+
+func (d *decodeState) syntaxError(msg string) error {
+	return &SyntaxError{Offset: d.pos, msg: msg}
+}
+
+func (d *decodeState) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, d.syntaxError("unexpected end of input")
+	}
+	return d.data[d.pos], nil
+}
+
+// value decodes the value at d.pos into v.
+func (d *decodeState) value(v reflect.Value, depth int) error {
+	start := d.pos
+
+	// Custom decoders get the raw bytes of the whole value
+	if v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		if err := d.skip(depth); err != nil {
+			return err
+		}
+		return v.Addr().Interface().(Unmarshaler).UnmarshalBencode(d.data[start:d.pos])
+	}
+
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem(), depth)
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		x, err := d.generic(depth)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(x))
+		return nil
+	}
+
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		return d.integer(v)
+	case c >= '0' && c <= '9':
+		return d.string(v)
+	case c == 'l':
+		return d.list(v, depth)
+	case c == 'd':
+		return d.dict(v, depth)
+	}
+	return d.syntaxError(fmt.Sprintf("invalid value start %q", c))
+}
+
+// readInt parses the digits at d.pos up to the terminator byte, leaving
+// d.pos just past it.
+func (d *decodeState) readInt(term byte) (string, error) {
+	end := bytes.IndexByte(d.data[d.pos:], term)
+	if end < 0 {
+		return "", d.syntaxError("unterminated integer")
+	}
+	s := string(d.data[d.pos : d.pos+end])
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" || strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+		return "", d.syntaxError(fmt.Sprintf("invalid integer %q", s))
+	}
+	if d.strict && ((len(digits) > 1 && digits[0] == '0') || s == "-0") {
+		return "", d.syntaxError(fmt.Sprintf("non-canonical integer %q", s))
+	}
+	d.pos += end + 1
+	return s, nil
+}
+
+// readString returns the bytes of the string at d.pos.
+func (d *decodeState) readString() ([]byte, error) {
+	s, err := d.readInt(':')
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(s)
+	if err != nil || length < 0 {
+		return nil, d.syntaxError(fmt.Sprintf("invalid string length %q", s))
+	}
+	if length > len(d.data)-d.pos {
+		return nil, d.syntaxError("string runs past end of input")
+	}
+	b := d.data[d.pos : d.pos+length]
+	d.pos += length
+	return b, nil
+}
+
+func (d *decodeState) integer(v reflect.Value) error {
+	start := d.pos
+	d.pos++ // 'i'
+	s, err := d.readInt('e')
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			return &UnmarshalTypeError{Value: "integer " + s, Type: v.Type(), Offset: start}
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			return &UnmarshalTypeError{Value: "integer " + s, Type: v.Type(), Offset: start}
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return &UnmarshalTypeError{Value: "integer " + s, Type: v.Type(), Offset: start}
+		}
+		v.SetBool(n != 0)
+	default:
+		return &UnmarshalTypeError{Value: "integer", Type: v.Type(), Offset: start}
+	}
+	return nil
+}
+
+func (d *decodeState) string(v reflect.Value) error {
+	start := d.pos
+	b, err := d.readString()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(b))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(append([]byte(nil), b...))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(b) != v.Len() {
+			return &UnmarshalTypeError{Value: fmt.Sprintf("string of length %d", len(b)), Type: v.Type(), Offset: start}
+		}
+		reflect.Copy(v, reflect.ValueOf(b))
+	default:
+		return &UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: start}
+	}
+	return nil
+}
+
+func (d *decodeState) list(v reflect.Value, depth int) error {
+	start := d.pos
+	if depth >= d.maxDepth {
+		return d.syntaxError("nesting too deep")
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return &UnmarshalTypeError{Value: "list", Type: v.Type(), Offset: start}
+	}
+	d.pos++ // 'l'
+
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	i := 0
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.pos++
+			break
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		} else if i >= v.Len() {
+			return &UnmarshalTypeError{Value: "list too long", Type: v.Type(), Offset: start}
+		}
+		if err := d.value(v.Index(i), depth+1); err != nil {
+			return err
+		}
+		i++
+	}
+	if v.Kind() == reflect.Array && i != v.Len() {
+		return &UnmarshalTypeError{Value: fmt.Sprintf("list of length %d", i), Type: v.Type(), Offset: start}
+	}
+	return nil
+}
+
+func (d *decodeState) dict(v reflect.Value, depth int) error {
+	start := d.pos
+	if depth >= d.maxDepth {
+		return d.syntaxError("nesting too deep")
+	}
+
+	var fields map[string]field
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case v.Kind() == reflect.Struct:
+		fields = fieldsByName(v.Type())
+	default:
+		return &UnmarshalTypeError{Value: "dictionary", Type: v.Type(), Offset: start}
+	}
+	d.pos++ // 'd'
+
+	var prev []byte
+	for n := 0; ; n++ {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.pos++
+			return nil
+		}
+
+		keyStart := d.pos
+		if c < '0' || c > '9' {
+			return d.syntaxError("dictionary key is not a string")
+		}
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if d.strict && n > 0 && bytes.Compare(prev, key) >= 0 {
+			d.pos = keyStart
+			return d.syntaxError(fmt.Sprintf("key %q out of order", key))
+		}
+		prev = key
+
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(elem, depth+1); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+			continue
+		}
+
+		f, ok := fields[string(key)]
+		if !ok {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.value(v.Field(f.index), depth+1); err != nil {
+			return err
+		}
+	}
+}
+
+// skip moves past the value at d.pos, validating it.
+func (d *decodeState) skip(depth int) error {
+	_, err := d.generic(depth)
+	return err
+}
+
+// generic decodes the value at d.pos into int64, string, []any or
+// map[string]any.
+func (d *decodeState) generic(depth int) (any, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == 'i':
+		var n int64
+		if err := d.integer(reflect.ValueOf(&n).Elem()); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case c >= '0' && c <= '9':
+		b, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case c == 'l':
+		if depth >= d.maxDepth {
+			return nil, d.syntaxError("nesting too deep")
+		}
+		d.pos++
+		list := []any{}
+		for {
+			c, err := d.peek()
+			if err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.pos++
+				return list, nil
+			}
+			x, err := d.generic(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, x)
+		}
+	case c == 'd':
+		m := map[string]any{}
+		if err := d.dict(reflect.ValueOf(&m).Elem(), depth); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return nil, d.syntaxError(fmt.Sprintf("invalid value start %q", c))
+}
+
+// field describes how a struct field maps to a dictionary key.
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedFields returns the encodable fields of a struct type sorted by key.
+func cachedFields(t reflect.Type) []field {
+	if fs, ok := fieldCache.Load(t); ok {
+		return fs.([]field)
+	}
+
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{
+			name:      name,
+			index:     i,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+	// Keys must be written in raw byte order
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+
+	fs, _ := fieldCache.LoadOrStore(t, fields)
+	return fs.([]field)
+}
+
+func fieldsByName(t reflect.Type) map[string]field {
+	byName := make(map[string]field)
+	for _, f := range cachedFields(t) {
+		byName[f.name] = f
+	}
+	return byName
+}
@@ -0,0 +1,203 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type decodeInfo struct {
+	Name        string `bencode:"name"`
+	PieceLength int    `bencode:"piece length"`
+	Private     bool   `bencode:"private"`
+}
+
+type decodeTorrent struct {
+	Announce string     `bencode:"announce"`
+	Info     decodeInfo `bencode:"info"`
+	InfoRaw  RawMessage `bencode:"-"`
+	Nodes    [][]any    `bencode:"nodes"`
+}
+
+type rawTorrent struct {
+	Info RawMessage `bencode:"info"`
+}
+
+// upper is an Unmarshaler that upper-cases the string it receives.
+type upper string
+
+func (u *upper) UnmarshalBencode(data []byte) error {
+	var s string
+	if err := Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b := []byte(s)
+	for i := range b {
+		if b[i] >= 'a' && b[i] <= 'z' {
+			b[i] -= 'a' - 'A'
+		}
+	}
+	*u = upper(b)
+	return nil
+}
+
+func TestUnmarshal_Struct(t *testing.T) {
+	data := []byte("d8:announce3:url4:infod4:name4:test12:piece lengthi16384e7:privatei1e6:sourcei1ee5:nodesll1:ai1eeee")
+
+	var got decodeTorrent
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	want := decodeTorrent{
+		Announce: "url",
+		Info:     decodeInfo{Name: "test", PieceLength: 16384, Private: true},
+		Nodes:    [][]any{{"a", int64(1)}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal() = %+v, want %+v", got, want)
+	}
+
+	var raw rawTorrent
+	if err := Unmarshal(data, &raw); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if string(raw.Info) != "d4:name4:test12:piece lengthi16384e7:privatei1e6:sourcei1ee" {
+		t.Errorf("Unmarshal() RawMessage = %q", raw.Info)
+	}
+}
+
+func TestUnmarshal_Values(t *testing.T) {
+	var s string
+	var n int
+	var u8 uint8
+	var b []byte
+	var arr [2]byte
+	var list []int
+	var m map[string]string
+	var x any
+	var p *int
+	var custom upper
+
+	tests := []struct {
+		name string
+		data string
+		v    any
+		want any
+	}{
+		{"string", "4:spam", &s, "spam"},
+		{"int", "i-42e", &n, -42},
+		{"uint8", "i255e", &u8, uint8(255)},
+		{"bytes", "3:\x00\x01\x02", &b, []byte{0, 1, 2}},
+		{"byte array", "2:ab", &arr, [2]byte{'a', 'b'}},
+		{"list", "li1ei2ee", &list, []int{1, 2}},
+		{"map", "d1:a1:b1:c1:de", &m, map[string]string{"a": "b", "c": "d"}},
+		{"generic", "d1:ali1e1:xee", &x, map[string]any{"a": []any{int64(1), "x"}}},
+		{"pointer", "i5e", &p, func() *int { n := 5; return &n }()},
+		{"unmarshaler", "5:hello", &custom, upper("HELLO")},
+		{"lenient leading zero", "i007e", &n, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Unmarshal([]byte(tt.data), tt.v); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			got := reflect.ValueOf(tt.v).Elem().Interface()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	var n int
+	var u8 uint8
+	var s string
+	var arr [2]byte
+	var info decodeInfo
+
+	tests := []struct {
+		name     string
+		data     string
+		v        any
+		wantType bool
+	}{
+		{"empty", "", &n, false},
+		{"trailing data", "i1ei2e", &n, false},
+		{"unterminated int", "i12", &n, false},
+		{"bad int", "i1x2e", &n, false},
+		{"empty int", "ie", &n, false},
+		{"string too long", "5:abc", &s, false},
+		{"negative length", "-1:a", &s, false},
+		{"non-string key", "di1ei2ee", &info, false},
+		{"unterminated dict", "d4:name1:a", &info, false},
+		{"overflow", "i256e", &u8, true},
+		{"negative uint", "i-1e", &u8, true},
+		{"wrong type", "i1e", &s, true},
+		{"array length", "3:abc", &arr, true},
+		{"struct field type", "d4:name1:a12:piece length1:xe", &info, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Unmarshal([]byte(tt.data), tt.v)
+			if err == nil {
+				t.Fatalf("Unmarshal(%q) should return error", tt.data)
+			}
+			var typeErr *UnmarshalTypeError
+			if errors.As(err, &typeErr) != tt.wantType {
+				t.Errorf("Unmarshal(%q) error = %v, want type error %v", tt.data, err, tt.wantType)
+			}
+		})
+	}
+
+	if err := Unmarshal([]byte("i1e"), n); err == nil {
+		t.Errorf("Unmarshal() into non-pointer should return error")
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"canonical", "d1:ai1e1:bl0:i-1eee", false},
+		{"unsorted keys", "d1:bi1e1:ai2ee", true},
+		{"duplicate keys", "d1:ai1e1:ai2ee", true},
+		{"leading zero int", "i01e", true},
+		{"negative zero", "i-0e", true},
+		{"leading zero length", "01:a", true},
+		{"zero is fine", "i0e", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var x any
+			err := UnmarshalStrict([]byte(tt.data), &x)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UnmarshalStrict(%q) error = %v, wantErr %v", tt.data, err, tt.wantErr)
+			}
+			// The lenient decoder accepts all of these
+			if err := Unmarshal([]byte(tt.data), &x); err != nil {
+				t.Errorf("Unmarshal(%q) error = %v", tt.data, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshal_MaxDepth(t *testing.T) {
+	deep := make([]byte, 0, 2*(DefaultMaxDepth+1))
+	for i := 0; i <= DefaultMaxDepth; i++ {
+		deep = append(deep, 'l')
+	}
+	for i := 0; i <= DefaultMaxDepth; i++ {
+		deep = append(deep, 'e')
+	}
+
+	var x any
+	if err := Unmarshal(deep, &x); err == nil {
+		t.Errorf("Unmarshal() should reject nesting deeper than %d", DefaultMaxDepth)
+	}
+}
@@ -0,0 +1,98 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+)
+
+type encodeInner struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type encodeOuter struct {
+	Name     string        `bencode:"name"`
+	Files    []encodeInner `bencode:"files,omitempty"`
+	Private  bool          `bencode:"private,omitempty"`
+	Skipped  string        `bencode:"-"`
+	Hash     [4]byte       `bencode:"hash"`
+	Raw      RawMessage    `bencode:"raw,omitempty"`
+	Optional *int          `bencode:"optional"`
+	hidden   int
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{"string", "spam", "4:spam"},
+		{"empty string", "", "0:"},
+		{"bytes", []byte{0, 1}, "2:\x00\x01"},
+		{"positive int", 42, "i42e"},
+		{"negative int", int64(-3), "i-3e"},
+		{"zero", uint16(0), "i0e"},
+		{"bool", true, "i1e"},
+		{"list", []any{"a", 1}, "l1:ai1ee"},
+		{"sorted map", map[string]int{"b": 2, "a": 1}, "d1:ai1e1:bi2ee"},
+		{"raw message", RawMessage("d1:xi1ee"), "d1:xi1ee"},
+		{
+			"struct sorts keys and honours tags",
+			encodeOuter{Name: "n", Hash: [4]byte{'a', 'b', 'c', 'd'}, Skipped: "x", hidden: 1},
+			"d4:hash4:abcd4:name1:ne",
+		},
+		{
+			"struct with nested values",
+			encodeOuter{Name: "n", Private: true, Files: []encodeInner{{1, []string{"a"}}}, Raw: RawMessage("i7e")},
+			"d5:filesld6:lengthi1e4:pathl1:aeee4:hash4:\x00\x00\x00\x004:name1:n7:privatei1e3:rawi7ee",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.v)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Marshal() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshal_Unsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+	}{
+		{"float", 1.5},
+		{"nil", nil},
+		{"int map keys", map[int]string{1: "a"}},
+		{"nil in list", []any{nil}},
+		{"empty raw message", RawMessage(nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Marshal(tt.v); err == nil {
+				t.Errorf("Marshal(%v) should return error", tt.v)
+			}
+		})
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(1); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "1:ai1e" {
+		t.Errorf("Encode() wrote %q, want %q", buf.String(), "1:ai1e")
+	}
+}
@@ -0,0 +1,57 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+)
+
+var fuzzSeeds = []string{
+	"i0e", "i-12e", "4:spam", "0:", "le", "de",
+	"l4:spami42ee", "d3:cow3:moo4:spam4:eggse",
+	"d8:announce3:url4:infod6:lengthi5e4:name1:aee",
+	"i01e", "d1:b0:1:a0:e", "llllllllee", "5:ab",
+}
+
+// FuzzUnmarshal checks that arbitrary input never panics and that anything
+// the strict decoder accepts re-encodes to exactly the same bytes.
+func FuzzUnmarshal(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var lenient any
+		Unmarshal(data, &lenient)
+
+		var strict any
+		if err := UnmarshalStrict(data, &strict); err != nil {
+			return
+		}
+		out, err := Marshal(strict)
+		if err != nil {
+			t.Fatalf("Marshal() of decoded value error = %v", err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("round trip of %q produced %q", data, out)
+		}
+	})
+}
+
+// FuzzDecoder checks that the stream decoder agrees with Unmarshal.
+func FuzzDecoder(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := NewDecoder(bytes.NewReader(data))
+		dec.SetMaxSize(1 << 16)
+		var streamed any
+		streamErr := dec.Decode(&streamed)
+
+		if streamErr == nil && dec.InputOffset() == int64(len(data)) {
+			var whole any
+			if err := Unmarshal(data, &whole); err != nil {
+				t.Errorf("Decoder accepted %q but Unmarshal failed: %v", data, err)
+			}
+		}
+	})
+}
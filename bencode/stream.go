@@ -0,0 +1,154 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxIntLength bounds the digits of an integer or string length read from
+// a stream; no valid value needs more.
+const maxIntLength = 20
+
+// Decoder reads bencoded values from a stream. It reads exactly one value
+// per Decode call and can enforce limits, making it suitable for input from
+// trackers and peers.
+type Decoder struct {
+	r        *bufio.Reader
+	strict   bool
+	maxSize  int
+	maxDepth int
+	offset   int64
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), maxDepth: DefaultMaxDepth}
+}
+
+// Strict makes the decoder reject non-canonical input, as UnmarshalStrict
+// does.
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// SetMaxSize limits the encoded size of each value; zero means no limit.
+func (d *Decoder) SetMaxSize(n int) {
+	d.maxSize = n
+}
+
+// SetMaxDepth limits list and dictionary nesting.
+func (d *Decoder) SetMaxDepth(n int) {
+	d.maxDepth = n
+}
+
+// InputOffset returns the number of bytes consumed by Decode so far.
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Decode reads the next value from the stream and stores it in v.
+func (d *Decoder) Decode(v any) error {
+	data, err := d.readValue()
+	if err != nil {
+		return err
+	}
+	d.offset += int64(len(data))
+	return unmarshalWith(&decodeState{data: data, strict: d.strict, maxDepth: d.maxDepth}, v)
+}
+
+// readValue reads the raw bytes of one value, enforcing the size and depth
+// limits before anything is buffered.
+func (d *Decoder) readValue() ([]byte, error) {
+	var buf bytes.Buffer
+	depth := 0
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && buf.Len() > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		buf.WriteByte(c)
+		if err := d.checkSize(buf.Len()); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case c == 'i':
+			if _, err := d.readDigits(&buf, 'e'); err != nil {
+				return nil, err
+			}
+		case c >= '0' && c <= '9':
+			digits, err := d.readDigits(&buf, ':')
+			if err != nil {
+				return nil, err
+			}
+			length, err := strconv.ParseInt(string(c)+digits, 10, 64)
+			if err != nil {
+				return nil, d.syntaxError(buf.Len(), "invalid string length")
+			}
+			if err := d.checkSize(buf.Len() + int(length)); err != nil {
+				return nil, err
+			}
+			// CopyN grows the buffer as data arrives, so a bogus length
+			// can't make us allocate up front
+			if _, err := io.CopyN(&buf, d.r, length); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+		case c == 'l' || c == 'd':
+			depth++
+			if depth > d.maxDepth {
+				return nil, d.syntaxError(buf.Len(), "nesting too deep")
+			}
+			continue
+		case c == 'e':
+			if depth == 0 {
+				return nil, d.syntaxError(buf.Len(), "unexpected end marker")
+			}
+			depth--
+		default:
+			return nil, d.syntaxError(buf.Len(), fmt.Sprintf("invalid value start %q", c))
+		}
+
+		if depth == 0 {
+			return buf.Bytes(), nil
+		}
+	}
+}
+
+// readDigits copies bytes up to and including term into buf and returns
+// the bytes before term.
+func (d *Decoder) readDigits(buf *bytes.Buffer, term byte) (string, error) {
+	start := buf.Len()
+	for i := 0; i <= maxIntLength; i++ {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		buf.WriteByte(c)
+		if c == term {
+			return string(buf.Bytes()[start : buf.Len()-1]), nil
+		}
+	}
+	return "", d.syntaxError(buf.Len(), "integer too long")
+}
+
+func (d *Decoder) checkSize(n int) error {
+	if d.maxSize > 0 && (n > d.maxSize || n < 0) {
+		return fmt.Errorf("bencode: value exceeds maximum size of %d bytes", d.maxSize)
+	}
+	return nil
+}
+
+func (d *Decoder) syntaxError(n int, msg string) error {
+	return &SyntaxError{Offset: int(d.offset) + n - 1, msg: msg}
+}
@@ -0,0 +1,58 @@
+package bencode
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecoder_Sequence(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("i1e4:spamd1:ali1eee"))
+
+	var n int
+	var s string
+	var m map[string][]int
+	if err := dec.Decode(&n); err != nil || n != 1 {
+		t.Fatalf("Decode() = %d, %v", n, err)
+	}
+	if err := dec.Decode(&s); err != nil || s != "spam" {
+		t.Fatalf("Decode() = %q, %v", s, err)
+	}
+	if err := dec.Decode(&m); err != nil || len(m["a"]) != 1 {
+		t.Fatalf("Decode() = %v, %v", m, err)
+	}
+	if off := dec.InputOffset(); off != 19 {
+		t.Errorf("InputOffset() = %d, want 19", off)
+	}
+	if err := dec.Decode(&n); err != io.EOF {
+		t.Errorf("Decode() at end error = %v, want io.EOF", err)
+	}
+}
+
+func TestDecoder_Limits(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		setup func(*Decoder)
+	}{
+		{"value over max size", "d5:peers20:aaaaaaaaaaaaaaaaaaaae", func(d *Decoder) { d.SetMaxSize(16) }},
+		{"huge declared length", "99999999999:a", func(d *Decoder) { d.SetMaxSize(1024) }},
+		{"too deep", "lllleeee", func(d *Decoder) { d.SetMaxDepth(3) }},
+		{"strict rejects unsorted", "d1:bi1e1:ai1ee", func(d *Decoder) { d.Strict() }},
+		{"truncated string", "10:abc", func(d *Decoder) {}},
+		{"truncated dict", "d1:a", func(d *Decoder) {}},
+		{"stray end", "e", func(d *Decoder) {}},
+		{"endless integer", "i" + strings.Repeat("1", 100) + "e", func(d *Decoder) {}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(strings.NewReader(tt.input))
+			tt.setup(dec)
+			var x any
+			if err := dec.Decode(&x); err == nil || err == io.EOF {
+				t.Errorf("Decode(%q) error = %v, want a decoding error", tt.input, err)
+			}
+		})
+	}
+}
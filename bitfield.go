@@ -1,4 +1,4 @@
-package main
+package torrent
 
 type Bitfield []byte
 
@@ -13,3 +13,13 @@ func (bf Bitfield) HasPiece(index int) bool {
 	// Big-endian bit order the most significant bit is index 0
 	return bf[byteIndex]>>(7-offset)&1 != 0
 }
+
+// SetPiece sets a bit in the bitfield
+func (bf Bitfield) SetPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - offset)
+}
@@ -1,4 +1,4 @@
-package main
+package torrent
 
 import "testing"
 
@@ -73,3 +73,26 @@ func TestHasPiece(t *testing.T) {
 		})
 	}
 }
+
+func TestSetPiece(t *testing.T) {
+	bf := make(Bitfield, 2)
+	for _, index := range []int{0, 6, 9, 15} {
+		bf.SetPiece(index)
+	}
+
+	want := Bitfield{0b10000010, 0b01000001}
+	for i := range want {
+		if bf[i] != want[i] {
+			t.Errorf("SetPiece() byte %d = %08b, want %08b", i, bf[i], want[i])
+		}
+	}
+
+	// Out of range indexes are ignored
+	bf.SetPiece(16)
+	bf.SetPiece(-1)
+	for _, index := range []int{0, 6, 9, 15} {
+		if !bf.HasPiece(index) {
+			t.Errorf("HasPiece(%d) = false after SetPiece", index)
+		}
+	}
+}
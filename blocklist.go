@@ -0,0 +1,275 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// datAllowLevel is the access level from which DAT entries allow rather
+// than block their range
+const datAllowLevel = 128
+
+// errBlocked is returned for peers the IP filter blocks.
+var errBlocked = errors.New("peer is blocked by the IP filter")
+
+// IPFilter blocks ranges of IPv4 and IPv6 addresses. It holds the ranges
+// merged and sorted, so lookups are a binary search however long the
+// lists it was loaded from. A nil IPFilter blocks nothing.
+type IPFilter struct {
+	ranges []ipRange
+}
+
+// ipRange is an inclusive range of addresses, IPv4 ones mapped into IPv6
+// so that both families share one ordering.
+type ipRange struct {
+	first, last netip.Addr
+}
+
+// LoadIPFilter reads the blocklists at paths into one filter. Lists may
+// be gzipped.
+func LoadIPFilter(paths ...string) (*IPFilter, error) {
+	var ranges []ipRange
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		r, err := parseBlocklist(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		ranges = append(ranges, r...)
+	}
+	return newIPFilter(ranges), nil
+}
+
+// ParseIPFilter reads a blocklist, which may be gzipped. Each line is a
+// range in one of the common formats:
+//
+//	PeerGuardian text:  Some description:1.2.3.0-1.2.3.255
+//	eMule DAT:          001.002.003.000 - 001.002.003.255 , 000 , Some description
+//	CIDR:               1.2.3.0/24
+//
+// IPv6 addresses work in each. DAT entries with an access level of 128 or
+// more allow their range and are skipped. Blank lines and lines starting
+// with # or // are ignored.
+func ParseIPFilter(r io.Reader) (*IPFilter, error) {
+	ranges, err := parseBlocklist(r)
+	if err != nil {
+		return nil, err
+	}
+	return newIPFilter(ranges), nil
+}
+
+func parseBlocklist(r io.Reader) ([]ipRange, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	var ranges []ipRange
+	sc := bufio.NewScanner(br)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, ok, err := parseBlocklistLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if ok {
+			ranges = append(ranges, rng)
+		}
+	}
+	return ranges, sc.Err()
+}
+
+// parseBlocklistLine parses one line of a blocklist, reporting false for
+// DAT entries that allow their range.
+func parseBlocklistLine(line string) (ipRange, bool, error) {
+	// DAT: range, access level, description. PeerGuardian descriptions
+	// can hold commas too, so it's only DAT if the fields parse.
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if rng, rerr := parseIPRange(fields[0]); err == nil && rerr == nil {
+			return rng, level < datAllowLevel, nil
+		}
+	}
+
+	// CIDR
+	if !strings.Contains(line, "-") && strings.Contains(line, "/") {
+		prefix, err := netip.ParsePrefix(strings.Fields(line)[0])
+		if err != nil {
+			return ipRange{}, false, err
+		}
+		return prefixRange(prefix), true, nil
+	}
+
+	// PeerGuardian text: the description can hold colons and so can IPv6
+	// ranges, so try each split until the rest parses
+	for i := -1; i < len(line); i++ {
+		if i >= 0 && line[i] != ':' {
+			continue
+		}
+		if rng, err := parseIPRange(line[i+1:]); err == nil {
+			return rng, true, nil
+		}
+	}
+	return ipRange{}, false, fmt.Errorf("invalid range %q", line)
+}
+
+// parseIPRange parses "first-last", with optional spaces around the dash.
+func parseIPRange(s string) (ipRange, error) {
+	a, b, ok := strings.Cut(s, "-")
+	if !ok {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	first, err := parseBlocklistAddr(a)
+	if err != nil {
+		return ipRange{}, err
+	}
+	last, err := parseBlocklistAddr(b)
+	if err != nil {
+		return ipRange{}, err
+	}
+	if last.Less(first) {
+		return ipRange{}, fmt.Errorf("range %q ends before it starts", s)
+	}
+	return ipRange{first, last}, nil
+}
+
+// parseBlocklistAddr parses an address as mapped IPv6, accepting the zero
+// padded IPv4 octets DAT files use.
+func parseBlocklistAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if octets := strings.Split(s, "."); len(octets) == 4 && !strings.Contains(s, ":") {
+		for i, o := range octets {
+			if trimmed := strings.TrimLeft(o, "0"); trimmed != "" {
+				octets[i] = trimmed
+			} else if o != "" {
+				octets[i] = "0"
+			}
+		}
+		s = strings.Join(octets, ".")
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.AddrFrom16(addr.As16()), nil
+}
+
+// prefixRange returns the addresses in prefix as a range.
+func prefixRange(prefix netip.Prefix) ipRange {
+	prefix = prefix.Masked()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	first := prefix.Addr().As16()
+	last := first
+	for i := bits; i < 128; i++ {
+		last[i/8] |= 1 << (7 - i%8)
+	}
+	return ipRange{netip.AddrFrom16(first), netip.AddrFrom16(last)}
+}
+
+// newIPFilter sorts ranges and merges those that overlap or touch.
+func newIPFilter(ranges []ipRange) *IPFilter {
+	slices.SortFunc(ranges, func(a, b ipRange) int { return a.first.Compare(b.first) })
+	var merged []ipRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			prev := &merged[n-1]
+			if next := prev.last.Next(); !next.IsValid() || r.first.Compare(next) <= 0 {
+				if prev.last.Less(r.last) {
+					prev.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return &IPFilter{ranges: merged}
+}
+
+// Blocked reports whether the filter blocks ip.
+func (f *IPFilter) Blocked(ip netip.Addr) bool {
+	if f == nil || !ip.IsValid() {
+		return false
+	}
+	ip = netip.AddrFrom16(ip.As16())
+	// Find the last range starting at or before ip
+	i, found := slices.BinarySearchFunc(f.ranges, ip, func(r ipRange, ip netip.Addr) int {
+		return r.first.Compare(ip)
+	})
+	if found {
+		return true
+	}
+	return i > 0 && !f.ranges[i-1].last.Less(ip)
+}
+
+// Len returns how many distinct ranges the filter blocks.
+func (f *IPFilter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.ranges)
+}
+
+// blocklist is the client's current IP filter, swapped whole on reload so
+// lookups never wait. A nil blocklist blocks nothing.
+type blocklist struct {
+	filter atomic.Pointer[IPFilter]
+}
+
+// blocks reports whether the host of addr, an IP or host:port, is
+// filtered.
+func (b *blocklist) blocks(addr string) bool {
+	if b == nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(peerIP(addr))
+	return err == nil && b.filter.Load().Blocked(ip)
+}
+
+// SetIPFilter replaces the filter that peers from every source are
+// checked against before they're dialled or accepted. Connections already
+// open are kept. A nil filter blocks nothing.
+func (c *Client) SetIPFilter(f *IPFilter) {
+	c.blocklist.filter.Store(f)
+}
+
+// IPFilter returns the filter in use, nil if there is none.
+func (c *Client) IPFilter() *IPFilter {
+	return c.blocklist.filter.Load()
+}
+
+// ReloadBlocklists reloads ClientConfig.Blocklists from disk. If any
+// fails to load, the filter in use is kept.
+func (c *Client) ReloadBlocklists() error {
+	f, err := LoadIPFilter(c.cfg.Blocklists...)
+	if err != nil {
+		return err
+	}
+	c.SetIPFilter(f)
+	c.log.Info("blocklists loaded", "ranges", f.Len())
+	return nil
+}
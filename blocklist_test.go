@@ -0,0 +1,138 @@
+package torrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+const testBlocklist = `# PeerGuardian text
+Bad Corp, Inc.:10.0.0.0-10.0.0.255
+Spammers: with colons:192.168.1.10-192.168.1.20
+v6 range:2001:db8::-2001:db8::ffff
+
+// DAT, the second entry allowed by its level
+001.002.003.000 - 001.002.003.255 , 000 , Some description
+005.006.007.000 - 005.006.007.255 , 200 , Trusted
+# CIDR
+172.16.0.0/12
+2001:db8:1::/48
+`
+
+func TestIPFilter(t *testing.T) {
+	f, err := ParseIPFilter(strings.NewReader(testBlocklist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"10.0.0.0", true},
+		{"10.0.0.255", true},
+		{"10.0.1.0", false},
+		{"9.255.255.255", false},
+		{"192.168.1.10", true},
+		{"192.168.1.21", false},
+		{"1.2.3.4", true},
+		{"5.6.7.8", false},
+		{"172.31.255.255", true},
+		{"172.32.0.0", false},
+		{"2001:db8::1", true},
+		{"2001:db8::1:0", false},
+		{"2001:db8:1:ffff::1", true},
+		{"2001:db8:2::", false},
+		// IPv4 addresses match the same whether or not they're mapped
+		{"::ffff:10.0.0.7", true},
+	}
+	for _, tt := range tests {
+		if got := f.Blocked(netip.MustParseAddr(tt.ip)); got != tt.blocked {
+			t.Errorf("Blocked(%s) = %v, want %v", tt.ip, got, tt.blocked)
+		}
+	}
+	if f.Len() != 6 {
+		t.Errorf("Len() = %d, want 6", f.Len())
+	}
+
+	var none *IPFilter
+	if none.Blocked(netip.MustParseAddr("10.0.0.1")) {
+		t.Errorf("a nil IPFilter should block nothing")
+	}
+}
+
+func TestIPFilterMerges(t *testing.T) {
+	f, err := ParseIPFilter(strings.NewReader(`
+a:10.0.0.10-10.0.0.20
+b:10.0.0.0-10.0.0.9
+c:10.0.0.15-10.0.0.30
+d:10.0.0.40-10.0.0.50
+e:255.255.255.0-255.255.255.255
+f:255.255.255.128-255.255.255.255
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ipRange{
+		{netip.MustParseAddr("::ffff:10.0.0.0"), netip.MustParseAddr("::ffff:10.0.0.30")},
+		{netip.MustParseAddr("::ffff:10.0.0.40"), netip.MustParseAddr("::ffff:10.0.0.50")},
+		{netip.MustParseAddr("::ffff:255.255.255.0"), netip.MustParseAddr("::ffff:255.255.255.255")},
+	}
+	if len(f.ranges) != len(want) {
+		t.Fatalf("ranges = %v, want %v", f.ranges, want)
+	}
+	for i := range want {
+		if f.ranges[i] != want[i] {
+			t.Errorf("ranges[%d] = %v, want %v", i, f.ranges[i], want[i])
+		}
+	}
+}
+
+func TestIPFilterGzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("10.0.0.0/8\n"))
+	zw.Close()
+	f, err := ParseIPFilter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Blocked(netip.MustParseAddr("10.1.2.3")) {
+		t.Errorf("gzipped list wasn't read")
+	}
+}
+
+func TestIPFilterInvalid(t *testing.T) {
+	for _, list := range []string{
+		"no range here",
+		"bad:10.0.0.9-10.0.0.1",
+		"10.0.0.0/33",
+		"x:10.0.0.1-not an ip",
+	} {
+		if _, err := ParseIPFilter(strings.NewReader(list)); err == nil {
+			t.Errorf("ParseIPFilter(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	var none *blocklist
+	if none.blocks("10.0.0.1:6881") {
+		t.Errorf("a nil blocklist should block no one")
+	}
+	b := new(blocklist)
+	if b.blocks("10.0.0.1:6881") {
+		t.Errorf("an empty blocklist blocked a peer")
+	}
+	f, _ := ParseIPFilter(strings.NewReader("10.0.0.0/24\n2001:db8::/32\n"))
+	b.filter.Store(f)
+	for _, addr := range []string{"10.0.0.1:6881", "10.0.0.1", "[2001:db8::1]:51413"} {
+		if !b.blocks(addr) {
+			t.Errorf("blocks(%q) = false, want true", addr)
+		}
+	}
+	if b.blocks("10.0.1.1:6881") || b.blocks("not an address") {
+		t.Errorf("blocked an address outside the filter")
+	}
+}
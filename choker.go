@@ -0,0 +1,204 @@
+package torrent
+
+import (
+	"cmp"
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// chokeInterval is how often the choker re-ranks peers
+	chokeInterval = 10 * time.Second
+	// optimisticRounds is how many choke rounds an optimistic unchoke
+	// lasts, 30 seconds
+	optimisticRounds = 3
+	// DefaultUploadSlots is how many peers are unchoked on merit when
+	// ClientConfig.UploadSlots is zero
+	DefaultUploadSlots = 4
+	// snubTimeout is how long a peer can go without sending us data
+	// before it's considered to be snubbing us
+	snubTimeout = time.Minute
+)
+
+// choker decides which of a torrent's peers we upload to. Every
+// chokeInterval it unchokes the interested peers that give us the most:
+// those we download fastest from, or while seeding those we upload fastest
+// to, so data flows to peers that can take it. One more interested peer
+// is unchoked at random and kept for optimisticRounds, giving newcomers a
+// chance to prove themselves. Peers that have stopped sending us data are
+// snubbing us and only get the optimistic slot.
+type choker struct {
+	slots   int
+	seeding bool
+
+	mu       sync.Mutex
+	sessions map[*peerConn]*chokeSession
+	// optimistic is the peer holding the optimistic unchoke
+	optimistic *peerConn
+	// round counts ticks, to rotate the optimistic unchoke
+	round int
+	// kick asks for a round out of turn
+	kick chan struct{}
+}
+
+// chokeSession is the choker's view of one connection.
+type chokeSession struct {
+	pc *peerConn
+	// send writes a message to the peer; it must be safe to call
+	// alongside the connection's own writes
+	send func(*Message) error
+	// lastData is when the peer last sent us data, and lastDown how much
+	// it had sent by then
+	lastData time.Time
+	lastDown int64
+}
+
+func newChoker(slots int, seeding bool) *choker {
+	if slots <= 0 {
+		slots = DefaultUploadSlots
+	}
+	return &choker{
+		slots:    slots,
+		seeding:  seeding,
+		sessions: make(map[*peerConn]*chokeSession),
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+// add hands pc to the choker, which chokes and unchokes it through send.
+// The returned func removes it again.
+func (c *choker) add(pc *peerConn, send func(*Message) error) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions[pc] = &chokeSession{pc: pc, send: send, lastData: time.Now()}
+	return func() {
+		c.mu.Lock()
+		delete(c.sessions, pc)
+		if c.optimistic == pc {
+			c.optimistic = nil
+		}
+		c.mu.Unlock()
+		c.poke()
+	}
+}
+
+// poke schedules a round out of turn, so that when a peer's interest
+// changes or it leaves a free slot is filled or a wasted one freed without
+// waiting for the next tick.
+func (c *choker) poke() {
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run re-chokes every chokeInterval, and whenever poked, until ctx is
+// done.
+func (c *choker) run(ctx context.Context) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.round++
+			c.rechoke(now, c.round%optimisticRounds == 0)
+		case <-c.kick:
+			c.rechoke(time.Now(), false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rechoke ranks the peers at now, picking a new optimistic unchoke if
+// rotate is set or the current one no longer qualifies, and sends chokes
+// and unchokes to the peers whose state changes.
+func (c *choker) rechoke(now time.Time, rotate bool) {
+	type ranked struct {
+		s          *chokeSession
+		rate       float64
+		interested bool
+		snubbed    bool
+	}
+
+	c.mu.Lock()
+	peers := make([]ranked, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		down, downRate := s.pc.down.snapshotAt(now.Unix())
+		_, upRate := s.pc.up.snapshotAt(now.Unix())
+		if down > s.lastDown {
+			s.lastDown, s.lastData = down, now
+		}
+		s.pc.mu.Lock()
+		interested, amInterested := s.pc.peerInterested, s.pc.amInterested
+		s.pc.mu.Unlock()
+
+		r := ranked{s: s, rate: downRate, interested: interested}
+		if c.seeding {
+			r.rate = upRate
+		} else {
+			r.snubbed = amInterested && now.Sub(s.lastData) >= snubTimeout
+		}
+		peers = append(peers, r)
+	}
+	slices.SortFunc(peers, func(a, b ranked) int { return cmp.Compare(b.rate, a.rate) })
+
+	unchoke := make(map[*peerConn]bool)
+	interested := make(map[*peerConn]bool)
+	for _, r := range peers {
+		interested[r.s.pc] = r.interested
+		if r.interested && !r.snubbed && len(unchoke) < c.slots {
+			unchoke[r.s.pc] = true
+		}
+	}
+
+	// Keep the optimistic unchoke while it's still interested, unless it's
+	// time to rotate or it has earned a regular slot
+	if rotate || !interested[c.optimistic] || unchoke[c.optimistic] {
+		c.optimistic = nil
+		var candidates []*peerConn
+		for _, r := range peers {
+			if r.interested && !unchoke[r.s.pc] {
+				candidates = append(candidates, r.s.pc)
+			}
+		}
+		if len(candidates) > 0 {
+			c.optimistic = candidates[rand.IntN(len(candidates))]
+		}
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	// Change the state before telling the peer, so requests that follow
+	// an unchoke aren't refused
+	var changes []*chokeSession
+	var choke []bool
+	for _, r := range peers {
+		want := !unchoke[r.s.pc]
+		changed := false
+		r.s.pc.update(func(p *peerConn) {
+			changed = p.amChoking != want
+			p.amChoking = want
+		})
+		if changed {
+			changes = append(changes, r.s)
+			choke = append(choke, want)
+		}
+	}
+	c.mu.Unlock()
+
+	// Writes can wait on rate limits, so each peer is told on its own
+	var wg sync.WaitGroup
+	for i, s := range changes {
+		msg := &Message{ID: MsgUnchoke}
+		if choke[i] {
+			msg.ID = MsgChoke
+		}
+		wg.Go(func() { s.send(msg) })
+	}
+	wg.Wait()
+}
@@ -0,0 +1,141 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chokeRecorder records the messages the choker sends each peer.
+type chokeRecorder struct {
+	mu   sync.Mutex
+	sent map[*peerConn][]messageID
+}
+
+func (r *chokeRecorder) add(c *choker, p *peerConn) {
+	c.add(p, func(msg *Message) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.sent[p] = append(r.sent[p], msg.ID)
+		return nil
+	})
+}
+
+func newChokeTest(n int, seeding bool) (*choker, []*peerConn, *chokeRecorder) {
+	c := newChoker(2, seeding)
+	rec := &chokeRecorder{sent: make(map[*peerConn][]messageID)}
+	var peers []*peerConn
+	for i := range n {
+		p := peerConfig{}.newPeerConn(fmt.Sprintf("10.0.0.%d:6881", i), true)
+		p.peerInterested = true
+		rec.add(c, p)
+		peers = append(peers, p)
+	}
+	return c, peers, rec
+}
+
+func unchoked(peers []*peerConn) []int {
+	var out []int
+	for i, p := range peers {
+		if !p.info().AmChoking {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func TestChokerUnchokesFastestWhileSeeding(t *testing.T) {
+	c, peers, rec := newChokeTest(5, true)
+	now := time.Now()
+	// Peers 3 and 1 take the most from us
+	for i, n := range []int{100, 900, 200, 1000, 300} {
+		peers[i].up.addAt(now.Unix()-1, n)
+	}
+
+	c.rechoke(now, true)
+	got := unchoked(peers)
+	if len(got) != 3 || peers[1].info().AmChoking || peers[3].info().AmChoking {
+		t.Fatalf("unchoked %v, want peers 1 and 3 plus one optimistic", got)
+	}
+	if c.optimistic == peers[1] || c.optimistic == peers[3] || c.optimistic == nil {
+		t.Errorf("optimistic unchoke = %v, want one of the slower peers", c.optimistic)
+	}
+	for _, i := range got {
+		if ids := rec.sent[peers[i]]; len(ids) != 1 || ids[0] != MsgUnchoke {
+			t.Errorf("peer %d was sent %v, want one unchoke", i, ids)
+		}
+	}
+
+	// The optimistic unchoke survives rounds that don't rotate it, and a
+	// round without changes sends nothing
+	optimistic := c.optimistic
+	c.rechoke(now, false)
+	if c.optimistic != optimistic {
+		t.Errorf("optimistic unchoke changed without rotating")
+	}
+	for i, p := range peers {
+		if len(rec.sent[p]) > 1 {
+			t.Errorf("peer %d was sent %v after an unchanged round", i, rec.sent[p])
+		}
+	}
+}
+
+func TestChokerHonoursInterest(t *testing.T) {
+	c, peers, rec := newChokeTest(3, true)
+	now := time.Now()
+	c.rechoke(now, true)
+	if got := unchoked(peers); len(got) != 3 {
+		t.Fatalf("unchoked %v, want all three interested peers", got)
+	}
+
+	peers[0].update(func(p *peerConn) { p.peerInterested = false })
+	c.rechoke(now, false)
+	if !peers[0].info().AmChoking {
+		t.Errorf("a peer that lost interest stayed unchoked")
+	}
+	if ids := rec.sent[peers[0]]; len(ids) != 2 || ids[1] != MsgChoke {
+		t.Errorf("uninterested peer was sent %v, want unchoke then choke", ids)
+	}
+}
+
+func TestChokerSkipsSnubbingPeers(t *testing.T) {
+	c, peers, _ := newChokeTest(3, false)
+	start := time.Now()
+	for _, p := range peers {
+		p.amInterested = true
+	}
+	// Peer 0 was fastest but then stopped sending; the others keep going
+	peers[0].down.addAt(start.Unix()-1, 10000)
+	c.rechoke(start, false)
+
+	later := start.Add(snubTimeout)
+	peers[1].down.addAt(later.Unix()-1, 10)
+	peers[2].down.addAt(later.Unix()-1, 20)
+	c.rechoke(later, true)
+	for _, i := range []int{1, 2} {
+		if peers[i].info().AmChoking || c.optimistic == peers[i] {
+			t.Errorf("peer %d should hold a regular unchoke", i)
+		}
+	}
+	if c.optimistic != peers[0] {
+		t.Errorf("snubbing peer should only get the optimistic unchoke")
+	}
+}
+
+func TestChokerForgetsRemovedPeers(t *testing.T) {
+	c := newChoker(1, true)
+	p := peerConfig{}.newPeerConn("10.0.0.1:6881", true)
+	p.peerInterested = true
+	remove := c.add(p, func(*Message) error { return nil })
+	c.rechoke(time.Now(), true)
+	remove()
+	if c.optimistic != nil || len(c.sessions) != 0 {
+		t.Errorf("removed peer still tracked: optimistic %v, %d sessions", c.optimistic, len(c.sessions))
+	}
+	select {
+	case <-c.kick:
+	default:
+		t.Errorf("removing a peer should ask for a round")
+	}
+}
@@ -0,0 +1,824 @@
+// Package torrent is a BitTorrent client library. A Client is a session
+// managing many torrents added from .torrent files, raw metainfo or magnet
+// links under one peer ID, one listening port and shared connection and
+// bandwidth limits; each Torrent can be started, seeded, paused, resumed,
+// removed and queried for status.
+//
+// The lower level pieces (metainfo parsing with Open and Parse, Create,
+// TorrentFile.Download and the wire protocol messages) can also be used on
+// their own.
+package torrent
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrPaused is returned by Torrent.Wait when the torrent is paused.
+	ErrPaused = errors.New("torrent paused")
+	// ErrRemoved is returned for torrents that were removed from their client.
+	ErrRemoved = errors.New("torrent removed")
+)
+
+// ClientConfig configures a Client.
+type ClientConfig struct {
+	// DataDir is where torrents are saved; empty means the working
+	// directory
+	DataDir string
+	// ListenPort is the port announced to trackers and listened on while
+	// seeding; zero means DefaultListenPort
+	ListenPort uint16
+	// MaxPeers caps the peers each torrent is connected to at once; zero
+	// means no limit
+	MaxPeers int
+	// MaxHalfOpen caps the connections each torrent is dialling at once;
+	// zero means DefaultMaxHalfOpen
+	MaxHalfOpen int
+	// UploadSlots is how many peers each torrent uploads to at once on
+	// merit, besides one optimistic unchoke; zero means DefaultUploadSlots
+	UploadSlots int
+	// SuperSeed makes seeds reveal their pieces to each peer one at a
+	// time (BEP 16), so a torrent's first seed uploads each piece as few
+	// times as possible. It suits a lone initial seed and slows down
+	// swarms that have other seeds.
+	SuperSeed bool
+	// DownloadRateLimit and UploadRateLimit cap the transfer rates of all
+	// torrents together in bytes per second; zero means unlimited
+	DownloadRateLimit int
+	UploadRateLimit   int
+	// PeerDownloadRateLimit and PeerUploadRateLimit cap each peer
+	// connection on its own, in bytes per second; zero means unlimited
+	PeerDownloadRateLimit int
+	PeerUploadRateLimit   int
+	// RateSchedule replaces DownloadRateLimit and UploadRateLimit while
+	// one of its rules is in effect; the first matching rule wins
+	RateSchedule []RateRule
+	// MaxConnections caps the peer connections of all torrents together;
+	// zero means no limit
+	MaxConnections int
+	// MaxActiveDownloads and MaxActiveSeeds cap how many torrents download
+	// and seed at once. Torrents started beyond a limit are queued and
+	// started in order as others finish or pause; zero means no limit.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// Encryption is whether peer connections use Message Stream
+	// Encryption; the zero value, EncryptionDisabled, speaks plain
+	// BitTorrent only
+	Encryption EncryptionPolicy
+	// Blocklists are files of IP ranges that peers are never dialled or
+	// accepted from, in any format ParseIPFilter reads; ReloadBlocklists
+	// rereads them
+	Blocklists []string
+	// Logger receives the client's logs, with torrent and peer attributes;
+	// nil means slog.Default()
+	Logger *slog.Logger
+}
+
+// Client downloads and seeds a set of torrents under one peer ID. All of
+// its methods, and those of its torrents, are safe for concurrent use.
+type Client struct {
+	cfg    ClientConfig
+	peerID [20]byte
+	// download, upload and conns are shared by every torrent
+	download, upload *rateLimiter
+	conns            *connLimiter
+	// bans is shared by every torrent, so a peer caught poisoning one is
+	// refused by all
+	bans *banList
+	// blocklist filters peers from every source by IP
+	blocklist *blocklist
+	// peerDownload and peerUpload are the per-connection limits new
+	// peers start with
+	peerDownload, peerUpload atomic.Int64
+	// queueSeq orders queued torrents
+	queueSeq atomic.Uint64
+	// rates tracks the limits SetRateLimits asked for and which scheduled
+	// rule, if any, overrides them
+	rates rateState
+	// quit is closed by Close to stop background goroutines
+	quit chan struct{}
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	closed   bool
+	// ln accepts incoming peers for every torrent once one starts seeding
+	ln net.Listener
+	// events fans torrent events out to subscribers
+	events  eventBus
+	log     *slog.Logger
+	metrics *clientMetrics
+}
+
+func NewClient(cfg ClientConfig) (*Client, error) {
+	peerID, err := GeneratePeerID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate peer ID: %v", err)
+	}
+	if cfg.ListenPort == 0 {
+		cfg.ListenPort = DefaultListenPort
+	}
+	log := cfg.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	c := &Client{
+		cfg:    cfg,
+		peerID: peerID,
+		// The limiters always exist so SetRateLimits can change them later
+		download:  newAdjustableRateLimiter(cfg.DownloadRateLimit),
+		upload:    newAdjustableRateLimiter(cfg.UploadRateLimit),
+		conns:     newConnLimiter(cfg.MaxConnections),
+		bans:      new(banList),
+		blocklist: new(blocklist),
+		rates:     rateState{download: cfg.DownloadRateLimit, upload: cfg.UploadRateLimit, rule: -1},
+		quit:      make(chan struct{}),
+		torrents:  make(map[[20]byte]*Torrent),
+		log:       log,
+		metrics:   newClientMetrics(),
+	}
+	if len(cfg.Blocklists) > 0 {
+		if err := c.ReloadBlocklists(); err != nil {
+			return nil, fmt.Errorf("failed to load blocklists: %v", err)
+		}
+	}
+	c.peerDownload.Store(int64(cfg.PeerDownloadRateLimit))
+	c.peerUpload.Store(int64(cfg.PeerUploadRateLimit))
+	if len(cfg.RateSchedule) > 0 {
+		c.applyRateSchedule(time.Now())
+		go c.runRateSchedule()
+	}
+	return c, nil
+}
+
+// peerConfig returns the settings torrents connect to peers with.
+func (c *Client) peerConfig() peerConfig {
+	return peerConfig{
+		peerID:       c.peerID,
+		port:         c.cfg.ListenPort,
+		maxPeers:     c.cfg.MaxPeers,
+		maxHalfOpen:  c.cfg.MaxHalfOpen,
+		uploadSlots:  c.cfg.UploadSlots,
+		superSeed:    c.cfg.SuperSeed,
+		download:     rateLimits{c.download},
+		upload:       rateLimits{c.upload},
+		peerDownload: int(c.peerDownload.Load()),
+		peerUpload:   int(c.peerUpload.Load()),
+		conns:        c.conns,
+		bans:         c.bans,
+		blocklist:    c.blocklist,
+		encryption:   c.cfg.Encryption,
+		log:          c.log,
+		metrics:      c.metrics,
+	}
+}
+
+// Config returns the configuration the client was created with, with
+// defaults filled in. Rate limits changed by SetRateLimits are not
+// reflected.
+func (c *Client) Config() ClientConfig {
+	return c.cfg
+}
+
+// SetRateLimits changes the download and upload rate limits shared by
+// every torrent, in bytes per second; zero means unlimited. Running
+// transfers pick up the new limits straight away, unless a RateSchedule
+// rule is in effect, in which case they apply once no rule is.
+func (c *Client) SetRateLimits(download, upload int) {
+	c.rates.mu.Lock()
+	defer c.rates.mu.Unlock()
+	c.rates.download, c.rates.upload = download, upload
+	if c.rates.rule < 0 {
+		c.download.setRate(download)
+		c.upload.setRate(upload)
+	}
+}
+
+// RateLimits returns the download and upload rate limits in effect, in
+// bytes per second; zero means unlimited.
+func (c *Client) RateLimits() (download, upload int) {
+	return c.download.limit(), c.upload.limit()
+}
+
+// SetPeerRateLimits changes the download and upload rate limits of each
+// peer connection, in bytes per second; zero means unlimited. Connected
+// peers pick up the new limits straight away.
+func (c *Client) SetPeerRateLimits(download, upload int) {
+	c.peerDownload.Store(int64(download))
+	c.peerUpload.Store(int64(upload))
+	for _, t := range c.Torrents() {
+		t.stats.connMu.Lock()
+		for p := range t.stats.conns {
+			p.download.setRate(download)
+			p.upload.setRate(upload)
+		}
+		t.stats.connMu.Unlock()
+	}
+}
+
+// PeerRateLimits returns the per-connection download and upload rate
+// limits in bytes per second; zero means unlimited.
+func (c *Client) PeerRateLimits() (download, upload int) {
+	return int(c.peerDownload.Load()), int(c.peerUpload.Load())
+}
+
+// AddTorrentFile adds the torrent described by the .torrent file at path.
+func (c *Client) AddTorrentFile(path string) (*Torrent, error) {
+	mi, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.AddMetaInfo(mi)
+}
+
+// AddTorrentBytes adds the torrent described by bencoded metainfo.
+func (c *Client) AddTorrentBytes(data []byte) (*Torrent, error) {
+	mi, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.AddMetaInfo(mi)
+}
+
+// AddMetaInfo adds a torrent from decoded metainfo.
+func (c *Client) AddMetaInfo(mi *MetaInfo) (*Torrent, error) {
+	tf, err := mi.ToTorrentFile()
+	if err != nil {
+		return nil, err
+	}
+	tf.rootAt(c.cfg.DataDir)
+	t := newTorrent(c, tf.InfoHash, mi.Info.Name)
+	t.tf = &tf
+	return c.add(t)
+}
+
+// AddMagnet adds a torrent from a magnet link. Its metadata is fetched
+// from peers once it is started.
+func (c *Client) AddMagnet(uri string) (*Torrent, error) {
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	t := newTorrent(c, m.InfoHash, m.Name)
+	t.magnet = m
+	return c.add(t)
+}
+
+func (c *Client) add(t *Torrent) (*Torrent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, fmt.Errorf("client is closed")
+	}
+	if _, ok := c.torrents[t.infoHash]; ok {
+		return nil, fmt.Errorf("torrent %x already added", t.infoHash)
+	}
+	c.torrents[t.infoHash] = t
+	return t, nil
+}
+
+// Torrent returns the torrent with the given infohash.
+func (c *Client) Torrent(infoHash [20]byte) (*Torrent, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.torrents[infoHash]
+	return t, ok
+}
+
+// Torrents returns every torrent in the client.
+func (c *Client) Torrents() []*Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		out = append(out, t)
+	}
+	return out
+}
+
+// Close pauses every torrent and stops listening for peers. The client
+// can't be used afterwards.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		close(c.quit)
+	}
+	c.closed = true
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+	ln := c.ln
+	c.ln = nil
+	c.mu.Unlock()
+
+	for _, t := range torrents {
+		t.Pause()
+	}
+	c.events.close()
+	if ln != nil {
+		return ln.Close()
+	}
+	return nil
+}
+
+// schedule starts queued torrents, oldest first, while the client is under
+// its active download and seed limits.
+func (c *Client) schedule() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+
+	type entry struct {
+		t   *Torrent
+		seq uint64
+	}
+	var queued []entry
+	active := make(map[runMode]int)
+	for _, t := range c.torrents {
+		t.mu.Lock()
+		switch {
+		case t.queued:
+			queued = append(queued, entry{t, t.queueSeq})
+		case t.cancel != nil:
+			active[t.mode]++
+		}
+		t.mu.Unlock()
+	}
+	slices.SortFunc(queued, func(a, b entry) int { return cmp.Compare(a.seq, b.seq) })
+
+	for _, e := range queued {
+		t := e.t
+		t.mu.Lock()
+		limit := c.cfg.MaxActiveDownloads
+		if t.mode == modeSeed {
+			limit = c.cfg.MaxActiveSeeds
+		}
+		if t.queued && (limit <= 0 || active[t.mode] < limit) {
+			t.queued = false
+			active[t.mode]++
+			t.runLocked()
+		}
+		t.mu.Unlock()
+	}
+}
+
+// State is the lifecycle state of a Torrent.
+type State int
+
+const (
+	StatePaused State = iota
+	StateFetchingMetadata
+	StateDownloading
+	StateComplete
+	StateFailed
+	StateChecking
+	StateSeeding
+	StateQueued
+)
+
+func (s State) String() string {
+	switch s {
+	case StatePaused:
+		return "paused"
+	case StateFetchingMetadata:
+		return "fetching metadata"
+	case StateDownloading:
+		return "downloading"
+	case StateComplete:
+		return "complete"
+	case StateFailed:
+		return "failed"
+	case StateChecking:
+		return "checking"
+	case StateSeeding:
+		return "seeding"
+	case StateQueued:
+		return "queued"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Status is a snapshot of a torrent's progress.
+type Status struct {
+	State State
+	Name  string
+	// Length is zero until a magnet's metadata has arrived
+	Length       int
+	PiecesDone   int
+	PiecesWanted int
+	PiecesTotal  int
+	// Err is why the torrent failed
+	Err error
+}
+
+// runMode is what a torrent does while it runs.
+type runMode int
+
+const (
+	modeDownload runMode = iota
+	modeSeed
+)
+
+// Torrent is a torrent managed by a Client.
+type Torrent struct {
+	client   *Client
+	infoHash [20]byte
+	magnet   *Magnet
+
+	mu      sync.Mutex
+	name    string
+	tf      *TorrentFile
+	state   State
+	err     error
+	removed bool
+	done    int
+	wanted  int
+	// mode is what the torrent last ran as; queued torrents are waiting
+	// for the client to start them in that mode
+	mode     runMode
+	queued   bool
+	queueSeq uint64
+	cancel   context.CancelFunc
+	// stopped is closed when the running goroutine exits
+	stopped chan struct{}
+	// inbound receives peers the client's listener accepted for the
+	// torrent while it downloads or seeds
+	inbound chan inboundConn
+	// changed is closed and replaced on every state change
+	changed chan struct{}
+	// stats counts traffic and peers across runs
+	stats transferStats
+	// trackers holds the last announce to each tracker, by URL
+	trackerMu sync.Mutex
+	trackers  map[string]TrackerStatus
+	// download and upload limit this torrent's transfers on top of the
+	// client's limits
+	downLimit, upLimit *rateLimiter
+}
+
+func newTorrent(c *Client, infoHash [20]byte, name string) *Torrent {
+	return &Torrent{
+		client:    c,
+		infoHash:  infoHash,
+		name:      name,
+		changed:   make(chan struct{}),
+		downLimit: newAdjustableRateLimiter(0),
+		upLimit:   newAdjustableRateLimiter(0),
+	}
+}
+
+// InfoHash returns the infohash the torrent is known by.
+func (t *Torrent) InfoHash() [20]byte {
+	return t.infoHash
+}
+
+// Name returns the torrent's name, which magnet links may not provide
+// until their metadata arrives.
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.name
+}
+
+// Info returns the torrent's metadata, or nil while a magnet's metadata is
+// still being fetched.
+func (t *Torrent) Info() *TorrentFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tf
+}
+
+// Status returns a snapshot of the torrent's state and progress.
+func (t *Torrent) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Status{
+		State:        t.state,
+		Name:         t.name,
+		PiecesDone:   t.done,
+		PiecesWanted: t.wanted,
+		Err:          t.err,
+	}
+	if t.tf != nil {
+		s.Length = t.tf.Length
+		s.PiecesTotal = t.tf.NumPieces()
+	}
+	return s
+}
+
+// Start downloads the torrent in the background, queueing it while the
+// client is at MaxActiveDownloads. Starting a running, queued or complete
+// torrent does nothing.
+func (t *Torrent) Start() error {
+	t.mu.Lock()
+	if t.removed {
+		t.mu.Unlock()
+		return ErrRemoved
+	}
+	if t.cancel != nil || t.queued || t.state == StateComplete {
+		t.mu.Unlock()
+		return nil
+	}
+	t.enqueueLocked(modeDownload)
+	t.mu.Unlock()
+
+	t.client.schedule()
+	return nil
+}
+
+// Seed checks the torrent's data on disk and serves the verified pieces to
+// peers in the background until paused, queueing it while the client is
+// at MaxActiveSeeds. Missing pieces are not downloaded. Seeding a running
+// or queued torrent does nothing.
+func (t *Torrent) Seed() error {
+	t.mu.Lock()
+	if t.removed {
+		t.mu.Unlock()
+		return ErrRemoved
+	}
+	if t.tf == nil {
+		t.mu.Unlock()
+		return fmt.Errorf("torrent %x has no metadata to seed", t.infoHash)
+	}
+	if t.cancel != nil || t.queued {
+		t.mu.Unlock()
+		return nil
+	}
+	t.enqueueLocked(modeSeed)
+	t.mu.Unlock()
+
+	t.client.schedule()
+	return nil
+}
+
+// SetRateLimits limits the torrent's download and upload rates, in bytes
+// per second, on top of the client's limits; zero means only the client's
+// apply. Running transfers pick up the new limits straight away.
+func (t *Torrent) SetRateLimits(download, upload int) {
+	t.downLimit.setRate(download)
+	t.upLimit.setRate(upload)
+}
+
+// RateLimits returns the torrent's own download and upload rate limits in
+// bytes per second; zero means unlimited.
+func (t *Torrent) RateLimits() (download, upload int) {
+	return t.downLimit.limit(), t.upLimit.limit()
+}
+
+// Resume restarts a paused torrent the way it last ran: seeding if it was
+// seeding and downloading otherwise.
+func (t *Torrent) Resume() error {
+	t.mu.Lock()
+	mode := t.mode
+	t.mu.Unlock()
+	if mode == modeSeed {
+		return t.Seed()
+	}
+	return t.Start()
+}
+
+// enqueueLocked queues the torrent to run in mode. The caller must hold
+// t.mu.
+func (t *Torrent) enqueueLocked(mode runMode) {
+	t.mode = mode
+	t.queued = true
+	t.queueSeq = t.client.queueSeq.Add(1)
+	t.err = nil
+	t.setStateLocked(StateQueued)
+}
+
+// runLocked starts the torrent's goroutine in its mode. The caller must
+// hold t.mu.
+func (t *Torrent) runLocked() {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	t.stopped = make(chan struct{})
+
+	fn, state := t.download, StateDownloading
+	switch {
+	case t.mode == modeSeed:
+		fn, state = t.seed, StateChecking
+	case t.tf == nil:
+		state = StateFetchingMetadata
+	}
+	t.setStateLocked(state)
+	go t.run(ctx, t.stopped, fn)
+}
+
+// Pause stops the torrent, or takes it out of the queue, and waits for it
+// to wind down. Verified pieces are kept, so starting again resumes where
+// it left off.
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	if t.queued {
+		t.queued = false
+		t.setStateLocked(StatePaused)
+	}
+	cancel, stopped := t.cancel, t.stopped
+	t.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-stopped
+}
+
+// Remove pauses the torrent and removes it from its client. Downloaded
+// files are left on disk.
+func (t *Torrent) Remove() error {
+	t.Pause()
+
+	c := t.client
+	c.mu.Lock()
+	if c.torrents[t.infoHash] == t {
+		delete(c.torrents, t.infoHash)
+	}
+	c.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removed = true
+	t.notifyLocked()
+	return nil
+}
+
+// Wait blocks until the torrent completes, fails or is paused, returning
+// nil only for completion. A queued torrent waits for its turn, and a
+// seeding torrent runs until it is paused.
+func (t *Torrent) Wait(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		state, err, removed, running, changed := t.state, t.err, t.removed, t.cancel != nil || t.queued, t.changed
+		t.mu.Unlock()
+
+		switch {
+		case removed:
+			return ErrRemoved
+		case state == StateComplete:
+			return nil
+		case state == StateFailed:
+			return err
+		case !running:
+			return ErrPaused
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *Torrent) run(ctx context.Context, stopped chan struct{}, fn func(ctx context.Context) error) {
+	// Once stopped, the torrent's slot goes to the next queued torrent
+	defer t.client.schedule()
+	defer close(stopped)
+	err := fn(ctx)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cancel = nil
+	switch {
+	case ctx.Err() != nil:
+		t.setStateLocked(StatePaused)
+	case err != nil:
+		t.err = err
+		t.setStateLocked(StateFailed)
+	default:
+		t.setStateLocked(StateComplete)
+	}
+	switch t.state {
+	case StateFailed:
+		t.emit(Event{Type: EventError, Err: err})
+	case StateComplete:
+		t.emit(Event{Type: EventCompleted})
+	}
+}
+
+func (t *Torrent) download(ctx context.Context) error {
+	t.mu.Lock()
+	tf := t.tf
+	t.mu.Unlock()
+
+	if tf == nil {
+		info, err := fetchMagnetMetadata(ctx, t.magnet, t.peerConfig())
+		if err != nil {
+			return err
+		}
+		mi, err := t.magnet.metaInfo(info)
+		if err != nil {
+			return err
+		}
+		got, err := mi.ToTorrentFile()
+		if err != nil {
+			return err
+		}
+		got.rootAt(t.client.cfg.DataDir)
+		tf = &got
+
+		t.mu.Lock()
+		t.tf, t.name = tf, mi.Info.Name
+		t.setStateLocked(StateDownloading)
+		t.mu.Unlock()
+	}
+
+	// Peers the trackers hand our port to can connect, but a download
+	// still gets by dialling out if it can't listen
+	cfg := t.peerConfig()
+	inbound, stop, err := t.acceptPeers()
+	if err != nil {
+		cfg.logger().Warn("not accepting incoming peers", "err", err)
+	} else {
+		defer stop()
+	}
+	return tf.download(ctx, cfg, inbound, t.setProgress)
+}
+
+func (t *Torrent) seed(ctx context.Context) error {
+	t.mu.Lock()
+	tf := t.tf
+	t.mu.Unlock()
+
+	have, err := tf.verify(ctx, nil)
+	if err != nil {
+		return err
+	}
+	done := 0
+	for i := 0; i < tf.NumPieces(); i++ {
+		if have.HasPiece(i) {
+			done++
+		}
+	}
+
+	inbound, stop, err := t.acceptPeers()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	t.mu.Lock()
+	t.done, t.wanted = done, tf.NumPieces()
+	t.setStateLocked(StateSeeding)
+	t.mu.Unlock()
+
+	return tf.seed(ctx, t.peerConfig(), inbound)
+}
+
+// acceptPeers starts the client's listener and has it hand the torrent's
+// peers to the returned channel until stop is called.
+func (t *Torrent) acceptPeers() (inbound <-chan inboundConn, stop func(), err error) {
+	if err := t.client.listen(); err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan inboundConn)
+	t.mu.Lock()
+	t.inbound = ch
+	t.mu.Unlock()
+	return ch, func() {
+		t.mu.Lock()
+		t.inbound = nil
+		t.mu.Unlock()
+	}, nil
+}
+
+func (t *Torrent) setProgress(done, wanted int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done, t.wanted = done, wanted
+	t.notifyLocked()
+}
+
+func (t *Torrent) setStateLocked(s State) {
+	t.state = s
+	t.notifyLocked()
+	t.emit(Event{Type: EventStateChanged, State: s})
+}
+
+// peerConfig returns the client's settings with the torrent's stats and
+// events hooked in.
+func (t *Torrent) peerConfig() peerConfig {
+	cfg := t.client.peerConfig()
+	cfg.download = cfg.download.with(t.downLimit)
+	cfg.upload = cfg.upload.with(t.upLimit)
+	cfg.stats = &t.stats
+	cfg.onEvent = t.emit
+	cfg.log = cfg.log.With("torrent", t.Name(), "infohash", fmt.Sprintf("%x", t.infoHash))
+	return cfg
+}
+
+func (t *Torrent) notifyLocked() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
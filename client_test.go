@@ -0,0 +1,454 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"torrent/bencode"
+)
+
+// newClientTestSeed creates a torrent whose files are served by a web
+// seed, returning its metainfo (with the seed in url-list) and contents.
+func newClientTestSeed(t *testing.T, handler func(http.Handler) http.Handler) (*MetaInfo, map[string][]byte) {
+	t.Helper()
+	served := t.TempDir()
+	root := filepath.Join(served, "release")
+	os.MkdirAll(root, 0755)
+	contents := map[string][]byte{
+		"a.bin": bytes.Repeat([]byte("a"), 40000),
+		"b.bin": bytes.Repeat([]byte("b"), 30000),
+	}
+	for name, data := range contents {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var h http.Handler = http.FileServer(http.Dir(served))
+	if handler != nil {
+		h = handler(h)
+	}
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+
+	mi, err := Create(root, CreateOptions{PieceLength: 16384, WebSeeds: []string{server.URL + "/"}})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	return mi, contents
+}
+
+func checkDownloaded(t *testing.T, dir string, contents map[string][]byte) {
+	t.Helper()
+	for name, want := range contents {
+		got, err := os.ReadFile(filepath.Join(dir, "release", name))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s does not match the seed's copy", name)
+		}
+	}
+}
+
+func waitTorrent(t *testing.T, tr *Torrent) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return tr.Wait(ctx)
+}
+
+func TestClientDownload(t *testing.T) {
+	mi, contents := newClientTestSeed(t, nil)
+	var buf bytes.Buffer
+	if err := mi.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	c, err := NewClient(ClientConfig{DataDir: dir})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Close()
+
+	tr, err := c.AddTorrentBytes(buf.Bytes())
+	if err != nil {
+		t.Fatalf("AddTorrentBytes() error = %v", err)
+	}
+	if s := tr.Status(); s.State != StatePaused || s.Name != "release" || s.Length != 70000 {
+		t.Errorf("Status() before start = %+v", s)
+	}
+	if err := tr.Wait(context.Background()); !errors.Is(err, ErrPaused) {
+		t.Errorf("Wait() before start error = %v, want ErrPaused", err)
+	}
+
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := waitTorrent(t, tr); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	s := tr.Status()
+	if s.State != StateComplete || s.PiecesDone != s.PiecesTotal || s.PiecesTotal != 5 {
+		t.Errorf("Status() after download = %+v", s)
+	}
+	checkDownloaded(t, dir, contents)
+}
+
+func TestClientAddRemove(t *testing.T) {
+	mi, _ := newClientTestSeed(t, nil)
+	c, _ := NewClient(ClientConfig{DataDir: t.TempDir()})
+
+	tr, err := c.AddMetaInfo(mi)
+	if err != nil {
+		t.Fatalf("AddMetaInfo() error = %v", err)
+	}
+	if _, err := c.AddMetaInfo(mi); err == nil {
+		t.Errorf("AddMetaInfo() should reject a duplicate torrent")
+	}
+	if got, ok := c.Torrent(tr.InfoHash()); !ok || got != tr {
+		t.Errorf("Torrent() = %v, %v", got, ok)
+	}
+
+	if err := tr.Remove(); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if len(c.Torrents()) != 0 {
+		t.Errorf("Torrents() after Remove() = %v", c.Torrents())
+	}
+	if err := tr.Start(); !errors.Is(err, ErrRemoved) {
+		t.Errorf("Start() after Remove() error = %v, want ErrRemoved", err)
+	}
+
+	c.Close()
+	if _, err := c.AddMetaInfo(mi); err == nil {
+		t.Errorf("AddMetaInfo() should fail on a closed client")
+	}
+}
+
+func TestClientPauseResume(t *testing.T) {
+	// The seed serves the first piece, then stalls until released
+	release := make(chan struct{})
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	mi, contents := newClientTestSeed(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			first := len(requests) == 0
+			requests[r.URL.Path+" "+r.Header.Get("Range")]++
+			mu.Unlock()
+			if !first {
+				select {
+				case <-release:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+
+	dir := t.TempDir()
+	c, _ := NewClient(ClientConfig{DataDir: dir})
+	defer c.Close()
+	tr, err := c.AddMetaInfo(mi)
+	if err != nil {
+		t.Fatalf("AddMetaInfo() error = %v", err)
+	}
+	tr.Start()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for tr.Status().PiecesDone == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("first piece never arrived")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tr.Pause()
+	if s := tr.Status(); s.State != StatePaused || s.PiecesDone != 1 {
+		t.Errorf("Status() after Pause() = %+v", s)
+	}
+	if err := tr.Wait(context.Background()); !errors.Is(err, ErrPaused) {
+		t.Errorf("Wait() after Pause() error = %v, want ErrPaused", err)
+	}
+
+	close(release)
+	tr.Start()
+	if err := waitTorrent(t, tr); err != nil {
+		t.Fatalf("Wait() after resume error = %v", err)
+	}
+	checkDownloaded(t, dir, contents)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := requests["/release/a.bin bytes=0-16383"]; n != 1 {
+		t.Errorf("first piece was requested %d times, want once", n)
+	}
+}
+
+func TestClientMagnet(t *testing.T) {
+	mi, contents := newClientTestSeed(t, nil)
+	info, err := bencode.Marshal(mi.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoHash := sha1.Sum(info)
+
+	// A peer that only hands out metadata
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := ReadHandshake(conn); err != nil {
+					return
+				}
+				hs := NewHandshake(infoHash, [20]byte{'p'})
+				hs.Reserved[reservedExtByte] |= reservedExtBit
+				conn.Write(hs.Serialize())
+				(&metadataPeer{info: info}).serve(conn)
+			}()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := make([]byte, 6)
+		copy(peer, addr.IP.To4())
+		binary.BigEndian.PutUint16(peer[4:], uint16(addr.Port))
+		w.Write([]byte("d8:intervali1800e5:peers6:" + string(peer) + "e"))
+	}))
+	defer tracker.Close()
+
+	m := &Magnet{
+		InfoHash: infoHash,
+		Name:     "from magnet",
+		Trackers: []string{tracker.URL},
+		WebSeeds: mi.URLList,
+	}
+
+	dir := t.TempDir()
+	c, _ := NewClient(ClientConfig{DataDir: dir})
+	defer c.Close()
+	tr, err := c.AddMagnet(m.String())
+	if err != nil {
+		t.Fatalf("AddMagnet() error = %v", err)
+	}
+	if tr.Info() != nil || tr.Name() != "from magnet" {
+		t.Errorf("AddMagnet() Info() = %v, Name() = %q", tr.Info(), tr.Name())
+	}
+
+	tr.Start()
+	if err := waitTorrent(t, tr); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if tr.Info() == nil || tr.Name() != "release" {
+		t.Errorf("after metadata Info() = %v, Name() = %q", tr.Info(), tr.Name())
+	}
+	checkDownloaded(t, dir, contents)
+}
+
+func TestClientQueue(t *testing.T) {
+	// The first torrent's seed stalls until released
+	release := make(chan struct{})
+	first, contents := newClientTestSeed(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	// The second is the same data under a different infohash
+	second, _ := newClientTestSeed(t, nil)
+	second.Info.Private = 1
+	second.Info.raw = nil
+
+	dir := t.TempDir()
+	c, _ := NewClient(ClientConfig{DataDir: dir, MaxActiveDownloads: 1})
+	defer c.Close()
+	t1, _ := c.AddMetaInfo(first)
+	t2, err := c.AddMetaInfo(second)
+	if err != nil {
+		t.Fatalf("AddMetaInfo() error = %v", err)
+	}
+
+	t1.Start()
+	t2.Start()
+	if s := t1.Status(); s.State != StateDownloading {
+		t.Errorf("first torrent state = %v, want downloading", s.State)
+	}
+	if s := t2.Status(); s.State != StateQueued {
+		t.Errorf("second torrent state = %v, want queued", s.State)
+	}
+
+	t2.Pause()
+	if s := t2.Status(); s.State != StatePaused {
+		t.Errorf("state after pausing a queued torrent = %v, want paused", s.State)
+	}
+	if err := t2.Resume(); err != nil {
+		t.Fatalf("Resume() error = %v", err)
+	}
+	if s := t2.Status(); s.State != StateQueued {
+		t.Errorf("state after Resume() = %v, want queued", s.State)
+	}
+
+	close(release)
+	if err := waitTorrent(t, t1); err != nil {
+		t.Fatalf("first Wait() error = %v", err)
+	}
+	if err := waitTorrent(t, t2); err != nil {
+		t.Fatalf("second Wait() error = %v", err)
+	}
+	checkDownloaded(t, dir, contents)
+}
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(1)
+	if !l.tryAcquire() {
+		t.Fatal("tryAcquire() failed on an empty limiter")
+	}
+	if l.tryAcquire() {
+		t.Error("tryAcquire() succeeded past the limit")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if l.acquire(ctx) {
+		t.Error("acquire() succeeded past the limit")
+	}
+	l.release()
+	if !l.acquire(context.Background()) {
+		t.Error("acquire() failed after release()")
+	}
+
+	var unlimited *connLimiter
+	if !unlimited.tryAcquire() || !unlimited.acquire(context.Background()) {
+		t.Error("nil limiter should not limit")
+	}
+	unlimited.release()
+}
+
+// TestDownloadAcceptsInboundPeers downloads from a peer that connects to
+// us, the only peer the tracker knows never unchoking us.
+func TestDownloadAcceptsInboundPeers(t *testing.T) {
+	const pieceLength = 16384
+	src := t.TempDir()
+	root := filepath.Join(src, "release")
+	os.MkdirAll(root, 0755)
+	contents := map[string][]byte{"a.bin": bytes.Repeat([]byte("a"), 40000)}
+	if err := os.WriteFile(filepath.Join(root, "a.bin"), contents["a.bin"], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tracker's peer completes the handshake and says nothing more
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				hs, err := ReadHandshake(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(NewHandshake(hs.InfoHash, [20]byte{2}).Serialize())
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	tracker := newTrackerServer(t, uint16(ln.Addr().(*net.TCPAddr).Port))
+	mi, err := Create(root, CreateOptions{PieceLength: pieceLength, Announce: tracker.URL + "/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := mi.ToTorrentFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	port := freePort(t)
+	leecher, _ := NewClient(ClientConfig{DataDir: dst, ListenPort: port})
+	defer leecher.Close()
+	lt, err := leecher.AddMetaInfo(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lt.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Connect to the leecher once it takes peers, and serve it everything
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			context.AfterFunc(ctx, func() { conn.Close() })
+			conn.Write(NewHandshake(tf.InfoHash, [20]byte{1}).Serialize())
+			if _, err := ReadHandshake(conn); err != nil {
+				conn.Close()
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			defer conn.Close()
+			conn.Write((&Message{ID: MsgBitfield, Payload: Bitfield{0xe0}}).Serialize())
+			conn.Write((&Message{ID: MsgUnchoke}).Serialize())
+			data := contents["a.bin"]
+			for {
+				msg, err := ReadMessage(conn)
+				if err != nil {
+					return
+				}
+				if msg == nil || msg.ID != MsgRequest {
+					continue
+				}
+				index, begin, length, _ := ParseRequest(msg)
+				start := index*pieceLength + begin
+				conn.Write(FormatPiece(index, begin, data[start:start+length]).Serialize())
+			}
+		}
+	}()
+
+	if err := waitTorrent(t, lt); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	checkDownloaded(t, dst, contents)
+}
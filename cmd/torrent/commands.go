@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"torrent"
+	"torrent/httpapi"
+	"torrent/transmission"
+)
+
+// runDownload implements `download [flags] <file.torrent | magnet>`.
+func runDownload(ctx context.Context, args []string) error {
+	fs := newFlagSet("download", "[flags] <file.torrent | magnet>")
+	cfg := fs.clientFlags()
+	if err := fs.parse(args, 1); err != nil {
+		return err
+	}
+
+	client, err := torrent.NewClient(*cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	logEvents(client)
+	if err := serveMetrics(ctx, client, fs.metricsAddr); err != nil {
+		return err
+	}
+
+	t, err := addSource(client, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Downloading: %s\n", t.Name())
+	slog.Debug("starting download", "infohash", fmt.Sprintf("%x", t.InfoHash()), "port", cfg.ListenPort)
+	if err := t.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- t.Wait(ctx) }()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			printProgress(t)
+			if err != nil {
+				// Closing the client pauses the torrent, which waits for
+				// its peers to disconnect and its files to be flushed
+				fmt.Println()
+				return err
+			}
+			fmt.Println("\nSuccessfully downloaded: ", t.Name())
+			return nil
+		case <-ticker.C:
+			printProgress(t)
+		}
+	}
+}
+
+// addSource adds a .torrent file or magnet link to the client.
+func addSource(client *torrent.Client, source string) (*torrent.Torrent, error) {
+	if strings.HasPrefix(source, "magnet:") {
+		return client.AddMagnet(source)
+	}
+	return client.AddTorrentFile(source)
+}
+
+func printProgress(t *torrent.Torrent) {
+	s, st := t.Status(), t.Stats()
+	if s.PiecesWanted == 0 {
+		return
+	}
+	percent := float64(s.PiecesDone) / float64(s.PiecesWanted) * 100
+	eta := ""
+	if st.ETA > 0 {
+		eta = ", ETA " + st.ETA.Round(time.Second).String()
+	}
+	// Trailing spaces clear what a longer previous line left behind
+	fmt.Printf("\r[%-50s] %0.2f%% (%d/%d pieces, %s/s, %d peers%s)   ", strings.Repeat("-", int(percent/2)), percent,
+		s.PiecesDone, s.PiecesWanted, formatBytes(int64(st.DownloadRate)), st.Peers, eta)
+}
+
+// serveMetrics serves the client's metrics on addr until ctx is done. An
+// empty addr serves nothing.
+func serveMetrics(ctx context.Context, client *torrent.Client, addr string) error {
+	if addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", client.MetricsHandler())
+	srv := &http.Server{Handler: mux}
+	context.AfterFunc(ctx, func() { srv.Close() })
+	go srv.Serve(ln)
+	slog.Info("serving metrics", "addr", ln.Addr().String())
+	return nil
+}
+
+// logEvents logs the client's events at debug level until it is closed.
+func logEvents(client *torrent.Client) {
+	events, _ := client.Subscribe(64)
+	go func() {
+		for e := range events {
+			attrs := []any{"infohash", fmt.Sprintf("%x", e.InfoHash)}
+			switch e.Type {
+			case torrent.EventStateChanged:
+				attrs = append(attrs, "state", e.State)
+			case torrent.EventPieceVerified:
+				attrs = append(attrs, "piece", e.Piece)
+			case torrent.EventHashFailed, torrent.EventPeerBanned:
+				attrs = append(attrs, "piece", e.Piece, "peer", e.Peer)
+			case torrent.EventPeerConnected, torrent.EventPeerDisconnected:
+				attrs = append(attrs, "peer", e.Peer)
+			case torrent.EventAnnounce:
+				attrs = append(attrs, "tracker", e.Tracker, "peers", e.Peers)
+			}
+			if e.Err != nil {
+				attrs = append(attrs, "err", e.Err)
+			}
+			slog.Debug(e.Type.String(), attrs...)
+		}
+	}()
+}
+
+// runSeed implements `seed [flags] <file.torrent>`.
+func runSeed(ctx context.Context, args []string) error {
+	fs := newFlagSet("seed", "[flags] <file.torrent>")
+	cfg := fs.clientFlags()
+	if err := fs.parse(args, 1); err != nil {
+		return err
+	}
+
+	client, err := torrent.NewClient(*cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	logEvents(client)
+	if err := serveMetrics(ctx, client, fs.metricsAddr); err != nil {
+		return err
+	}
+
+	t, err := client.AddTorrentFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Checking: %s\n", t.Name())
+	if err := t.Seed(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- t.Wait(ctx) }()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	seeding := false
+	for {
+		select {
+		case err := <-done:
+			// Closing the client stops the seed and announces it stopped
+			return err
+		case <-ticker.C:
+			s := t.Status()
+			if s.State == torrent.StateSeeding && !seeding {
+				seeding = true
+				fmt.Printf("Seeding %d/%d pieces on port %d\n", s.PiecesDone, s.PiecesTotal, cfg.ListenPort)
+			}
+		}
+	}
+}
+
+// runServe implements `serve [flags] [file.torrent | magnet ...]`.
+func runServe(ctx context.Context, args []string) error {
+	fs := newFlagSet("serve", "[flags] [file.torrent | magnet ...]")
+	cfg := fs.clientFlags()
+	addr := fs.String("api", "localhost:8080", "`address` to serve the HTTP API on")
+	token := fs.String("token", "", "bearer `token` API requests must carry; empty for none")
+	rpc := fs.Bool("transmission", false, "also serve the Transmission RPC protocol at /transmission/rpc")
+	rpcUser := fs.String("rpc-user", "", "`user` name Transmission RPC requests must authenticate with")
+	rpcPassword := fs.String("rpc-password", "", "`password` Transmission RPC requests must authenticate with")
+	if err := fs.parse(args, -1); err != nil {
+		return err
+	}
+
+	client, err := torrent.NewClient(*cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	logEvents(client)
+	if err := serveMetrics(ctx, client, fs.metricsAddr); err != nil {
+		return err
+	}
+	reloadOnHangup(ctx, client)
+
+	for _, source := range fs.Args() {
+		t, err := addSource(client, source)
+		if err != nil {
+			return err
+		}
+		if err := t.Start(); err != nil {
+			return err
+		}
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", httpapi.New(client, *token))
+	if *rpc {
+		mux.Handle("/transmission/rpc", transmission.New(client, *rpcUser, *rpcPassword))
+	}
+	srv := &http.Server{Handler: mux}
+	context.AfterFunc(ctx, func() { srv.Close() })
+	slog.Info("serving API", "addr", ln.Addr().String())
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// Closing the client pauses every torrent and announces them stopped
+	return ctx.Err()
+}
+
+// reloadOnHangup rereads the client's blocklists on SIGHUP until ctx is
+// done.
+func reloadOnHangup(ctx context.Context, client *torrent.Client) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if err := client.ReloadBlocklists(); err != nil {
+					slog.Error("failed to reload blocklists", "err", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// runInfo implements `info [flags] <file.torrent>`.
+func runInfo(ctx context.Context, args []string) error {
+	fs := newFlagSet("info", "[flags] <file.torrent>")
+	if err := fs.parse(args, 1); err != nil {
+		return err
+	}
+
+	mi, err := torrent.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	tf, err := mi.ToTorrentFile()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Name:         %s\n", tf.Name)
+	if !tf.IsV2() || tf.IsHybrid() {
+		fmt.Printf("Info hash:    %x\n", tf.InfoHash)
+	}
+	if tf.IsV2() {
+		fmt.Printf("Info hash v2: %x\n", tf.InfoHashV2)
+	}
+	fmt.Printf("Size:         %s (%d bytes)\n", formatBytes(int64(tf.Length)), tf.Length)
+	fmt.Printf("Pieces:       %d x %s\n", tf.NumPieces(), formatBytes(int64(tf.PieceLength)))
+	fmt.Printf("Private:      %t\n", mi.Info.Private == 1)
+	if mi.Comment != "" {
+		fmt.Printf("Comment:      %s\n", mi.Comment)
+	}
+	if mi.CreatedBy != "" {
+		fmt.Printf("Created by:   %s\n", mi.CreatedBy)
+	}
+	if mi.CreationDate != 0 {
+		fmt.Printf("Created:      %s\n", time.Unix(mi.CreationDate, 0).UTC().Format(time.RFC3339))
+	}
+	for _, tracker := range mi.Trackers() {
+		fmt.Printf("Tracker:      %s\n", tracker)
+	}
+	for _, ws := range tf.WebSeeds {
+		fmt.Printf("Web seed:     %s\n", ws)
+	}
+
+	fmt.Println("Files:")
+	for _, f := range tf.Files {
+		if f.Padding {
+			continue
+		}
+		fmt.Printf("  %10s  %s\n", formatBytes(int64(f.Length)), f.Path)
+	}
+	return nil
+}
+
+// runVerify implements `verify [flags] <file.torrent>`.
+func runVerify(ctx context.Context, args []string) error {
+	fs := newFlagSet("verify", "[flags] <file.torrent>")
+	dir := fs.String("o", "", "`directory` the torrent was saved into (default the working directory)")
+	if err := fs.parse(args, 1); err != nil {
+		return err
+	}
+
+	client, err := torrent.NewClient(torrent.ClientConfig{DataDir: *dir})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	t, err := client.AddTorrentFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	have, err := t.Info().Verify()
+	if err != nil {
+		return err
+	}
+
+	total := t.Status().PiecesTotal
+	good := 0
+	for i := 0; i < total; i++ {
+		if have.HasPiece(i) {
+			good++
+		}
+	}
+	fmt.Printf("%s: %d/%d pieces OK\n", t.Name(), good, total)
+	if good < total {
+		return fmt.Errorf("%d pieces missing or corrupt", total-good)
+	}
+	return nil
+}
+
+// runMagnet implements `magnet [flags] <file.torrent>`.
+func runMagnet(ctx context.Context, args []string) error {
+	fs := newFlagSet("magnet", "[flags] <file.torrent>")
+	if err := fs.parse(args, 1); err != nil {
+		return err
+	}
+
+	mi, err := torrent.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	m, err := mi.Magnet()
+	if err != nil {
+		return err
+	}
+	fmt.Println(m)
+	return nil
+}
+
+// runScrape implements `scrape [flags] <file.torrent | magnet>`.
+func runScrape(ctx context.Context, args []string) error {
+	fs := newFlagSet("scrape", "[flags] <file.torrent | magnet>")
+	if err := fs.parse(args, 1); err != nil {
+		return err
+	}
+
+	var m *torrent.Magnet
+	var err error
+	if source := fs.Arg(0); strings.HasPrefix(source, "magnet:") {
+		m, err = torrent.ParseMagnet(source)
+	} else {
+		var mi *torrent.MetaInfo
+		if mi, err = torrent.Open(source); err == nil {
+			m, err = mi.Magnet()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(m.Trackers) == 0 {
+		return fmt.Errorf("torrent has no trackers")
+	}
+
+	answered := 0
+	for _, tracker := range m.Trackers {
+		results, err := torrent.Scrape(tracker, m.InfoHash)
+		if err != nil {
+			slog.Warn("scrape failed", "tracker", tracker, "err", err)
+			continue
+		}
+		answered++
+		res, ok := results[m.InfoHash]
+		if !ok {
+			fmt.Printf("%s: torrent not tracked\n", tracker)
+			continue
+		}
+		fmt.Printf("%s: %d seeders, %d leechers, %d downloads\n", tracker, res.Complete, res.Incomplete, res.Downloaded)
+	}
+	if answered == 0 {
+		return fmt.Errorf("no tracker answered")
+	}
+	return nil
+}
+
+// runCreate implements `create [flags] <file or directory>`.
+func runCreate(ctx context.Context, args []string) error {
+	fs := newFlagSet("create", "[flags] <file or directory>")
+	output := fs.String("o", "", "output .torrent path (default <name>.torrent)")
+	comment := fs.String("c", "", "comment")
+	createdBy := fs.String("created-by", "torrent-go", "created by")
+	private := fs.Bool("private", false, "set the private flag")
+	pieceLength := fs.Int("piece-length", 0, "piece length in bytes (default automatic)")
+	var trackers, webSeeds stringList
+	fs.Var(&trackers, "a", "announce URL; repeat for more tiers")
+	fs.Var(&webSeeds, "w", "web seed URL; repeatable")
+	if err := fs.parse(args, 1); err != nil {
+		return err
+	}
+
+	opts := torrent.CreateOptions{
+		WebSeeds:    webSeeds,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		PieceLength: *pieceLength,
+	}
+	for _, tracker := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, []string{tracker})
+	}
+
+	bt, err := torrent.Create(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	// Make sure the torrent can be read back before writing it
+	tf, err := bt.ToTorrentFile()
+	if err != nil {
+		return err
+	}
+
+	path := *output
+	if path == "" {
+		path = bt.Info.Name + ".torrent"
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := bt.Write(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s (info hash %x)\n", path, tf.InfoHash)
+	return nil
+}
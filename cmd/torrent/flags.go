@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"torrent"
+)
+
+// errUsage is returned for bad command lines once usage has been printed.
+var errUsage = errors.New("usage error")
+
+// flagSet is a subcommand's flags. Every command takes -log-level; commands
+// that run a client add the client flags, which can also be given in a
+// -config file.
+type flagSet struct {
+	*flag.FlagSet
+	level     slog.LevelVar
+	logFormat string
+	config    string
+	// metricsAddr is where client commands serve metrics; empty for none
+	metricsAddr string
+}
+
+func newFlagSet(name, args string) *flagSet {
+	fs := &flagSet{FlagSet: flag.NewFlagSet(name, flag.ContinueOnError)}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: torrent %s %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	fs.TextVar(&fs.level, "log-level", new(slog.LevelVar), "log `level`: debug, info, warn or error; debug traces peer wire messages")
+	fs.StringVar(&fs.logFormat, "log-format", "text", "log `format`: text or json")
+	return fs
+}
+
+// clientFlags registers the flags that configure a client and returns the
+// config they fill in.
+func (fs *flagSet) clientFlags() *torrent.ClientConfig {
+	cfg := &torrent.ClientConfig{ListenPort: torrent.DefaultListenPort}
+	fs.StringVar(&cfg.DataDir, "o", "", "`directory` to save into (default the working directory)")
+	fs.Var((*portFlag)(&cfg.ListenPort), "port", "`port` to announce and listen on")
+	fs.IntVar(&cfg.MaxPeers, "max-peers", 0, "maximum peers per torrent, 0 for no limit")
+	fs.IntVar(&cfg.MaxHalfOpen, "max-half-open", 0, "maximum peers per torrent being dialled at once (default 16)")
+	fs.IntVar(&cfg.UploadSlots, "upload-slots", 0, "peers per torrent to upload to at once besides an optimistic unchoke (default 4)")
+	fs.BoolVar(&cfg.SuperSeed, "super-seed", false, "reveal pieces to peers one at a time while seeding, for a torrent's first seed")
+	fs.IntVar(&cfg.MaxConnections, "max-connections", 0, "maximum peer connections in total, 0 for no limit")
+	fs.Var((*rateFlag)(&cfg.DownloadRateLimit), "download-rate", "download `rate` limit in bytes per second, e.g. 500K or 2M; 0 for no limit")
+	fs.Var((*rateFlag)(&cfg.UploadRateLimit), "upload-rate", "upload `rate` limit in bytes per second, e.g. 500K or 2M; 0 for no limit")
+	fs.Var((*rateFlag)(&cfg.PeerDownloadRateLimit), "peer-download-rate", "download `rate` limit per peer connection; 0 for no limit")
+	fs.Var((*rateFlag)(&cfg.PeerUploadRateLimit), "peer-upload-rate", "upload `rate` limit per peer connection; 0 for no limit")
+	fs.Var((*encryptionFlag)(&cfg.Encryption), "encryption", "peer encryption `policy`: disabled, preferred (encrypt, falling back to plain) or required")
+	fs.Var((*stringList)(&cfg.Blocklists), "blocklist", "`file` of IP ranges never to connect to, in PeerGuardian, DAT or CIDR format, optionally gzipped; repeatable")
+	fs.Var((*scheduleFlag)(&cfg.RateSchedule), "rate-schedule", "`rule` replacing the rate limits for part of the day, as [DAYS@]HH:MM-HH:MM=DOWN/UP,\ne.g. mon,tue,wed,thu,fri@09:00-17:00=1M/256K; repeatable, the first matching rule wins")
+	fs.StringVar(&fs.metricsAddr, "metrics", "", "`address` to serve Prometheus metrics on at /metrics, e.g. localhost:9100")
+	fs.StringVar(&fs.config, "config", "", "JSON `file` of flag values; flags on the command line take precedence")
+	return cfg
+}
+
+// parse parses args, which must leave nargs positional arguments or any
+// number if nargs is negative, applies the config file and sets up logging.
+func (fs *flagSet) parse(args []string, nargs int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if nargs >= 0 && fs.NArg() != nargs {
+		fs.Usage()
+		return errUsage
+	}
+	if fs.config != "" {
+		if err := fs.applyConfig(fs.config); err != nil {
+			return fmt.Errorf("config %s: %v", fs.config, err)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: &fs.level}
+	switch fs.logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		fmt.Fprintf(fs.Output(), "invalid log format %q\n", fs.logFormat)
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// applyConfig sets flags from a JSON object keyed by flag name, skipping
+// flags that were given on the command line.
+func (fs *flagSet) applyConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for name, v := range values {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if set[name] {
+			continue
+		}
+
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			s = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("setting %q has an unsupported value", name)
+		}
+		if err := fs.Set(name, s); err != nil {
+			return fmt.Errorf("setting %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// portFlag is a TCP port number.
+type portFlag uint16
+
+func (p *portFlag) String() string { return strconv.Itoa(int(*p)) }
+
+func (p *portFlag) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || n == 0 {
+		return fmt.Errorf("invalid port %q", s)
+	}
+	*p = portFlag(n)
+	return nil
+}
+
+// rateFlag is a rate in bytes per second, written with an optional K, M or
+// G suffix for powers of 1024.
+type rateFlag int
+
+func (r *rateFlag) String() string { return formatBytes(int64(*r)) }
+
+func (r *rateFlag) Set(s string) error {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := 1.0
+	if n := len(num); n > 0 {
+		switch num[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			num = num[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid rate %q", s)
+	}
+	*r = rateFlag(v * mult)
+	return nil
+}
+
+// scheduleFlag collects repeatable rate schedule rules written as
+// [DAYS@]HH:MM-HH:MM=DOWN/UP, where DAYS are comma separated three letter
+// day names and DOWN and UP are rates as for rateFlag.
+type scheduleFlag []torrent.RateRule
+
+func (f *scheduleFlag) String() string {
+	var rules []string
+	for _, r := range *f {
+		var days []string
+		for _, d := range r.Weekdays {
+			days = append(days, strings.ToLower(d.String()[:3]))
+		}
+		rule := fmt.Sprintf("%s-%s=%d/%d", r.From, r.To, r.DownloadRateLimit, r.UploadRateLimit)
+		if len(days) > 0 {
+			rule = strings.Join(days, ",") + "@" + rule
+		}
+		rules = append(rules, rule)
+	}
+	return strings.Join(rules, " ")
+}
+
+func (f *scheduleFlag) Set(s string) error {
+	var r torrent.RateRule
+	span, rates, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("invalid rule %q, want [DAYS@]HH:MM-HH:MM=DOWN/UP", s)
+	}
+	if days, rest, ok := strings.Cut(span, "@"); ok {
+		span = rest
+		for _, name := range strings.Split(days, ",") {
+			d, err := parseWeekday(name)
+			if err != nil {
+				return err
+			}
+			r.Weekdays = append(r.Weekdays, d)
+		}
+	}
+	from, to, ok := strings.Cut(span, "-")
+	if !ok {
+		return fmt.Errorf("invalid rule %q, want [DAYS@]HH:MM-HH:MM=DOWN/UP", s)
+	}
+	var err error
+	if r.From, err = torrent.ParseTimeOfDay(from); err != nil {
+		return err
+	}
+	if r.To, err = torrent.ParseTimeOfDay(to); err != nil {
+		return err
+	}
+	down, up, ok := strings.Cut(rates, "/")
+	if !ok {
+		return fmt.Errorf("invalid rule %q, want [DAYS@]HH:MM-HH:MM=DOWN/UP", s)
+	}
+	if err := (*rateFlag)(&r.DownloadRateLimit).Set(down); err != nil {
+		return err
+	}
+	if err := (*rateFlag)(&r.UploadRateLimit).Set(up); err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// parseWeekday parses a three letter day name such as "mon".
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()[:3]) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q, want mon, tue, ...", s)
+}
+
+// encryptionFlag is an encryption policy by name.
+type encryptionFlag torrent.EncryptionPolicy
+
+func (e *encryptionFlag) String() string { return torrent.EncryptionPolicy(*e).String() }
+
+func (e *encryptionFlag) Set(s string) error {
+	p, err := torrent.ParseEncryptionPolicy(s)
+	if err != nil {
+		return err
+	}
+	*e = encryptionFlag(p)
+	return nil
+}
+
+// stringList collects a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,113 @@
+// Command torrent downloads, seeds and inspects BitTorrent torrents.
+//
+// Usage:
+//
+//	torrent <command> [flags] [arguments]
+//
+// Run `torrent help` for the list of commands, or `torrent <command> -h`
+// for a command's flags.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Exit codes
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitInterrupted = 130
+)
+
+// command is a subcommand of the CLI.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"download", "[flags] <file.torrent | magnet>", "download a torrent", runDownload},
+	{"seed", "[flags] <file.torrent>", "check data on disk and serve it to peers", runSeed},
+	{"tui", "[flags] <file.torrent | magnet> ...", "download torrents in a full-screen terminal UI", runTUI},
+	{"serve", "[flags] [file.torrent | magnet ...]", "run a client controlled over HTTP", runServe},
+	{"info", "[flags] <file.torrent>", "print a torrent's metadata", runInfo},
+	{"create", "[flags] <file or directory>", "build a .torrent file", runCreate},
+	{"verify", "[flags] <file.torrent>", "check downloaded data against a torrent", runVerify},
+	{"magnet", "[flags] <file.torrent>", "print a magnet link for a torrent", runMagnet},
+	{"scrape", "[flags] <file.torrent | magnet>", "ask trackers for swarm statistics", runScrape},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run executes the command line and returns the process exit code.
+func run(args []string) int {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return exitUsage
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+		return exitOK
+	}
+
+	cmd := lookup(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "torrent: unknown command %q\n", args[0])
+		usage(os.Stderr)
+		return exitUsage
+	}
+
+	// The first SIGINT or SIGTERM cancels ctx so the command can shut down
+	// cleanly; a second one kills the process as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
+	err := cmd.run(ctx, args[1:])
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case ctx.Err() != nil:
+		fmt.Fprintf(os.Stderr, "torrent %s: interrupted\n", cmd.name)
+		return exitInterrupted
+	case errors.Is(err, errUsage):
+		// The flag set has already explained what was wrong
+		return exitUsage
+	default:
+		fmt.Fprintf(os.Stderr, "torrent %s: %v\n", cmd.name, err)
+		return exitFailure
+	}
+}
+
+func lookup(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: torrent <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'torrent <command> -h' for a command's flags.")
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+var errNoTerminal = errors.New("terminal control is not supported on this platform")
+
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errNoTerminal
+}
+
+func termSize(fd int) (width, height int, err error) {
+	return 0, 0, errNoTerminal
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"torrent"
+)
+
+// tuiRefresh is how often the screen is redrawn without input
+const tuiRefresh = 500 * time.Millisecond
+
+// tuiLogLines is how many log lines the TUI keeps
+const tuiLogLines = 50
+
+// runTUI implements `tui [flags] <file.torrent | magnet> ...`.
+func runTUI(ctx context.Context, args []string) error {
+	fs := newFlagSet("tui", "[flags] <file.torrent | magnet> ...")
+	cfg := fs.clientFlags()
+	if err := fs.parse(args, -1); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	// Logs would scribble over the screen, so they go to a pane instead
+	logs := &logBuffer{max: tuiLogLines}
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: &fs.level})))
+
+	width, height, err := termSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return fmt.Errorf("tui needs a terminal: %v", err)
+	}
+
+	client, err := torrent.NewClient(*cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := serveMetrics(ctx, client, fs.metricsAddr); err != nil {
+		return err
+	}
+
+	var torrents []*torrent.Torrent
+	for _, source := range fs.Args() {
+		t, err := addSource(client, source)
+		if err != nil {
+			return err
+		}
+		if err := t.Start(); err != nil {
+			return err
+		}
+		torrents = append(torrents, t)
+	}
+
+	restore, err := makeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return fmt.Errorf("tui needs a terminal: %v", err)
+	}
+	defer restore()
+	// Switch to the alternate screen and hide the cursor until we leave
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan key)
+	go readKeys(os.Stdin, keys)
+
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	ui := &tui{client: client, torrents: torrents, logs: logs}
+	for {
+		if w, h, err := termSize(int(os.Stdout.Fd())); err == nil {
+			width, height = w, h
+		}
+		var frame bytes.Buffer
+		ui.render(&frame, width, height)
+		os.Stdout.Write(frame.Bytes())
+
+		select {
+		case k := <-keys:
+			if ui.handle(k) {
+				return nil
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// key is a key press the TUI understands.
+type key int
+
+const (
+	keyOther key = iota
+	keyUp
+	keyDown
+	keyQuit
+	keyPause
+	keyResume
+	keySeed
+)
+
+// readKeys sends the keys pressed on r until it fails.
+func readKeys(r io.Reader, keys chan<- key) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return
+		}
+		k := keyOther
+		switch b {
+		case 'q', 'Q':
+			k = keyQuit
+		case 'k':
+			k = keyUp
+		case 'j':
+			k = keyDown
+		case 'p':
+			k = keyPause
+		case 'r':
+			k = keyResume
+		case 's':
+			k = keySeed
+		case 0x1b:
+			// Arrow keys arrive as ESC [ A and ESC [ B
+			if next, _ := br.Peek(2); len(next) == 2 && next[0] == '[' {
+				br.Discard(2)
+				switch next[1] {
+				case 'A':
+					k = keyUp
+				case 'B':
+					k = keyDown
+				}
+			}
+		}
+		keys <- k
+	}
+}
+
+// tui is the state of the terminal UI.
+type tui struct {
+	client   *torrent.Client
+	torrents []*torrent.Torrent
+	selected int
+	logs     *logBuffer
+}
+
+// handle acts on a key and reports whether the TUI should quit.
+func (ui *tui) handle(k key) bool {
+	t := ui.torrents[ui.selected]
+	switch k {
+	case keyQuit:
+		return true
+	case keyUp:
+		ui.selected = max(ui.selected-1, 0)
+	case keyDown:
+		ui.selected = min(ui.selected+1, len(ui.torrents)-1)
+	case keyPause:
+		// Pausing waits for peers to disconnect, so it runs aside
+		go t.Pause()
+	case keyResume:
+		if err := t.Resume(); err != nil {
+			slog.Error("resume failed", "torrent", t.Name(), "err", err)
+		}
+	case keySeed:
+		if err := t.Seed(); err != nil {
+			slog.Error("seed failed", "torrent", t.Name(), "err", err)
+		}
+	}
+	return false
+}
+
+// render draws a full frame for a width by height terminal.
+func (ui *tui) render(w io.Writer, width, height int) {
+	var lines []string
+	add := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	stats := ui.client.Stats()
+	add("torrent  ↓ %s/s  ↑ %s/s  %d peers        q quit  ↑↓ select  p pause  r resume  s seed",
+		formatBytes(int64(stats.DownloadRate)), formatBytes(int64(stats.UploadRate)), stats.Peers)
+	add("")
+	add("   %-28s %-17s %7s %10s %10s %5s %8s", "Name", "State", "Done", "Down", "Up", "Peers", "ETA")
+	for i, t := range ui.torrents {
+		s, st := t.Status(), t.Stats()
+		cursor := " "
+		if i == ui.selected {
+			cursor = ">"
+		}
+		done := "-"
+		if s.PiecesWanted > 0 {
+			done = fmt.Sprintf("%.1f%%", float64(s.PiecesDone)/float64(s.PiecesWanted)*100)
+		}
+		eta := "-"
+		if st.ETA > 0 {
+			eta = st.ETA.Round(time.Second).String()
+		}
+		add(" %s %-28s %-17s %7s %8s/s %8s/s %5d %8s", cursor, truncate(s.Name, 28), s.State, done,
+			formatBytes(int64(st.DownloadRate)), formatBytes(int64(st.UploadRate)), st.Peers, eta)
+	}
+
+	t := ui.torrents[ui.selected]
+	s := t.Status()
+	add("")
+	if s.Err != nil {
+		add("Error: %v", s.Err)
+	}
+	add("Pieces (%d/%d):", s.PiecesDone, s.PiecesTotal)
+	for _, row := range pieceMap(t.Have(), s.PiecesTotal, width-2, 4) {
+		add(" %s", row)
+	}
+
+	add("")
+	add("Trackers:")
+	trackers := t.Trackers()
+	if len(trackers) == 0 {
+		add("  none announced to yet")
+	}
+	for _, tr := range trackers {
+		result := fmt.Sprintf("%d peers", tr.Peers)
+		if tr.Err != nil {
+			result = "error: " + tr.Err.Error()
+		}
+		add("  %s  %s, %s ago", tr.URL, result, time.Since(tr.LastAnnounce).Round(time.Second))
+	}
+
+	add("")
+	add("  %-22s %-22s %-5s %10s %10s", "Peer", "Client", "Flags", "Down", "Up")
+	peers := t.Peers()
+	// Keep room for the log pane
+	room := max(height-len(lines)-6, 1)
+	for i, p := range peers {
+		if i == room-1 && len(peers) > room {
+			add("  ... %d more", len(peers)-i)
+			break
+		}
+		add("  %-22s %-22s %-5s %8s/s %8s/s", truncate(p.Addr, 22), truncate(p.Client, 22), peerFlags(p),
+			formatBytes(int64(p.DownloadRate)), formatBytes(int64(p.UploadRate)))
+	}
+
+	add("")
+	logLines := ui.logs.lines()
+	for _, l := range logLines[max(0, len(logLines)-max(height-len(lines), 0)):] {
+		add("%s", l)
+	}
+
+	// Home the cursor and overwrite in place, clearing each line's tail,
+	// so the screen doesn't flicker
+	io.WriteString(w, "\x1b[H")
+	for i, l := range lines {
+		if i == height {
+			break
+		}
+		if i > 0 {
+			io.WriteString(w, "\r\n")
+		}
+		io.WriteString(w, truncate(l, width))
+		io.WriteString(w, "\x1b[K")
+	}
+	io.WriteString(w, "\x1b[J")
+}
+
+// peerFlags summarises a connection the way many clients do: D and d for
+// downloading from an unchoked or choked peer we're interested in, U and u
+// for uploading to an interested peer we unchoke or choke, I for incoming
+// connections and E for encrypted ones.
+func peerFlags(p torrent.PeerInfo) string {
+	var b strings.Builder
+	switch {
+	case p.AmInterested && !p.PeerChoking:
+		b.WriteByte('D')
+	case p.AmInterested:
+		b.WriteByte('d')
+	}
+	switch {
+	case p.PeerInterested && !p.AmChoking:
+		b.WriteByte('U')
+	case p.PeerInterested:
+		b.WriteByte('u')
+	}
+	if p.Incoming {
+		b.WriteByte('I')
+	}
+	if p.Encrypted {
+		b.WriteByte('E')
+	}
+	return b.String()
+}
+
+// pieceMap draws have as up to rows lines of width cells. Each cell
+// covers a run of pieces and shows whether all, some or none of them are
+// verified.
+func pieceMap(have torrent.Bitfield, pieces, width, rows int) []string {
+	if pieces == 0 || width <= 0 {
+		return []string{"(waiting for metadata)"}
+	}
+	cells := min(pieces, width*rows)
+	var b strings.Builder
+	var out []string
+	for c := 0; c < cells; c++ {
+		first, last := c*pieces/cells, (c+1)*pieces/cells
+		got := 0
+		for i := first; i < last; i++ {
+			if have.HasPiece(i) {
+				got++
+			}
+		}
+		switch {
+		case got == last-first:
+			b.WriteRune('█')
+		case got > 0:
+			b.WriteRune('▒')
+		default:
+			b.WriteRune('░')
+		}
+		if (c+1)%width == 0 || c == cells-1 {
+			out = append(out, b.String())
+			b.Reset()
+		}
+	}
+	return out
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:max(n, 0)])
+}
+
+// logBuffer keeps the last max lines written to it.
+type logBuffer struct {
+	mu   sync.Mutex
+	max  int
+	buf  []string
+	part []byte
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.part = append(l.part, p...)
+	for {
+		i := bytes.IndexByte(l.part, '\n')
+		if i < 0 {
+			break
+		}
+		l.buf = append(l.buf, string(l.part[:i]))
+		l.part = l.part[i+1:]
+	}
+	if len(l.buf) > l.max {
+		l.buf = slices.Delete(l.buf, 0, len(l.buf)-l.max)
+	}
+	return len(p), nil
+}
+
+func (l *logBuffer) lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.buf)
+}
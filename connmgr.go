@@ -0,0 +1,301 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxHalfOpen is how many connections a torrent dials at once
+	// when ClientConfig.MaxHalfOpen is zero
+	DefaultMaxHalfOpen = 16
+	// reannounceInterval is how often a download asks its trackers for
+	// more peers, and minReannounceInterval how soon it may ask again when
+	// it runs out
+	reannounceInterval    = 5 * time.Minute
+	minReannounceInterval = time.Minute
+	// peerRetryDelay is how long a peer waits before it's dialled again,
+	// doubling with each failure in a row up to peerRetryMaxDelay
+	peerRetryDelay    = 10 * time.Second
+	peerRetryMaxDelay = 5 * time.Minute
+	// peerMaxFailures is how many failures in a row drop a peer for good
+	peerMaxFailures = 5
+)
+
+// errWrongSwarm is returned for peers that answer for another torrent,
+// which no retry will fix, any more than for banned peers.
+var errWrongSwarm = errors.New("peer is in another swarm")
+
+// connManager keeps a download connected to as many peers as it may. It
+// holds a pool of candidate peers fed by the torrent's peer sources and
+// dials them while under its caps on active and half-open connections,
+// refilling slots as connections drop. Peers that fail are retried with
+// exponential backoff until they fail too often in a row.
+type connManager struct {
+	// maxActive caps connections, including half-open ones; zero means
+	// no limit
+	maxActive   int
+	maxHalfOpen int
+	// connect runs a connection to p until it ends, calling connected once
+	// its handshake completes
+	connect func(ctx context.Context, p swarmPeer, connected func()) error
+	// discover finds more peers; nil if there are no more to be found
+	discover func(ctx context.Context) []swarmPeer
+	// inbound carries peers that connected to us, which accept runs
+	// until they end; nil if none do
+	inbound <-chan inboundConn
+	accept  func(ctx context.Context, in inboundConn) error
+	// lastDiscover is when peers were last looked for
+	lastDiscover time.Time
+	log          *slog.Logger
+	// retryDelay, retryMaxDelay and maxFailures tune backoff
+	retryDelay, retryMaxDelay time.Duration
+	maxFailures               int
+
+	mu         sync.Mutex
+	candidates map[string]*candidate
+	// dropped holds peers that failed too often, so they aren't added
+	// back when a tracker returns them again
+	dropped          map[string]bool
+	active, halfOpen int
+	wake             chan struct{}
+}
+
+// candidate is a peer in the pool.
+type candidate struct {
+	peer swarmPeer
+	// busy is set while a connection to the peer runs
+	busy bool
+	// failures counts failed attempts in a row, and next is when the peer
+	// may be dialled again
+	failures int
+	next     time.Time
+}
+
+func newConnManager(cfg peerConfig, connect func(ctx context.Context, p swarmPeer, connected func()) error) *connManager {
+	maxHalfOpen := cfg.maxHalfOpen
+	if maxHalfOpen <= 0 {
+		maxHalfOpen = DefaultMaxHalfOpen
+	}
+	return &connManager{
+		maxActive:     cfg.maxPeers,
+		maxHalfOpen:   maxHalfOpen,
+		connect:       connect,
+		log:           cfg.logger(),
+		lastDiscover:  time.Now(),
+		retryDelay:    peerRetryDelay,
+		retryMaxDelay: peerRetryMaxDelay,
+		maxFailures:   peerMaxFailures,
+		candidates:    make(map[string]*candidate),
+		dropped:       make(map[string]bool),
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// add puts peers in the pool, skipping those already there or dropped,
+// and returns how many were new.
+func (m *connManager) add(peers []swarmPeer) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	added := 0
+	for _, p := range peers {
+		addr := p.String()
+		if _, ok := m.candidates[addr]; ok || m.dropped[addr] {
+			continue
+		}
+		m.candidates[addr] = &candidate{peer: p}
+		added++
+	}
+	if added > 0 {
+		m.poke()
+	}
+	return added
+}
+
+// discoverPeers adds the peers discover finds to the pool and returns how
+// many were new.
+func (m *connManager) discoverPeers(ctx context.Context) int {
+	m.lastDiscover = time.Now()
+	return m.add(m.discover(ctx))
+}
+
+// poke wakes run to look for work.
+func (m *connManager) poke() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run dials candidates and takes inbound peers until ctx is done or the
+// pool runs dry: nothing is connected, nothing is left to retry and
+// discover finds no one new. It returns once every connection it started
+// or took has ended.
+func (m *connManager) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var reannounce <-chan time.Time
+	if m.discover != nil {
+		ticker := time.NewTicker(reannounceInterval)
+		defer ticker.Stop()
+		reannounce = ticker.C
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		next, exhausted := m.dial(ctx, &wg)
+		if exhausted {
+			if m.discover == nil {
+				m.log.Debug("no peers left to connect to")
+				return
+			}
+			// Don't pester the trackers; wait until they may be asked again
+			if due := m.lastDiscover.Add(minReannounceInterval); time.Now().Before(due) {
+				next = due
+			} else if m.discoverPeers(ctx) == 0 {
+				m.log.Debug("no peers left to connect to")
+				return
+			} else {
+				continue
+			}
+		}
+
+		timer.Stop()
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+		select {
+		case <-m.wake:
+		case <-timer.C:
+		case <-reannounce:
+			m.discoverPeers(ctx)
+		case in := <-m.inbound:
+			m.adopt(ctx, &wg, in)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dial starts connections to the candidates that are due while there is
+// room. It returns when the next candidate waiting on backoff is due, and
+// whether the pool is exhausted.
+func (m *connManager) dial(ctx context.Context, wg *sync.WaitGroup) (next time.Time, exhausted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ctx.Err() != nil {
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	for _, c := range m.candidates {
+		if c.busy {
+			continue
+		}
+		if c.next.After(now) {
+			if next.IsZero() || c.next.Before(next) {
+				next = c.next
+			}
+			continue
+		}
+		if m.maxActive > 0 && m.active >= m.maxActive || m.halfOpen >= m.maxHalfOpen {
+			continue
+		}
+		c.busy = true
+		m.active++
+		m.halfOpen++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.attempt(ctx, c)
+		}()
+	}
+	return next, m.active == 0 && len(m.candidates) == 0
+}
+
+// adopt runs a connection a peer made to us if there is room for it,
+// closing it otherwise.
+func (m *connManager) adopt(ctx context.Context, wg *sync.WaitGroup, in inboundConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.maxActive > 0 && m.active >= m.maxActive {
+		m.log.Debug("inbound peer refused", "peer", in.conn.RemoteAddr().String(), "reason", "peer limit")
+		in.conn.Close()
+		return
+	}
+	m.active++
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := m.accept(ctx, in); err != nil {
+			m.log.Debug("inbound peer disconnected", "peer", in.conn.RemoteAddr().String(), "err", err)
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.active--
+		m.poke()
+	}()
+}
+
+// attempt runs one connection to c and schedules what happens to it next.
+func (m *connManager) attempt(ctx context.Context, c *candidate) {
+	connected := false
+	err := m.connect(ctx, c.peer, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if !connected {
+			connected = true
+			m.halfOpen--
+			m.poke()
+		}
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.poke()
+	if !connected {
+		m.halfOpen--
+	}
+	m.active--
+	c.busy = false
+	if ctx.Err() != nil {
+		return
+	}
+
+	addr := c.peer.String()
+	switch {
+	case errors.Is(err, errWrongSwarm), errors.Is(err, errBanned):
+		delete(m.candidates, addr)
+		m.dropped[addr] = true
+	case errors.Is(err, errBlocked):
+		// Left out of dropped, so it can come back if the filter changes
+		delete(m.candidates, addr)
+	case connected:
+		// The peer worked, so it's worth reconnecting to before long
+		c.failures = 0
+		c.next = time.Now().Add(m.retryDelay)
+	default:
+		c.failures++
+		if c.failures >= m.maxFailures {
+			m.log.Debug("dropping peer", "peer", addr, "failures", c.failures, "err", err)
+			delete(m.candidates, addr)
+			m.dropped[addr] = true
+			return
+		}
+		c.next = time.Now().Add(m.backoff(c.failures))
+	}
+}
+
+// backoff returns how long to wait after failures in a row.
+func (m *connManager) backoff(failures int) time.Duration {
+	d := m.retryDelay
+	for i := 1; i < failures && d < m.retryMaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, m.retryMaxDelay)
+}
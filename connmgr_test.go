@@ -0,0 +1,193 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSwarmPeers(n int) []swarmPeer {
+	peers := make([]swarmPeer, n)
+	for i := range peers {
+		peers[i] = swarmPeer{Peer: Peer{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 6881}}
+	}
+	return peers
+}
+
+func newTestConnManager(cfg peerConfig, connect func(ctx context.Context, p swarmPeer, connected func()) error) *connManager {
+	m := newConnManager(cfg, connect)
+	m.retryDelay, m.retryMaxDelay = time.Millisecond, 4*time.Millisecond
+	return m
+}
+
+func TestConnManagerCaps(t *testing.T) {
+	var mu sync.Mutex
+	var active, halfOpen, maxActive, maxHalfOpen, done int
+	m := newTestConnManager(peerConfig{maxPeers: 3, maxHalfOpen: 2}, func(ctx context.Context, p swarmPeer, connected func()) error {
+		mu.Lock()
+		active++
+		halfOpen++
+		maxActive, maxHalfOpen = max(maxActive, active), max(maxHalfOpen, halfOpen)
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		halfOpen--
+		mu.Unlock()
+		connected()
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		done++
+		mu.Unlock()
+		// Pretend the download ran out of work for this peer
+		return errWrongSwarm
+	})
+	m.add(testSwarmPeers(10))
+	m.run(context.Background())
+
+	if done != 10 {
+		t.Errorf("%d peers connected, want 10", done)
+	}
+	if maxActive > 3 || maxHalfOpen > 2 {
+		t.Errorf("peaked at %d active and %d half-open, want at most 3 and 2", maxActive, maxHalfOpen)
+	}
+}
+
+func TestConnManagerRetriesWithBackoff(t *testing.T) {
+	var attempts atomic.Int32
+	m := newTestConnManager(peerConfig{}, func(ctx context.Context, p swarmPeer, connected func()) error {
+		attempts.Add(1)
+		return errors.New("connection refused")
+	})
+	m.add(testSwarmPeers(1))
+	m.run(context.Background())
+
+	if got := attempts.Load(); got != peerMaxFailures {
+		t.Errorf("dialled %d times, want %d before dropping", got, peerMaxFailures)
+	}
+	// A dropped peer isn't taken back
+	if m.add(testSwarmPeers(1)) != 0 {
+		t.Errorf("a dropped peer was added back")
+	}
+}
+
+func TestConnManagerReconnects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var attempts atomic.Int32
+	m := newTestConnManager(peerConfig{}, func(ctx context.Context, p swarmPeer, connected func()) error {
+		connected()
+		// Peers that connected are always retried, so stop after a few
+		if attempts.Add(1) == peerMaxFailures+2 {
+			cancel()
+		}
+		return errors.New("peer disconnected")
+	})
+	m.add(testSwarmPeers(1))
+
+	done := make(chan struct{})
+	go func() {
+		m.run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run() didn't return once cancelled")
+	}
+	if got := attempts.Load(); got != peerMaxFailures+2 {
+		t.Errorf("connected %d times, want %d", got, peerMaxFailures+2)
+	}
+}
+
+func TestConnManagerDiscovers(t *testing.T) {
+	var connected sync.Map
+	m := newTestConnManager(peerConfig{}, func(ctx context.Context, p swarmPeer, _ func()) error {
+		connected.Store(p.String(), true)
+		return errWrongSwarm
+	})
+	peers := testSwarmPeers(3)
+	var calls atomic.Int32
+	m.discover = func(ctx context.Context) []swarmPeer {
+		n := int(calls.Add(1))
+		return peers[n : n+1]
+	}
+	// Let the first refill happen straight away
+	m.lastDiscover = time.Now().Add(-minReannounceInterval)
+	m.add(peers[:1])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	select {
+	case <-done:
+		t.Fatalf("run() returned before it may ask for more peers")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The second refill has to wait, so the pool is still one short
+	if _, ok := connected.Load(peers[2].String()); ok {
+		t.Errorf("trackers were asked again too soon")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("discover called %d times, want 1", n)
+	}
+	for _, p := range peers[:2] {
+		if _, ok := connected.Load(p.String()); !ok {
+			t.Errorf("peer %s was never dialled", p)
+		}
+	}
+}
+
+func TestConnManagerDropsBanned(t *testing.T) {
+	attempts := 0
+	m := newTestConnManager(peerConfig{}, func(ctx context.Context, p swarmPeer, connected func()) error {
+		attempts++
+		connected()
+		return errBanned
+	})
+	m.add(testSwarmPeers(1))
+	m.run(context.Background())
+	if attempts != 1 {
+		t.Errorf("connected %d times, want 1 before dropping a banned peer", attempts)
+	}
+}
+
+func TestConnManagerBackoff(t *testing.T) {
+	m := newConnManager(peerConfig{}, nil)
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, 5 * time.Minute, 5 * time.Minute}
+	for i, w := range want {
+		if got := m.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestConnManagerForgetsBlocked(t *testing.T) {
+	attempts := 0
+	m := newTestConnManager(peerConfig{}, func(ctx context.Context, p swarmPeer, connected func()) error {
+		attempts++
+		return errBlocked
+	})
+	m.add(testSwarmPeers(1))
+	m.run(context.Background())
+	if attempts != 1 {
+		t.Errorf("dialled %d times, want 1", attempts)
+	}
+	// The filter may be reloaded without the peer, so it can come back
+	if m.add(testSwarmPeers(1)) != 1 {
+		t.Errorf("a blocked peer couldn't be added back")
+	}
+}
@@ -0,0 +1,249 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"torrent/bencode"
+)
+
+const (
+	minPieceLength = 16 * 1024        // 16KB
+	maxPieceLength = 16 * 1024 * 1024 // 16MB
+	// targetPieces is roughly how many pieces automatic piece lengths aim for
+	targetPieces = 1500
+)
+
+// CreateOptions controls the metainfo written by Create.
+type CreateOptions struct {
+	Announce     string
+	AnnounceList [][]string
+	WebSeeds     []string
+	Comment      string
+	CreatedBy    string
+	// CreationDate defaults to the current time
+	CreationDate time.Time
+	Private      bool
+	// PieceLength of zero picks one based on the total size
+	PieceLength int
+}
+
+// createFile is a file found under the path passed to Create.
+type createFile struct {
+	fullPath string
+	path     []string
+	length   int
+}
+
+// Create builds the metainfo for the file or directory at path, hashing its
+// pieces in parallel. Directories become multi-file torrents with their
+// files in lexical order.
+func Create(path string, opts CreateOptions) (*MetaInfo, error) {
+	// Resolve the path so that "." and ".." are named after the directory
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	if err := validatePathElement(name); err != nil {
+		return nil, fmt.Errorf("cannot name a torrent after %s: %v", path, err)
+	}
+	files, err := collectFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0
+	for _, f := range files {
+		total += f.length
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("nothing to hash in %s", path)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(total)
+	}
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length %d", pieceLength)
+	}
+
+	pieces, err := hashPieces(files, pieceLength, total)
+	if err != nil {
+		return nil, err
+	}
+
+	info := InfoDict{
+		Pieces:      pieces,
+		PieceLength: pieceLength,
+		Name:        name,
+	}
+	if len(files) == 1 && files[0].path == nil {
+		info.Length = total
+	} else {
+		info.Files = make([]FileDict, len(files))
+		for i, f := range files {
+			info.Files[i] = FileDict{Length: f.length, Path: f.path}
+		}
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+
+	created := opts.CreationDate
+	if created.IsZero() {
+		created = time.Now()
+	}
+	announce := opts.Announce
+	if announce == "" && len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		announce = opts.AnnounceList[0][0]
+	}
+
+	return &MetaInfo{
+		Announce:     announce,
+		AnnounceList: opts.AnnounceList,
+		URLList:      urlList(opts.WebSeeds),
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: created.Unix(),
+		Info:         info,
+	}, nil
+}
+
+// Write bencodes the metainfo to w.
+func (b *MetaInfo) Write(w io.Writer) error {
+	return bencode.NewEncoder(w).Encode(b)
+}
+
+// collectFiles lists the regular files to include. A single file is
+// returned with a nil path; directory entries carry their path relative to
+// the directory.
+func collectFiles(root string) ([]createFile, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []createFile{{fullPath: root, length: int(info.Size())}}, nil
+	}
+
+	var files []createFile
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, createFile{
+			fullPath: p,
+			path:     strings.Split(filepath.ToSlash(rel), "/"),
+			length:   int(fi.Size()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files found in %s", root)
+	}
+	return files, nil
+}
+
+// choosePieceLength picks the power of two that gives about targetPieces
+// pieces, clamped to sensible bounds.
+func choosePieceLength(total int) int {
+	length := minPieceLength
+	for length < maxPieceLength && (total+length-1)/length > targetPieces {
+		length *= 2
+	}
+	return length
+}
+
+// hashPieces reads the files as one stream and hashes each piece on a pool
+// of workers, returning the concatenated hashes.
+func hashPieces(files []createFile, pieceLength, total int) (string, error) {
+	numPieces := (total + pieceLength - 1) / pieceLength
+	hashes := make([]byte, numPieces*sha1.Size)
+
+	type job struct {
+		index int
+		buf   []byte
+	}
+	jobs := make(chan job, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				sum := sha1.Sum(j.buf)
+				copy(hashes[j.index*sha1.Size:], sum[:])
+			}
+		}()
+	}
+
+	err := readPieces(files, pieceLength, func(index int, buf []byte) {
+		jobs <- job{index, buf}
+	})
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return "", err
+	}
+	return string(hashes), nil
+}
+
+// readPieces streams the files back to back and calls fn with each piece.
+func readPieces(files []createFile, pieceLength int, fn func(index int, buf []byte)) error {
+	index := 0
+	buf := make([]byte, 0, pieceLength)
+	for _, f := range files {
+		file, err := os.Open(f.fullPath)
+		if err != nil {
+			return err
+		}
+
+		remaining := f.length
+		for remaining > 0 {
+			n := min(pieceLength-len(buf), remaining)
+			start := len(buf)
+			buf = buf[:start+n]
+			if _, err := io.ReadFull(file, buf[start:]); err != nil {
+				file.Close()
+				return fmt.Errorf("failed to read %s: %v", f.fullPath, err)
+			}
+			remaining -= n
+
+			if len(buf) == pieceLength {
+				fn(index, buf)
+				index++
+				buf = make([]byte, 0, pieceLength)
+			}
+		}
+		file.Close()
+	}
+
+	if len(buf) > 0 {
+		fn(index, buf)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChoosePieceLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		total int
+		want  int
+	}{
+		{"tiny file", 1, minPieceLength},
+		{"exactly target at minimum", minPieceLength * targetPieces, minPieceLength},
+		{"just over target", minPieceLength*targetPieces + 1, 2 * minPieceLength},
+		{"huge file", 1 << 40, maxPieceLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := choosePieceLength(tt.total); got != tt.want {
+				t.Errorf("choosePieceLength(%d) = %d, want %d", tt.total, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreate_Directory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "release")
+	os.MkdirAll(filepath.Join(root, "bin"), 0755)
+	contents := map[string][]byte{
+		"README":        bytes.Repeat([]byte("r"), 100),
+		"bin/tool":      bytes.Repeat([]byte("t"), 40000),
+		"bin/tool.sha1": bytes.Repeat([]byte("s"), 40),
+	}
+	for name, data := range contents {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	created := time.Unix(1700000000, 0)
+	bt, err := Create(root, CreateOptions{
+		AnnounceList: [][]string{{"http://a.example/announce"}, {"http://b.example/announce"}},
+		WebSeeds:     []string{"http://seed.example/files/"},
+		Comment:      "build 42",
+		CreatedBy:    "test",
+		CreationDate: created,
+		Private:      true,
+		PieceLength:  16384,
+	})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	if bt.Announce != "http://a.example/announce" {
+		t.Errorf("Create() Announce = %v, want first tier tracker", bt.Announce)
+	}
+	if bt.CreationDate != created.Unix() || bt.Info.Private != 1 {
+		t.Errorf("Create() CreationDate = %d, Private = %d", bt.CreationDate, bt.Info.Private)
+	}
+
+	// Files are in lexical order, pieces span file boundaries
+	wantFiles := []FileDict{
+		{Length: 100, Path: []string{"README"}},
+		{Length: 40000, Path: []string{"bin", "tool"}},
+		{Length: 40, Path: []string{"bin", "tool.sha1"}},
+	}
+	if !reflect.DeepEqual(bt.Info.Files, wantFiles) {
+		t.Errorf("Create() Files = %v, want %v", bt.Info.Files, wantFiles)
+	}
+
+	var all []byte
+	all = append(all, contents["README"]...)
+	all = append(all, contents["bin/tool"]...)
+	all = append(all, contents["bin/tool.sha1"]...)
+	var wantPieces []byte
+	for off := 0; off < len(all); off += 16384 {
+		sum := sha1.Sum(all[off:min(off+16384, len(all))])
+		wantPieces = append(wantPieces, sum[:]...)
+	}
+	if bt.Info.Pieces != string(wantPieces) {
+		t.Errorf("Create() Pieces do not match the file contents")
+	}
+}
+
+func TestCreate_RoundTripInfoHash(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "artifact.bin")
+	if err := os.WriteFile(src, bytes.Repeat([]byte{0xAB}, 50000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bt, err := Create(src, CreateOptions{Announce: "http://tracker.example/announce", Private: true})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if bt.Info.Length != 50000 || bt.Info.Files != nil {
+		t.Errorf("Create() single file Length = %d, Files = %v", bt.Info.Length, bt.Info.Files)
+	}
+	want, err := bt.ToTorrentFile()
+	if err != nil {
+		t.Fatalf("ToTorrentFile() error = %v", err)
+	}
+
+	out := filepath.Join(dir, "artifact.torrent")
+	f, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Write(f); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	f.Close()
+
+	opened, err := Open(out)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	got, err := opened.ToTorrentFile()
+	if err != nil {
+		t.Fatalf("ToTorrentFile() error = %v", err)
+	}
+	if got.InfoHash != want.InfoHash {
+		t.Errorf("InfoHash after round trip = %x, want %x", got.InfoHash, want.InfoHash)
+	}
+}
+
+func TestCreate_Errors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Create(filepath.Join(dir, "missing"), CreateOptions{}); err == nil {
+		t.Errorf("Create() should return error for missing path")
+	}
+	if _, err := Create(dir, CreateOptions{}); err == nil {
+		t.Errorf("Create() should return error for empty directory")
+	}
+}
+
+func TestCreate_CurrentDirectory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "release")
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	if err := os.WriteFile(filepath.Join(root, "a.bin"), bytes.Repeat([]byte("a"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(filepath.Join(root, "sub"))
+
+	for _, path := range []string{"..", "../sub/.."} {
+		bt, err := Create(path, CreateOptions{})
+		if err != nil {
+			t.Fatalf("Create(%q) error = %v", path, err)
+		}
+		if bt.Info.Name != "release" {
+			t.Errorf("Create(%q) name = %q, want %q", path, bt.Info.Name, "release")
+		}
+		if _, err := bt.ToTorrentFile(); err != nil {
+			t.Errorf("ToTorrentFile() error = %v", err)
+		}
+	}
+
+	t.Chdir(root)
+	bt, err := Create(".", CreateOptions{})
+	if err != nil {
+		t.Fatalf("Create(\".\") error = %v", err)
+	}
+	if bt.Info.Name != "release" {
+		t.Errorf("Create(\".\") name = %q, want %q", bt.Info.Name, "release")
+	}
+	if _, err := bt.ToTorrentFile(); err != nil {
+		t.Errorf("ToTorrentFile() error = %v", err)
+	}
+}
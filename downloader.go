@@ -1,19 +1,74 @@
-package main
+package torrent
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
-	"net"
-	"os"
-	"strings"
+	"io"
+	"log/slog"
 	"sync"
 	"time"
 )
 
 const MaxBlockSize = 16384 // 16KB
+
+// DefaultListenPort is the port announced to trackers when none is
+// configured.
+const DefaultListenPort = 6881
+
+// stopAnnounceTimeout bounds the stopped announce sent on shutdown
+const stopAnnounceTimeout = 5 * time.Second
+
+// peerConfig holds the client settings a download or seed runs with.
+type peerConfig struct {
+	peerID [20]byte
+	port   uint16
+	// maxPeers caps the peers connected to at once; zero means no limit
+	maxPeers int
+	// maxHalfOpen caps the connections being dialled at once; zero means
+	// DefaultMaxHalfOpen
+	maxHalfOpen int
+	// uploadSlots is how many peers the choker unchokes on merit; zero
+	// means DefaultUploadSlots
+	uploadSlots int
+	// superSeed hides what seeds have and reveals pieces one at a time
+	superSeed bool
+	// download and upload limit the bytes moved over peer connections
+	// and web seeds; empty means unlimited
+	download, upload rateLimits
+	// peerDownload and peerUpload are the rates each new peer connection
+	// starts out limited to; zero means unlimited
+	peerDownload, peerUpload int
+	// conns caps the connections open across torrents; nil means no limit
+	conns *connLimiter
+	// bans holds the IPs refused for sending corrupt data; nil bans no one
+	bans *banList
+	// blocklist filters peers by IP; nil filters no one
+	blocklist *blocklist
+	// encryption is whether outgoing connections use MSE
+	encryption EncryptionPolicy
+	// stats counts traffic and connected peers; nil counts nothing
+	stats *transferStats
+	// onEvent receives what happens to the download or seed; nil drops it
+	onEvent func(Event)
+	// log receives the download's or seed's logs; nil means slog.Default()
+	log *slog.Logger
+	// metrics records client-wide metrics; nil records nothing
+	metrics *clientMetrics
+}
+
 type pieceWork struct {
 	index  int
 	hash   [20]byte
 	length int
+	// hashV2 is set for pieces of v2 and hybrid torrents
+	hashV2 *pieceHashV2
+}
+
+// swarmPeer is a peer found in one of the torrent's swarms.
+type swarmPeer struct {
+	Peer
+	infoHash [20]byte
 }
 
 type pieceResult struct {
@@ -21,63 +76,108 @@ type pieceResult struct {
 	buf   []byte
 }
 
-// safelyRequeueWork attempts to requeue work, handling closed channels gracefully
-func safelyRequeueWork(work chan *pieceWork, pw *pieceWork) {
-	defer func() {
-		if recover() != nil {
-			// Channel is closed, ignore the requeue attempt
-		}
-	}()
-	select {
-	case work <- pw:
-	default:
-		// Channel is full, work will be lost but that's acceptable
-	}
-}
-
-func (t *TorrentFile) Download() error {
+// Download fetches every wanted piece, calling progress, if not nil, after
+// each one is verified. When ctx is cancelled it closes every peer
+// connection, flushes what was written to disk, tells the trackers it
+// stopped and returns ctx's error.
+func (t *TorrentFile) Download(ctx context.Context, progress func(done, wanted int)) error {
 	peerID, err := GeneratePeerID()
 	if err != nil {
 		return fmt.Errorf("failed to generate peer ID: %v", err)
 	}
-	peers, err := t.RequestPeers(peerID, 6881)
-	if err != nil {
+
+	cfg := peerConfig{peerID: peerID, port: DefaultListenPort}
+	return t.download(ctx, cfg, nil, progress)
+}
+
+// download runs the download until every wanted piece is verified or ctx
+// is cancelled, calling progress after each piece. Peers that connect to
+// us arrive on inbound, which may be nil. Pieces verified by an earlier
+// call are not fetched again. However it returns, every worker
+// has exited and storage is flushed and closed by then.
+func (t *TorrentFile) download(ctx context.Context, cfg peerConfig, inbound <-chan inboundConn, progress func(done, wanted int)) (err error) {
+	// Web seeds can carry the download alone when no tracker answers
+	peers, err := t.requestSwarmPeers(ctx, cfg, t.Length, eventStarted)
+	if err != nil && len(t.WebSeeds) == 0 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return fmt.Errorf("failed to request peers: %v", err)
 	}
-
-	if len(peers) == 0 {
+	if len(peers) == 0 && len(t.WebSeeds) == 0 {
 		return fmt.Errorf("no peers available")
 	}
+	log := cfg.logger()
+	log.Info("download started", "peers", len(peers), "web_seeds", len(t.WebSeeds))
 
-	// Open the file once for all piece writes
-	file, err := os.OpenFile(t.Name, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
-	}
-	defer file.Close()
+	sel := t.selection()
+	defer func() { t.announceStopped(ctx, cfg, t.leftBytes(sel.haveSnapshot())) }()
 
-	// Make workQueue 2x size to allow requeuing failed work without blocking
-	workQueue := make(chan *pieceWork, len(t.PieceHashes)*2)
-	results := make(chan *pieceResult)
+	// Cancelling stops the workers however download returns
+	ctx, cancel := context.WithCancel(ctx)
 
-	// fill work queue
-	for i, hash := range t.PieceHashes {
-		pieceLength := t.PieceLength
-		// Last piece might be shorter
-		if i == len(t.PieceHashes)-1 {
-			pieceLength = t.Length - (i * t.PieceLength)
-		}
-		workQueue <- &pieceWork{i, hash, pieceLength}
-	}
+	store := newStorage(t)
+	pieces := t.pieceWorks()
+	queue := newWorkQueue(pieces, t.PiecePriorities())
+
+	// Let SetFilePriority and readers reach this download while it runs
+	sel.attach(queue, store, len(pieces))
+
+	results := make(chan *pieceResult)
 
 	// start workers with WaitGroup tracking
 	var wg sync.WaitGroup
-	for _, peer := range peers {
+	defer func() {
+		// Wait for every worker so nothing writes to storage once it is
+		// closed; closing the queue releases workers waiting for a piece
+		cancel()
+		queue.close()
+		wg.Wait()
+		sel.detach()
+		if cerr := store.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to flush files: %v", cerr)
+		}
+	}()
+
+	// The choker runs apart from the workers, whose end it mustn't hold up
+	sw := newDownloadSwarm(t, cfg, queue, results, store, sel)
+	chokerDone := make(chan struct{})
+	go func() {
+		defer close(chokerDone)
+		sw.choker.run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-chokerDone
+	}()
+
+	conns := newConnManager(cfg, func(ctx context.Context, p swarmPeer, connected func()) error {
+		return t.startWorker(ctx, p.Peer, p.infoHash, sw, connected)
+	})
+	conns.inbound = inbound
+	conns.accept = func(ctx context.Context, in inboundConn) error {
+		return t.acceptPeer(ctx, in, sw)
+	}
+	if t.Announce != "" {
+		conns.discover = func(ctx context.Context) []swarmPeer {
+			found, _ := t.requestSwarmPeers(ctx, cfg, t.leftBytes(sel.haveSnapshot()), "")
+			return found
+		}
+	}
+	conns.add(peers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conns.run(ctx)
+	}()
+	for _, u := range t.WebSeeds {
+		ws := newWebSeed(u)
+		ws.cfg = cfg
 		wg.Add(1)
-		go func(p Peer) {
+		go func() {
 			defer wg.Done()
-			t.startWorker(p, peerID, workQueue, results, file)
-		}(peer)
+			t.startWebSeed(ctx, ws, queue, results, store)
+		}()
 	}
 
 	// Close results channel when all workers are done
@@ -86,149 +186,266 @@ func (t *TorrentFile) Download() error {
 		close(results)
 	}()
 
-	// progress bar logic
-	doneCount := 0
-	totalPieces := len(t.PieceHashes)
-	fmt.Printf("Downloading %s...\n", t.Name)
-	for doneCount < totalPieces {
-		_, ok := <-results
-		if !ok {
-			// Channel closed, all workers are done
-			if doneCount < totalPieces {
+	for {
+		doneCount, totalPieces, changed := queue.progress()
+		if doneCount == totalPieces {
+			break
+		}
+
+		select {
+		case res, ok := <-results:
+			if !ok {
+				// Channel closed, all workers are done
+				log.Warn("every peer disconnected", "done", doneCount, "wanted", totalPieces)
 				return fmt.Errorf("all workers finished but only %d/%d pieces downloaded", doneCount, totalPieces)
 			}
-			break
+			queue.done(res.index)
+			sel.markDone(res.index)
+			sw.verified()
+			cfg.pieceVerified(res.index)
+			doneCount++
+		case <-changed:
+			// Priorities changed; recount the wanted pieces
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		doneCount++
 
-		percent := float64(doneCount) / float64(totalPieces) * 100
-		fmt.Printf("\r[%-50s] %0.2f%% (%d/%d pieces)", strings.Repeat("-", int(percent/2)), percent, doneCount, totalPieces)
+		if progress != nil {
+			progress(doneCount, totalPieces)
+		}
 	}
 
-	// All pieces downloaded, close workQueue so workers can exit
-	// Use recover in safelyRequeueWork to handle any requeue attempts after closure
-	close(workQueue)
+	// All wanted pieces downloaded; closing the queue lets workers exit
+	queue.close()
 
-	fmt.Println("\nDownload complete!")
+	if err := store.finish(); err != nil {
+		return fmt.Errorf("failed to create files: %v", err)
+	}
+	log.Info("download complete")
+	if t.leftBytes(sel.haveSnapshot()) == 0 {
+		t.requestSwarmPeers(ctx, cfg, 0, eventCompleted)
+	}
 	return nil
 }
 
-func (t *TorrentFile) startWorker(peer Peer, peerID [20]byte, work chan *pieceWork, results chan *pieceResult, file *os.File) {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", peer.IP, peer.Port), 5*time.Second)
-	if err != nil {
-		return
-	}
-	defer conn.Close()
-
-	// 1. Handshake
-	hs := NewHandshake(t.InfoHash, peerID)
-	if _, err := conn.Write(hs.Serialize()); err != nil {
-		return
+// requestSwarmPeers announces event to every swarm the torrent is in with
+// left bytes still to download, gathering peers and dropping those seen in
+// more than one swarm. It only fails if no swarm answered.
+func (t *TorrentFile) requestSwarmPeers(ctx context.Context, cfg peerConfig, left int, event string) ([]swarmPeer, error) {
+	if t.Announce == "" {
+		return nil, fmt.Errorf("torrent has no tracker")
 	}
-	_, err = ReadHandshake(conn)
-	if err != nil {
-		return
+	var peers []swarmPeer
+	var lastErr error
+	answered := false
+	seen := make(map[string]bool)
+	for _, infoHash := range t.swarmHashes() {
+		start := time.Now()
+		found, err := t.requestPeers(ctx, announceRequest{
+			infoHash: infoHash,
+			peerID:   cfg.peerID,
+			port:     cfg.port,
+			left:     left,
+			event:    event,
+		})
+		cfg.metrics.observeAnnounce(time.Since(start), err)
+		cfg.emit(Event{Type: EventAnnounce, Tracker: t.Announce, Peers: len(found), Err: err})
+		log := cfg.logger().With("tracker", t.Announce, "swarm", fmt.Sprintf("%x", infoHash), "event", event)
+		if err != nil {
+			log.Warn("announce failed", "err", err)
+			lastErr = err
+			continue
+		}
+		log.Debug("announced", "peers", len(found))
+		answered = true
+		for _, p := range found {
+			if addr := p.String(); !seen[addr] {
+				seen[addr] = true
+				peers = append(peers, swarmPeer{p, infoHash})
+			}
+		}
 	}
-
-	// 2. Identify what the peer has (Bitfield)
-	var bf Bitfield
-	msg, err := ReadMessage(conn)
-	if err == nil && msg.ID == MsgBitfield {
-		bf = msg.Payload
+	if !answered {
+		return nil, lastErr
 	}
+	return peers, nil
+}
 
-	// 3. Initialize Session State
-	unchoked := false
-	interestedMsg := (&Message{ID: MsgInterested}).Serialize()
-	if _, err := conn.Write(interestedMsg); err != nil {
+// announceStopped tells the trackers we are leaving the swarm. It usually
+// runs once ctx is cancelled, so it gets a deadline of its own.
+func (t *TorrentFile) announceStopped(ctx context.Context, cfg peerConfig, left int) {
+	if t.Announce == "" {
 		return
 	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), stopAnnounceTimeout)
+	defer cancel()
+	t.requestSwarmPeers(ctx, cfg, left, eventStopped)
+}
 
-	// Set read deadline for unchoke waiting (30 second timeout)
-	unchokeTimeout := 30 * time.Second
-
-	// 4. THE CONSOLIDATED LOOP
-	for pw := range work {
-		// Skip peers that don't have our piece
-		if bf != nil && !bf.HasPiece(pw.index) {
-			safelyRequeueWork(work, pw)
-			continue
+// pieceWorks lists every piece with its length and hashes. Pieces of v2
+// torrents end with their file, so the gaps left by piece alignment are
+// never requested.
+func (t *TorrentFile) pieceWorks() []*pieceWork {
+	pieces := make([]*pieceWork, t.NumPieces())
+	for i := range pieces {
+		// Last piece might be shorter
+		pieceLength := min(t.PieceLength, t.Length-i*t.PieceLength)
+		pw := &pieceWork{index: i, length: pieceLength}
+		if i < len(t.PieceHashes) {
+			pw.hash = t.PieceHashes[i]
 		}
-
-		// Wait for Unchoke with timeout
-		for !unchoked {
-			conn.SetReadDeadline(time.Now().Add(unchokeTimeout))
-			msg, err := ReadMessage(conn)
-			if err != nil {
-				safelyRequeueWork(work, pw)
-				return
-			}
-			if msg == nil {
-				continue // Keep-alive message
-			}
-			switch msg.ID {
-			case MsgUnchoke:
-				unchoked = true
-				conn.SetReadDeadline(time.Time{}) // Clear deadline
-			case MsgChoke:
-				unchoked = false // Peer choked us
-			case MsgHave, MsgBitfield, MsgPiece:
-				// Handle other messages but continue waiting for unchoke
-				continue
+		if i < len(t.piecesV2) && t.piecesV2[i] != nil {
+			pw.hashV2 = t.piecesV2[i]
+			if !t.IsHybrid() {
+				pw.length = pw.hashV2.length
 			}
 		}
+		pieces[i] = pw
+	}
+	return pieces
+}
 
-		// 5. Download & Verify
-		buf, err := t.attemptDownloadPiece(conn, pw)
-		if err != nil {
-			safelyRequeueWork(work, pw)
-			return // Peer failed us, kill worker
-		}
+// startWorker connects to peer and runs a session with it in sw until the
+// download ends or the peer fails us, calling connected once the
+// handshake completes. It returns why the peer failed, or nil.
+func (t *TorrentFile) startWorker(ctx context.Context, peer Peer, infoHash [20]byte, sw *downloadSwarm, connected func()) error {
+	cfg := sw.cfg
+	if cfg.bans.isBanned(peer.String()) {
+		return errBanned
+	}
+	if cfg.blocklist.blocks(peer.String()) {
+		return errBlocked
+	}
+	if !cfg.conns.acquire(ctx) {
+		return nil
+	}
+	defer cfg.conns.release()
+	log := cfg.logger().With("peer", peer.String())
+	stats := sw.stats
 
-		if err := t.VerifyAndSave(pw, buf, file); err != nil {
-			safelyRequeueWork(work, pw)
-			continue
+	// The connection is half-open until the handshake completes
+	stats.halfOpen.Add(1)
+	halfOpen := true
+	defer func() {
+		if halfOpen {
+			stats.halfOpen.Add(-1)
 		}
+	}()
 
-		results <- &pieceResult{pw.index, buf}
+	raw, err := dialPeer(ctx, peer.String(), infoHash, cfg.encryption)
+	if err != nil {
+		log.Debug("dial failed", "err", err)
+		return err
 	}
+	defer raw.Close()
+	// Closing the connection unblocks any read when the download stops
+	stop := context.AfterFunc(ctx, func() { raw.Close() })
+	defer stop()
+	pc := cfg.newPeerConn(peer.String(), false)
+	pc.encrypted = isEncrypted(raw)
+	conn := limitConn(ctx, raw, cfg, pc)
+
+	hs := NewHandshake(infoHash, cfg.peerID)
+	if t.IsV2() {
+		hs.Reserved[reservedV2Byte] |= reservedV2Bit
+	}
+	if _, err := conn.Write(hs.Serialize()); err != nil {
+		log.Debug("handshake failed", "err", err)
+		return err
+	}
+	resp, err := ReadHandshake(conn)
+	if err != nil {
+		log.Debug("handshake failed", "err", err)
+		return err
+	}
+	if resp.InfoHash != infoHash {
+		log.Debug("peer is in another swarm", "infohash", fmt.Sprintf("%x", resp.InfoHash))
+		return errWrongSwarm
+	}
+	stats.halfOpen.Add(-1)
+	halfOpen = false
+	connected()
+	pc.update(func(p *peerConn) { p.client = peerClient(resp.PeerID) })
+	log = log.With("client", pc.client)
+	log.Debug("peer connected")
+	defer cfg.trackPeer(pc)()
+	return sw.runPeer(ctx, traceConn(conn, log), pc, log)
 }
 
-func (t *TorrentFile) attemptDownloadPiece(conn net.Conn, pw *pieceWork) ([]byte, error) {
+// acceptPeer answers the handshake of a peer that connected to us and runs
+// a session with it in sw until the download ends or the peer fails us.
+func (t *TorrentFile) acceptPeer(ctx context.Context, in inboundConn, sw *downloadSwarm) error {
+	cfg := sw.cfg
+	raw := in.conn
+	defer raw.Close()
+	if !cfg.conns.tryAcquire() {
+		return fmt.Errorf("connection limit reached")
+	}
+	defer cfg.conns.release()
+	stop := context.AfterFunc(ctx, func() { raw.Close() })
+	defer stop()
+	pc := cfg.newPeerConn(raw.RemoteAddr().String(), true)
+	pc.encrypted = isEncrypted(raw)
+	pc.client = peerClient(in.hs.PeerID)
+	conn := limitConn(ctx, raw, cfg, pc)
+
+	// Answer in the swarm the peer asked for
+	reply := NewHandshake(in.hs.InfoHash, cfg.peerID)
+	if t.IsV2() {
+		reply.Reserved[reservedV2Byte] |= reservedV2Bit
+	}
+	log := cfg.logger().With("peer", pc.addr, "client", pc.client)
+	if _, err := conn.Write(reply.Serialize()); err != nil {
+		log.Debug("handshake failed", "err", err)
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	log.Debug("peer connected")
+	defer cfg.trackPeer(pc)()
+	return sw.runPeer(ctx, traceConn(conn, log), pc, log)
+}
+
+// attemptDownloadPiece requests pw block by block through w, taking the
+// peer's replies from next. It fails with errChoked if the peer chokes us
+// before the piece is complete.
+func (t *TorrentFile) attemptDownloadPiece(w io.Writer, next func() (*Message, error), pw *pieceWork) ([]byte, error) {
 	progress := pieceProgress{
 		index: pw.index,
 		buf:   make([]byte, pw.length),
 	}
 
 	for progress.downloaded < pw.length {
-		blockSize := MaxBlockSize
-		if pw.length-progress.downloaded < blockSize {
-			blockSize = pw.length - progress.downloaded
-		}
+		blockSize := min(MaxBlockSize, pw.length-progress.downloaded)
 
 		// send request message
 		req := FormatRequest(pw.index, progress.downloaded, blockSize)
-		if _, err := conn.Write(req.Serialize()); err != nil {
+		if _, err := w.Write(req.Serialize()); err != nil {
 			return nil, err
 		}
 
-		// Read piece message block
-		msg, err := ReadMessage(conn)
-		if err != nil {
-			return nil, err
-		}
-		if msg == nil {
-			continue // Keep-alive message
-		}
-		if msg.ID == MsgChoke {
-			return nil, fmt.Errorf("peer choked during piece download")
-		}
-		if msg.ID != MsgPiece {
-			continue
-		}
+		// Wait for the block, skipping blocks left over from requests
+		// that a choke cut short
+		for requested := progress.downloaded; progress.downloaded == requested; {
+			msg, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if msg == nil {
+				continue // Keep-alive message
+			}
+			if msg.ID == MsgChoke {
+				return nil, errChoked
+			}
+			if msg.ID != MsgPiece || len(msg.Payload) < 8 ||
+				int(binary.BigEndian.Uint32(msg.Payload[0:4])) != pw.index ||
+				int(binary.BigEndian.Uint32(msg.Payload[4:8])) != requested {
+				continue
+			}
 
-		// add block to our buffer
-		t.handlePieceMsg(msg, &progress)
+			// add block to our buffer
+			t.handlePieceMsg(msg, &progress)
+		}
 	}
 
 	return progress.buf, nil
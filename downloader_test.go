@@ -1,11 +1,27 @@
-package main
+package torrent
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
+
+	"torrent/bencode"
 )
 
+// connMessages reads messages straight off conn.
+func connMessages(conn net.Conn) func() (*Message, error) {
+	return func() (*Message, error) { return ReadMessage(conn) }
+}
+
 func TestAttemptDownloadPiece(t *testing.T) {
 	// Create a pipe to simulate connection
 	clientConn, serverConn := net.Pipe()
@@ -21,7 +37,7 @@ func TestAttemptDownloadPiece(t *testing.T) {
 		serverConn.Read(buf)
 
 		// Send piece message
-		payload := make([]byte, 12+blockSize)
+		payload := make([]byte, 8+blockSize)
 		binary.BigEndian.PutUint32(payload[0:4], uint32(pieceIndex))
 		binary.BigEndian.PutUint32(payload[4:8], 0) // begin
 		// Fill with test data
@@ -41,7 +57,7 @@ func TestAttemptDownloadPiece(t *testing.T) {
 		length: pieceLength,
 	}
 
-	buf, err := tf.attemptDownloadPiece(clientConn, pw)
+	buf, err := tf.attemptDownloadPiece(clientConn, connMessages(clientConn), pw)
 	clientConn.Close()
 
 	if err != nil {
@@ -75,7 +91,7 @@ func TestAttemptDownloadPiece_MultipleBlocks(t *testing.T) {
 		serverConn.Read(buf)
 
 		// Send first block
-		payload1 := make([]byte, 12+blockSize)
+		payload1 := make([]byte, 8+blockSize)
 		binary.BigEndian.PutUint32(payload1[0:4], uint32(pieceIndex))
 		binary.BigEndian.PutUint32(payload1[4:8], 0)
 		for i := 0; i < blockSize; i++ {
@@ -88,7 +104,7 @@ func TestAttemptDownloadPiece_MultipleBlocks(t *testing.T) {
 		serverConn.Read(buf)
 
 		// Send second block
-		payload2 := make([]byte, 12+blockSize)
+		payload2 := make([]byte, 8+blockSize)
 		binary.BigEndian.PutUint32(payload2[0:4], uint32(pieceIndex))
 		binary.BigEndian.PutUint32(payload2[4:8], uint32(blockSize))
 		for i := 0; i < blockSize; i++ {
@@ -106,7 +122,7 @@ func TestAttemptDownloadPiece_MultipleBlocks(t *testing.T) {
 		length: pieceLength,
 	}
 
-	buf, err := tf.attemptDownloadPiece(clientConn, pw)
+	buf, err := tf.attemptDownloadPiece(clientConn, connMessages(clientConn), pw)
 	clientConn.Close()
 
 	if err != nil {
@@ -141,7 +157,7 @@ func TestAttemptDownloadPiece_ChokeMessage(t *testing.T) {
 		length: 16384,
 	}
 
-	_, err := tf.attemptDownloadPiece(clientConn, pw)
+	_, err := tf.attemptDownloadPiece(clientConn, connMessages(clientConn), pw)
 	clientConn.Close()
 
 	if err == nil {
@@ -162,10 +178,79 @@ func TestAttemptDownloadPiece_ConnectionError(t *testing.T) {
 		length: 16384,
 	}
 
-	_, err := tf.attemptDownloadPiece(clientConn, pw)
+	_, err := tf.attemptDownloadPiece(clientConn, connMessages(clientConn), pw)
 	clientConn.Close()
 
 	if err == nil {
 		t.Errorf("attemptDownloadPiece() should return error on connection close")
 	}
 }
+
+func TestDownloadCancel(t *testing.T) {
+	// A peer that completes the handshake and then never unchokes us
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				hs, err := ReadHandshake(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(NewHandshake(hs.InfoHash, [20]byte{}).Serialize())
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	peer := make([]byte, 6)
+	copy(peer, net.IPv4(127, 0, 0, 1).To4())
+	binary.BigEndian.PutUint16(peer[4:], uint16(ln.Addr().(*net.TCPAddr).Port))
+	var mu sync.Mutex
+	var events []string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		resp, _ := bencode.Marshal(bencodeTrackerResponse{Interval: 1800, Peers: string(peer)})
+		w.Write(resp)
+	}))
+	defer tracker.Close()
+
+	tf := &TorrentFile{
+		Announce:    tracker.URL,
+		Name:        filepath.Join(t.TempDir(), "file.bin"),
+		PieceLength: 16384,
+		Length:      16384,
+		PieceHashes: [][20]byte{{1}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- tf.Download(ctx, nil) }()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Download() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download() did not return after cancellation")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{eventStarted, eventStopped}; !reflect.DeepEqual(events, want) {
+		t.Errorf("tracker events = %q, want %q", events, want)
+	}
+}
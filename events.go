@@ -0,0 +1,148 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType identifies what an Event reports.
+type EventType int
+
+const (
+	// EventStateChanged reports a new State
+	EventStateChanged EventType = iota
+	// EventPieceVerified reports a piece that passed its hash check
+	EventPieceVerified
+	// EventHashFailed reports a piece from Peer that failed its hash check
+	EventHashFailed
+	EventPeerConnected
+	EventPeerDisconnected
+	// EventAnnounce reports the result of an announce to Tracker: Peers
+	// peers on success, Err on failure
+	EventAnnounce
+	// EventCompleted reports that every wanted piece was downloaded
+	EventCompleted
+	// EventError reports the error a torrent failed with
+	EventError
+	// EventPeerBanned reports that the IP in Peer was banned for the rest
+	// of the session, with Err saying why and Piece the piece that showed it
+	EventPeerBanned
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventStateChanged:
+		return "state changed"
+	case EventPieceVerified:
+		return "piece verified"
+	case EventHashFailed:
+		return "hash failed"
+	case EventPeerConnected:
+		return "peer connected"
+	case EventPeerDisconnected:
+		return "peer disconnected"
+	case EventAnnounce:
+		return "announce"
+	case EventCompleted:
+		return "completed"
+	case EventError:
+		return "error"
+	case EventPeerBanned:
+		return "peer banned"
+	}
+	return fmt.Sprintf("EventType(%d)", int(e))
+}
+
+// Event is something that happened to one of a client's torrents. Only
+// the fields relevant to Type are set.
+type Event struct {
+	Type     EventType
+	InfoHash [20]byte
+	Time     time.Time
+
+	State   State
+	Piece   int
+	Peer    string
+	Tracker string
+	Peers   int
+	Err     error
+}
+
+// eventBus fans events out to subscribers. Delivery never blocks: a
+// subscriber whose buffer is full misses events until it catches up.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func (b *eventBus) subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if _, ok := b.subs[ch]; ok {
+				delete(b.subs, ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// close ends every subscription.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Subscribe returns a channel of the events of every torrent in the
+// client, buffering up to buffer events, and a function that ends the
+// subscription. Events that arrive while the buffer is full are dropped.
+// The channel is closed when the subscription ends or the client is
+// closed.
+func (c *Client) Subscribe(buffer int) (<-chan Event, func()) {
+	return c.events.subscribe(buffer)
+}
+
+// emit publishes e for the torrent.
+func (t *Torrent) emit(e Event) {
+	e.InfoHash = t.infoHash
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Type == EventAnnounce {
+		t.recordAnnounce(e)
+	}
+	t.client.events.publish(e)
+}
+
+// emit reports e if the download or seed has someone to report to.
+func (cfg peerConfig) emit(e Event) {
+	if cfg.onEvent != nil {
+		cfg.onEvent(e)
+	}
+}
@@ -0,0 +1,114 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestClientEvents(t *testing.T) {
+	src := t.TempDir()
+	root := filepath.Join(src, "release")
+	os.MkdirAll(root, 0755)
+	data := bytes.Repeat([]byte("e"), 70000)
+	if err := os.WriteFile(filepath.Join(root, "e.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	tracker := newTrackerServer(t, port)
+	mi, err := Create(root, CreateOptions{PieceLength: 16384, Announce: tracker.URL + "/announce"})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	seeder, _ := NewClient(ClientConfig{DataDir: src, ListenPort: port})
+	defer seeder.Close()
+	st, _ := seeder.AddMetaInfo(mi)
+	if err := st.Seed(); err != nil {
+		t.Fatalf("Seed() error = %v", err)
+	}
+	waitState(t, st, StateSeeding)
+
+	leecher, _ := NewClient(ClientConfig{DataDir: t.TempDir(), ListenPort: freePort(t)})
+	events, unsubscribe := leecher.Subscribe(256)
+	defer unsubscribe()
+	lt, _ := leecher.AddMetaInfo(mi)
+	if err := lt.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := waitTorrent(t, lt); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	if s := lt.Stats(); s.BytesDownloaded < int64(len(data)) {
+		t.Errorf("leecher Stats().BytesDownloaded = %d, want at least %d", s.BytesDownloaded, len(data))
+	}
+	if s := st.Stats(); s.BytesUploaded < int64(len(data)) {
+		t.Errorf("seeder Stats().BytesUploaded = %d, want at least %d", s.BytesUploaded, len(data))
+	}
+
+	// Closing the client ends the subscription once every event is in
+	leecher.Close()
+	counts := make(map[EventType]int)
+	var states []State
+	for e := range events {
+		if e.InfoHash != lt.InfoHash() {
+			t.Errorf("event %v for torrent %x", e.Type, e.InfoHash)
+		}
+		counts[e.Type]++
+		if e.Type == EventStateChanged {
+			states = append(states, e.State)
+		}
+	}
+
+	pieces := lt.Status().PiecesTotal
+	if counts[EventPieceVerified] != pieces {
+		t.Errorf("got %d piece verified events, want %d", counts[EventPieceVerified], pieces)
+	}
+	for _, typ := range []EventType{EventAnnounce, EventPeerConnected, EventPeerDisconnected, EventCompleted} {
+		if counts[typ] == 0 {
+			t.Errorf("no %v event", typ)
+		}
+	}
+	if counts[EventError] != 0 {
+		t.Errorf("got %d error events, want 0", counts[EventError])
+	}
+	if !slices.Contains(states, StateDownloading) || states[len(states)-1] != StateComplete {
+		t.Errorf("state changes = %v, want downloading ... complete", states)
+	}
+	if s := lt.Stats(); s.Peers != 0 {
+		t.Errorf("Stats().Peers = %d after stopping, want 0", s.Peers)
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	var bus eventBus
+	slow, _ := bus.subscribe(1)
+	fast, unsubscribe := bus.subscribe(4)
+
+	for i := 0; i < 3; i++ {
+		bus.publish(Event{Type: EventPieceVerified, Piece: i})
+	}
+	// A full buffer drops events rather than blocking the publisher
+	if e := <-slow; e.Piece != 0 {
+		t.Errorf("slow subscriber got piece %d, want 0", e.Piece)
+	}
+	for i := 0; i < 3; i++ {
+		if e := <-fast; e.Piece != i {
+			t.Errorf("fast subscriber got piece %d, want %d", e.Piece, i)
+		}
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-fast; ok {
+		t.Errorf("channel still open after unsubscribing")
+	}
+	bus.close()
+	if _, ok := <-slow; ok {
+		t.Errorf("channel still open after close")
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package torrent
 
 import (
 	"fmt"
@@ -7,13 +7,36 @@ import (
 
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+// btProtocol is the protocol string every handshake starts with
+const btProtocol = "BitTorrent protocol"
+
+// reservedV2Byte and reservedV2Bit locate the reserved bit that advertises
+// BitTorrent v2 support
+const reservedV2Byte, reservedV2Bit = 7, 0x10
+
+// reservedExtByte and reservedExtBit locate the reserved bit that
+// advertises the BEP 10 extension protocol
+const reservedExtByte, reservedExtBit = 5, 0x10
+
+// SupportsExtensions reports whether the peer set the extension protocol
+// reserved bit.
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[reservedExtByte]&reservedExtBit != 0
+}
+
+// SupportsV2 reports whether the peer set the BitTorrent v2 reserved bit.
+func (h *Handshake) SupportsV2() bool {
+	return h.Reserved[reservedV2Byte]&reservedV2Bit != 0
+}
+
 func NewHandshake(infoHash, peerID [20]byte) *Handshake {
 	return &Handshake{
-		Pstr:     "BitTorrent protocol",
+		Pstr:     btProtocol,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -25,7 +48,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -43,12 +66,15 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 		return nil, fmt.Errorf("invalid pstrLen: %d", pstrLen)
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
+	copy(reserved[:], buf[20:28])
 	copy(infoHash[:], buf[28:48])
 	copy(peerID[:], buf[48:68])
 
 	return &Handshake{
 		Pstr:     string(buf[1:20]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}, nil
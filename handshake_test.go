@@ -1,4 +1,4 @@
-package main
+package torrent
 
 import (
 	"bytes"
@@ -99,3 +99,20 @@ func TestReadHandshake(t *testing.T) {
 		})
 	}
 }
+
+func TestHandshakeReserved(t *testing.T) {
+	var infoHash, peerID [20]byte
+	hs := NewHandshake(infoHash, peerID)
+	if hs.SupportsV2() {
+		t.Errorf("SupportsV2() = true for a plain handshake")
+	}
+
+	hs.Reserved[reservedV2Byte] |= reservedV2Bit
+	got, err := ReadHandshake(bytes.NewReader(hs.Serialize()))
+	if err != nil {
+		t.Fatalf("ReadHandshake() error = %v", err)
+	}
+	if !got.SupportsV2() {
+		t.Errorf("SupportsV2() = false after round trip, reserved = %x", got.Reserved)
+	}
+}
@@ -0,0 +1,522 @@
+// Package httpapi serves a JSON API over HTTP for controlling a running
+// torrent.Client from other programs.
+//
+// Torrents are named by their hex infohash. The endpoints are:
+//
+//	GET    /api/torrents                   list torrents
+//	POST   /api/torrents                   add a torrent (see below)
+//	GET    /api/torrents/{hash}            one torrent
+//	DELETE /api/torrents/{hash}            remove a torrent, keeping its files
+//	POST   /api/torrents/{hash}/{action}   start, seed, pause or resume
+//	GET    /api/torrents/{hash}/files      list files with their priorities
+//	PUT    /api/torrents/{hash}/files/{i}  set a file's priority: {"priority": "high"}
+//	GET    /api/torrents/{hash}/limits     the torrent's own rate limits
+//	PUT    /api/torrents/{hash}/limits     set them, as for /api/limits without the peer limits
+//	GET    /api/stats                      client-wide transfer statistics
+//	GET    /api/limits                     rate limits in bytes per second
+//	PUT    /api/limits                     set them: {"download_rate": 0, "upload_rate": 1048576,
+//	                                       "peer_download_rate": 0, "peer_upload_rate": 65536}
+//	GET    /api/events                     torrent events as Server-Sent Events
+//	POST   /api/blocklist/reload           reread the client's blocklists: {"ranges": 1234}
+//
+// A torrent is added by POSTing a .torrent file as the "torrent" field of a
+// multipart form, as a body of type application/x-bittorrent, or as JSON
+// {"magnet": "magnet:?..."}. Add ?start=true to start it straight away.
+//
+// When the server has a token, every request must carry it as a bearer
+// token in the Authorization header or, for clients such as EventSource
+// that can't set headers, in the token query parameter.
+package httpapi
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"torrent"
+)
+
+// maxTorrentSize bounds uploaded .torrent files
+const maxTorrentSize = 10 << 20 // 10MB
+
+// eventKeepAlive is how often an idle event stream gets a comment so
+// proxies don't close it
+const eventKeepAlive = 30 * time.Second
+
+// Server is the HTTP API of one client.
+type Server struct {
+	client *torrent.Client
+	token  string
+	mux    *http.ServeMux
+}
+
+// New returns the API of client. A non-empty token is required on every
+// request.
+func New(client *torrent.Client, token string) *Server {
+	s := &Server{client: client, token: token, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /api/torrents", s.listTorrents)
+	s.mux.HandleFunc("POST /api/torrents", s.addTorrent)
+	s.mux.HandleFunc("GET /api/torrents/{hash}", s.getTorrent)
+	s.mux.HandleFunc("DELETE /api/torrents/{hash}", s.removeTorrent)
+	s.mux.HandleFunc("POST /api/torrents/{hash}/{action}", s.torrentAction)
+	s.mux.HandleFunc("GET /api/torrents/{hash}/files", s.listFiles)
+	s.mux.HandleFunc("PUT /api/torrents/{hash}/files/{index}", s.setFilePriority)
+	s.mux.HandleFunc("GET /api/torrents/{hash}/limits", s.getTorrentLimits)
+	s.mux.HandleFunc("PUT /api/torrents/{hash}/limits", s.setTorrentLimits)
+	s.mux.HandleFunc("GET /api/stats", s.getStats)
+	s.mux.HandleFunc("GET /api/limits", s.getLimits)
+	s.mux.HandleFunc("PUT /api/limits", s.setLimits)
+	s.mux.HandleFunc("GET /api/events", s.streamEvents)
+	s.mux.HandleFunc("POST /api/blocklist/reload", s.reloadBlocklists)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" && !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="torrent"`)
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		got = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) == 1
+}
+
+// Torrent is the JSON form of a torrent.
+type Torrent struct {
+	InfoHash     string `json:"infohash"`
+	Name         string `json:"name"`
+	State        string `json:"state"`
+	Error        string `json:"error,omitempty"`
+	Length       int    `json:"length"`
+	PiecesDone   int    `json:"pieces_done"`
+	PiecesWanted int    `json:"pieces_wanted"`
+	PiecesTotal  int    `json:"pieces_total"`
+	Stats
+}
+
+// Stats is the JSON form of torrent.Stats.
+type Stats struct {
+	BytesDownloaded int64   `json:"bytes_downloaded"`
+	BytesUploaded   int64   `json:"bytes_uploaded"`
+	DownloadRate    float64 `json:"download_rate"`
+	UploadRate      float64 `json:"upload_rate"`
+	// ETA is in seconds, zero when unknown
+	ETA   float64 `json:"eta"`
+	Peers int     `json:"peers"`
+}
+
+// File is the JSON form of a file in a torrent.
+type File struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Length   int    `json:"length"`
+	Priority string `json:"priority"`
+}
+
+// Limits is the JSON form of the client's or a torrent's rate limits. The
+// per-peer limits are client-wide and left out for torrents.
+type Limits struct {
+	DownloadRate     int `json:"download_rate"`
+	UploadRate       int `json:"upload_rate"`
+	PeerDownloadRate int `json:"peer_download_rate,omitempty"`
+	PeerUploadRate   int `json:"peer_upload_rate,omitempty"`
+}
+
+func (l Limits) validate() error {
+	if l.DownloadRate < 0 || l.UploadRate < 0 || l.PeerDownloadRate < 0 || l.PeerUploadRate < 0 {
+		return errors.New("rate limits can't be negative")
+	}
+	return nil
+}
+
+// Event is the JSON form of torrent.Event.
+type Event struct {
+	Type     string    `json:"type"`
+	InfoHash string    `json:"infohash"`
+	Time     time.Time `json:"time"`
+	State    string    `json:"state,omitempty"`
+	Piece    *int      `json:"piece,omitempty"`
+	Peer     string    `json:"peer,omitempty"`
+	Tracker  string    `json:"tracker,omitempty"`
+	Peers    *int      `json:"peers,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func newStats(st torrent.Stats) Stats {
+	return Stats{
+		BytesDownloaded: st.BytesDownloaded,
+		BytesUploaded:   st.BytesUploaded,
+		DownloadRate:    st.DownloadRate,
+		UploadRate:      st.UploadRate,
+		ETA:             st.ETA.Seconds(),
+		Peers:           st.Peers,
+	}
+}
+
+func newTorrent(t *torrent.Torrent) Torrent {
+	hash := t.InfoHash()
+	s := t.Status()
+	out := Torrent{
+		InfoHash:     hex.EncodeToString(hash[:]),
+		Name:         s.Name,
+		State:        s.State.String(),
+		Length:       s.Length,
+		PiecesDone:   s.PiecesDone,
+		PiecesWanted: s.PiecesWanted,
+		PiecesTotal:  s.PiecesTotal,
+		Stats:        newStats(t.Stats()),
+	}
+	if s.Err != nil {
+		out.Error = s.Err.Error()
+	}
+	return out
+}
+
+func newEvent(e torrent.Event) Event {
+	out := Event{
+		Type:     EventName(e.Type),
+		InfoHash: hex.EncodeToString(e.InfoHash[:]),
+		Time:     e.Time,
+	}
+	switch e.Type {
+	case torrent.EventStateChanged:
+		out.State = e.State.String()
+	case torrent.EventPieceVerified:
+		out.Piece = &e.Piece
+	case torrent.EventHashFailed, torrent.EventPeerBanned:
+		out.Piece, out.Peer = &e.Piece, e.Peer
+	case torrent.EventPeerConnected, torrent.EventPeerDisconnected:
+		out.Peer = e.Peer
+	case torrent.EventAnnounce:
+		out.Tracker, out.Peers = e.Tracker, &e.Peers
+	}
+	if e.Err != nil {
+		out.Error = e.Err.Error()
+	}
+	return out
+}
+
+// EventName is the name an event type is sent under, e.g. "piece_verified".
+func EventName(t torrent.EventType) string {
+	return strings.ReplaceAll(t.String(), " ", "_")
+}
+
+func (s *Server) listTorrents(w http.ResponseWriter, r *http.Request) {
+	torrents := s.client.Torrents()
+	out := make([]Torrent, 0, len(torrents))
+	for _, t := range torrents {
+		out = append(out, newTorrent(t))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) addTorrent(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxTorrentSize)
+
+	var t *torrent.Torrent
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		var f io.ReadCloser
+		if f, _, err = r.FormFile("torrent"); err == nil {
+			var data []byte
+			data, err = io.ReadAll(f)
+			f.Close()
+			if err == nil {
+				t, err = s.client.AddTorrentBytes(data)
+			}
+		}
+	case "application/x-bittorrent":
+		var data []byte
+		if data, err = io.ReadAll(r.Body); err == nil {
+			t, err = s.client.AddTorrentBytes(data)
+		}
+	case "application/json":
+		var req struct {
+			Magnet string `json:"magnet"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+			if req.Magnet == "" {
+				err = errors.New("missing magnet")
+			} else {
+				t, err = s.client.AddMagnet(req.Magnet)
+			}
+		}
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", mediaType))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if start, _ := strconv.ParseBool(r.URL.Query().Get("start")); start {
+		if err := t.Start(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusCreated, newTorrent(t))
+}
+
+// lookup finds the torrent named by the request's {hash}, answering with
+// an error if there is none.
+func (s *Server) lookup(w http.ResponseWriter, r *http.Request) (*torrent.Torrent, bool) {
+	var hash [20]byte
+	b, err := hex.DecodeString(r.PathValue("hash"))
+	if err != nil || len(b) != len(hash) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid infohash %q", r.PathValue("hash")))
+		return nil, false
+	}
+	copy(hash[:], b)
+	t, ok := s.client.Torrent(hash)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no torrent %x", hash))
+		return nil, false
+	}
+	return t, true
+}
+
+func (s *Server) getTorrent(w http.ResponseWriter, r *http.Request) {
+	if t, ok := s.lookup(w, r); ok {
+		writeJSON(w, http.StatusOK, newTorrent(t))
+	}
+}
+
+func (s *Server) removeTorrent(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	if err := t.Remove(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) torrentAction(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	switch action := r.PathValue("action"); action {
+	case "start":
+		err = t.Start()
+	case "seed":
+		err = t.Seed()
+	case "pause":
+		t.Pause()
+	case "resume":
+		err = t.Resume()
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action %q", action))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTorrent(t))
+}
+
+// files lists the files of tf, leaving out padding.
+func files(tf *torrent.TorrentFile) []File {
+	list := tf.Files
+	if len(list) == 0 {
+		list = []torrent.File{{Path: tf.Name, Length: tf.Length}}
+	}
+	out := make([]File, 0, len(list))
+	for i, f := range list {
+		if f.Padding {
+			continue
+		}
+		out = append(out, File{Index: i, Path: f.Path, Length: f.Length, Priority: tf.FilePriority(i).String()})
+	}
+	return out
+}
+
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	tf := t.Info()
+	if tf == nil {
+		writeError(w, http.StatusConflict, errors.New("metadata not fetched yet"))
+		return
+	}
+	writeJSON(w, http.StatusOK, files(tf))
+}
+
+func (s *Server) setFilePriority(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	tf := t.Info()
+	if tf == nil {
+		writeError(w, http.StatusConflict, errors.New("metadata not fetched yet"))
+		return
+	}
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid file index %q", r.PathValue("index")))
+		return
+	}
+	var req struct {
+		Priority string `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p, err := torrent.ParsePriority(req.Priority)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := tf.SetFilePriority(index, p); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, files(tf))
+}
+
+func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newStats(s.client.Stats()))
+}
+
+func (s *Server) limits() Limits {
+	var limits Limits
+	limits.DownloadRate, limits.UploadRate = s.client.RateLimits()
+	limits.PeerDownloadRate, limits.PeerUploadRate = s.client.PeerRateLimits()
+	return limits
+}
+
+func (s *Server) getLimits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.limits())
+}
+
+func (s *Server) setLimits(w http.ResponseWriter, r *http.Request) {
+	// Fields left out keep their current value
+	limits := s.limits()
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := limits.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.client.SetRateLimits(limits.DownloadRate, limits.UploadRate)
+	s.client.SetPeerRateLimits(limits.PeerDownloadRate, limits.PeerUploadRate)
+	writeJSON(w, http.StatusOK, s.limits())
+}
+
+func (s *Server) reloadBlocklists(w http.ResponseWriter, r *http.Request) {
+	if err := s.client.ReloadBlocklists(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"ranges": s.client.IPFilter().Len()})
+}
+
+func (s *Server) getTorrentLimits(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	var limits Limits
+	limits.DownloadRate, limits.UploadRate = t.RateLimits()
+	writeJSON(w, http.StatusOK, limits)
+}
+
+func (s *Server) setTorrentLimits(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	var limits Limits
+	limits.DownloadRate, limits.UploadRate = t.RateLimits()
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := limits.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if limits.PeerDownloadRate != 0 || limits.PeerUploadRate != 0 {
+		writeError(w, http.StatusBadRequest, errors.New("peer rate limits are set for the whole client"))
+		return
+	}
+	t.SetRateLimits(limits.DownloadRate, limits.UploadRate)
+	writeJSON(w, http.StatusOK, limits)
+}
+
+// streamEvents sends the client's events as Server-Sent Events until the
+// request ends or the client closes.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	events, unsubscribe := s.client.Subscribe(256)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(newEvent(e))
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", EventName(e.Type), data)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,240 @@
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"torrent"
+)
+
+// newTestServer serves the API of a fresh client with token "secret" and
+// returns it with the bytes of a two-file .torrent.
+func newTestServer(t *testing.T) (*httptest.Server, []byte) {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "release")
+	os.MkdirAll(root, 0755)
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if err := os.WriteFile(filepath.Join(root, name), bytes.Repeat([]byte(name), 10000), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mi, err := torrent.Create(root, torrent.CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	var buf bytes.Buffer
+	if err := mi.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := torrent.NewClient(torrent.ClientConfig{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	srv := httptest.NewServer(New(client, "secret"))
+	t.Cleanup(srv.Close)
+	return srv, buf.Bytes()
+}
+
+// call sends a request with the token and decodes a JSON answer into out.
+func call(t *testing.T, srv *httptest.Server, method, path, contentType string, body []byte, out any) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding answer: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAuth(t *testing.T) {
+	srv, _ := newTestServer(t)
+	for _, url := range []string{"/api/torrents", "/api/torrents?token=wrong"} {
+		resp, err := http.Get(srv.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET %s status = %d, want 401", url, resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(srv.URL + "/api/torrents?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET with token query status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestTorrentLifecycle(t *testing.T) {
+	srv, data := newTestServer(t)
+
+	var added Torrent
+	if code := call(t, srv, "POST", "/api/torrents", "application/x-bittorrent", data, &added); code != http.StatusCreated {
+		t.Fatalf("add status = %d, want 201", code)
+	}
+	if added.Name != "release" || added.State != "paused" || added.Length != 100000 {
+		t.Errorf("added torrent = %+v", added)
+	}
+	if code := call(t, srv, "POST", "/api/torrents", "application/x-bittorrent", data, nil); code != http.StatusBadRequest {
+		t.Errorf("adding twice status = %d, want 400", code)
+	}
+
+	var list []Torrent
+	call(t, srv, "GET", "/api/torrents", "", nil, &list)
+	if len(list) != 1 || list[0].InfoHash != added.InfoHash {
+		t.Errorf("list = %+v, want the added torrent", list)
+	}
+
+	path := "/api/torrents/" + added.InfoHash
+	var files []File
+	call(t, srv, "GET", path+"/files", "", nil, &files)
+	if len(files) != 2 || files[1].Priority != "normal" {
+		t.Fatalf("files = %+v", files)
+	}
+	if code := call(t, srv, "PUT", path+"/files/1", "application/json", []byte(`{"priority":"skip"}`), &files); code != http.StatusOK {
+		t.Fatalf("set priority status = %d", code)
+	}
+	if files[1].Priority != "skip" {
+		t.Errorf("priority after PUT = %q, want skip", files[1].Priority)
+	}
+	if code := call(t, srv, "PUT", path+"/files/1", "application/json", []byte(`{"priority":"urgent"}`), nil); code != http.StatusBadRequest {
+		t.Errorf("invalid priority status = %d, want 400", code)
+	}
+
+	if code := call(t, srv, "POST", path+"/explode", "", nil, nil); code != http.StatusNotFound {
+		t.Errorf("unknown action status = %d, want 404", code)
+	}
+	if code := call(t, srv, "GET", "/api/torrents/"+strings.Repeat("0", 40), "", nil, nil); code != http.StatusNotFound {
+		t.Errorf("unknown torrent status = %d, want 404", code)
+	}
+	if code := call(t, srv, "GET", "/api/torrents/xyz", "", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("bad infohash status = %d, want 400", code)
+	}
+
+	if code := call(t, srv, "DELETE", path, "", nil, nil); code != http.StatusNoContent {
+		t.Errorf("remove status = %d, want 204", code)
+	}
+	call(t, srv, "GET", "/api/torrents", "", nil, &list)
+	if len(list) != 0 {
+		t.Errorf("list after remove = %+v, want empty", list)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	srv, _ := newTestServer(t)
+	var limits Limits
+	if code := call(t, srv, "PUT", "/api/limits", "application/json", []byte(`{"upload_rate":1024}`), &limits); code != http.StatusOK {
+		t.Fatalf("set limits status = %d", code)
+	}
+	call(t, srv, "GET", "/api/limits", "", nil, &limits)
+	if limits != (Limits{UploadRate: 1024}) {
+		t.Errorf("limits = %+v, want upload 1024", limits)
+	}
+	if code := call(t, srv, "PUT", "/api/limits", "application/json", []byte(`{"download_rate":-1}`), nil); code != http.StatusBadRequest {
+		t.Errorf("negative limit status = %d, want 400", code)
+	}
+	call(t, srv, "PUT", "/api/limits", "application/json", []byte(`{"peer_upload_rate":512}`), &limits)
+	if limits != (Limits{UploadRate: 1024, PeerUploadRate: 512}) {
+		t.Errorf("limits = %+v, want upload 1024 and peer upload 512", limits)
+	}
+
+	hash := strings.Repeat("ab", 20)
+	call(t, srv, "POST", "/api/torrents", "application/json", []byte(`{"magnet":"magnet:?xt=urn:btih:`+hash+`"}`), nil)
+	path := "/api/torrents/" + hash + "/limits"
+	var tl Limits
+	if code := call(t, srv, "PUT", path, "application/json", []byte(`{"download_rate":2048}`), &tl); code != http.StatusOK {
+		t.Fatalf("set torrent limits status = %d", code)
+	}
+	call(t, srv, "GET", path, "", nil, &tl)
+	if tl != (Limits{DownloadRate: 2048}) {
+		t.Errorf("torrent limits = %+v, want download 2048", tl)
+	}
+	if code := call(t, srv, "PUT", path, "application/json", []byte(`{"peer_download_rate":1}`), nil); code != http.StatusBadRequest {
+		t.Errorf("torrent peer limit status = %d, want 400", code)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv, data := newTestServer(t)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/api/events", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	// Seeding data that isn't on disk checks it and ends up seeding nothing
+	var added Torrent
+	call(t, srv, "POST", "/api/torrents", "application/x-bittorrent", data, &added)
+	if code := call(t, srv, "POST", "/api/torrents/"+added.InfoHash+"/seed", "", nil, nil); code != http.StatusOK {
+		t.Fatalf("seed status = %d", code)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	var name string
+	for sc.Scan() {
+		line := sc.Text()
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			name = v
+			continue
+		}
+		v, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(v), &e); err != nil {
+			t.Fatalf("bad event data %q: %v", v, err)
+		}
+		if name != e.Type || e.InfoHash != added.InfoHash {
+			t.Fatalf("event %q = %+v", name, e)
+		}
+		if e.Type == EventName(torrent.EventStateChanged) && e.State == "checking" {
+			return
+		}
+	}
+	t.Fatalf("stream ended without a checking event: %v", sc.Err())
+}
+
+func TestAddMagnet(t *testing.T) {
+	srv, _ := newTestServer(t)
+	hash := strings.Repeat("ab", 20)
+	var added Torrent
+	body := []byte(`{"magnet":"magnet:?xt=urn:btih:` + hash + `&dn=thing"}`)
+	if code := call(t, srv, "POST", "/api/torrents", "application/json", body, &added); code != http.StatusCreated {
+		t.Fatalf("add magnet status = %d", code)
+	}
+	if added.InfoHash != hash || added.Name != "thing" {
+		t.Errorf("added = %+v", added)
+	}
+	if code := call(t, srv, "GET", "/api/torrents/"+hash+"/files", "", nil, nil); code != http.StatusConflict {
+		t.Errorf("files without metadata status = %d, want 409", code)
+	}
+}
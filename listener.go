@@ -0,0 +1,164 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// handshakeTimeout bounds how long an incoming peer has to send its
+// handshake
+const handshakeTimeout = 30 * time.Second
+
+// inboundConn is a peer that connected to us, with the handshake it sent.
+type inboundConn struct {
+	conn net.Conn
+	hs   *Handshake
+}
+
+// listen starts accepting peers on the client's port unless it already
+// is. Every torrent shares the one listener; peers are handed to the
+// torrent their handshake names.
+func (c *Client) listen() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return fmt.Errorf("client is closed")
+	}
+	if c.ln != nil {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(c.cfg.ListenPort))))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	c.ln = ln
+	go c.accept(ln)
+	return nil
+}
+
+// accept hands incoming connections to torrents until ln is closed.
+func (c *Client) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.handleInbound(conn)
+	}
+}
+
+// handleInbound reads an incoming peer's handshake and passes the
+// connection to the torrent it asks for, closing it if no torrent of ours
+// takes it.
+func (c *Client) handleInbound(conn net.Conn) {
+	if addr := conn.RemoteAddr().String(); c.bans.isBanned(addr) || c.blocklist.blocks(addr) {
+		c.log.Debug("inbound peer refused", "peer", addr, "reason", "banned or blocked")
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	enc, err := c.acceptEncryption(conn)
+	if err != nil {
+		c.log.Debug("inbound encryption handshake failed", "peer", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	conn = enc
+	hs, err := ReadHandshake(conn)
+	if err != nil {
+		c.log.Debug("inbound handshake failed", "peer", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	t := c.torrentForSwarm(hs.InfoHash)
+	if t == nil || !t.acceptInbound(inboundConn{conn, hs}) {
+		c.log.Debug("inbound peer refused", "peer", conn.RemoteAddr().String(), "infohash", fmt.Sprintf("%x", hs.InfoHash))
+		conn.Close()
+	}
+}
+
+// torrentForSwarm finds the torrent known by infoHash in any of its swarms.
+func (c *Client) torrentForSwarm(infoHash [20]byte) *Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.torrents[infoHash]; ok {
+		return t
+	}
+	for _, t := range c.torrents {
+		if tf := t.Info(); tf != nil && slices.Contains(tf.swarmHashes(), infoHash) {
+			return t
+		}
+	}
+	return nil
+}
+
+// acceptInbound gives an incoming peer to the torrent's download or seed,
+// reporting whether it was taken.
+func (t *Torrent) acceptInbound(in inboundConn) bool {
+	t.mu.Lock()
+	inbound, stopped := t.inbound, t.stopped
+	t.mu.Unlock()
+	if inbound == nil {
+		return false
+	}
+	select {
+	case inbound <- in:
+		return true
+	case <-stopped:
+		return false
+	}
+}
+
+// connLimiter caps the peer connections open at once across torrents. A
+// nil connLimiter doesn't limit.
+type connLimiter struct {
+	slots chan struct{}
+}
+
+// newConnLimiter returns a limiter for n connections, or nil when n is zero
+// or negative, meaning unlimited.
+func newConnLimiter(n int) *connLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &connLimiter{slots: make(chan struct{}, n)}
+}
+
+// acquire blocks until a connection may be opened, returning false if ctx
+// is done first.
+func (l *connLimiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// tryAcquire takes a connection slot if one is free.
+func (l *connLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot taken by acquire or tryAcquire.
+func (l *connLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,136 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// logger returns the logger a download or seed reports to.
+func (cfg peerConfig) logger() *slog.Logger {
+	if cfg.log != nil {
+		return cfg.log
+	}
+	return slog.Default()
+}
+
+// clientNames maps Azureus-style peer ID prefixes to client names
+var clientNames = map[string]string{
+	"AZ": "Vuze",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"GM": "torrent-go",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+}
+
+// peerClient names the client software behind a peer ID, for logs. IDs
+// following the Azureus convention of "-XX1234-" give a name and version;
+// for others the printable prefix is shown.
+func peerClient(id [20]byte) string {
+	if id[0] == '-' && id[7] == '-' {
+		code, version := string(id[1:3]), id[3:7]
+		name, ok := clientNames[code]
+		if !ok {
+			name = code
+		}
+		return fmt.Sprintf("%s %c.%c.%c.%c", name, version[0], version[1], version[2], version[3])
+	}
+
+	var b strings.Builder
+	for _, c := range id {
+		if c < 0x20 || c > 0x7e {
+			break
+		}
+		b.WriteByte(c)
+	}
+	if b.Len() == 0 {
+		return "unknown"
+	}
+	return b.String()
+}
+
+// traceConn logs the messages sent and received on conn at debug level.
+// It must wrap the connection after the handshake, once the stream is
+// made of length-prefixed messages. conn is returned as is unless debug
+// logging is enabled.
+func traceConn(conn net.Conn, log *slog.Logger) net.Conn {
+	if !log.Enabled(context.Background(), slog.LevelDebug) {
+		return conn
+	}
+	return &tracedConn{
+		Conn: conn,
+		in:   wireTracer{log: log, dir: "recv"},
+		out:  wireTracer{log: log, dir: "send"},
+	}
+}
+
+type tracedConn struct {
+	net.Conn
+	in, out wireTracer
+}
+
+func (c *tracedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.feed(p[:n])
+	return n, err
+}
+
+func (c *tracedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.feed(p[:n])
+	return n, err
+}
+
+// wireTracer follows the message framing of one direction of a stream,
+// however it is chunked, and logs each message as its header goes by.
+type wireTracer struct {
+	log *slog.Logger
+	dir string
+	// hdr collects the length prefix and message ID
+	hdr [5]byte
+	n   int
+	// skip is what remains of the current message's payload
+	skip int
+}
+
+func (w *wireTracer) feed(p []byte) {
+	for len(p) > 0 {
+		if w.skip > 0 {
+			k := min(w.skip, len(p))
+			w.skip -= k
+			p = p[k:]
+			continue
+		}
+
+		k := copy(w.hdr[w.n:], p)
+		w.n += k
+		p = p[k:]
+		if w.n < 4 {
+			return
+		}
+		length := int(binary.BigEndian.Uint32(w.hdr[:4]))
+		if length == 0 {
+			w.log.Debug("wire", "dir", w.dir, "type", "keep-alive")
+			// The byte taken as an ID belongs to the next message
+			p = append(w.hdr[4:w.n:w.n], p...)
+			w.n = 0
+			continue
+		}
+		if w.n < 5 {
+			return
+		}
+		w.log.Debug("wire", "dir", w.dir, "type", messageID(w.hdr[4]), "len", length-1)
+		w.n = 0
+		w.skip = length - 1
+	}
+}
@@ -0,0 +1,63 @@
+package torrent
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestPeerClient(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"-TR3000-abcdefghijkl", "Transmission 3.0.0.0"},
+		{"-XX1234-abcdefghijkl", "XX 1.2.3.4"},
+		{"M7-2-0--\x01bcdefghijk", "M7-2-0--"},
+		{"\x00bcdefghijklmnopqrs", "unknown"},
+	}
+	for _, tt := range tests {
+		var id [20]byte
+		copy(id[:], tt.id)
+		if got := peerClient(id); got != tt.want {
+			t.Errorf("peerClient(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestWireTracer(t *testing.T) {
+	var out bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	var stream []byte
+	stream = append(stream, (&Message{ID: MsgUnchoke}).Serialize()...)
+	stream = append(stream, (*Message)(nil).Serialize()...)
+	stream = append(stream, FormatPiece(1, 0, make([]byte, 100)).Serialize()...)
+	stream = append(stream, (&Message{ID: MsgHave, Payload: []byte{0, 0, 0, 3}}).Serialize()...)
+
+	// However the stream is split, every message is seen once
+	w := wireTracer{log: log, dir: "recv"}
+	for i := 0; i < len(stream); i += 3 {
+		w.feed(stream[i:min(i+3, len(stream))])
+	}
+
+	want := []string{
+		"level=DEBUG msg=wire dir=recv type=unchoke len=0",
+		"level=DEBUG msg=wire dir=recv type=keep-alive",
+		"level=DEBUG msg=wire dir=recv type=piece len=108",
+		"level=DEBUG msg=wire dir=recv type=have len=4",
+	}
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("traced:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
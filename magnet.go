@@ -0,0 +1,158 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Magnet is a parsed magnet link. It identifies a torrent by infohash;
+// the info dictionary itself is fetched from peers.
+type Magnet struct {
+	InfoHash [20]byte
+	// InfoHashV2 is set by links carrying a v2 (btmh) infohash
+	InfoHashV2 [32]byte
+	Name       string
+	Trackers   []string
+	WebSeeds   []string
+}
+
+// sha256Multihash prefixes a SHA-256 digest in a btmh multihash
+const sha256Multihash = "1220"
+
+// ParseMagnet parses a magnet URI with a btih (v1) or btmh (v2) exact
+// topic, or both for hybrid torrents.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %q", uri)
+	}
+
+	q := u.Query()
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		WebSeeds: q["ws"],
+	}
+
+	var v1, v2 bool
+	for _, xt := range q["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			hash, err := decodeBTIH(strings.TrimPrefix(xt, "urn:btih:"))
+			if err != nil {
+				return nil, err
+			}
+			m.InfoHash, v1 = hash, true
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			mh := strings.TrimPrefix(xt, "urn:btmh:")
+			if !strings.HasPrefix(mh, sha256Multihash) {
+				return nil, fmt.Errorf("unsupported multihash %q", mh)
+			}
+			b, err := hex.DecodeString(strings.TrimPrefix(mh, sha256Multihash))
+			if err != nil || len(b) != 32 {
+				return nil, fmt.Errorf("invalid btmh infohash %q", mh)
+			}
+			copy(m.InfoHashV2[:], b)
+			v2 = true
+		}
+	}
+	if !v1 && !v2 {
+		return nil, fmt.Errorf("magnet link has no BitTorrent infohash")
+	}
+	if !v1 {
+		// v2-only swarms go by the truncated v2 infohash
+		copy(m.InfoHash[:], m.InfoHashV2[:])
+	}
+	return m, nil
+}
+
+// decodeBTIH decodes a v1 infohash in hex or base32.
+func decodeBTIH(s string) ([20]byte, error) {
+	var hash [20]byte
+	var b []byte
+	var err error
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = fmt.Errorf("wrong length")
+	}
+	if err != nil {
+		return hash, fmt.Errorf("invalid btih infohash %q: %v", s, err)
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// String formats the magnet link as a URI.
+func (m *Magnet) String() string {
+	hasV2 := m.InfoHashV2 != [32]byte{}
+	var xt []string
+	if !hasV2 || [20]byte(m.InfoHashV2[:20]) != m.InfoHash {
+		xt = append(xt, "xt=urn:btih:"+hex.EncodeToString(m.InfoHash[:]))
+	}
+	if hasV2 {
+		xt = append(xt, "xt=urn:btmh:"+sha256Multihash+hex.EncodeToString(m.InfoHashV2[:]))
+	}
+
+	params := url.Values{}
+	if m.Name != "" {
+		params.Set("dn", m.Name)
+	}
+	for _, tr := range m.Trackers {
+		params.Add("tr", tr)
+	}
+	for _, ws := range m.WebSeeds {
+		params.Add("ws", ws)
+	}
+
+	uri := "magnet:?" + strings.Join(xt, "&")
+	if len(params) > 0 {
+		uri += "&" + params.Encode()
+	}
+	return uri
+}
+
+// Magnet returns a magnet link for the torrent with its name, trackers and
+// web seeds.
+func (b *MetaInfo) Magnet() (*Magnet, error) {
+	t, err := b.ToTorrentFile()
+	if err != nil {
+		return nil, err
+	}
+	return &Magnet{
+		InfoHash:   t.InfoHash,
+		InfoHashV2: t.InfoHashV2,
+		Name:       b.Info.Name,
+		Trackers:   b.Trackers(),
+		WebSeeds:   b.URLList,
+	}, nil
+}
+
+// Trackers returns every tracker of the metainfo, the announce URL first
+// followed by the announce-list tiers, without duplicates.
+func (b *MetaInfo) Trackers() []string {
+	var trackers []string
+	seen := make(map[string]bool)
+	add := func(tracker string) {
+		if tracker != "" && !seen[tracker] {
+			seen[tracker] = true
+			trackers = append(trackers, tracker)
+		}
+	}
+	add(b.Announce)
+	for _, tier := range b.AnnounceList {
+		for _, tracker := range tier {
+			add(tracker)
+		}
+	}
+	return trackers
+}
@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hexHash := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	var v1 [20]byte
+	hex.Decode(v1[:], []byte(hexHash))
+	v2Hex := "caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+	var v2 [32]byte
+	hex.Decode(v2[:], []byte(v2Hex))
+	var truncated [20]byte
+	copy(truncated[:], v2[:])
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    *Magnet
+		wantErr bool
+	}{
+		{
+			name: "hex with name, trackers and web seeds",
+			uri:  "magnet:?xt=urn:btih:" + hexHash + "&dn=My+File&tr=http%3A%2F%2Fa%2Fannounce&tr=http%3A%2F%2Fb%2Fannounce&ws=http%3A%2F%2Fseed%2F",
+			want: &Magnet{
+				InfoHash: v1,
+				Name:     "My File",
+				Trackers: []string{"http://a/announce", "http://b/announce"},
+				WebSeeds: []string{"http://seed/"},
+			},
+		},
+		{
+			name: "base32",
+			uri:  "magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK",
+			want: &Magnet{InfoHash: v1},
+		},
+		{
+			name: "v2 only",
+			uri:  "magnet:?xt=urn:btmh:1220" + v2Hex,
+			want: &Magnet{InfoHash: truncated, InfoHashV2: v2},
+		},
+		{
+			name: "hybrid",
+			uri:  "magnet:?xt=urn:btih:" + hexHash + "&xt=urn:btmh:1220" + v2Hex,
+			want: &Magnet{InfoHash: v1, InfoHashV2: v2},
+		},
+		{name: "not a magnet", uri: "http://example.com/?xt=urn:btih:" + hexHash, wantErr: true},
+		{name: "no infohash", uri: "magnet:?dn=x", wantErr: true},
+		{name: "short hash", uri: "magnet:?xt=urn:btih:abcd", wantErr: true},
+		{name: "bad hex", uri: "magnet:?xt=urn:btih:" + hexHash[:39] + "z", wantErr: true},
+		{name: "unsupported multihash", uri: "magnet:?xt=urn:btmh:1114" + v2Hex, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMagnet(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMagnet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMagnet() = %+v, want %+v", got, tt.want)
+			}
+			if tt.want == nil {
+				return
+			}
+
+			// Formatting and parsing again gives the same link
+			again, err := ParseMagnet(got.String())
+			if err != nil {
+				t.Fatalf("ParseMagnet(%q) error = %v", got.String(), err)
+			}
+			if !reflect.DeepEqual(again, got) {
+				t.Errorf("ParseMagnet(String()) = %+v, want %+v", again, got)
+			}
+		})
+	}
+}
+
+func TestMetaInfoMagnet(t *testing.T) {
+	mi := &MetaInfo{
+		Announce:     "http://a/announce",
+		AnnounceList: [][]string{{"http://a/announce"}, {"http://b/announce"}},
+		URLList:      urlList{"http://seed/"},
+		Info:         InfoDict{Name: "file.bin", PieceLength: 16384, Length: 3, Pieces: string(make([]byte, 20))},
+	}
+	tf, err := mi.ToTorrentFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mi.Magnet()
+	if err != nil {
+		t.Fatalf("Magnet() error = %v", err)
+	}
+	got, err := ParseMagnet(m.String())
+	if err != nil {
+		t.Fatalf("ParseMagnet(%q) error = %v", m, err)
+	}
+	want := &Magnet{
+		InfoHash: tf.InfoHash,
+		Name:     "file.bin",
+		Trackers: []string{"http://a/announce", "http://b/announce"},
+		WebSeeds: []string{"http://seed/"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Magnet() round trip = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// merkleBlockSize is the size of the leaves of BitTorrent v2 hash trees.
+const merkleBlockSize = 16 * 1024 // 16KB
+
+// blockHashes returns the SHA-256 of each 16KB block of data; the last
+// block may be short.
+func blockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+merkleBlockSize-1)/merkleBlockSize)
+	for off := 0; off < len(data); off += merkleBlockSize {
+		hashes = append(hashes, sha256.Sum256(data[off:min(off+merkleBlockSize, len(data))]))
+	}
+	return hashes
+}
+
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// padHash is the root of a subtree of 2^height leaves that lie entirely
+// past the end of a file. Such leaves are all-zero hashes, not hashes of
+// zero blocks.
+func padHash(height int) [32]byte {
+	var h [32]byte
+	for i := 0; i < height; i++ {
+		h = hashPair(h, h)
+	}
+	return h
+}
+
+// nextPowerOfTwo returns the smallest power of two >= n, and 1 for n <= 1.
+func nextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// log2 returns the base-2 logarithm of a power of two.
+func log2(n int) int {
+	return bits.TrailingZeros(uint(n))
+}
+
+// merkleRoot computes the root of a tree with width leaves, where width is
+// a power of two and leaves beyond len(nodes) are padding subtrees of the
+// given height.
+func merkleRoot(nodes [][32]byte, width int, padHeight int) [32]byte {
+	level := make([][32]byte, width)
+	copy(level, nodes)
+	pad := padHash(padHeight)
+	for i := len(nodes); i < width; i++ {
+		level[i] = pad
+	}
+
+	for len(level) > 1 {
+		next := make([][32]byte, len(level)/2)
+		for i := range next {
+			next[i] = hashPair(level[2*i], level[2*i+1])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// pieceHashV2 is what a piece is verified against in a v2 torrent: the
+// root of the subtree covering the piece's blocks.
+type pieceHashV2 struct {
+	root [32]byte
+	// leaves is the number of block slots under root; slots past the end
+	// of the file hold zero hashes
+	leaves int
+	// length is how many bytes of the piece belong to the file. In hybrid
+	// torrents the rest of the piece is padding and isn't hashed.
+	length int
+}
+
+func (h *pieceHashV2) verify(buf []byte) bool {
+	if len(buf) < h.length {
+		return false
+	}
+	return merkleRoot(blockHashes(buf[:h.length]), h.leaves, 0) == h.root
+}
+
+// piecesRootFromLayer computes a file's pieces root from its piece layer.
+func piecesRootFromLayer(layer [][32]byte, pieceLength int) [32]byte {
+	return merkleRoot(layer, nextPowerOfTwo(len(layer)), log2(pieceLength/merkleBlockSize))
+}
+
+// uncleHashes returns the proof for the run of count nodes starting at
+// index in nodes: the sibling of the run's subtree root and of each of its
+// ancestors, lowest first, up to maxLayers of them. The tree is padded to
+// width with padding subtrees of padHeight.
+func uncleHashes(nodes [][32]byte, width, padHeight, index, count, maxLayers int) [][32]byte {
+	level := make([][32]byte, width)
+	copy(level, nodes)
+	pad := padHash(padHeight)
+	for i := len(nodes); i < width; i++ {
+		level[i] = pad
+	}
+
+	var proof [][32]byte
+	for len(level) > 1 {
+		if count <= 1 {
+			if len(proof) == maxLayers {
+				break
+			}
+			proof = append(proof, level[index^1])
+		} else {
+			count /= 2
+		}
+		next := make([][32]byte, len(level)/2)
+		for i := range next {
+			next[i] = hashPair(level[2*i], level[2*i+1])
+		}
+		level = next
+		index /= 2
+	}
+	return proof
+}
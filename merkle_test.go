@@ -0,0 +1,170 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+// verifyProof checks that hashes, a run of nodes starting at index whose
+// length is a power of two aligned to it, hash up through the uncle proof
+// to root.
+func verifyProof(root [32]byte, hashes [][32]byte, index int, proof [][32]byte) error {
+	if len(hashes) == 0 || nextPowerOfTwo(len(hashes)) != len(hashes) || index%len(hashes) != 0 {
+		return fmt.Errorf("hashes are not an aligned power of two")
+	}
+
+	node := merkleRoot(hashes, len(hashes), 0)
+	index /= len(hashes)
+	for _, uncle := range proof {
+		if index%2 == 0 {
+			node = hashPair(node, uncle)
+		} else {
+			node = hashPair(uncle, node)
+		}
+		index /= 2
+	}
+	if node != root {
+		return fmt.Errorf("hashes do not match pieces root")
+	}
+	return nil
+}
+
+func TestNextPowerOfTwo(t *testing.T) {
+	tests := []struct {
+		n, want int
+	}{
+		{0, 1}, {1, 1}, {2, 2}, {3, 4}, {4, 4}, {5, 8}, {1000, 1024},
+	}
+	for _, tt := range tests {
+		if got := nextPowerOfTwo(tt.n); got != tt.want {
+			t.Errorf("nextPowerOfTwo(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, merkleBlockSize+100)
+	leaves := blockHashes(data)
+	if len(leaves) != 2 {
+		t.Fatalf("blockHashes() returned %d hashes, want 2", len(leaves))
+	}
+	if leaves[1] != sha256.Sum256(data[merkleBlockSize:]) {
+		t.Errorf("blockHashes() last block hash is wrong")
+	}
+
+	if got := merkleRoot(leaves[:1], 1, 0); got != leaves[0] {
+		t.Errorf("merkleRoot() of one leaf = %x, want the leaf", got)
+	}
+	if got, want := merkleRoot(leaves, 2, 0), hashPair(leaves[0], leaves[1]); got != want {
+		t.Errorf("merkleRoot() of two leaves = %x, want %x", got, want)
+	}
+
+	// Missing leaves are zero hashes, not hashes of empty blocks
+	var zero [32]byte
+	want := hashPair(hashPair(leaves[0], leaves[1]), hashPair(zero, zero))
+	if got := merkleRoot(leaves, 4, 0); got != want {
+		t.Errorf("merkleRoot() padded = %x, want %x", got, want)
+	}
+	if got := merkleRoot(leaves[:1], 2, 1); got != hashPair(leaves[0], hashPair(zero, zero)) {
+		t.Errorf("merkleRoot() with padding height 1 = %x", got)
+	}
+}
+
+func TestPiecesRootFromLayer(t *testing.T) {
+	// A 5.5 block file with 2-block pieces: the root over its piece layer
+	// must equal the root over all of its blocks
+	const pieceLength = 2 * merkleBlockSize
+	data := make([]byte, 5*merkleBlockSize+merkleBlockSize/2)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	blocks := blockHashes(data)
+	want := merkleRoot(blocks, nextPowerOfTwo(len(blocks)), 0)
+
+	var layer [][32]byte
+	for off := 0; off < len(data); off += pieceLength {
+		piece := data[off:min(off+pieceLength, len(data))]
+		layer = append(layer, merkleRoot(blockHashes(piece), pieceLength/merkleBlockSize, 0))
+	}
+	if got := piecesRootFromLayer(layer, pieceLength); got != want {
+		t.Errorf("piecesRootFromLayer() = %x, want %x", got, want)
+	}
+}
+
+func TestPieceHashV2Verify(t *testing.T) {
+	piece := bytes.Repeat([]byte{1}, merkleBlockSize+10)
+	h := &pieceHashV2{
+		root:   merkleRoot(blockHashes(piece), 4, 0),
+		leaves: 4,
+		length: len(piece),
+	}
+
+	if !h.verify(piece) {
+		t.Errorf("verify() = false for the hashed piece")
+	}
+	// Bytes past length are padding and aren't hashed
+	if !h.verify(append(append([]byte(nil), piece...), 0, 0, 0)) {
+		t.Errorf("verify() = false with trailing padding")
+	}
+
+	corrupt := append([]byte(nil), piece...)
+	corrupt[5] ^= 0xff
+	if h.verify(corrupt) {
+		t.Errorf("verify() = true for corrupt data")
+	}
+	if h.verify(piece[:10]) {
+		t.Errorf("verify() = true for short data")
+	}
+}
+
+func TestUncleHashes(t *testing.T) {
+	nodes := make([][32]byte, 5)
+	for i := range nodes {
+		nodes[i] = sha256.Sum256([]byte{byte(i)})
+	}
+	const width, padHeight = 8, 2
+	root := merkleRoot(nodes, width, padHeight)
+
+	tests := []struct {
+		index, count int
+		wantProof    int
+	}{
+		{0, 1, 3},
+		{4, 1, 3},
+		{2, 2, 2},
+		{4, 4, 1},
+		{0, 8, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d+%d", tt.index, tt.count), func(t *testing.T) {
+			run := make([][32]byte, tt.count)
+			pad := padHash(padHeight)
+			for i := range run {
+				if tt.index+i < len(nodes) {
+					run[i] = nodes[tt.index+i]
+				} else {
+					run[i] = pad
+				}
+			}
+
+			proof := uncleHashes(nodes, width, padHeight, tt.index, tt.count, 10)
+			if len(proof) != tt.wantProof {
+				t.Fatalf("uncleHashes() returned %d hashes, want %d", len(proof), tt.wantProof)
+			}
+			if err := verifyProof(root, run, tt.index, proof); err != nil {
+				t.Errorf("verifyProof() error = %v", err)
+			}
+		})
+	}
+
+	if proof := uncleHashes(nodes, width, padHeight, 0, 1, 1); len(proof) != 1 {
+		t.Errorf("uncleHashes() with maxLayers 1 returned %d hashes", len(proof))
+	}
+	if err := verifyProof(root, nodes[1:2], 0, uncleHashes(nodes, width, padHeight, 0, 1, 10)); err == nil {
+		t.Errorf("verifyProof() should fail for the wrong node")
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package torrent
 
 import (
 	"encoding/binary"
@@ -20,6 +20,48 @@ const (
 	MsgCancel
 )
 
+// MsgExtended carries BEP 10 extension protocol messages
+const MsgExtended messageID = 20
+
+// BitTorrent v2 (BEP 52) hash transfer messages
+const (
+	MsgHashRequest messageID = 21
+	MsgHashes      messageID = 22
+	MsgHashReject  messageID = 23
+)
+
+func (id messageID) String() string {
+	switch id {
+	case MsgChoke:
+		return "choke"
+	case MsgUnchoke:
+		return "unchoke"
+	case MsgInterested:
+		return "interested"
+	case MsgNotInterested:
+		return "not interested"
+	case MsgHave:
+		return "have"
+	case MsgBitfield:
+		return "bitfield"
+	case MsgRequest:
+		return "request"
+	case MsgPiece:
+		return "piece"
+	case MsgCancel:
+		return "cancel"
+	case MsgExtended:
+		return "extended"
+	case MsgHashRequest:
+		return "hash request"
+	case MsgHashes:
+		return "hashes"
+	case MsgHashReject:
+		return "hash reject"
+	}
+	return fmt.Sprintf("message(%d)", uint8(id))
+}
+
 const (
 	// MaxMessageSize is the maximum size of a BitTorrent message (2MB)
 	// This prevents memory exhaustion from malicious peers
@@ -88,3 +130,118 @@ func FormatRequest(index, begin, length int) *Message {
 		Payload: payload,
 	}
 }
+
+// ParseRequest parses the index, begin and length of a request message.
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest {
+		return 0, 0, 0, fmt.Errorf("expected request (ID %d), got ID %d", MsgRequest, msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("request payload must be 12 bytes, got %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// FormatHave announces that we have the piece at index.
+func FormatHave(index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: MsgHave, Payload: payload}
+}
+
+// ParseHave parses the piece index of a have message.
+func ParseHave(msg *Message) (int, error) {
+	if msg.ID != MsgHave {
+		return 0, fmt.Errorf("expected have (ID %d), got ID %d", MsgHave, msg.ID)
+	}
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("have payload must be 4 bytes, got %d", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+// FormatPiece answers a request with a block of piece data.
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// HashRequest asks for Length hashes of BaseLayer in the merkle tree of the
+// file with PiecesRoot, starting at Index, along with up to ProofLayers
+// uncle hashes to verify them against the root.
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+const hashRequestSize = 48
+
+func (r HashRequest) payload(extra int) []byte {
+	payload := make([]byte, hashRequestSize, hashRequestSize+extra)
+	copy(payload[0:32], r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(r.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(r.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(r.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(r.ProofLayers))
+	return payload
+}
+
+func FormatHashRequest(r HashRequest) *Message {
+	return &Message{ID: MsgHashRequest, Payload: r.payload(0)}
+}
+
+func FormatHashReject(r HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: r.payload(0)}
+}
+
+// FormatHashes answers r with the requested hashes followed by the proof.
+func FormatHashes(r HashRequest, hashes [][32]byte) *Message {
+	payload := r.payload(len(hashes) * 32)
+	for _, h := range hashes {
+		payload = append(payload, h[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// ParseHashRequest parses a hash request, hashes or hash reject message.
+// For hashes messages the trailing hashes are returned too.
+func ParseHashRequest(msg *Message) (HashRequest, [][32]byte, error) {
+	if msg.ID != MsgHashRequest && msg.ID != MsgHashes && msg.ID != MsgHashReject {
+		return HashRequest{}, nil, fmt.Errorf("expected hash message, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) < hashRequestSize {
+		return HashRequest{}, nil, fmt.Errorf("hash message too short: %d bytes", len(msg.Payload))
+	}
+
+	var r HashRequest
+	copy(r.PiecesRoot[:], msg.Payload[0:32])
+	r.BaseLayer = int(binary.BigEndian.Uint32(msg.Payload[32:36]))
+	r.Index = int(binary.BigEndian.Uint32(msg.Payload[36:40]))
+	r.Length = int(binary.BigEndian.Uint32(msg.Payload[40:44]))
+	r.ProofLayers = int(binary.BigEndian.Uint32(msg.Payload[44:48]))
+
+	rest := msg.Payload[hashRequestSize:]
+	if msg.ID != MsgHashes {
+		if len(rest) != 0 {
+			return HashRequest{}, nil, fmt.Errorf("unexpected %d trailing bytes", len(rest))
+		}
+		return r, nil, nil
+	}
+	if len(rest)%32 != 0 {
+		return HashRequest{}, nil, fmt.Errorf("hashes payload is not a multiple of 32 bytes")
+	}
+	hashes := make([][32]byte, len(rest)/32)
+	for i := range hashes {
+		copy(hashes[i][:], rest[i*32:(i+1)*32])
+	}
+	return r, hashes, nil
+}
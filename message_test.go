@@ -1,4 +1,4 @@
-package main
+package torrent
 
 import (
 	"bytes"
@@ -149,3 +149,87 @@ func TestFormatRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestHashMessages(t *testing.T) {
+	req := HashRequest{BaseLayer: 1, Index: 4, Length: 2, ProofLayers: 3}
+	copy(req.PiecesRoot[:], "pieces-root-pieces-root-pieces-r")
+	hashes := [][32]byte{{1}, {2}, {3}}
+
+	tests := []struct {
+		name       string
+		msg        *Message
+		wantID     messageID
+		wantHashes [][32]byte
+	}{
+		{"request", FormatHashRequest(req), MsgHashRequest, nil},
+		{"reject", FormatHashReject(req), MsgHashReject, nil},
+		{"hashes", FormatHashes(req, hashes), MsgHashes, hashes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.msg.ID != tt.wantID {
+				t.Errorf("message ID = %d, want %d", tt.msg.ID, tt.wantID)
+			}
+			got, gotHashes, err := ParseHashRequest(tt.msg)
+			if err != nil {
+				t.Fatalf("ParseHashRequest() error = %v", err)
+			}
+			if got != req {
+				t.Errorf("ParseHashRequest() = %+v, want %+v", got, req)
+			}
+			if !reflect.DeepEqual(gotHashes, tt.wantHashes) {
+				t.Errorf("ParseHashRequest() hashes = %x, want %x", gotHashes, tt.wantHashes)
+			}
+		})
+	}
+
+	invalid := []*Message{
+		{ID: MsgRequest, Payload: make([]byte, 48)},
+		{ID: MsgHashRequest, Payload: make([]byte, 47)},
+		{ID: MsgHashRequest, Payload: make([]byte, 49)},
+		{ID: MsgHashes, Payload: make([]byte, 48+31)},
+	}
+	for _, msg := range invalid {
+		if _, _, err := ParseHashRequest(msg); err == nil {
+			t.Errorf("ParseHashRequest() should fail for ID %d with %d bytes", msg.ID, len(msg.Payload))
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	index, begin, length, err := ParseRequest(FormatRequest(3, 16384, 1000))
+	if err != nil {
+		t.Fatalf("ParseRequest() error = %v", err)
+	}
+	if index != 3 || begin != 16384 || length != 1000 {
+		t.Errorf("ParseRequest() = %d, %d, %d, want 3, 16384, 1000", index, begin, length)
+	}
+
+	if _, _, _, err := ParseRequest(&Message{ID: MsgRequest, Payload: make([]byte, 8)}); err == nil {
+		t.Errorf("ParseRequest() should reject a short payload")
+	}
+	if _, _, _, err := ParseRequest(&Message{ID: MsgHave, Payload: make([]byte, 12)}); err == nil {
+		t.Errorf("ParseRequest() should reject other messages")
+	}
+}
+
+func TestParseHave(t *testing.T) {
+	index, err := ParseHave(FormatHave(70000))
+	if err != nil || index != 70000 {
+		t.Errorf("ParseHave() = %d, %v, want 70000", index, err)
+	}
+	if _, err := ParseHave(&Message{ID: MsgHave, Payload: make([]byte, 5)}); err == nil {
+		t.Errorf("ParseHave() should reject a long payload")
+	}
+	if _, err := ParseHave(&Message{ID: MsgRequest, Payload: make([]byte, 4)}); err == nil {
+		t.Errorf("ParseHave() should reject other messages")
+	}
+}
+
+func TestFormatPiece(t *testing.T) {
+	msg := FormatPiece(7, 32, []byte("data"))
+	want := []byte{0, 0, 0, 7, 0, 0, 0, 32, 'd', 'a', 't', 'a'}
+	if msg.ID != MsgPiece || !reflect.DeepEqual(msg.Payload, want) {
+		t.Errorf("FormatPiece() = %v, want payload %v", msg, want)
+	}
+}
@@ -0,0 +1,270 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+
+	"torrent/bencode"
+)
+
+const (
+	// extHandshakeID is the extended message ID of the BEP 10 handshake
+	extHandshakeID = 0
+	// utMetadataID is the ID we ask peers to send ut_metadata messages with
+	utMetadataID = 1
+
+	metadataPieceSize = 16 * 1024 // 16KB
+	// maxMetadataSize bounds the info dictionary we accept from a peer
+	maxMetadataSize = 8 * 1024 * 1024
+)
+
+// ut_metadata (BEP 9) message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+type extHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// formatExtended bencodes v as an extended message with the given ID,
+// followed by any trailing data.
+func formatExtended(extID byte, v any, trailer []byte) (*Message, error) {
+	payload, err := bencode.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	payload = append([]byte{extID}, payload...)
+	return &Message{ID: MsgExtended, Payload: append(payload, trailer...)}, nil
+}
+
+// parseExtended decodes the dictionary at the start of an extended
+// message into v, returning the extension ID and the bytes after it.
+func parseExtended(msg *Message, v any) (byte, []byte, error) {
+	if msg.ID != MsgExtended || len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("not an extended message")
+	}
+	dec := bencode.NewDecoder(bytes.NewReader(msg.Payload[1:]))
+	if err := dec.Decode(v); err != nil {
+		return 0, nil, fmt.Errorf("invalid extended message: %v", err)
+	}
+	return msg.Payload[0], msg.Payload[1+dec.InputOffset():], nil
+}
+
+// fetchMetadata downloads the info dictionary over an established peer
+// connection with ut_metadata and checks it with verify.
+func fetchMetadata(conn io.ReadWriter, verify func([]byte) error) ([]byte, error) {
+	hs, err := formatExtended(extHandshakeID, extHandshake{M: map[string]int{"ut_metadata": utMetadataID}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(hs.Serialize()); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	var got []bool
+	remaining := 0
+	for {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != MsgExtended {
+			continue
+		}
+
+		if data == nil {
+			var peerHS extHandshake
+			id, _, err := parseExtended(msg, &peerHS)
+			if err != nil {
+				return nil, err
+			}
+			if id != extHandshakeID {
+				continue
+			}
+			peerID := peerHS.M["ut_metadata"]
+			if peerID <= 0 || peerID > 255 {
+				return nil, fmt.Errorf("peer does not support ut_metadata")
+			}
+			size := peerHS.MetadataSize
+			if size <= 0 || size > maxMetadataSize {
+				return nil, fmt.Errorf("invalid metadata size %d", size)
+			}
+
+			data = make([]byte, size)
+			remaining = (size + metadataPieceSize - 1) / metadataPieceSize
+			got = make([]bool, remaining)
+			for piece := range got {
+				req, err := formatExtended(byte(peerID), metadataMsg{MsgType: metadataRequest, Piece: piece}, nil)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := conn.Write(req.Serialize()); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		var mm metadataMsg
+		id, block, err := parseExtended(msg, &mm)
+		if err != nil {
+			return nil, err
+		}
+		if id != utMetadataID {
+			continue
+		}
+		switch mm.MsgType {
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", mm.Piece)
+		case metadataData:
+			if mm.Piece < 0 || mm.Piece >= len(got) {
+				return nil, fmt.Errorf("invalid metadata piece %d", mm.Piece)
+			}
+			begin := mm.Piece * metadataPieceSize
+			end := min(begin+metadataPieceSize, len(data))
+			if len(block) != end-begin {
+				return nil, fmt.Errorf("metadata piece %d has %d bytes, want %d", mm.Piece, len(block), end-begin)
+			}
+			if !got[mm.Piece] {
+				copy(data[begin:], block)
+				got[mm.Piece] = true
+				remaining--
+			}
+			if remaining == 0 {
+				if err := verify(data); err != nil {
+					return nil, err
+				}
+				return data, nil
+			}
+		}
+	}
+}
+
+// verifyMetadata checks an info dictionary against the magnet's infohash,
+// using the v1 hash when there is one.
+func (m *Magnet) verifyMetadata(data []byte) error {
+	isV2Only := m.InfoHashV2 != [32]byte{} && [20]byte(m.InfoHashV2[:20]) == m.InfoHash
+	if isV2Only {
+		if sha256.Sum256(data) != m.InfoHashV2 {
+			return fmt.Errorf("metadata does not match infohash")
+		}
+		return nil
+	}
+	if sha1.Sum(data) != m.InfoHash {
+		return fmt.Errorf("metadata does not match infohash")
+	}
+	return nil
+}
+
+// fetchMetadataFrom connects to a peer and downloads the magnet's info
+// dictionary from it.
+func fetchMetadataFrom(ctx context.Context, peer Peer, m *Magnet, cfg peerConfig) ([]byte, error) {
+	conn, err := dialPeer(ctx, peer.String(), m.InfoHash, cfg.encryption)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	hs := NewHandshake(m.InfoHash, cfg.peerID)
+	hs.Reserved[reservedExtByte] |= reservedExtBit
+	if m.InfoHashV2 != [32]byte{} {
+		hs.Reserved[reservedV2Byte] |= reservedV2Bit
+	}
+	if _, err := conn.Write(hs.Serialize()); err != nil {
+		return nil, err
+	}
+	resp, err := ReadHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if resp.InfoHash != m.InfoHash {
+		return nil, fmt.Errorf("peer answered for infohash %x", resp.InfoHash)
+	}
+	if !resp.SupportsExtensions() {
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+	return fetchMetadata(conn, m.verifyMetadata)
+}
+
+// fetchMagnetMetadata asks the magnet's trackers for peers and downloads
+// the info dictionary from the first peer that has it.
+func fetchMagnetMetadata(ctx context.Context, m *Magnet, cfg peerConfig) ([]byte, error) {
+	if len(m.Trackers) == 0 {
+		return nil, fmt.Errorf("magnet link has no trackers")
+	}
+
+	lastErr := fmt.Errorf("no peers available")
+	seen := make(map[string]bool)
+	for _, tracker := range m.Trackers {
+		tf := &TorrentFile{Announce: tracker, InfoHash: m.InfoHash}
+		start := time.Now()
+		peers, err := tf.requestPeers(ctx, announceRequest{infoHash: m.InfoHash, peerID: cfg.peerID, port: cfg.port})
+		cfg.metrics.observeAnnounce(time.Since(start), err)
+		if err != nil {
+			cfg.logger().Warn("announce failed", "tracker", tracker, "err", err)
+			lastErr = fmt.Errorf("failed to request peers: %v", err)
+			continue
+		}
+		for _, p := range peers {
+			if seen[p.String()] || cfg.blocklist.blocks(p.String()) {
+				continue
+			}
+			seen[p.String()] = true
+
+			if !cfg.conns.acquire(ctx) {
+				return nil, ctx.Err()
+			}
+			data, err := fetchMetadataFrom(ctx, p, m, cfg)
+			cfg.conns.release()
+			if err == nil {
+				return data, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			cfg.logger().Debug("metadata fetch failed", "peer", p.String(), "err", err)
+			lastErr = err
+		}
+	}
+	return nil, fmt.Errorf("failed to fetch metadata: %v", lastErr)
+}
+
+// metaInfo builds the metainfo for a magnet from its fetched info
+// dictionary.
+func (m *Magnet) metaInfo(info []byte) (*MetaInfo, error) {
+	mi := &MetaInfo{URLList: m.WebSeeds}
+	if err := bencode.Unmarshal(info, &mi.Info); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	for _, tracker := range m.Trackers {
+		mi.AnnounceList = append(mi.AnnounceList, []string{tracker})
+	}
+	if len(m.Trackers) > 0 {
+		mi.Announce = m.Trackers[0]
+	}
+	if mi.Info.MetaVersion == 2 && mi.Info.Pieces != "" {
+		// Piece layers live outside the info dictionary, so without them a
+		// hybrid torrent is downloaded as v1
+		mi.Info.MetaVersion = 0
+	}
+	return mi, nil
+}
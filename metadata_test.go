@@ -0,0 +1,189 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// tcpPipe returns both ends of a loopback TCP connection. Unlike net.Pipe
+// it buffers, as pipelined requests expect.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// metadataPeer plays the remote side of a ut_metadata exchange.
+type metadataPeer struct {
+	info []byte
+	// hs overrides the extension handshake the peer sends
+	hs     *extHandshake
+	reject bool
+}
+
+const testPeerMetadataID = 3
+
+func (p *metadataPeer) serve(conn io.ReadWriter) error {
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return err
+	}
+	var theirs extHandshake
+	if _, _, err := parseExtended(msg, &theirs); err != nil {
+		return err
+	}
+
+	hs := extHandshake{M: map[string]int{"ut_metadata": testPeerMetadataID}, MetadataSize: len(p.info)}
+	if p.hs != nil {
+		hs = *p.hs
+	}
+	reply, _ := formatExtended(extHandshakeID, hs, nil)
+	// Unrelated traffic is skipped by the fetcher
+	conn.Write((&Message{ID: MsgUnchoke}).Serialize())
+	if _, err := conn.Write(reply.Serialize()); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			return nil
+		}
+		var req metadataMsg
+		id, _, err := parseExtended(msg, &req)
+		if err != nil || id != testPeerMetadataID || req.MsgType != metadataRequest {
+			return fmt.Errorf("unexpected request %+v", req)
+		}
+
+		begin := req.Piece * metadataPieceSize
+		resp := metadataMsg{MsgType: metadataData, Piece: req.Piece, TotalSize: len(p.info)}
+		data := p.info[begin:min(begin+metadataPieceSize, len(p.info))]
+		if p.reject {
+			resp, data = metadataMsg{MsgType: metadataReject, Piece: req.Piece}, nil
+		}
+		out, _ := formatExtended(byte(theirs.M["ut_metadata"]), resp, data)
+		if _, err := conn.Write(out.Serialize()); err != nil {
+			return err
+		}
+	}
+}
+
+func TestExtendedMessage(t *testing.T) {
+	msg, err := formatExtended(7, metadataMsg{MsgType: metadataData, Piece: 2, TotalSize: 100}, []byte("tail"))
+	if err != nil {
+		t.Fatalf("formatExtended() error = %v", err)
+	}
+	var got metadataMsg
+	id, rest, err := parseExtended(msg, &got)
+	if err != nil {
+		t.Fatalf("parseExtended() error = %v", err)
+	}
+	if id != 7 || got != (metadataMsg{MsgType: metadataData, Piece: 2, TotalSize: 100}) || string(rest) != "tail" {
+		t.Errorf("parseExtended() = %d, %+v, %q", id, got, rest)
+	}
+
+	if _, _, err := parseExtended(&Message{ID: MsgExtended}, &got); err == nil {
+		t.Errorf("parseExtended() should fail for an empty payload")
+	}
+	if _, _, err := parseExtended(&Message{ID: MsgPiece, Payload: []byte{0, 'd', 'e'}}, &got); err == nil {
+		t.Errorf("parseExtended() should fail for other message types")
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	info := bytes.Repeat([]byte("metadata"), 5000) // three pieces
+	hash := sha1.Sum(info)
+	verify := func(data []byte) error {
+		if sha1.Sum(data) != hash {
+			return fmt.Errorf("hash mismatch")
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name    string
+		peer    *metadataPeer
+		wantErr string
+	}{
+		{"success", &metadataPeer{info: info}, ""},
+		{"wrong metadata", &metadataPeer{info: append([]byte("x"), info[1:]...)}, "hash mismatch"},
+		{"reject", &metadataPeer{info: info, reject: true}, "rejected"},
+		{"no ut_metadata", &metadataPeer{info: info, hs: &extHandshake{MetadataSize: len(info)}}, "does not support"},
+		{"too large", &metadataPeer{info: info, hs: &extHandshake{
+			M:            map[string]int{"ut_metadata": testPeerMetadataID},
+			MetadataSize: maxMetadataSize + 1,
+		}}, "invalid metadata size"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ours, theirs := tcpPipe(t)
+			go tt.peer.serve(theirs)
+
+			got, err := fetchMetadata(ours, verify)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("fetchMetadata() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchMetadata() error = %v", err)
+			}
+			if !bytes.Equal(got, info) {
+				t.Errorf("fetchMetadata() returned different metadata")
+			}
+		})
+	}
+}
+
+func TestMagnetMetaInfo(t *testing.T) {
+	info := "d6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces20:" + string(make([]byte, 20)) + "e"
+	m := &Magnet{
+		InfoHash: sha1.Sum([]byte(info)),
+		Trackers: []string{"http://a/announce", "http://b/announce"},
+		WebSeeds: []string{"http://seed/"},
+	}
+	if err := m.verifyMetadata([]byte(info)); err != nil {
+		t.Errorf("verifyMetadata() error = %v", err)
+	}
+	if err := m.verifyMetadata([]byte(info + " ")); err == nil {
+		t.Errorf("verifyMetadata() should reject other metadata")
+	}
+
+	mi, err := m.metaInfo([]byte(info))
+	if err != nil {
+		t.Fatalf("metaInfo() error = %v", err)
+	}
+	tf, err := mi.ToTorrentFile()
+	if err != nil {
+		t.Fatalf("ToTorrentFile() error = %v", err)
+	}
+	if tf.InfoHash != m.InfoHash || tf.Announce != "http://a/announce" || len(tf.WebSeeds) != 1 {
+		t.Errorf("ToTorrentFile() = %+v", tf)
+	}
+}
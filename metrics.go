@@ -0,0 +1,204 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// announceBuckets are the upper bounds, in seconds, of the announce
+// latency histogram
+var announceBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// histogram counts observations into buckets by upper bound.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	// counts[i] is the number of observations in (bounds[i-1], bounds[i]];
+	// the last is for those above every bound
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// clientMetrics holds the client-wide metrics that aren't kept per
+// torrent. A nil clientMetrics records nothing.
+type clientMetrics struct {
+	announces       atomic.Int64
+	announceErrors  atomic.Int64
+	announceLatency *histogram
+}
+
+func newClientMetrics() *clientMetrics {
+	return &clientMetrics{announceLatency: newHistogram(announceBuckets)}
+}
+
+// observeAnnounce records an announce that took d and failed with err.
+func (m *clientMetrics) observeAnnounce(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.announces.Add(1)
+	if err != nil {
+		m.announceErrors.Add(1)
+	}
+	m.announceLatency.observe(d.Seconds())
+}
+
+// torrentMetric is a metric reported for every torrent.
+type torrentMetric struct {
+	name, kind, help string
+	value            func(m *torrentMetrics) float64
+}
+
+// torrentMetrics is a snapshot of a torrent's metrics.
+type torrentMetrics struct {
+	Stats
+	piecesVerified, hashFailures int64
+	halfOpen, chokingUs          int64
+	queuePending, queueActive    int
+}
+
+var torrentMetricDefs = []torrentMetric{
+	{"torrent_downloaded_bytes_total", "counter", "Bytes downloaded from peers and web seeds.",
+		func(m *torrentMetrics) float64 { return float64(m.BytesDownloaded) }},
+	{"torrent_uploaded_bytes_total", "counter", "Bytes uploaded to peers.",
+		func(m *torrentMetrics) float64 { return float64(m.BytesUploaded) }},
+	{"torrent_download_rate_bytes", "gauge", "Download rate in bytes per second.",
+		func(m *torrentMetrics) float64 { return m.DownloadRate }},
+	{"torrent_upload_rate_bytes", "gauge", "Upload rate in bytes per second.",
+		func(m *torrentMetrics) float64 { return m.UploadRate }},
+	{"torrent_pieces_verified_total", "counter", "Pieces downloaded that passed their hash check.",
+		func(m *torrentMetrics) float64 { return float64(m.piecesVerified) }},
+	{"torrent_pieces_failed_total", "counter", "Pieces downloaded that failed their hash check.",
+		func(m *torrentMetrics) float64 { return float64(m.hashFailures) }},
+	{"torrent_peers", "gauge", "Connected peers.",
+		func(m *torrentMetrics) float64 { return float64(m.Peers) }},
+	{"torrent_half_open_connections", "gauge", "Peer connections being dialled or handshaken.",
+		func(m *torrentMetrics) float64 { return float64(m.halfOpen) }},
+	{"torrent_peers_choking_us", "gauge", "Connected peers we download from that are choking us.",
+		func(m *torrentMetrics) float64 { return float64(m.chokingUs) }},
+	{"torrent_peers_unchoking_us", "gauge", "Connected peers we download from that have unchoked us.",
+		func(m *torrentMetrics) float64 { return float64(max(0, int64(m.Peers)-m.chokingUs)) }},
+	{"torrent_queue_pending_pieces", "gauge", "Wanted pieces waiting for a peer.",
+		func(m *torrentMetrics) float64 { return float64(m.queuePending) }},
+	{"torrent_queue_active_pieces", "gauge", "Pieces being downloaded.",
+		func(m *torrentMetrics) float64 { return float64(m.queueActive) }},
+}
+
+// metrics returns a snapshot of the torrent's metrics.
+func (t *Torrent) metrics() *torrentMetrics {
+	m := &torrentMetrics{
+		Stats:          t.Stats(),
+		piecesVerified: t.stats.piecesVerified.Load(),
+		hashFailures:   t.stats.hashFailures.Load(),
+		halfOpen:       t.stats.halfOpen.Load(),
+		chokingUs:      t.stats.chokingUs.Load(),
+	}
+	if tf := t.Info(); tf != nil {
+		m.queuePending, m.queueActive = tf.selection().queueDepth()
+	}
+	return m
+}
+
+// WriteMetrics writes the client's metrics to w in the Prometheus text
+// exposition format. Torrent metrics are labelled with the infohash and
+// name of their torrent.
+func (c *Client) WriteMetrics(w io.Writer) error {
+	torrents := c.Torrents()
+	slices.SortFunc(torrents, func(a, b *Torrent) int { return bytes.Compare(a.infoHash[:], b.infoHash[:]) })
+	snapshots := make([]*torrentMetrics, len(torrents))
+	labels := make([]string, len(torrents))
+	for i, t := range torrents {
+		snapshots[i] = t.metrics()
+		labels[i] = fmt.Sprintf(`{infohash="%x",name="%s"}`, t.infoHash, escapeLabel(t.Name()))
+	}
+
+	bw := bufio.NewWriter(w)
+	header := func(name, kind, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	for _, def := range torrentMetricDefs {
+		header(def.name, def.kind, def.help)
+		for i, m := range snapshots {
+			fmt.Fprintf(bw, "%s%s %s\n", def.name, labels[i], formatFloat(def.value(m)))
+		}
+	}
+
+	header("torrent_torrents", "gauge", "Torrents in the client by state.")
+	states := make(map[State]int)
+	for _, t := range torrents {
+		states[t.Status().State]++
+	}
+	for s := StatePaused; s <= StateQueued; s++ {
+		fmt.Fprintf(bw, "torrent_torrents{state=\"%s\"} %d\n", s, states[s])
+	}
+
+	m := c.metrics
+	header("torrent_tracker_announces_total", "counter", "Tracker announces sent.")
+	fmt.Fprintf(bw, "torrent_tracker_announces_total %d\n", m.announces.Load())
+	header("torrent_tracker_announce_errors_total", "counter", "Tracker announces that failed.")
+	fmt.Fprintf(bw, "torrent_tracker_announce_errors_total %d\n", m.announceErrors.Load())
+
+	h := m.announceLatency
+	h.mu.Lock()
+	header("torrent_tracker_announce_duration_seconds", "histogram", "Time taken by tracker announces.")
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(bw, "torrent_tracker_announce_duration_seconds_bucket{le=\"%s\"} %d\n", formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(bw, "torrent_tracker_announce_duration_seconds_bucket{le=\"+Inf\"} %d\n", h.count)
+	fmt.Fprintf(bw, "torrent_tracker_announce_duration_seconds_sum %s\n", formatFloat(h.sum))
+	fmt.Fprintf(bw, "torrent_tracker_announce_duration_seconds_count %d\n", h.count)
+	h.mu.Unlock()
+
+	return bw.Flush()
+}
+
+// MetricsHandler returns an HTTP handler serving the client's metrics for
+// Prometheus to scrape.
+func (c *Client) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.WriteMetrics(w)
+	})
+}
+
+// escapeLabel escapes a label value for the text exposition format.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
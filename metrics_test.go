@@ -0,0 +1,79 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.observe(v)
+	}
+	if want := []uint64{2, 1, 1}; fmt.Sprint(h.counts) != fmt.Sprint(want) {
+		t.Errorf("counts = %v, want %v", h.counts, want)
+	}
+	if h.sum != 14.5 || h.count != 4 {
+		t.Errorf("sum, count = %v, %d; want 14.5, 4", h.sum, h.count)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	mi, _ := newClientTestSeed(t, nil)
+	client, _ := NewClient(ClientConfig{DataDir: t.TempDir()})
+	defer client.Close()
+	tr, err := client.AddMetaInfo(mi)
+	if err != nil {
+		t.Fatalf("AddMetaInfo() error = %v", err)
+	}
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := waitTorrent(t, tr); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	client.metrics.observeAnnounce(200*time.Millisecond, nil)
+	client.metrics.observeAnnounce(3*time.Second, errors.New("timeout"))
+
+	rec := httptest.NewRecorder()
+	client.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+
+	labels := fmt.Sprintf(`{infohash="%x",name="release"}`, tr.InfoHash())
+	for _, want := range []string{
+		"# TYPE torrent_downloaded_bytes_total counter",
+		"torrent_downloaded_bytes_total" + labels + " 70000",
+		"torrent_pieces_verified_total" + labels + " 5",
+		"torrent_pieces_failed_total" + labels + " 0",
+		"torrent_peers" + labels + " 0",
+		"torrent_queue_pending_pieces" + labels + " 0",
+		`torrent_torrents{state="complete"} 1`,
+		`torrent_torrents{state="paused"} 0`,
+		"torrent_tracker_announces_total 2",
+		"torrent_tracker_announce_errors_total 1",
+		`torrent_tracker_announce_duration_seconds_bucket{le="0.25"} 1`,
+		`torrent_tracker_announce_duration_seconds_bucket{le="5"} 2`,
+		`torrent_tracker_announce_duration_seconds_bucket{le="+Inf"} 2`,
+		"torrent_tracker_announce_duration_seconds_sum 3.2",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics:\n%s", body)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got, want := escapeLabel("a\"b\\c\nd"), `a\"b\\c\nd`; got != want {
+		t.Errorf("escapeLabel() = %q, want %q", got, want)
+	}
+}
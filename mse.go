@@ -0,0 +1,434 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// EncryptionPolicy decides whether peer connections use Message Stream
+// Encryption, the Diffie-Hellman and RC4 obfuscation most clients speak to
+// get past networks that throttle BitTorrent.
+type EncryptionPolicy int
+
+const (
+	// EncryptionDisabled speaks plain BitTorrent only, refusing peers that
+	// connect encrypted
+	EncryptionDisabled EncryptionPolicy = iota
+	// EncryptionPreferred encrypts outgoing connections, dialling peers
+	// that don't answer again in plain, and accepts peers either way
+	EncryptionPreferred
+	// EncryptionRequired only connects to and accepts peers that encrypt
+	// the whole stream with RC4
+	EncryptionRequired
+)
+
+func (p EncryptionPolicy) String() string {
+	switch p {
+	case EncryptionDisabled:
+		return "disabled"
+	case EncryptionPreferred:
+		return "preferred"
+	case EncryptionRequired:
+		return "required"
+	}
+	return fmt.Sprintf("EncryptionPolicy(%d)", int(p))
+}
+
+// ParseEncryptionPolicy parses a policy name as returned by
+// EncryptionPolicy.String.
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	for p := EncryptionDisabled; p <= EncryptionRequired; p++ {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid encryption policy %q, want disabled, preferred or required", s)
+}
+
+const (
+	// mseKeySize is the size of a Diffie-Hellman public key, and
+	// mseMaxPad the most random padding either side may add
+	mseKeySize = 96
+	mseMaxPad  = 512
+	// mseTimeout bounds the encryption handshake of outgoing connections,
+	// so peers that don't speak it are soon retried in plain
+	mseTimeout = 10 * time.Second
+	// cryptoPlaintext and cryptoRC4 are the bits of crypto_provide and
+	// crypto_select that offer and pick how the stream is encrypted
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+// msePrime is the 768-bit prime of the key exchange, whose generator is 2
+var msePrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+// mseVC is the verification constant that proves each side derived the
+// same keys
+var mseVC [8]byte
+
+// errPlaintextRefused is returned for peers that connect without
+// encryption when it's required.
+var errPlaintextRefused = errors.New("peer connected without encryption, which is required")
+
+// mseConn is a peer connection after its handshake was read into r. When
+// MSE set up RC4, reads and writes are encrypted with it; pending holds
+// payload the peer sent inside the handshake.
+type mseConn struct {
+	net.Conn
+	r        io.Reader
+	pending  []byte
+	dec, enc *rc4.Cipher
+
+	// writeMu keeps the keystream in step with the bytes written
+	writeMu sync.Mutex
+}
+
+func (c *mseConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(p)
+	if c.dec != nil {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *mseConn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+// isEncrypted reports whether conn is encrypted with RC4.
+func isEncrypted(conn net.Conn) bool {
+	c, ok := conn.(*mseConn)
+	return ok && c.enc != nil
+}
+
+// dialPeer connects to addr, encrypting the connection as policy asks
+// with infoHash as the shared secret. Under EncryptionPreferred, peers
+// that fail the encryption handshake are dialled again in plain.
+func dialPeer(ctx context.Context, addr string, infoHash [20]byte, policy EncryptionPolicy) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil || policy == EncryptionDisabled {
+		return conn, err
+	}
+	enc, err := encryptOutgoing(ctx, conn, infoHash)
+	if err == nil {
+		return enc, nil
+	}
+	conn.Close()
+	if policy == EncryptionRequired || ctx.Err() != nil {
+		return nil, fmt.Errorf("encryption handshake failed: %v", err)
+	}
+	// The peer may not speak MSE at all
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// encryptOutgoing runs the MSE handshake as the side that connected,
+// asking for the whole stream to be encrypted with RC4.
+func encryptOutgoing(ctx context.Context, conn net.Conn, skey [20]byte) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// 1. A->B: Ya, PadA
+	priv, pub, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(pub, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	br := bufio.NewReader(conn)
+	yb := make([]byte, mseKeySize)
+	if _, err := io.ReadFull(br, yb); err != nil {
+		return nil, err
+	}
+	s, err := mseSecret(priv, yb)
+	if err != nil {
+		return nil, err
+	}
+	enc := mseCipher("keyA", s, skey[:])
+	dec := mseCipher("keyB", s, skey[:])
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), with neither
+	// padding nor initial payload
+	var msg bytes.Buffer
+	msg.Write(mseHash("req1", s))
+	msg.Write(xorBytes(mseHash("req2", skey[:]), mseHash("req3", s)))
+	hdr := make([]byte, len(mseVC)+8)
+	binary.BigEndian.PutUint32(hdr[len(mseVC):], cryptoRC4)
+	enc.XORKeyStream(hdr, hdr)
+	msg.Write(hdr)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(PadD), PadD), found past
+	// PadB by its encrypted VC
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC[:])
+	if err := mseSync(br, vc, mseMaxPad); err != nil {
+		return nil, err
+	}
+	sel := make([]byte, 6)
+	if _, err := io.ReadFull(br, sel); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(sel, sel)
+	if method := binary.BigEndian.Uint32(sel); method != cryptoRC4 {
+		return nil, fmt.Errorf("peer selected crypto method %#x, want RC4", method)
+	}
+	if err := mseSkipPad(br, dec, binary.BigEndian.Uint16(sel[4:])); err != nil {
+		return nil, err
+	}
+	return &mseConn{Conn: conn, r: br, dec: dec, enc: enc}, nil
+}
+
+// acceptEncryption tells an incoming plain handshake from an MSE one by
+// its first bytes and, if the peer is encrypting, answers it as policy
+// allows. It returns the connection to read the BitTorrent handshake from.
+func (c *Client) acceptEncryption(conn net.Conn) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	start, err := br.Peek(1 + len(btProtocol))
+	if err != nil {
+		return nil, err
+	}
+	plain := start[0] == byte(len(btProtocol)) && string(start[1:]) == btProtocol
+	switch policy := c.cfg.Encryption; {
+	case plain && policy == EncryptionRequired:
+		return nil, errPlaintextRefused
+	case plain:
+		return &mseConn{Conn: conn, r: br}, nil
+	case policy == EncryptionDisabled:
+		return nil, fmt.Errorf("peer connected encrypted, which is disabled")
+	case policy == EncryptionRequired:
+		return encryptIncoming(conn, br, c.skeyHash, cryptoRC4)
+	default:
+		return encryptIncoming(conn, br, c.skeyHash, cryptoRC4|cryptoPlaintext)
+	}
+}
+
+// skeyHash finds the swarm whose HASH('req2', SKEY) is req2.
+func (c *Client) skeyHash(req2 []byte) ([20]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for hash, t := range c.torrents {
+		hashes := [][20]byte{hash}
+		if tf := t.Info(); tf != nil {
+			hashes = append(hashes, tf.swarmHashes()...)
+		}
+		for _, h := range hashes {
+			if bytes.Equal(mseHash("req2", h[:]), req2) {
+				return h, true
+			}
+		}
+	}
+	return [20]byte{}, false
+}
+
+// encryptIncoming runs the MSE handshake as the side that was connected
+// to, finding the swarm the peer wants with lookup and picking RC4 over
+// plaintext if both are offered and allowed.
+func encryptIncoming(conn net.Conn, br *bufio.Reader, lookup func(req2 []byte) ([20]byte, bool), allow uint32) (net.Conn, error) {
+	// 1. A->B: Ya, PadA
+	ya := make([]byte, mseKeySize)
+	if _, err := io.ReadFull(br, ya); err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	priv, pub, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	s, err := mseSecret(priv, ya)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(pub, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	// 3. A->B: HASH('req1', S) past PadA, then HASH('req2', SKEY) xor
+	// HASH('req3', S) naming the swarm
+	if err := mseSync(br, mseHash("req1", s), mseMaxPad); err != nil {
+		return nil, err
+	}
+	req := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return nil, err
+	}
+	skey, ok := lookup(xorBytes(req, mseHash("req3", s)))
+	if !ok {
+		return nil, fmt.Errorf("peer asked for a swarm we aren't in")
+	}
+	dec := mseCipher("keyA", s, skey[:])
+	enc := mseCipher("keyB", s, skey[:])
+
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	hdr := make([]byte, len(mseVC)+6)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(hdr, hdr)
+	if !bytes.Equal(hdr[:len(mseVC)], mseVC[:]) {
+		return nil, fmt.Errorf("invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(hdr[len(mseVC):])
+	if err := mseSkipPad(br, dec, binary.BigEndian.Uint16(hdr[len(mseVC)+4:])); err != nil {
+		return nil, err
+	}
+	iaLen := make([]byte, 2)
+	if _, err := io.ReadFull(br, iaLen); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(iaLen, iaLen)
+	ia := make([]byte, binary.BigEndian.Uint16(iaLen))
+	if _, err := io.ReadFull(br, ia); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var method uint32
+	switch {
+	case provide&allow&cryptoRC4 != 0:
+		method = cryptoRC4
+	case provide&allow&cryptoPlaintext != 0:
+		method = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("peer offered crypto methods %#x, none of which are allowed", provide)
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(PadD), PadD), without
+	// padding
+	reply := make([]byte, len(mseVC)+6)
+	binary.BigEndian.PutUint32(reply[len(mseVC):], method)
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+	if method == cryptoPlaintext {
+		return &mseConn{Conn: conn, r: br, pending: ia}, nil
+	}
+	return &mseConn{Conn: conn, r: br, pending: ia, dec: dec, enc: enc}, nil
+}
+
+// mseKeyPair returns a random 160-bit private key and its public key.
+func mseKeyPair() (*big.Int, []byte, error) {
+	x := make([]byte, 20)
+	if _, err := rand.Read(x); err != nil {
+		return nil, nil, err
+	}
+	priv := new(big.Int).SetBytes(x)
+	pub := new(big.Int).Exp(big.NewInt(2), priv, msePrime)
+	return priv, pub.FillBytes(make([]byte, mseKeySize)), nil
+}
+
+// mseSecret returns the secret S shared with the peer whose public key is
+// peerPub.
+func mseSecret(priv *big.Int, peerPub []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(peerPub)
+	// Keys of 0, 1 or p-1 would give away the secret
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(msePrime, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	s := new(big.Int).Exp(y, priv, msePrime)
+	return s.FillBytes(make([]byte, mseKeySize)), nil
+}
+
+// mseHash returns the SHA-1 of label followed by parts.
+func mseHash(label string, parts ...[]byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(label))
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// mseCipher returns the RC4 cipher keyed by HASH(label, S, SKEY), with the
+// first 1KiB of its keystream discarded.
+func mseCipher(label string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash(label, s, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// msePad returns up to mseMaxPad random bytes.
+func msePad() []byte {
+	pad := make([]byte, mrand.IntN(mseMaxPad+1))
+	rand.Read(pad)
+	return pad
+}
+
+// mseSync reads from r until it has read pattern, failing if it isn't
+// found within maxSkip bytes.
+func mseSync(r io.ByteReader, pattern []byte, maxSkip int) error {
+	window := make([]byte, 0, len(pattern))
+	for range maxSkip + len(pattern) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if len(window) == len(pattern) {
+			copy(window, window[1:])
+			window = window[:len(window)-1]
+		}
+		window = append(window, b)
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("encryption handshake out of sync")
+}
+
+// mseSkipPad reads and decrypts n bytes of padding.
+func mseSkipPad(r io.Reader, dec *rc4.Cipher, n uint16) error {
+	if n > mseMaxPad {
+		return fmt.Errorf("padding of %d bytes is too long", n)
+	}
+	pad := make([]byte, n)
+	if _, err := io.ReadFull(r, pad); err != nil {
+		return err
+	}
+	dec.XORKeyStream(pad, pad)
+	return nil
+}
+
+// xorBytes returns a xor b, which are the same length.
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range out {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
@@ -0,0 +1,220 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mseServer accepts one connection on a loopback listener and runs the
+// receiving side of MSE for swarm skey on it, echoing what the peer sends
+// once it's done.
+func mseServer(t *testing.T, skey [20]byte, allow uint32) (addr string, result chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	result = make(chan error, 1)
+	go func() {
+		raw, err := ln.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer raw.Close()
+		lookup := func(req2 []byte) ([20]byte, bool) {
+			return skey, bytes.Equal(req2, mseHash("req2", skey[:]))
+		}
+		conn, err := encryptIncoming(raw, bufio.NewReader(raw), lookup, allow)
+		if err != nil {
+			result <- err
+			return
+		}
+		if !isEncrypted(conn) {
+			t.Errorf("incoming connection isn't encrypted")
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			result <- err
+			return
+		}
+		_, err = conn.Write(buf)
+		result <- err
+	}()
+	return ln.Addr().String(), result
+}
+
+func TestMSEHandshake(t *testing.T) {
+	skey := [20]byte{1, 2, 3}
+	addr, result := mseServer(t, skey, cryptoRC4|cryptoPlaintext)
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	conn, err := encryptOutgoing(context.Background(), raw, skey)
+	if err != nil {
+		t.Fatalf("encryptOutgoing() error = %v", err)
+	}
+	if !isEncrypted(conn) {
+		t.Errorf("outgoing connection isn't encrypted")
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("echo = %q, %v", buf, err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("server error = %v", err)
+	}
+}
+
+func TestMSEHandshakeFails(t *testing.T) {
+	tests := []struct {
+		name  string
+		skey  [20]byte
+		allow uint32
+	}{
+		{"unknown swarm", [20]byte{9}, cryptoRC4},
+		{"no common method", [20]byte{1}, cryptoPlaintext},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, result := mseServer(t, tt.skey, tt.allow)
+			raw, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The server only closes the connection, so don't wait long
+			raw.SetDeadline(time.Now().Add(5 * time.Second))
+			go func() {
+				<-result
+				raw.Close()
+			}()
+			if _, err := encryptOutgoing(context.Background(), raw, [20]byte{1}); err == nil {
+				t.Errorf("encryptOutgoing() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestMSESync(t *testing.T) {
+	pattern := []byte("mark")
+	pad := bytes.Repeat([]byte{0}, mseMaxPad)
+	r := bufio.NewReader(bytes.NewReader(append(append(pad, pattern...), "rest"...)))
+	if err := mseSync(r, pattern, mseMaxPad); err != nil {
+		t.Fatalf("mseSync() error = %v", err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+		t.Errorf("left %q after the pattern, want %q", rest, "rest")
+	}
+
+	r = bufio.NewReader(bytes.NewReader(append(append(pad, 0), pattern...)))
+	if err := mseSync(r, pattern, mseMaxPad); err == nil {
+		t.Errorf("mseSync() found the pattern past the padding limit")
+	}
+}
+
+func TestAcceptEncryptionPolicy(t *testing.T) {
+	plain := NewHandshake([20]byte{1}, [20]byte{2}).Serialize()
+	tests := []struct {
+		policy EncryptionPolicy
+		first  []byte
+		ok     bool
+	}{
+		{EncryptionDisabled, plain, true},
+		{EncryptionPreferred, plain, true},
+		{EncryptionRequired, plain, false},
+		// Looks like the start of an MSE public key
+		{EncryptionDisabled, bytes.Repeat([]byte{0xab}, mseKeySize), false},
+	}
+	for _, tt := range tests {
+		c := &Client{cfg: ClientConfig{Encryption: tt.policy}}
+		local, remote := net.Pipe()
+		go func() {
+			remote.Write(tt.first)
+			remote.Close()
+		}()
+		conn, err := c.acceptEncryption(local)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: acceptEncryption() error = %v, want ok %v", tt.policy, err, tt.ok)
+		}
+		if err == nil {
+			// Nothing read ahead is lost
+			if hs, err := ReadHandshake(conn); err != nil || hs.InfoHash != [20]byte{1} {
+				t.Errorf("%v: ReadHandshake() = %v, %v", tt.policy, hs, err)
+			}
+		}
+		local.Close()
+	}
+}
+
+func TestSeedEncryption(t *testing.T) {
+	tests := []struct {
+		name        string
+		seed, leech EncryptionPolicy
+	}{
+		{"required", EncryptionRequired, EncryptionRequired},
+		{"preferred falls back to plain", EncryptionDisabled, EncryptionPreferred},
+		{"preferred accepts plain", EncryptionPreferred, EncryptionDisabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := t.TempDir()
+			root := filepath.Join(src, "release")
+			os.MkdirAll(root, 0755)
+			contents := map[string][]byte{"a.bin": bytes.Repeat([]byte("a"), 40000)}
+			if err := os.WriteFile(filepath.Join(root, "a.bin"), contents["a.bin"], 0644); err != nil {
+				t.Fatal(err)
+			}
+			port := freePort(t)
+			tracker := newTrackerServer(t, port)
+			mi, err := Create(root, CreateOptions{PieceLength: 16384, Announce: tracker.URL + "/announce"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			seeder, _ := NewClient(ClientConfig{DataDir: src, ListenPort: port, Encryption: tt.seed})
+			defer seeder.Close()
+			st, _ := seeder.AddMetaInfo(mi)
+			if err := st.Seed(); err != nil {
+				t.Fatal(err)
+			}
+			waitState(t, st, StateSeeding)
+
+			dst := t.TempDir()
+			leecher, _ := NewClient(ClientConfig{DataDir: dst, ListenPort: freePort(t), Encryption: tt.leech})
+			defer leecher.Close()
+			lt, _ := leecher.AddMetaInfo(mi)
+			if err := lt.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if err := waitTorrent(t, lt); err != nil {
+				t.Fatalf("Wait() error = %v", err)
+			}
+			checkDownloaded(t, dst, contents)
+		})
+	}
+}
+
+func TestParseEncryptionPolicy(t *testing.T) {
+	for p := EncryptionDisabled; p <= EncryptionRequired; p++ {
+		if got, err := ParseEncryptionPolicy(p.String()); err != nil || got != p {
+			t.Errorf("ParseEncryptionPolicy(%q) = %v, %v", p.String(), got, err)
+		}
+	}
+	if _, err := ParseEncryptionPolicy("sometimes"); err == nil {
+		t.Errorf("ParseEncryptionPolicy() accepted an unknown policy")
+	}
+}
@@ -1,12 +1,16 @@
-package main
+package torrent
 
 import (
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"os"
+	"io"
 )
 
+// errHashMismatch is returned for pieces that fail their hash check.
+var errHashMismatch = errors.New("hash mismatch")
+
 type pieceProgress struct {
 	index      int
 	buf        []byte
@@ -26,13 +30,28 @@ func (t *TorrentFile) handlePieceMsg(msg *Message, progress *pieceProgress) {
 	progress.downloaded += len(block)
 }
 
-func (t *TorrentFile) VerifyAndSave(pw *pieceWork, buf []byte, file *os.File) error {
-	hash := sha1.Sum(buf)
-	if hash != pw.hash {
-		return fmt.Errorf("piece %d hash mismatch", pw.index)
+func (t *TorrentFile) VerifyAndSave(pw *pieceWork, buf []byte, w io.WriterAt) error {
+	if err := t.checkPiece(pw, buf); err != nil {
+		return err
 	}
 
 	offset := int64(pw.index * t.PieceLength)
-	_, err := file.WriteAt(buf, offset)
+	_, err := w.WriteAt(buf, offset)
 	return err
 }
+
+// checkPiece verifies a piece's data against its hashes.
+func (t *TorrentFile) checkPiece(pw *pieceWork, buf []byte) error {
+	// Hybrid torrents are checked against both hashes so neither swarm can
+	// feed us data the other would reject
+	if pw.hashV2 == nil || t.IsHybrid() {
+		hash := sha1.Sum(buf)
+		if hash != pw.hash {
+			return fmt.Errorf("piece %d %w", pw.index, errHashMismatch)
+		}
+	}
+	if pw.hashV2 != nil && !pw.hashV2.verify(buf) {
+		return fmt.Errorf("piece %d %w", pw.index, errHashMismatch)
+	}
+	return nil
+}
@@ -1,4 +1,4 @@
-package main
+package torrent
 
 import (
 	"bytes"
@@ -19,7 +19,7 @@ func TestHandlePieceMsg(t *testing.T) {
 		{
 			name: "valid piece message at beginning",
 			msg: func() *Message {
-				payload := make([]byte, 12+5)
+				payload := make([]byte, 8+5)
 				binary.BigEndian.PutUint32(payload[0:4], 0) // index
 				binary.BigEndian.PutUint32(payload[4:8], 0) // begin
 				copy(payload[8:13], []byte("hello"))        // block data (exactly 5 bytes)
@@ -36,7 +36,7 @@ func TestHandlePieceMsg(t *testing.T) {
 		{
 			name: "valid piece message at offset",
 			msg: func() *Message {
-				payload := make([]byte, 12+4)
+				payload := make([]byte, 8+4)
 				binary.BigEndian.PutUint32(payload[0:4], 0)   // index
 				binary.BigEndian.PutUint32(payload[4:8], 100) // begin
 				copy(payload[8:12], []byte("test"))           // block data (exactly 4 bytes)
@@ -53,7 +53,7 @@ func TestHandlePieceMsg(t *testing.T) {
 		{
 			name: "multiple blocks",
 			msg: func() *Message {
-				payload := make([]byte, 12+3)
+				payload := make([]byte, 8+3)
 				binary.BigEndian.PutUint32(payload[0:4], 0) // index
 				binary.BigEndian.PutUint32(payload[4:8], 0) // begin
 				copy(payload[8:11], []byte("abc"))          // block data (exactly 3 bytes)
@@ -87,7 +87,7 @@ func TestHandlePieceMsg(t *testing.T) {
 func TestHandlePieceMsg_BoundsCheck(t *testing.T) {
 	// Test that out-of-bounds writes are handled gracefully
 	msg := func() *Message {
-		payload := make([]byte, 12+10)
+		payload := make([]byte, 8+10)
 		binary.BigEndian.PutUint32(payload[0:4], 0)     // index
 		binary.BigEndian.PutUint32(payload[4:8], 16380) // begin (near end of buffer)
 		copy(payload[8:], []byte("1234567890"))         // 10 bytes, would overflow
@@ -1,9 +1,10 @@
-package main
+package torrent
 
 import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 )
 
 type Peer struct {
@@ -11,6 +12,11 @@ type Peer struct {
 	Port uint16
 }
 
+// String returns the peer's host:port address.
+func (p Peer) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
 func UnmarshalPeer(peersBin []byte) ([]Peer, error) {
 	const peerSize = 6
 	if len(peersBin)%peerSize != 0 {
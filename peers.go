@@ -0,0 +1,141 @@
+package torrent
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PeerInfo describes a connected peer.
+type PeerInfo struct {
+	Addr string
+	// Client names the peer's software, from its peer ID
+	Client   string
+	Incoming bool
+	// Encrypted is set for connections encrypted with MSE
+	Encrypted bool
+	// AmChoking and AmInterested are our side of the connection's choke
+	// and interest state, PeerChoking and PeerInterested the peer's
+	AmChoking, AmInterested     bool
+	PeerChoking, PeerInterested bool
+	// Downloaded and Uploaded count bytes over this connection, and the
+	// rates are in bytes per second
+	Downloaded, Uploaded     int64
+	DownloadRate, UploadRate float64
+}
+
+// peerConn is the state of a connection to a peer that outlives no more
+// than the connection.
+type peerConn struct {
+	addr      string
+	incoming  bool
+	encrypted bool
+	down, up  meter
+	// download and upload limit this connection alone
+	download, upload *rateLimiter
+
+	mu     sync.Mutex
+	client string
+	// Every connection starts out choked and not interested both ways
+	amChoking, amInterested     bool
+	peerChoking, peerInterested bool
+}
+
+// newPeerConn returns the state of a connection to addr whose traffic also
+// counts towards cfg's stats.
+func (cfg peerConfig) newPeerConn(addr string, incoming bool) *peerConn {
+	p := &peerConn{
+		addr:        addr,
+		incoming:    incoming,
+		download:    newAdjustableRateLimiter(cfg.peerDownload),
+		upload:      newAdjustableRateLimiter(cfg.peerUpload),
+		amChoking:   true,
+		peerChoking: true,
+	}
+	p.down.parent, p.up.parent = cfg.meters()
+	return p
+}
+
+// update changes the connection's state under its lock.
+func (p *peerConn) update(fn func(p *peerConn)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(p)
+}
+
+func (p *peerConn) info() PeerInfo {
+	info := PeerInfo{Addr: p.addr, Incoming: p.incoming, Encrypted: p.encrypted}
+	info.Downloaded, info.DownloadRate = p.down.snapshot()
+	info.Uploaded, info.UploadRate = p.up.snapshot()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info.Client = p.client
+	info.AmChoking, info.AmInterested = p.amChoking, p.amInterested
+	info.PeerChoking, info.PeerInterested = p.peerChoking, p.peerInterested
+	return info
+}
+
+// Peers returns the peers the torrent is connected to, by address.
+func (t *Torrent) Peers() []PeerInfo {
+	t.stats.connMu.Lock()
+	conns := make([]*peerConn, 0, len(t.stats.conns))
+	for p := range t.stats.conns {
+		conns = append(conns, p)
+	}
+	t.stats.connMu.Unlock()
+
+	out := make([]PeerInfo, len(conns))
+	for i, p := range conns {
+		out[i] = p.info()
+	}
+	slices.SortFunc(out, func(a, b PeerInfo) int { return cmp.Compare(a.Addr, b.Addr) })
+	return out
+}
+
+// Have returns the pieces of the torrent that have been verified, or nil
+// before its metadata is known.
+func (t *Torrent) Have() Bitfield {
+	tf := t.Info()
+	if tf == nil {
+		return nil
+	}
+	have := tf.selection().haveSnapshot()
+	if len(have) != (tf.NumPieces()+7)/8 {
+		// Nothing verified yet
+		return make(Bitfield, (tf.NumPieces()+7)/8)
+	}
+	return have
+}
+
+// TrackerStatus is the outcome of the last announce to a tracker.
+type TrackerStatus struct {
+	URL          string
+	LastAnnounce time.Time
+	// Peers is how many peers the tracker returned, and Err why it failed
+	Peers int
+	Err   error
+}
+
+// Trackers returns the last announce to each of the torrent's trackers,
+// by URL. Trackers that haven't been announced to are left out.
+func (t *Torrent) Trackers() []TrackerStatus {
+	t.trackerMu.Lock()
+	defer t.trackerMu.Unlock()
+	out := make([]TrackerStatus, 0, len(t.trackers))
+	for _, ts := range t.trackers {
+		out = append(out, ts)
+	}
+	slices.SortFunc(out, func(a, b TrackerStatus) int { return cmp.Compare(a.URL, b.URL) })
+	return out
+}
+
+// recordAnnounce keeps the outcome of an announce for Trackers.
+func (t *Torrent) recordAnnounce(e Event) {
+	t.trackerMu.Lock()
+	defer t.trackerMu.Unlock()
+	if t.trackers == nil {
+		t.trackers = make(map[string]TrackerStatus)
+	}
+	t.trackers[e.Tracker] = TrackerStatus{URL: e.Tracker, LastAnnounce: e.Time, Peers: e.Peers, Err: e.Err}
+}
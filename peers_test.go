@@ -0,0 +1,70 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTorrentPeers(t *testing.T) {
+	src := t.TempDir()
+	root := filepath.Join(src, "release")
+	os.MkdirAll(root, 0755)
+	if err := os.WriteFile(filepath.Join(root, "p.bin"), bytes.Repeat([]byte("p"), 70000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	tracker := newTrackerServer(t, port)
+	mi, err := Create(root, CreateOptions{PieceLength: 16384, Announce: tracker.URL + "/announce"})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	// A slow seed keeps the peers connected long enough to look at
+	seeder, _ := NewClient(ClientConfig{DataDir: src, ListenPort: port, UploadRateLimit: 32 * 1024})
+	defer seeder.Close()
+	st, _ := seeder.AddMetaInfo(mi)
+	st.Seed()
+	waitState(t, st, StateSeeding)
+
+	leecher, _ := NewClient(ClientConfig{DataDir: t.TempDir(), ListenPort: freePort(t)})
+	defer leecher.Close()
+	lt, _ := leecher.AddMetaInfo(mi)
+	if have := lt.Have(); len(have) != 1 || have[0] != 0 {
+		t.Errorf("Have() before starting = %v, want no pieces", have)
+	}
+	lt.Start()
+
+	var out, in []PeerInfo
+	deadline := time.Now().Add(5 * time.Second)
+	for (len(out) == 0 || len(in) == 0) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		out, in = lt.Peers(), st.Peers()
+	}
+	if len(out) != 1 || len(in) != 1 {
+		t.Fatalf("Peers() = %v and %v, want one each", out, in)
+	}
+	if p := out[0]; p.Incoming || p.Client != "torrent-go 1.0.0.0" || !p.AmInterested || !p.AmChoking {
+		t.Errorf("leecher's peer = %+v", p)
+	}
+	if p := in[0]; !p.Incoming || p.AmChoking || !p.PeerInterested {
+		t.Errorf("seeder's peer = %+v", p)
+	}
+
+	if err := waitTorrent(t, lt); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	have := lt.Have()
+	for i := 0; i < lt.Status().PiecesTotal; i++ {
+		if !have.HasPiece(i) {
+			t.Errorf("Have() is missing piece %d after completing", i)
+		}
+	}
+	trackers := lt.Trackers()
+	if len(trackers) != 1 || trackers[0].URL != tracker.URL+"/announce" || trackers[0].Err != nil || trackers[0].LastAnnounce.IsZero() {
+		t.Errorf("Trackers() = %+v", trackers)
+	}
+}
@@ -0,0 +1,278 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Priority controls whether and how eagerly a file or piece is downloaded.
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority parses a priority name as returned by Priority.String.
+func ParsePriority(s string) (Priority, error) {
+	for p := PrioritySkip; p <= PriorityHigh; p++ {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid priority %q", s)
+}
+
+// fileSelection holds the per-file priorities of a torrent. It is shared by
+// every copy of a TorrentFile so priorities can be changed while a download
+// is running; the running download registers its queue and storage here.
+// It also tracks verified pieces and the windows of streaming readers.
+type fileSelection struct {
+	mu         sync.Mutex
+	priorities []Priority
+	queue      *workQueue
+	store      *storage
+	have       Bitfield
+	windows    map[*Reader]readWindow
+	// changed is closed and replaced when a piece is verified or a download
+	// starts or stops, waking blocked readers.
+	changed chan struct{}
+}
+
+// readWindow is the inclusive range of pieces a reader wants next.
+type readWindow struct {
+	first, last int
+}
+
+func newFileSelection(numFiles int) *fileSelection {
+	priorities := make([]Priority, numFiles)
+	for i := range priorities {
+		priorities[i] = PriorityNormal
+	}
+	return &fileSelection{
+		priorities: priorities,
+		windows:    make(map[*Reader]readWindow),
+		changed:    make(chan struct{}),
+	}
+}
+
+func (t *TorrentFile) selection() *fileSelection {
+	if t.sel == nil {
+		t.sel = newFileSelection(len(t.files()))
+	}
+	return t.sel
+}
+
+// SetFilePriority sets the priority of the file at index. It may be called
+// before or during Download; a running download reschedules its remaining
+// pieces immediately.
+func (t *TorrentFile) SetFilePriority(index int, p Priority) error {
+	if p < PrioritySkip || p > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", p)
+	}
+
+	sel := t.selection()
+	sel.mu.Lock()
+	if index < 0 || index >= len(sel.priorities) {
+		sel.mu.Unlock()
+		return fmt.Errorf("file index %d out of range", index)
+	}
+	prev := sel.priorities[index]
+	sel.priorities[index] = p
+	// Reschedule under the lock so concurrent changes apply in order.
+	if sel.queue != nil {
+		sel.queue.setPriorities(t.piecePriorities(sel.priorities))
+	}
+	store := sel.store
+	sel.mu.Unlock()
+
+	if store != nil && prev == PrioritySkip && p != PrioritySkip {
+		// Bytes of this file that arrived while it was skipped live in the
+		// part file; move them into place now that the file is wanted.
+		if err := store.materialize(index); err != nil {
+			return fmt.Errorf("failed to restore file %d: %v", index, err)
+		}
+	}
+	return nil
+}
+
+// FilePriority returns the priority of the file at index.
+func (t *TorrentFile) FilePriority(index int) Priority {
+	sel := t.selection()
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	if index < 0 || index >= len(sel.priorities) {
+		return PrioritySkip
+	}
+	return sel.priorities[index]
+}
+
+// filePriorities returns a snapshot of every file's priority.
+func (t *TorrentFile) filePriorities() []Priority {
+	sel := t.selection()
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	return append([]Priority(nil), sel.priorities...)
+}
+
+// PiecePriorities translates file priorities into piece priorities. A piece
+// takes the highest priority of the files it overlaps, so a piece is only
+// skipped when every file it touches is skipped.
+func (t *TorrentFile) PiecePriorities() []Priority {
+	return t.piecePriorities(t.filePriorities())
+}
+
+func (t *TorrentFile) piecePriorities(filePrios []Priority) []Priority {
+	files := t.files()
+	prios := make([]Priority, t.NumPieces())
+	if t.PieceLength <= 0 {
+		return prios
+	}
+
+	for i, f := range files {
+		// Padding never makes a piece wanted on its own
+		if f.Length == 0 || f.Padding {
+			continue
+		}
+		first := f.Offset / t.PieceLength
+		last := (f.Offset + f.Length - 1) / t.PieceLength
+		for piece := first; piece <= last && piece < len(prios); piece++ {
+			if filePrios[i] > prios[piece] {
+				prios[piece] = filePrios[i]
+			}
+		}
+	}
+	return prios
+}
+
+// attach registers a running download so priority changes and reader
+// windows reach it.
+func (sel *fileSelection) attach(queue *workQueue, store *storage, numPieces int) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	sel.queue, sel.store = queue, store
+	if len(sel.have) != (numPieces+7)/8 {
+		sel.have = make(Bitfield, (numPieces+7)/8)
+	}
+	if queue != nil {
+		// Pieces verified by an earlier run stay done, so a paused
+		// download picks up where it stopped
+		for i := 0; i < numPieces; i++ {
+			if sel.have.HasPiece(i) {
+				queue.done(i)
+			}
+		}
+		queue.setBoost(sel.boostLocked(numPieces))
+	}
+	sel.notifyLocked()
+}
+
+// queueDepth reports the depth of the running download's queue, or zeros
+// when nothing is downloading.
+func (sel *fileSelection) queueDepth() (pending, active int) {
+	sel.mu.Lock()
+	queue := sel.queue
+	sel.mu.Unlock()
+	if queue == nil {
+		return 0, 0
+	}
+	return queue.depth()
+}
+
+// detach unregisters the running download. Verified pieces are kept so
+// readers can still read them afterwards.
+func (sel *fileSelection) detach() {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	sel.queue, sel.store = nil, nil
+	sel.notifyLocked()
+}
+
+// markDone records that a piece has been verified and saved.
+func (sel *fileSelection) markDone(index int) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	sel.have.SetPiece(index)
+	sel.notifyLocked()
+}
+
+// setHave replaces the verified pieces with the result of a check of the
+// data on disk.
+func (sel *fileSelection) setHave(have Bitfield) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	sel.have = append(Bitfield(nil), have...)
+	sel.notifyLocked()
+}
+
+// haveSnapshot returns a copy of the verified pieces.
+func (sel *fileSelection) haveSnapshot() Bitfield {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	return append(Bitfield(nil), sel.have...)
+}
+
+// pieceState reports whether a piece is verified and returns a channel that
+// is closed on the next change.
+func (sel *fileSelection) pieceState(index int) (bool, <-chan struct{}) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	return sel.have.HasPiece(index), sel.changed
+}
+
+func (sel *fileSelection) setWindow(r *Reader, w readWindow, numPieces int) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	if cur, ok := sel.windows[r]; ok && cur == w {
+		return
+	}
+	sel.windows[r] = w
+	if sel.queue != nil {
+		sel.queue.setBoost(sel.boostLocked(numPieces))
+	}
+}
+
+func (sel *fileSelection) clearWindow(r *Reader, numPieces int) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	delete(sel.windows, r)
+	if sel.queue != nil {
+		sel.queue.setBoost(sel.boostLocked(numPieces))
+	}
+}
+
+// boostLocked turns reader windows into per-piece boosts. The piece under
+// each read position gets the largest boost and the boost falls off across
+// the readahead, so pieces arrive in the order they will be read.
+func (sel *fileSelection) boostLocked(numPieces int) []int {
+	boost := make([]int, numPieces)
+	for _, w := range sel.windows {
+		for piece := w.first; piece <= w.last && piece < numPieces; piece++ {
+			if b := w.last - piece + 1; b > boost[piece] {
+				boost[piece] = b
+			}
+		}
+	}
+	return boost
+}
+
+func (sel *fileSelection) notifyLocked() {
+	close(sel.changed)
+	sel.changed = make(chan struct{})
+}
@@ -0,0 +1,123 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func multiFileTorrent() *TorrentFile {
+	// Three files over four 10-byte pieces:
+	// a: [0, 15)  b: [15, 25)  c: [25, 40)
+	return &TorrentFile{
+		Name:        "multi",
+		PieceLength: 10,
+		Length:      40,
+		PieceHashes: make([][20]byte, 4),
+		Files: []File{
+			{Path: "multi/a", Length: 15, Offset: 0},
+			{Path: "multi/b", Length: 10, Offset: 15},
+			{Path: "multi/c", Length: 15, Offset: 25},
+		},
+	}
+}
+
+func TestPiecePriorities(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []Priority
+		want  []Priority
+	}{
+		{
+			name:  "all normal",
+			files: []Priority{PriorityNormal, PriorityNormal, PriorityNormal},
+			want:  []Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal},
+		},
+		{
+			name:  "skip middle file keeps boundary pieces",
+			files: []Priority{PriorityNormal, PrioritySkip, PriorityNormal},
+			want:  []Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal},
+		},
+		{
+			name:  "skip last file",
+			files: []Priority{PriorityNormal, PriorityNormal, PrioritySkip},
+			want:  []Priority{PriorityNormal, PriorityNormal, PriorityNormal, PrioritySkip},
+		},
+		{
+			name:  "boundary piece takes highest priority",
+			files: []Priority{PriorityLow, PriorityHigh, PrioritySkip},
+			want:  []Priority{PriorityLow, PriorityHigh, PriorityHigh, PrioritySkip},
+		},
+		{
+			name:  "skip everything",
+			files: []Priority{PrioritySkip, PrioritySkip, PrioritySkip},
+			want:  []Priority{PrioritySkip, PrioritySkip, PrioritySkip, PrioritySkip},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := multiFileTorrent()
+			for i, p := range tt.files {
+				if err := tf.SetFilePriority(i, p); err != nil {
+					t.Fatalf("SetFilePriority() error = %v", err)
+				}
+			}
+			if got := tf.PiecePriorities(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PiecePriorities() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPiecePriorities_Padding(t *testing.T) {
+	// a [0, 15), padding [15, 20), b [20, 30)
+	tf := &TorrentFile{
+		PieceLength: 10,
+		Length:      30,
+		PieceHashes: make([][20]byte, 3),
+		Files: []File{
+			{Path: "a", Length: 15},
+			{Path: ".pad/5", Length: 5, Offset: 15, Padding: true},
+			{Path: "b", Length: 10, Offset: 20},
+		},
+	}
+	tf.SetFilePriority(0, PrioritySkip)
+
+	want := []Priority{PrioritySkip, PrioritySkip, PriorityNormal}
+	if got := tf.PiecePriorities(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PiecePriorities() = %v, want %v", got, want)
+	}
+}
+
+func TestSetFilePriority_Invalid(t *testing.T) {
+	tf := multiFileTorrent()
+
+	if err := tf.SetFilePriority(3, PriorityHigh); err == nil {
+		t.Errorf("SetFilePriority() should return error for out of range index")
+	}
+	if err := tf.SetFilePriority(0, Priority(42)); err == nil {
+		t.Errorf("SetFilePriority() should return error for invalid priority")
+	}
+	if got := tf.FilePriority(0); got != PriorityNormal {
+		t.Errorf("FilePriority() = %v, want %v", got, PriorityNormal)
+	}
+}
+
+func TestSetFilePriority_ReschedulesQueue(t *testing.T) {
+	tf := multiFileTorrent()
+	pieces := make([]*pieceWork, 4)
+	for i := range pieces {
+		pieces[i] = &pieceWork{index: i, length: 10}
+	}
+	queue := newWorkQueue(pieces, tf.PiecePriorities())
+	tf.selection().attach(queue, nil, len(pieces))
+
+	if err := tf.SetFilePriority(2, PrioritySkip); err != nil {
+		t.Fatalf("SetFilePriority() error = %v", err)
+	}
+
+	done, wanted, _ := queue.progress()
+	if done != 0 || wanted != 3 {
+		t.Errorf("progress() = %d/%d, want 0/3", done, wanted)
+	}
+}
@@ -0,0 +1,190 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting a byte rate. Callers take the
+// bytes they move up front and sleep off any debt, so a single large read
+// or write is spread over the following interval. A nil rateLimiter
+// doesn't limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for bytesPerSec, or nil when the rate is
+// zero or negative, meaning unlimited.
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	// Allow a second's worth of bytes, but never less than one block, so
+	// short bursts aren't chopped up
+	burst := float64(max(bytesPerSec, MaxBlockSize))
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// setRate changes the limit to bytesPerSec; zero or negative lifts it.
+// Bytes already owed are forgiven.
+func (l *rateLimiter) setRate(bytesPerSec int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(max(bytesPerSec, 0))
+	l.burst = float64(max(bytesPerSec, MaxBlockSize))
+	l.tokens = l.burst
+	l.last = time.Now()
+}
+
+// limit returns the current rate in bytes per second, zero if unlimited.
+func (l *rateLimiter) limit() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+// newAdjustableRateLimiter returns a limiter for bytesPerSec that, unlike
+// one from newRateLimiter, exists even while unlimited so its rate can be
+// set later.
+func newAdjustableRateLimiter(bytesPerSec int) *rateLimiter {
+	l := new(rateLimiter)
+	l.setRate(bytesPerSec)
+	return l
+}
+
+// wait takes n bytes from the bucket, blocking until they are paid for or
+// ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	return sleep(ctx, l.reserve(n))
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller
+// must wait before moving them.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimits are limiters that all apply to the same bytes, such as the
+// client's, a torrent's and a peer's. Nil entries don't limit.
+type rateLimits []*rateLimiter
+
+// with returns the limits with l added, leaving the receiver untouched.
+func (ls rateLimits) with(l *rateLimiter) rateLimits {
+	if l == nil {
+		return ls
+	}
+	return append(ls[:len(ls):len(ls)], l)
+}
+
+// wait takes n bytes from every limiter and blocks until the slowest has
+// been paid, or ctx is done.
+func (ls rateLimits) wait(ctx context.Context, n int) error {
+	var delay time.Duration
+	for _, l := range ls {
+		delay = max(delay, l.reserve(n))
+	}
+	return sleep(ctx, delay)
+}
+
+// limitedConn applies rate limits to a connection and counts its traffic:
+// reads are charged to read and counted by in, writes to write and out.
+type limitedConn struct {
+	net.Conn
+	ctx         context.Context
+	read, write rateLimits
+	in, out     *meter
+}
+
+// limitConn wraps conn in a limitedConn applying cfg's rate limits and
+// p's own, and counting into p's meters.
+func limitConn(ctx context.Context, conn net.Conn, cfg peerConfig, p *peerConn) net.Conn {
+	return &limitedConn{
+		Conn:  conn,
+		ctx:   ctx,
+		read:  cfg.download.with(p.download),
+		write: cfg.upload.with(p.upload),
+		in:    &p.down,
+		out:   &p.up,
+	}
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.add(n)
+	if werr := c.read.wait(c.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	if err := c.write.wait(c.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(p)
+	c.out.add(n)
+	return n, err
+}
+
+// limitedReader charges everything read from r to limits and counts it.
+type limitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	limit rateLimits
+	count *meter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.count.add(n)
+	if werr := lr.limit.wait(lr.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package torrent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if l := newRateLimiter(0); l != nil {
+		t.Fatalf("newRateLimiter(0) = %v, want nil", l)
+	}
+	var unlimited *rateLimiter
+	if err := unlimited.wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("nil limiter wait() error = %v", err)
+	}
+
+	l := newRateLimiter(64 * 1024)
+	start := time.Now()
+	// The burst passes straight away, the next half second's worth waits
+	l.wait(context.Background(), 64*1024)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("burst took %v", elapsed)
+	}
+	l.wait(context.Background(), 32*1024)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("rate limited wait() took %v, want about 500ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, 1<<20); err == nil {
+		t.Errorf("wait() should fail once ctx is done")
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	l := newAdjustableRateLimiter(0)
+	start := time.Now()
+	if err := l.wait(context.Background(), 1<<30); err != nil || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("unlimited wait() = %v after %v", err, time.Since(start))
+	}
+
+	l.setRate(64 * 1024)
+	if got := l.limit(); got != 64*1024 {
+		t.Errorf("limit() = %d, want %d", got, 64*1024)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, 1<<20); err == nil {
+		t.Errorf("wait() for 16s worth of bytes should outlast its context")
+	}
+
+	l.setRate(0)
+	if err := l.wait(context.Background(), 1<<30); err != nil || l.limit() != 0 {
+		t.Errorf("lifted limiter wait() = %v, limit() = %d", err, l.limit())
+	}
+}
+
+func TestRateLimitsWaitForSlowest(t *testing.T) {
+	limits := rateLimits{newRateLimiter(1 << 30)}.with(nil).with(newRateLimiter(64 * 1024))
+	if len(limits) != 2 {
+		t.Fatalf("with(nil) should be a no-op, got %d limiters", len(limits))
+	}
+
+	// Drain the slow bucket's burst, then half a second more at its rate
+	limits.wait(context.Background(), 64*1024)
+	start := time.Now()
+	limits.wait(context.Background(), 32*1024)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("wait() took %v, want about 500ms from the slower limiter", elapsed)
+	}
+}
+
+func TestRateLimitsWithDoesNotAlias(t *testing.T) {
+	base := make(rateLimits, 1, 4)
+	base[0] = newRateLimiter(1)
+	a := base.with(newRateLimiter(2))
+	b := base.with(newRateLimiter(3))
+	if a[1] == b[1] {
+		t.Errorf("with() on a shared base overwrote an earlier result")
+	}
+}
+
+func TestClientPeerAndTorrentRateLimits(t *testing.T) {
+	c, err := NewClient(ClientConfig{DownloadRateLimit: 1000, PeerUploadRateLimit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tor := newTorrent(c, [20]byte{1}, "test")
+	c.add(tor)
+	tor.SetRateLimits(500, 0)
+
+	cfg := tor.peerConfig()
+	p := cfg.newPeerConn("10.0.0.1:6881", false)
+	defer cfg.trackPeer(p)()
+	if len(cfg.download) != 2 || cfg.download[0] != c.download || cfg.download[1] != tor.downLimit {
+		t.Errorf("download limits = %v, want the client's then the torrent's", cfg.download)
+	}
+	if got := p.upload.limit(); got != 10 {
+		t.Errorf("new peer upload limit = %d, want 10", got)
+	}
+
+	c.SetPeerRateLimits(20, 30)
+	if down, up := p.download.limit(), p.upload.limit(); down != 20 || up != 30 {
+		t.Errorf("connected peer limits = %d, %d; want 20, 30", down, up)
+	}
+	if down, up := c.PeerRateLimits(); down != 20 || up != 30 {
+		t.Errorf("PeerRateLimits() = %d, %d; want 20, 30", down, up)
+	}
+	if down, up := tor.RateLimits(); down != 500 || up != 0 {
+		t.Errorf("torrent RateLimits() = %d, %d; want 500, 0", down, up)
+	}
+}
@@ -0,0 +1,110 @@
+package torrent
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rateScheduleInterval is how often the client checks which RateSchedule
+// rule is in effect
+const rateScheduleInterval = time.Minute
+
+// TimeOfDay is a local wall clock time in minutes after midnight.
+type TimeOfDay int
+
+// ParseTimeOfDay parses a 24-hour "HH:MM" time, such as "08:30".
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return TimeOfDay(h*60 + m), nil
+}
+
+func (t TimeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d", int(t)/60, int(t)%60)
+}
+
+// RateRule sets the client's rate limits for part of the day.
+type RateRule struct {
+	// From and To bound the rule; it applies from From up to but not
+	// including To, and runs past midnight when To is before From
+	From, To TimeOfDay
+	// Weekdays are the days the rule starts on; empty means every day
+	Weekdays []time.Weekday
+	// DownloadRateLimit and UploadRateLimit replace the client's limits
+	// while the rule applies, in bytes per second; zero means unlimited
+	DownloadRateLimit int
+	UploadRateLimit   int
+}
+
+// Matches reports whether the rule applies at t, in t's location.
+func (r RateRule) Matches(t time.Time) bool {
+	now := TimeOfDay(t.Hour()*60 + t.Minute())
+	day := t.Weekday()
+	switch {
+	case r.From <= r.To:
+		if now < r.From || now >= r.To {
+			return false
+		}
+	case now >= r.From:
+	case now < r.To:
+		// The early hours of a span that began the day before
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+	return len(r.Weekdays) == 0 || slices.Contains(r.Weekdays, day)
+}
+
+// rateState is the client's configured rate limits and the index of the
+// RateSchedule rule overriding them, or -1.
+type rateState struct {
+	mu               sync.Mutex
+	download, upload int
+	rule             int
+}
+
+// applyRateSchedule sets the client's limiters from the rule in effect at
+// now, or from the configured limits if there is none. The limiters are
+// only touched when that changes, so bytes owed aren't forgiven every
+// check.
+func (c *Client) applyRateSchedule(now time.Time) {
+	rule := slices.IndexFunc(c.cfg.RateSchedule, func(r RateRule) bool { return r.Matches(now) })
+
+	c.rates.mu.Lock()
+	defer c.rates.mu.Unlock()
+	if rule == c.rates.rule {
+		return
+	}
+	c.rates.rule = rule
+	down, up := c.rates.download, c.rates.upload
+	if rule >= 0 {
+		r := c.cfg.RateSchedule[rule]
+		down, up = r.DownloadRateLimit, r.UploadRateLimit
+		c.log.Info("rate schedule rule in effect", "from", r.From, "to", r.To, "download", down, "upload", up)
+	} else {
+		c.log.Info("rate schedule rules lifted", "download", down, "upload", up)
+	}
+	c.download.setRate(down)
+	c.upload.setRate(up)
+}
+
+// runRateSchedule applies the rate schedule until the client is closed.
+func (c *Client) runRateSchedule() {
+	ticker := time.NewTicker(rateScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.applyRateSchedule(now)
+		case <-c.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package torrent
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestParseTimeOfDay(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TimeOfDay
+		wantErr bool
+	}{
+		{"00:00", 0, false},
+		{"08:30", 8*60 + 30, false},
+		{"23:59", 23*60 + 59, false},
+		{"24:00", 24 * 60, false},
+		{"24:01", 0, true},
+		{"12:60", 0, true},
+		{"noon", 0, true},
+		{"-1:00", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimeOfDay(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseTimeOfDay(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if s := TimeOfDay(8*60 + 5).String(); s != "08:05" {
+		t.Errorf("String() = %q, want 08:05", s)
+	}
+}
+
+func TestRateRuleMatches(t *testing.T) {
+	// 2026-10-19 is a Monday
+	at := func(day, h, m int) time.Time {
+		return time.Date(2026, 10, 19+day, h, m, 0, 0, time.UTC)
+	}
+	workHours := RateRule{From: 9 * 60, To: 17 * 60, Weekdays: []time.Weekday{time.Monday, time.Tuesday}}
+	overnight := RateRule{From: 22 * 60, To: 6 * 60, Weekdays: []time.Weekday{time.Friday}}
+	everyNight := RateRule{From: 22 * 60, To: 6 * 60}
+
+	tests := []struct {
+		name string
+		rule RateRule
+		at   time.Time
+		want bool
+	}{
+		{"work hours start", workHours, at(0, 9, 0), true},
+		{"work hours end is exclusive", workHours, at(0, 17, 0), false},
+		{"before work hours", workHours, at(1, 8, 59), false},
+		{"work hours on a listed day", workHours, at(1, 12, 0), true},
+		{"work hours on another day", workHours, at(2, 12, 0), false},
+		{"overnight evening", overnight, at(4, 23, 0), true},
+		{"overnight early hours count as the start day", overnight, at(5, 3, 0), true},
+		{"overnight early hours of the start day", overnight, at(4, 3, 0), false},
+		{"overnight daytime", overnight, at(4, 12, 0), false},
+		{"every night", everyNight, at(2, 5, 59), true},
+		{"every night ends", everyNight, at(2, 6, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Matches(tt.at); got != tt.want {
+			t.Errorf("%s: Matches(%v) = %v, want %v", tt.name, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestClientRateSchedule(t *testing.T) {
+	c := &Client{
+		cfg: ClientConfig{RateSchedule: []RateRule{
+			{From: 9 * 60, To: 17 * 60, DownloadRateLimit: 100, UploadRateLimit: 50},
+		}},
+		download: newAdjustableRateLimiter(1000),
+		upload:   newAdjustableRateLimiter(500),
+		rates:    rateState{download: 1000, upload: 500, rule: -1},
+		log:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	noon := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	evening := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+
+	c.applyRateSchedule(noon)
+	if down, up := c.RateLimits(); down != 100 || up != 50 {
+		t.Errorf("during rule RateLimits() = %d, %d; want 100, 50", down, up)
+	}
+	// Changes while a rule is in effect wait until it lifts
+	c.SetRateLimits(2000, 0)
+	if down, up := c.RateLimits(); down != 100 || up != 50 {
+		t.Errorf("after SetRateLimits during rule RateLimits() = %d, %d; want 100, 50", down, up)
+	}
+	c.applyRateSchedule(evening)
+	if down, up := c.RateLimits(); down != 2000 || up != 0 {
+		t.Errorf("after rule RateLimits() = %d, %d; want 2000, 0", down, up)
+	}
+}
@@ -0,0 +1,169 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultReadahead is how far past the read position a Reader asks for
+// pieces to be fetched early.
+const DefaultReadahead = 4 * 1024 * 1024 // 4MB
+
+var ErrReaderClosed = errors.New("reader closed")
+
+// Reader reads torrent data while it is being downloaded. Reads block until
+// the pieces they cover have been verified, and the pieces from the read
+// position through the readahead are scheduled ahead of everything else.
+// A Reader is an io.ReadSeeker over either the whole torrent or one file.
+type Reader struct {
+	t     *TorrentFile
+	sel   *fileSelection
+	store *storage
+	// offset and length are the torrent-wide range the reader covers
+	offset int64
+	length int64
+
+	mu        sync.Mutex
+	pos       int64
+	readahead int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewReader returns a Reader over the whole torrent.
+func (t *TorrentFile) NewReader() *Reader {
+	return t.newReader(0, int64(t.Length))
+}
+
+// NewFileReader returns a Reader over the file at index.
+func (t *TorrentFile) NewFileReader(index int) (*Reader, error) {
+	files := t.files()
+	if index < 0 || index >= len(files) {
+		return nil, fmt.Errorf("file index %d out of range", index)
+	}
+	return t.newReader(int64(files[index].Offset), int64(files[index].Length)), nil
+}
+
+func (t *TorrentFile) newReader(offset, length int64) *Reader {
+	return &Reader{
+		t:         t,
+		sel:       t.selection(),
+		store:     newStorage(t),
+		offset:    offset,
+		length:    length,
+		readahead: DefaultReadahead,
+		closed:    make(chan struct{}),
+	}
+}
+
+// SetReadahead changes how many bytes past the read position are
+// prioritised.
+func (r *Reader) SetReadahead(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readahead = max(n, 0)
+	r.updateWindow()
+}
+
+// Read reads from the current position, blocking until the bytes are
+// available.
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.closed:
+		return 0, ErrReaderClosed
+	default:
+	}
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	r.updateWindow()
+	off := r.offset + r.pos
+	piece := int(off / int64(r.t.PieceLength))
+	if err := r.waitPiece(piece); err != nil {
+		return 0, err
+	}
+
+	// Never read past the verified piece or the end of the reader
+	pieceEnd := int64(piece+1) * int64(r.t.PieceLength)
+	n := min(int64(len(p)), pieceEnd-off, r.length-r.pos)
+	read, err := r.store.ReadAt(p[:n], off)
+	r.pos += int64(read)
+	return read, err
+}
+
+// Seek sets the position for the next Read and moves the priority window
+// to it.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.length + offset
+	default:
+		return r.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return r.pos, fmt.Errorf("negative position %d", pos)
+	}
+
+	r.pos = pos
+	r.updateWindow()
+	return pos, nil
+}
+
+// Close stops the reader and unblocks any pending Read.
+func (r *Reader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.sel.clearWindow(r, r.t.NumPieces())
+		err = r.store.Close()
+	})
+	return err
+}
+
+// updateWindow prioritises the pieces from the read position through the
+// readahead. The caller must hold r.mu.
+func (r *Reader) updateWindow() {
+	if r.t.PieceLength <= 0 || r.pos >= r.length {
+		r.sel.clearWindow(r, r.t.NumPieces())
+		return
+	}
+	start := r.offset + r.pos
+	end := min(start+max(r.readahead, 1), r.offset+r.length)
+	r.sel.setWindow(r, readWindow{
+		first: int(start / int64(r.t.PieceLength)),
+		last:  int((end - 1) / int64(r.t.PieceLength)),
+	}, r.t.NumPieces())
+}
+
+// waitPiece blocks until a piece is verified or the reader is closed.
+func (r *Reader) waitPiece(index int) error {
+	for {
+		have, changed := r.sel.pieceState(index)
+		if have {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-r.closed:
+			return ErrReaderClosed
+		}
+	}
+}
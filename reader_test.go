@@ -0,0 +1,144 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeDownload serves pieces from data in the order the queue hands them
+// out and records that order.
+func fakeDownload(tf *TorrentFile, data []byte, queue *workQueue, store *storage, order chan<- int) {
+	sel := tf.selection()
+	for {
+		pw, ok := queue.pop(hasAll)
+		if !ok {
+			return
+		}
+		off := pw.index * tf.PieceLength
+		store.WriteAt(data[off:off+pw.length], int64(off))
+		queue.done(pw.index)
+		sel.markDone(pw.index)
+		order <- pw.index
+	}
+}
+
+func newReaderTestTorrent(t *testing.T) (*TorrentFile, []byte, *workQueue, *storage) {
+	dir := t.TempDir()
+	tf := multiFileTorrent()
+	tf.Name = filepath.Join(dir, "multi")
+	for i := range tf.Files {
+		tf.Files[i].Path = filepath.Join(dir, tf.Files[i].Path)
+	}
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD")
+
+	pieces := make([]*pieceWork, len(tf.PieceHashes))
+	for i := range pieces {
+		pieces[i] = &pieceWork{index: i, length: tf.PieceLength}
+	}
+	// Nothing is wanted until a reader asks for it
+	queue := newWorkQueue(pieces, make([]Priority, len(pieces)))
+	store := newStorage(tf)
+	tf.selection().attach(queue, store, len(pieces))
+	t.Cleanup(func() {
+		queue.close()
+		store.Close()
+	})
+	return tf, data, queue, store
+}
+
+func TestReaderReadsWholeTorrent(t *testing.T) {
+	tf, data, queue, store := newReaderTestTorrent(t)
+	order := make(chan int, len(tf.PieceHashes))
+	go fakeDownload(tf, data, queue, store, order)
+
+	r := tf.NewReader()
+	defer r.Close()
+	r.SetReadahead(int64(tf.PieceLength))
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("ReadAll() = %q, want %q", got, data)
+	}
+}
+
+func TestReaderFileAndSeek(t *testing.T) {
+	tf, data, queue, store := newReaderTestTorrent(t)
+	order := make(chan int, len(tf.PieceHashes))
+	go fakeDownload(tf, data, queue, store, order)
+
+	// File c covers [25, 40), i.e. pieces 2 and 3
+	r, err := tf.NewFileReader(2)
+	if err != nil {
+		t.Fatalf("NewFileReader() error = %v", err)
+	}
+	defer r.Close()
+	r.SetReadahead(1)
+
+	pos, err := r.Seek(10, io.SeekStart)
+	if err != nil || pos != 10 {
+		t.Fatalf("Seek() = %d, %v, want 10", pos, err)
+	}
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if want := data[35:40]; !bytes.Equal(got, want) {
+		t.Errorf("ReadAll() = %q, want %q", got, want)
+	}
+
+	// Seeking to offset 35 should only have fetched piece 3
+	if first := <-order; first != 3 {
+		t.Errorf("first downloaded piece = %d, want 3", first)
+	}
+
+	if _, err := r.Seek(-20, io.SeekEnd); err == nil {
+		t.Errorf("Seek() before start should return error")
+	}
+}
+
+func TestReaderCloseUnblocksRead(t *testing.T) {
+	tf, _, _, _ := newReaderTestTorrent(t)
+	r := tf.NewReader()
+
+	result := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 4))
+		result <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	select {
+	case err := <-result:
+		if err != ErrReaderClosed {
+			t.Errorf("Read() error = %v, want %v", err, ErrReaderClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Read() did not return after Close")
+	}
+}
+
+func TestReaderBoostsReadPosition(t *testing.T) {
+	tf, _, queue, _ := newReaderTestTorrent(t)
+	r := tf.NewReader()
+	defer r.Close()
+
+	r.SetReadahead(25) // pieces 0 through 2
+	pw, _ := queue.pop(hasAll)
+	if pw.index != 0 {
+		t.Errorf("pop() index = %d, want 0", pw.index)
+	}
+
+	r.Seek(30, io.SeekStart)
+	pw, _ = queue.pop(hasAll)
+	if pw.index != 3 {
+		t.Errorf("pop() after Seek index = %d, want 3", pw.index)
+	}
+}
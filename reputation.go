@@ -0,0 +1,182 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+)
+
+// maxHashStrikes is how many failed pieces a peer may send before it's
+// banned without proof from a good copy
+const maxHashStrikes = 3
+
+// errBanned is returned for peers whose IP is banned.
+var errBanned = errors.New("peer is banned")
+
+// banList holds the IPs banned for the rest of the client's session. A
+// nil banList bans no one.
+type banList struct {
+	mu     sync.Mutex
+	banned map[string]error
+}
+
+// ban bans ip for why, reporting whether it wasn't banned already.
+func (b *banList) ban(ip string, why error) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.banned == nil {
+		b.banned = make(map[string]error)
+	}
+	if _, ok := b.banned[ip]; ok {
+		return false
+	}
+	b.banned[ip] = why
+	return true
+}
+
+// isBanned reports whether the host of addr, an IP or host:port, is
+// banned.
+func (b *banList) isBanned(addr string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.banned[peerIP(addr)]
+	return ok
+}
+
+// list returns the banned IPs in order.
+func (b *banList) list() []string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]string, 0, len(b.banned))
+	for ip := range b.banned {
+		out = append(out, ip)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// peerIP returns the host of a host:port address, or addr itself if it has
+// no port.
+func peerIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// smartBan works out which peer poisoned a piece. When a piece fails its
+// hash check, a digest of every block is kept along with the IP that sent
+// it. Once the piece passes from another download, each kept block is
+// checked against the good copy and the IPs that sent a block that
+// differs are banned, sparing those whose blocks were all good. Peers
+// that keep failing pieces no one else completes are banned after
+// maxHashStrikes.
+type smartBan struct {
+	bans *banList
+	cfg  peerConfig
+
+	mu sync.Mutex
+	// suspects holds the blocks of each failed piece, by piece
+	suspects map[int][]sentBlock
+	// strikes counts the failed pieces each IP sent and isn't cleared of
+	strikes map[string]int
+}
+
+// sentBlock is a block of a failed piece and the IP that sent it. Blocks
+// of the same failed copy share an attempt number.
+type sentBlock struct {
+	ip      string
+	attempt int
+	begin   int
+	digest  [sha1.Size]byte
+}
+
+func newSmartBan(cfg peerConfig) *smartBan {
+	return &smartBan{
+		bans:     cfg.bans,
+		cfg:      cfg,
+		suspects: make(map[int][]sentBlock),
+		strikes:  make(map[string]int),
+	}
+}
+
+// failed records that the piece at index, with blocks from addr, failed
+// its hash check.
+func (s *smartBan) failed(index int, buf []byte, addr string) {
+	ip := peerIP(addr)
+	s.mu.Lock()
+	attempt := 0
+	if blocks := s.suspects[index]; len(blocks) > 0 {
+		attempt = blocks[len(blocks)-1].attempt + 1
+	}
+	for begin := 0; begin < len(buf); begin += MaxBlockSize {
+		block := buf[begin:min(begin+MaxBlockSize, len(buf))]
+		s.suspects[index] = append(s.suspects[index], sentBlock{ip: ip, attempt: attempt, begin: begin, digest: sha1.Sum(block)})
+	}
+	s.strikes[ip]++
+	strikes := s.strikes[ip]
+	s.mu.Unlock()
+
+	if strikes >= maxHashStrikes {
+		s.banIP(ip, index, fmt.Errorf("sent %d pieces that failed their hash check", strikes))
+	}
+}
+
+// verified checks the blocks kept for the piece at index against buf, its
+// good copy, banning the IPs that sent bad ones.
+func (s *smartBan) verified(index int, buf []byte) {
+	s.mu.Lock()
+	blocks := s.suspects[index]
+	delete(s.suspects, index)
+	guilty := make(map[string]bool)
+	// Each failed copy was a strike against each of its senders
+	type sender struct {
+		attempt int
+		ip      string
+	}
+	senders := make(map[sender]bool)
+	for _, b := range blocks {
+		senders[sender{b.attempt, b.ip}] = true
+		end := min(b.begin+MaxBlockSize, len(buf))
+		if b.begin < end && sha1.Sum(buf[b.begin:end]) != b.digest {
+			guilty[b.ip] = true
+		}
+	}
+	// Failures that weren't their fault don't count against them
+	for sn := range senders {
+		if !guilty[sn.ip] && s.strikes[sn.ip] > 0 {
+			s.strikes[sn.ip]--
+		}
+	}
+	s.mu.Unlock()
+
+	for ip := range guilty {
+		s.banIP(ip, index, fmt.Errorf("sent corrupt data for piece %d", index))
+	}
+}
+
+// banIP bans ip, logging and reporting it the first time.
+func (s *smartBan) banIP(ip string, index int, why error) {
+	if s.bans.ban(ip, why) {
+		s.cfg.logger().Warn("peer banned", "ip", ip, "piece", index, "reason", why)
+		s.cfg.emit(Event{Type: EventPeerBanned, Piece: index, Peer: ip, Err: why})
+	}
+}
+
+// BannedPeers returns the IPs banned this session for sending corrupt
+// data.
+func (c *Client) BannedPeers() []string {
+	return c.bans.list()
+}
@@ -0,0 +1,97 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+func TestBanList(t *testing.T) {
+	var none *banList
+	if none.ban("10.0.0.1", errors.New("x")) || none.isBanned("10.0.0.1:6881") || none.list() != nil {
+		t.Errorf("a nil banList should ban no one")
+	}
+
+	b := new(banList)
+	if !b.ban("10.0.0.2", errors.New("corrupt")) {
+		t.Errorf("first ban() = false, want true")
+	}
+	if b.ban("10.0.0.2", errors.New("again")) {
+		t.Errorf("second ban() = true, want false")
+	}
+	b.ban("::1", errors.New("corrupt"))
+	for _, addr := range []string{"10.0.0.2", "10.0.0.2:6881", "[::1]:51413"} {
+		if !b.isBanned(addr) {
+			t.Errorf("isBanned(%q) = false, want true", addr)
+		}
+	}
+	if b.isBanned("10.0.0.3:6881") {
+		t.Errorf("isBanned() = true for an IP that wasn't banned")
+	}
+	if got := b.list(); !slices.Equal(got, []string{"10.0.0.2", "::1"}) {
+		t.Errorf("list() = %v", got)
+	}
+}
+
+func newTestSmartBan() (*smartBan, *[]Event) {
+	var events []Event
+	cfg := peerConfig{
+		bans:    new(banList),
+		onEvent: func(e Event) { events = append(events, e) },
+		log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	return newSmartBan(cfg), &events
+}
+
+func TestSmartBanFindsPoisoner(t *testing.T) {
+	s, events := newTestSmartBan()
+	good := bytes.Repeat([]byte{1}, 3*MaxBlockSize)
+	bad := bytes.Clone(good)
+	bad[MaxBlockSize+10] = 2
+
+	s.failed(4, bad, "10.0.0.1:6881")
+	if s.bans.isBanned("10.0.0.1") {
+		t.Fatalf("banned on a single failure before any proof")
+	}
+	s.verified(4, good)
+	if !s.bans.isBanned("10.0.0.1:51413") {
+		t.Errorf("the peer that sent the bad block wasn't banned")
+	}
+	if len(*events) != 1 || (*events)[0].Type != EventPeerBanned || (*events)[0].Peer != "10.0.0.1" || (*events)[0].Piece != 4 {
+		t.Errorf("events = %+v, want one ban of 10.0.0.1 for piece 4", *events)
+	}
+	if len(s.suspects) != 0 {
+		t.Errorf("suspects kept after the piece verified: %v", s.suspects)
+	}
+}
+
+func TestSmartBanSparesInnocent(t *testing.T) {
+	s, _ := newTestSmartBan()
+	good := bytes.Repeat([]byte{1}, 2*MaxBlockSize)
+	// A copy that failed, say from a short read, but whose blocks match
+	s.failed(1, good, "10.0.0.2:6881")
+	s.verified(1, good)
+	if s.bans.isBanned("10.0.0.2") {
+		t.Errorf("banned a peer whose blocks were all good")
+	}
+	if s.strikes["10.0.0.2"] != 0 {
+		t.Errorf("strikes = %d, want the failure cleared", s.strikes["10.0.0.2"])
+	}
+}
+
+func TestSmartBanStrikes(t *testing.T) {
+	s, _ := newTestSmartBan()
+	bad := []byte("not the piece")
+	for i := range maxHashStrikes {
+		if s.bans.isBanned("10.0.0.3") {
+			t.Fatalf("banned after %d failures, want %d", i, maxHashStrikes)
+		}
+		s.failed(i, bad, "10.0.0.3:6881")
+	}
+	if !s.bans.isBanned("10.0.0.3") {
+		t.Errorf("not banned after %d failures", maxHashStrikes)
+	}
+}
@@ -0,0 +1,235 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// seedAnnounceInterval is how often a seed re-announces itself
+	seedAnnounceInterval = 30 * time.Minute
+	// peerIdleTimeout drops peers that send nothing for this long, and
+	// keepAliveInterval is how often we send something while idle
+	peerIdleTimeout   = 3 * time.Minute
+	keepAliveInterval = 2 * time.Minute
+	// maxRequestLength is the largest block a peer may request at once
+	maxRequestLength = 128 * 1024 // 128KB
+)
+
+// seed serves the torrent's verified pieces to the peers arriving on
+// inbound until ctx is cancelled, announcing itself to the torrent's
+// trackers as it goes.
+func (t *TorrentFile) seed(ctx context.Context, cfg peerConfig, inbound <-chan inboundConn) error {
+	have := t.selection().haveSnapshot()
+	if len(have) != (t.NumPieces()+7)/8 {
+		// Nothing has been verified yet
+		have = make(Bitfield, (t.NumPieces()+7)/8)
+	}
+
+	store := newStorage(t)
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	if t.Announce != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.announceSeed(ctx, cfg, t.leftBytes(have))
+		}()
+	}
+
+	var super *superSeeder
+	if cfg.superSeed {
+		super = newSuperSeeder(have, t.NumPieces())
+	}
+	choker := newChoker(cfg.uploadSlots, true)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		choker.run(ctx)
+	}()
+
+	// slots caps how many peers this torrent serves at once
+	var slots chan struct{}
+	if cfg.maxPeers > 0 {
+		slots = make(chan struct{}, cfg.maxPeers)
+	}
+	for {
+		var in inboundConn
+		select {
+		case in = <-inbound:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if !cfg.conns.tryAcquire() {
+			cfg.logger().Debug("inbound peer refused", "peer", in.conn.RemoteAddr().String(), "reason", "connection limit")
+			in.conn.Close()
+			continue
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				cfg.logger().Debug("inbound peer refused", "peer", in.conn.RemoteAddr().String(), "reason", "peer limit")
+				cfg.conns.release()
+				in.conn.Close()
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cfg.conns.release()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			t.servePeer(ctx, in.conn, in.hs, cfg, have, store, choker, super)
+		}()
+	}
+}
+
+// announceSeed announces to every swarm until ctx is cancelled, then
+// announces that it stopped. The peers the trackers return are ignored; a
+// seed waits to be connected to.
+func (t *TorrentFile) announceSeed(ctx context.Context, cfg peerConfig, left int) {
+	defer t.announceStopped(ctx, cfg, left)
+	ticker := time.NewTicker(seedAnnounceInterval)
+	defer ticker.Stop()
+	event := eventStarted
+	for {
+		t.requestSwarmPeers(ctx, cfg, left, event)
+		event = ""
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// leftBytes returns how many bytes of the torrent are missing from have.
+func (t *TorrentFile) leftBytes(have Bitfield) int {
+	left := 0
+	for _, pw := range t.pieceWorks() {
+		if !have.HasPiece(pw.index) {
+			left += pw.length
+		}
+	}
+	return left
+}
+
+// servePeer answers the requests of a peer that sent us hs for the pieces
+// in have, while choker has it unchoked. With a super-seeder, the peer
+// only learns of and may request the pieces it reveals.
+func (t *TorrentFile) servePeer(ctx context.Context, raw net.Conn, hs *Handshake, cfg peerConfig, have Bitfield, store io.ReaderAt, choker *choker, super *superSeeder) {
+	defer raw.Close()
+	stop := context.AfterFunc(ctx, func() { raw.Close() })
+	defer stop()
+	pc := cfg.newPeerConn(raw.RemoteAddr().String(), true)
+	pc.encrypted = isEncrypted(raw)
+	pc.client = peerClient(hs.PeerID)
+	conn := limitConn(ctx, raw, cfg, pc)
+
+	// 1. Answer the handshake in the swarm the peer asked for
+	conn.SetDeadline(time.Now().Add(peerIdleTimeout))
+	reply := NewHandshake(hs.InfoHash, cfg.peerID)
+	if t.IsV2() {
+		reply.Reserved[reservedV2Byte] |= reservedV2Bit
+	}
+	log := cfg.logger().With("peer", pc.addr, "client", pc.client)
+	if _, err := conn.Write(reply.Serialize()); err != nil {
+		log.Debug("handshake failed", "err", err)
+		return
+	}
+	log.Debug("peer connected")
+	defer cfg.trackPeer(pc)()
+	conn = traceConn(conn, log)
+
+	// 2. Tell the peer what we have, and leave unchoking it to the choker,
+	// whose writes share the connection with ours
+	out := &syncWriter{w: conn}
+	send := func(msg *Message) error {
+		_, err := out.Write(msg.Serialize())
+		return err
+	}
+	if super != nil {
+		defer super.add(pc, send)()
+	} else if err := send(&Message{ID: MsgBitfield, Payload: have}); err != nil {
+		return
+	}
+	defer choker.add(pc, send)()
+
+	// 3. Serve requests until the peer goes quiet or misbehaves
+	pieces := t.pieceWorks()
+	for {
+		conn.SetDeadline(time.Now().Add(peerIdleTimeout))
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			log.Debug("peer disconnected", "err", err)
+			return
+		}
+		if msg == nil {
+			continue // Keep-alive message
+		}
+
+		switch msg.ID {
+		case MsgInterested, MsgNotInterested:
+			pc.update(func(p *peerConn) { p.peerInterested = msg.ID == MsgInterested })
+			choker.poke()
+		case MsgBitfield:
+			if super != nil {
+				super.bitfield(pc, msg.Payload)
+			}
+		case MsgHave:
+			if index, err := ParseHave(msg); err == nil && super != nil {
+				super.haveAnnounced(pc, index)
+			}
+		case MsgRequest:
+			var choked bool
+			pc.update(func(p *peerConn) { choked = p.amChoking })
+			if choked {
+				// Requests that crossed a choke on the wire are dropped
+				continue
+			}
+			index, begin, length, err := ParseRequest(msg)
+			if err != nil || !have.HasPiece(index) || index >= len(pieces) ||
+				length <= 0 || length > maxRequestLength || begin+length > pieces[index].length ||
+				super != nil && !super.mayRequest(pc, index) {
+				log.Debug("dropping peer for a bad request", "piece", index, "begin", begin, "length", length)
+				return
+			}
+			block := make([]byte, length)
+			if _, err := store.ReadAt(block, int64(index*t.PieceLength+begin)); err != nil {
+				log.Warn("failed to read block", "piece", index, "err", err)
+				return
+			}
+			if _, err := out.Write(FormatPiece(index, begin, block).Serialize()); err != nil {
+				return
+			}
+		case MsgHashRequest:
+			if err := t.handleHashRequest(out, msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// syncWriter serialises writes to w, so whole messages from different
+// goroutines don't interleave.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
@@ -0,0 +1,165 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torrent/bencode"
+)
+
+// freePort returns a TCP port that was free a moment ago.
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// newTrackerServer answers every announce with a single local peer.
+func newTrackerServer(t *testing.T, port uint16) *httptest.Server {
+	t.Helper()
+	peer := []byte{127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(peer[4:], port)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := bencode.Marshal(bencodeTrackerResponse{Interval: 1800, Peers: string(peer)})
+		w.Write(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func waitState(t *testing.T, tr *Torrent, want State) Status {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if s := tr.Status(); s.State == want {
+			return s
+		} else if s.State == StateFailed {
+			t.Fatalf("torrent failed: %v", s.Err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("torrent never reached state %v", want)
+	return Status{}
+}
+
+func TestSeedServesDownload(t *testing.T) {
+	src := t.TempDir()
+	root := filepath.Join(src, "release")
+	os.MkdirAll(root, 0755)
+	contents := map[string][]byte{
+		"a.bin": bytes.Repeat([]byte("a"), 40000),
+		"b.bin": bytes.Repeat([]byte("b"), 30000),
+	}
+	for name, data := range contents {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	port := freePort(t)
+	tracker := newTrackerServer(t, port)
+	mi, err := Create(root, CreateOptions{PieceLength: 16384, Announce: tracker.URL + "/announce"})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	seeder, _ := NewClient(ClientConfig{DataDir: src, ListenPort: port, UploadRateLimit: 1 << 20})
+	defer seeder.Close()
+	st, err := seeder.AddMetaInfo(mi)
+	if err != nil {
+		t.Fatalf("AddMetaInfo() error = %v", err)
+	}
+	if err := st.Seed(); err != nil {
+		t.Fatalf("Seed() error = %v", err)
+	}
+	if s := waitState(t, st, StateSeeding); s.PiecesDone != s.PiecesTotal {
+		t.Fatalf("seeder verified %d/%d pieces", s.PiecesDone, s.PiecesTotal)
+	}
+
+	dst := t.TempDir()
+	leecher, _ := NewClient(ClientConfig{DataDir: dst, ListenPort: freePort(t), MaxPeers: 1})
+	defer leecher.Close()
+	lt, err := leecher.AddMetaInfo(mi)
+	if err != nil {
+		t.Fatalf("AddMetaInfo() error = %v", err)
+	}
+	if err := lt.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := waitTorrent(t, lt); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	checkDownloaded(t, dst, contents)
+
+	st.Pause()
+	if s := st.Status(); s.State != StatePaused {
+		t.Errorf("seeder state after Pause() = %v, want paused", s.State)
+	}
+}
+
+func TestSeedWithoutMetadata(t *testing.T) {
+	c, _ := NewClient(ClientConfig{})
+	defer c.Close()
+	tr, err := c.AddMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Seed(); err == nil {
+		t.Errorf("Seed() should fail before the metadata is known")
+	}
+}
+
+func TestSeedSharedListener(t *testing.T) {
+	src := t.TempDir()
+	port := freePort(t)
+	tracker := newTrackerServer(t, port)
+
+	// Two torrents seeded by one client on one port
+	var metas []*MetaInfo
+	for _, name := range []string{"one", "two"} {
+		os.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte(name), 10000), 0644)
+		mi, err := Create(filepath.Join(src, name), CreateOptions{PieceLength: 16384, Announce: tracker.URL + "/announce"})
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		metas = append(metas, mi)
+	}
+
+	seeder, _ := NewClient(ClientConfig{DataDir: src, ListenPort: port, MaxConnections: 4})
+	defer seeder.Close()
+	for _, mi := range metas {
+		st, _ := seeder.AddMetaInfo(mi)
+		if err := st.Seed(); err != nil {
+			t.Fatalf("Seed() error = %v", err)
+		}
+		waitState(t, st, StateSeeding)
+	}
+
+	dst := t.TempDir()
+	leecher, _ := NewClient(ClientConfig{DataDir: dst, ListenPort: freePort(t)})
+	defer leecher.Close()
+	for _, mi := range metas {
+		lt, _ := leecher.AddMetaInfo(mi)
+		lt.Start()
+		if err := waitTorrent(t, lt); err != nil {
+			t.Fatalf("Wait() for %s error = %v", mi.Info.Name, err)
+		}
+	}
+	for _, name := range []string{"one", "two"} {
+		got, _ := os.ReadFile(filepath.Join(dst, name))
+		if !bytes.Equal(got, bytes.Repeat([]byte(name), 10000)) {
+			t.Errorf("%s does not match the seed's copy", name)
+		}
+	}
+}
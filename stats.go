@@ -0,0 +1,195 @@
+package torrent
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// meterWindow is how many whole seconds transfer rates are averaged over
+const meterWindow = 5
+
+// meter counts bytes and measures their rate over the last few seconds. A
+// nil meter counts nothing.
+type meter struct {
+	mu    sync.Mutex
+	total int64
+	// buckets holds the bytes of each of the last seconds, the newest at
+	// index second%len(buckets)
+	buckets [meterWindow + 1]int64
+	second  int64
+	// parent, if set, counts everything this meter counts, e.g. a
+	// torrent's meter for one of its peers
+	parent *meter
+}
+
+func (m *meter) add(n int) {
+	m.addAt(time.Now().Unix(), n)
+}
+
+// addAt counts n bytes moved during the second now.
+func (m *meter) addAt(now int64, n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	m.advance(now)
+	m.total += int64(n)
+	m.buckets[m.second%int64(len(m.buckets))] += int64(n)
+	m.mu.Unlock()
+	m.parent.addAt(now, n)
+}
+
+// advance clears the buckets of seconds that passed without traffic. The
+// caller must hold m.mu.
+func (m *meter) advance(now int64) {
+	if now <= m.second {
+		return
+	}
+	for s := max(m.second+1, now-int64(len(m.buckets))+1); s <= now; s++ {
+		m.buckets[s%int64(len(m.buckets))] = 0
+	}
+	m.second = now
+}
+
+// snapshot returns the total bytes and the rate in bytes per second over
+// the last meterWindow whole seconds.
+func (m *meter) snapshot() (total int64, rate float64) {
+	return m.snapshotAt(time.Now().Unix())
+}
+
+func (m *meter) snapshotAt(now int64) (total int64, rate float64) {
+	if m == nil {
+		return 0, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	var sum int64
+	for s := now - meterWindow; s < now; s++ {
+		sum += m.buckets[s%int64(len(m.buckets))]
+	}
+	return m.total, float64(sum) / meterWindow
+}
+
+// transferStats accumulates a torrent's traffic across runs.
+type transferStats struct {
+	down, up meter
+	// peers is the number of connected peers, and chokingUs how many of
+	// those we download from haven't unchoked us
+	peers     atomic.Int64
+	chokingUs atomic.Int64
+	// halfOpen counts connections being dialled or handshaken
+	halfOpen atomic.Int64
+
+	piecesVerified atomic.Int64
+	hashFailures   atomic.Int64
+
+	connMu sync.Mutex
+	conns  map[*peerConn]struct{}
+}
+
+// Stats is a snapshot of a torrent's transfer statistics.
+type Stats struct {
+	// BytesDownloaded and BytesUploaded count peer wire and web seed
+	// traffic since the torrent was added
+	BytesDownloaded int64
+	BytesUploaded   int64
+	// DownloadRate and UploadRate are in bytes per second, averaged over
+	// the last few seconds
+	DownloadRate float64
+	UploadRate   float64
+	// ETA estimates how long the wanted pieces will take at the current
+	// download rate; zero when complete or stalled
+	ETA time.Duration
+	// Peers is the number of connected peers, not counting web seeds
+	Peers int
+}
+
+// add sums s and o, for client-wide totals.
+func (s Stats) add(o Stats) Stats {
+	return Stats{
+		BytesDownloaded: s.BytesDownloaded + o.BytesDownloaded,
+		BytesUploaded:   s.BytesUploaded + o.BytesUploaded,
+		DownloadRate:    s.DownloadRate + o.DownloadRate,
+		UploadRate:      s.UploadRate + o.UploadRate,
+		ETA:             max(s.ETA, o.ETA),
+		Peers:           s.Peers + o.Peers,
+	}
+}
+
+// Stats returns a snapshot of the torrent's transfer statistics.
+func (t *Torrent) Stats() Stats {
+	var s Stats
+	s.BytesDownloaded, s.DownloadRate = t.stats.down.snapshot()
+	s.BytesUploaded, s.UploadRate = t.stats.up.snapshot()
+	s.Peers = int(t.stats.peers.Load())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tf != nil && t.state == StateDownloading && s.DownloadRate > 0 {
+		left := min((t.wanted-t.done)*t.tf.PieceLength, t.tf.Length)
+		s.ETA = time.Duration(float64(left) / s.DownloadRate * float64(time.Second))
+	}
+	return s
+}
+
+// Stats returns the transfer statistics of every torrent together. The
+// ETA is that of the slowest download.
+func (c *Client) Stats() Stats {
+	var s Stats
+	for _, t := range c.Torrents() {
+		s = s.add(t.Stats())
+	}
+	return s
+}
+
+// meters returns the meters traffic is counted in, or nils when nothing
+// is counted.
+func (cfg peerConfig) meters() (down, up *meter) {
+	if cfg.stats == nil {
+		return nil, nil
+	}
+	return &cfg.stats.down, &cfg.stats.up
+}
+
+// pieceVerified counts and reports a verified piece.
+func (cfg peerConfig) pieceVerified(index int) {
+	if cfg.stats != nil {
+		cfg.stats.piecesVerified.Add(1)
+	}
+	cfg.emit(Event{Type: EventPieceVerified, Piece: index})
+}
+
+// hashFailed counts and reports a piece from peer that failed its hash
+// check.
+func (cfg peerConfig) hashFailed(index int, peer string) {
+	if cfg.stats != nil {
+		cfg.stats.hashFailures.Add(1)
+	}
+	cfg.emit(Event{Type: EventHashFailed, Piece: index, Peer: peer})
+}
+
+// trackPeer counts p as connected and reports it, returning the function
+// that reports it gone.
+func (cfg peerConfig) trackPeer(p *peerConn) func() {
+	if s := cfg.stats; s != nil {
+		s.peers.Add(1)
+		s.connMu.Lock()
+		if s.conns == nil {
+			s.conns = make(map[*peerConn]struct{})
+		}
+		s.conns[p] = struct{}{}
+		s.connMu.Unlock()
+	}
+	cfg.emit(Event{Type: EventPeerConnected, Peer: p.addr})
+	return func() {
+		if s := cfg.stats; s != nil {
+			s.peers.Add(-1)
+			s.connMu.Lock()
+			delete(s.conns, p)
+			s.connMu.Unlock()
+		}
+		cfg.emit(Event{Type: EventPeerDisconnected, Peer: p.addr})
+	}
+}
@@ -0,0 +1,28 @@
+package torrent
+
+import "testing"
+
+func TestMeter(t *testing.T) {
+	var nilMeter *meter
+	nilMeter.add(100)
+	if total, rate := nilMeter.snapshot(); total != 0 || rate != 0 {
+		t.Errorf("nil meter snapshot() = %d, %v; want 0, 0", total, rate)
+	}
+
+	var m meter
+	m.addAt(100, 1000)
+	m.addAt(100, 500)
+	m.addAt(102, 1000)
+
+	// The current second is still filling up and doesn't count yet
+	if total, rate := m.snapshotAt(102); total != 2500 || rate != 300 {
+		t.Errorf("snapshotAt(102) = %d, %v; want 2500, 300", total, rate)
+	}
+	if _, rate := m.snapshotAt(105); rate != 500 {
+		t.Errorf("snapshotAt(105) rate = %v, want 500", rate)
+	}
+	// Every counted second has left the window
+	if total, rate := m.snapshotAt(120); total != 2500 || rate != 0 {
+		t.Errorf("snapshotAt(120) = %d, %v; want 2500, 0", total, rate)
+	}
+}
@@ -0,0 +1,324 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// storage maps torrent-wide offsets onto the torrent's files. Files are
+// created lazily on their first write, and bytes that belong to skipped
+// files (the edges of pieces shared with wanted files) are kept in a
+// sparse part file instead, so skipped files never appear on disk.
+type storage struct {
+	mu          sync.Mutex
+	files       []File
+	pieceLength int
+	priority    func(index int) Priority
+	handles     []*os.File
+	partPath    string
+	part        *os.File
+	// partPieces records pieces that have bytes stored in the part file.
+	partPieces map[int]bool
+}
+
+func newStorage(t *TorrentFile) *storage {
+	files := t.files()
+	return &storage{
+		files:       files,
+		pieceLength: t.PieceLength,
+		priority:    t.FilePriority,
+		handles:     make([]*os.File, len(files)),
+		partPath:    filepath.Join(filepath.Dir(t.Name), "."+filepath.Base(t.Name)+".parts"),
+		partPieces:  make(map[int]bool),
+	}
+}
+
+// span is the part of a torrent-wide byte range that falls in one file.
+type span struct {
+	file    int
+	fileOff int64
+	bufOff  int
+	length  int
+}
+
+// spans splits [off, off+length) into per-file spans.
+func (s *storage) spans(off int64, length int) []span {
+	return fileSpans(s.files, off, length)
+}
+
+// fileSpans splits [off, off+length) into spans of the files it covers.
+// Padding files and the gaps between v2 files are not covered by any span;
+// their bytes are always zero.
+func fileSpans(files []File, off int64, length int) []span {
+	var out []span
+	end := off + int64(length)
+	for i, f := range files {
+		start, stop := int64(f.Offset), int64(f.Offset+f.Length)
+		if f.Length == 0 || f.Padding || stop <= off || start >= end {
+			continue
+		}
+		lo, hi := max(start, off), min(stop, end)
+		out = append(out, span{
+			file:    i,
+			fileOff: lo - start,
+			bufOff:  int(lo - off),
+			length:  int(hi - lo),
+		})
+	}
+	return out
+}
+
+// WriteAt writes p at the torrent-wide offset off.
+func (s *storage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sp := range s.spans(off, len(p)) {
+		chunk := p[sp.bufOff : sp.bufOff+sp.length]
+		if s.inPart(sp.file) {
+			if err := s.writePart(chunk, off+int64(sp.bufOff)); err != nil {
+				return sp.bufOff, err
+			}
+			continue
+		}
+
+		f, err := s.open(sp.file)
+		if err != nil {
+			return sp.bufOff, err
+		}
+		if _, err := f.WriteAt(chunk, sp.fileOff); err != nil {
+			return sp.bufOff, err
+		}
+	}
+	return len(p), nil
+}
+
+// ReadAt reads len(p) bytes from the torrent-wide offset off.
+func (s *storage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Padding isn't stored anywhere
+	clear(p)
+
+	for _, sp := range s.spans(off, len(p)) {
+		chunk := p[sp.bufOff : sp.bufOff+sp.length]
+		var err error
+		if s.inPart(sp.file) {
+			err = s.readPart(chunk, off+int64(sp.bufOff))
+		} else {
+			var f *os.File
+			if f, err = s.open(sp.file); err == nil {
+				_, err = f.ReadAt(chunk, sp.fileOff)
+			}
+		}
+		if err != nil {
+			return sp.bufOff, err
+		}
+	}
+	return len(p), nil
+}
+
+// inPart reports whether a file's bytes belong in the part file: the file
+// is skipped and hasn't been created on disk.
+func (s *storage) inPart(index int) bool {
+	if s.handles[index] != nil || s.priority(index) != PrioritySkip {
+		return false
+	}
+	_, err := os.Stat(s.files[index].Path)
+	return os.IsNotExist(err)
+}
+
+func (s *storage) writePart(chunk []byte, off int64) error {
+	if s.part == nil {
+		part, err := os.OpenFile(s.partPath, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return fmt.Errorf("failed to open part file: %v", err)
+		}
+		s.part = part
+	}
+	if _, err := s.part.WriteAt(chunk, off); err != nil {
+		return err
+	}
+	if s.pieceLength > 0 {
+		for piece := off / int64(s.pieceLength); piece*int64(s.pieceLength) < off+int64(len(chunk)); piece++ {
+			s.partPieces[int(piece)] = true
+		}
+	}
+	return nil
+}
+
+func (s *storage) readPart(chunk []byte, off int64) error {
+	if s.part == nil {
+		// A reader's storage shares the part file its download wrote
+		part, err := os.OpenFile(s.partPath, os.O_RDWR, 0666)
+		if err != nil {
+			return fmt.Errorf("no data stored for skipped range at offset %d", off)
+		}
+		s.part = part
+	}
+	_, err := s.part.ReadAt(chunk, off)
+	return err
+}
+
+// open returns the handle for a file, creating it and its directories on
+// first use.
+func (s *storage) open(index int) (*os.File, error) {
+	if s.handles[index] != nil {
+		return s.handles[index], nil
+	}
+
+	path := s.files[index].Path
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	perm := os.FileMode(0666)
+	if s.files[index].Executable {
+		perm = 0777
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	s.handles[index] = f
+	return f, nil
+}
+
+// materialize creates a file that was skipped and copies any of its bytes
+// that were stored in the part file.
+func (s *storage) materialize(index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.handles[index] != nil {
+		return nil
+	}
+	f, err := s.open(index)
+	if err != nil {
+		return err
+	}
+	if s.part == nil {
+		return nil
+	}
+
+	file := s.files[index]
+	for piece := range s.partPieces {
+		for _, sp := range s.spans(int64(piece*s.pieceLength), s.pieceLength) {
+			if sp.file != index {
+				continue
+			}
+			buf := make([]byte, sp.length)
+			if _, err := s.part.ReadAt(buf, int64(file.Offset)+sp.fileOff); err != nil && err != io.EOF {
+				return err
+			}
+			if _, err := f.WriteAt(buf, sp.fileOff); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// finish completes the wanted files once every piece is in: it creates
+// symlinks and zero-length files, which never receive a write, and marks
+// executables as such in case they existed before the download.
+func (s *storage) finish() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, f := range s.files {
+		if f.Padding || s.priority(i) == PrioritySkip {
+			continue
+		}
+		if f.Symlink != "" {
+			if err := createSymlink(f); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.Length == 0 {
+			if _, err := s.open(i); err != nil {
+				return err
+			}
+		}
+		if f.Executable {
+			info, err := os.Stat(f.Path)
+			if err != nil {
+				return err
+			}
+			if err := os.Chmod(f.Path, info.Mode()|0111); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createSymlink links f.Path to its target with a relative link, replacing
+// a stale link but never a regular file.
+func createSymlink(f File) error {
+	target, err := filepath.Rel(filepath.Dir(f.Path), f.Symlink)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(f.Path); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("refusing to replace %s with a symlink", f.Path)
+		}
+		if current, err := os.Readlink(f.Path); err == nil && current == target {
+			return nil
+		}
+		if err := os.Remove(f.Path); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, f.Path)
+}
+
+// Close flushes and closes every open file. The part file is removed once
+// no skipped file needs it any more.
+func (s *storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for i, f := range s.handles {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.handles[i] = nil
+	}
+	if s.part != nil {
+		if err := s.part.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.part = nil
+		if !s.anySkipped() {
+			os.Remove(s.partPath)
+		}
+	}
+	return firstErr
+}
+
+func (s *storage) anySkipped() bool {
+	for i := range s.files {
+		if s.priority(i) == PrioritySkip {
+			return true
+		}
+	}
+	return false
+}
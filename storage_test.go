@@ -0,0 +1,181 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorageWriteAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	tf := multiFileTorrent()
+	tf.Name = filepath.Join(dir, "multi")
+	for i := range tf.Files {
+		tf.Files[i].Path = filepath.Join(dir, tf.Files[i].Path)
+	}
+
+	store := newStorage(tf)
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD")
+	for piece := 0; piece < 4; piece++ {
+		if _, err := store.WriteAt(data[piece*10:(piece+1)*10], int64(piece*10)); err != nil {
+			t.Fatalf("WriteAt() error = %v", err)
+		}
+	}
+
+	buf := make([]byte, len(data))
+	if _, err := store.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("ReadAt() = %q, want %q", buf, data)
+	}
+	store.Close()
+
+	for _, f := range tf.Files {
+		got, err := os.ReadFile(f.Path)
+		if err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+		if want := data[f.Offset : f.Offset+f.Length]; !bytes.Equal(got, want) {
+			t.Errorf("%s = %q, want %q", f.Path, got, want)
+		}
+	}
+}
+
+func TestStorageSkippedFileUsesPartFile(t *testing.T) {
+	dir := t.TempDir()
+	tf := multiFileTorrent()
+	tf.Name = filepath.Join(dir, "multi")
+	for i := range tf.Files {
+		tf.Files[i].Path = filepath.Join(dir, tf.Files[i].Path)
+	}
+	tf.SetFilePriority(1, PrioritySkip)
+
+	store := newStorage(tf)
+	defer store.Close()
+
+	// Piece 1 covers a[10:15] and b[0:5]
+	piece := []byte("abcdeFGHIJ")
+	if _, err := store.WriteAt(piece, 10); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+
+	if _, err := os.Stat(tf.Files[1].Path); !os.IsNotExist(err) {
+		t.Errorf("skipped file was created on disk")
+	}
+	if _, err := os.Stat(store.partPath); err != nil {
+		t.Errorf("part file was not created: %v", err)
+	}
+
+	buf := make([]byte, len(piece))
+	if _, err := store.ReadAt(buf, 10); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(buf, piece) {
+		t.Errorf("ReadAt() = %q, want %q", buf, piece)
+	}
+
+	// Un-skipping the file moves its bytes out of the part file
+	store.priority = func(int) Priority { return PriorityNormal }
+	if err := store.materialize(1); err != nil {
+		t.Fatalf("materialize() error = %v", err)
+	}
+	got := make([]byte, 5)
+	if _, err := store.handles[1].ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(got, []byte("FGHIJ")) {
+		t.Errorf("materialized file = %q, want %q", got, "FGHIJ")
+	}
+}
+
+func TestStorageFinishCreatesEmptyFiles(t *testing.T) {
+	dir := t.TempDir()
+	tf := &TorrentFile{
+		Name:        filepath.Join(dir, "t"),
+		PieceLength: 10,
+		Files: []File{
+			{Path: filepath.Join(dir, "t", "empty"), Length: 0},
+			{Path: filepath.Join(dir, "t", "skipped"), Length: 0},
+		},
+	}
+	tf.SetFilePriority(1, PrioritySkip)
+
+	store := newStorage(tf)
+	if err := store.finish(); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+	store.Close()
+
+	if _, err := os.Stat(tf.Files[0].Path); err != nil {
+		t.Errorf("empty file was not created: %v", err)
+	}
+	if _, err := os.Stat(tf.Files[1].Path); !os.IsNotExist(err) {
+		t.Errorf("skipped empty file was created")
+	}
+}
+
+func TestStoragePaddingAndAttributes(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "t")
+	// tool [0, 6), padding [6, 10), link, data [10, 14)
+	tf := &TorrentFile{
+		Name:        root,
+		PieceLength: 10,
+		Length:      14,
+		Files: []File{
+			{Path: filepath.Join(root, "bin", "tool"), Length: 6, Executable: true},
+			{Path: filepath.Join(root, ".pad", "4"), Length: 4, Offset: 6, Padding: true},
+			{Path: filepath.Join(root, "link"), Offset: 10, Symlink: filepath.Join(root, "bin", "tool")},
+			{Path: filepath.Join(root, "data"), Length: 4, Offset: 10},
+		},
+	}
+
+	store := newStorage(tf)
+	data := []byte("#!/bin\x00\x00\x00\x00data")
+	if _, err := store.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	if err := store.finish(); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+	buf := bytes.Repeat([]byte{'?'}, len(data))
+	if _, err := store.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt() error = %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("ReadAt() = %q, want padding read back as zeros: %q", buf, data)
+	}
+	store.Close()
+
+	if _, err := os.Stat(filepath.Join(root, ".pad")); !os.IsNotExist(err) {
+		t.Errorf("padding file was created on disk")
+	}
+	info, err := os.Stat(tf.Files[0].Path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Mode()&0100 == 0 {
+		t.Errorf("executable file has mode %v", info.Mode())
+	}
+	target, err := os.Readlink(tf.Files[2].Path)
+	if err != nil {
+		t.Fatalf("Readlink() error = %v", err)
+	}
+	if target != filepath.Join("bin", "tool") {
+		t.Errorf("symlink target = %q, want a relative link to bin/tool", target)
+	}
+
+	// Finishing again keeps the link but won't clobber a regular file
+	store = newStorage(tf)
+	if err := store.finish(); err != nil {
+		t.Errorf("finish() again error = %v", err)
+	}
+	os.Remove(tf.Files[2].Path)
+	os.WriteFile(tf.Files[2].Path, []byte("mine"), 0644)
+	if err := store.finish(); err == nil {
+		t.Errorf("finish() should refuse to replace a regular file with a symlink")
+	}
+	store.Close()
+}
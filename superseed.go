@@ -0,0 +1,156 @@
+package torrent
+
+import "sync"
+
+// superSeeder runs BEP 16 super-seeding for a seed that may be the only
+// source of a torrent. Peers are shown no bitfield; each is instead told
+// about a single piece, the one offered least so far, and only told of
+// another once some other peer announces the first, showing the peer
+// passed it on. Each piece leaves the seed as few times as possible and
+// peers have to trade with each other for the rest.
+type superSeeder struct {
+	have Bitfield
+	// pieces is how many pieces the torrent has
+	pieces int
+
+	mu sync.Mutex
+	// offered counts how often each piece has been revealed, and seen how
+	// many connected peers announced it
+	offered []int
+	seen    []int
+	peers   map[*peerConn]*superPeer
+}
+
+// superPeer is what the super-seeder knows of one peer.
+type superPeer struct {
+	send func(*Message) error
+	// has holds the pieces the peer announced, revealed those we told it
+	// of; it may only request those
+	has, revealed Bitfield
+	// offer is the piece waiting to be seen elsewhere, or -1
+	offer int
+}
+
+func newSuperSeeder(have Bitfield, pieces int) *superSeeder {
+	return &superSeeder{
+		have:    have,
+		pieces:  pieces,
+		offered: make([]int, pieces),
+		seen:    make([]int, pieces),
+		peers:   make(map[*peerConn]*superPeer),
+	}
+}
+
+// add starts super-seeding to pc, revealing pieces to it through send.
+// The returned func forgets it again.
+func (s *superSeeder) add(pc *peerConn, send func(*Message) error) func() {
+	s.mu.Lock()
+	p := &superPeer{
+		send:     send,
+		has:      make(Bitfield, (s.pieces+7)/8),
+		revealed: make(Bitfield, (s.pieces+7)/8),
+		offer:    -1,
+	}
+	s.peers[pc] = p
+	reveal := s.revealLocked(p)
+	s.mu.Unlock()
+	reveal()
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i := range s.pieces {
+			if p.has.HasPiece(i) {
+				s.seen[i]--
+			}
+		}
+		delete(s.peers, pc)
+	}
+}
+
+// bitfield records the pieces pc had when it connected. If it already has
+// the piece it was offered, it is offered another straight away.
+func (s *superSeeder) bitfield(pc *peerConn, bf Bitfield) {
+	s.mu.Lock()
+	p, ok := s.peers[pc]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	for i := range s.pieces {
+		if bf.HasPiece(i) && !p.has.HasPiece(i) {
+			p.has.SetPiece(i)
+			s.seen[i]++
+		}
+	}
+	reveal := func() {}
+	if p.offer >= 0 && p.has.HasPiece(p.offer) {
+		reveal = s.revealLocked(p)
+	}
+	s.mu.Unlock()
+	reveal()
+}
+
+// haveAnnounced records that pc announced piece index. Every other peer
+// that was offered the piece has now passed it on and is offered another.
+// So is pc itself if it finished its own offer with no one else around
+// to pass it to.
+func (s *superSeeder) haveAnnounced(pc *peerConn, index int) {
+	if index < 0 || index >= s.pieces {
+		return
+	}
+	s.mu.Lock()
+	p, ok := s.peers[pc]
+	if !ok || p.has.HasPiece(index) {
+		s.mu.Unlock()
+		return
+	}
+	p.has.SetPiece(index)
+	s.seen[index]++
+
+	var reveals []func()
+	for other, op := range s.peers {
+		if op.offer != index {
+			continue
+		}
+		if other != pc || len(s.peers) == 1 {
+			reveals = append(reveals, s.revealLocked(op))
+		}
+	}
+	s.mu.Unlock()
+	for _, reveal := range reveals {
+		reveal()
+	}
+}
+
+// mayRequest reports whether pc was told about piece index.
+func (s *superSeeder) mayRequest(pc *peerConn, index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.peers[pc]
+	return ok && p.revealed.HasPiece(index)
+}
+
+// revealLocked picks the next piece to offer p and returns a func that
+// tells p about it, to be called once s.mu is released. The piece is one
+// of ours p lacks, offered least and then seen least, so the rarest
+// pieces go out first. The caller must hold s.mu.
+func (s *superSeeder) revealLocked(p *superPeer) func() {
+	best := -1
+	for i := range s.pieces {
+		if !s.have.HasPiece(i) || p.has.HasPiece(i) || p.revealed.HasPiece(i) {
+			continue
+		}
+		if best < 0 || s.offered[i] < s.offered[best] ||
+			s.offered[i] == s.offered[best] && s.seen[i] < s.seen[best] {
+			best = i
+		}
+	}
+	p.offer = best
+	if best < 0 {
+		return func() {}
+	}
+	s.offered[best]++
+	p.revealed.SetPiece(best)
+	return func() { p.send(FormatHave(best)) }
+}
@@ -0,0 +1,115 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// haveRecorder records the pieces a super-seeder reveals to each peer.
+type haveRecorder struct {
+	mu       sync.Mutex
+	revealed map[*peerConn][]int
+}
+
+func (r *haveRecorder) add(s *superSeeder, name string) (*peerConn, func()) {
+	p := peerConfig{}.newPeerConn(name, true)
+	remove := s.add(p, func(msg *Message) error {
+		index, err := ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.revealed[p] = append(r.revealed[p], index)
+		return nil
+	})
+	return p, remove
+}
+
+func (r *haveRecorder) last(p *peerConn) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.revealed[p]) == 0 {
+		return -1
+	}
+	return r.revealed[p][len(r.revealed[p])-1]
+}
+
+func newSuperSeedTest(pieces int) (*superSeeder, *haveRecorder) {
+	have := make(Bitfield, (pieces+7)/8)
+	for i := range pieces {
+		have.SetPiece(i)
+	}
+	return newSuperSeeder(have, pieces), &haveRecorder{revealed: make(map[*peerConn][]int)}
+}
+
+func TestSuperSeederRevealsOnePieceEach(t *testing.T) {
+	s, rec := newSuperSeedTest(4)
+	a, _ := rec.add(s, "a")
+	b, _ := rec.add(s, "b")
+	if rec.last(a) != 0 || rec.last(b) != 1 {
+		t.Fatalf("revealed %d and %d, want different pieces 0 and 1", rec.last(a), rec.last(b))
+	}
+	if !s.mayRequest(a, 0) || s.mayRequest(a, 1) {
+		t.Errorf("a may only request the piece it was told of")
+	}
+
+	// b announcing a's piece shows a passed it on; b still waits for its own
+	s.haveAnnounced(b, 0)
+	if got := rec.revealed[a]; fmt.Sprint(got) != "[0 2]" {
+		t.Errorf("a was revealed %v, want [0 2]", got)
+	}
+	if got := rec.revealed[b]; fmt.Sprint(got) != "[1]" {
+		t.Errorf("b was revealed %v, want [1]", got)
+	}
+
+	// a finishing its piece with others around doesn't reveal more
+	s.haveAnnounced(a, 2)
+	if got := rec.revealed[a]; len(got) != 2 {
+		t.Errorf("a was revealed %v after finishing its own piece", got)
+	}
+}
+
+func TestSuperSeederSkipsPiecesPeersHave(t *testing.T) {
+	s, rec := newSuperSeedTest(3)
+	a, _ := rec.add(s, "a")
+	if rec.last(a) != 0 {
+		t.Fatalf("revealed %d, want 0", rec.last(a))
+	}
+	// The bitfield arrives after the first reveal and already has it
+	bf := make(Bitfield, 1)
+	bf.SetPiece(0)
+	bf.SetPiece(1)
+	s.bitfield(a, bf)
+	if rec.last(a) != 2 {
+		t.Errorf("revealed %d after the bitfield, want 2", rec.last(a))
+	}
+}
+
+func TestSuperSeederLonePeer(t *testing.T) {
+	s, rec := newSuperSeedTest(2)
+	a, _ := rec.add(s, "a")
+	s.haveAnnounced(a, 0)
+	if got := rec.revealed[a]; fmt.Sprint(got) != "[0 1]" {
+		t.Errorf("lone peer was revealed %v, want [0 1]", got)
+	}
+	// Nothing is left, so nothing more is sent
+	s.haveAnnounced(a, 1)
+	if got := rec.revealed[a]; len(got) != 2 {
+		t.Errorf("revealed %v once the peer had everything", got)
+	}
+}
+
+func TestSuperSeederRemove(t *testing.T) {
+	s, rec := newSuperSeedTest(2)
+	a, remove := rec.add(s, "a")
+	s.haveAnnounced(a, 1)
+	remove()
+	if s.seen[1] != 0 || len(s.peers) != 0 {
+		t.Errorf("removed peer still counted: seen %v, %d peers", s.seen, len(s.peers))
+	}
+	if s.mayRequest(a, 0) {
+		t.Errorf("removed peer may still request")
+	}
+}
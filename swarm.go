@@ -0,0 +1,421 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// unchokeTimeout is how long a download waits to be unchoked by a peer
+// that wants nothing from us before giving up on it.
+const unchokeTimeout = 30 * time.Second
+
+// errChoked is returned when a peer chokes us before a piece is complete.
+var errChoked = errors.New("peer choked during piece download")
+
+// downloadSwarm is what the peer sessions of one download share: the
+// pieces left to fetch, the storage they're written to and served from,
+// and the choker that picks which peers we upload to, by how fast they
+// give to us.
+type downloadSwarm struct {
+	t        *TorrentFile
+	cfg      peerConfig
+	stats    *transferStats
+	queue    *workQueue
+	results  chan<- *pieceResult
+	store    *storage
+	sel      *fileSelection
+	pieces   []*pieceWork
+	suspects *smartBan
+	choker   *choker
+
+	mu       sync.Mutex
+	sessions map[*peerSession]bool
+}
+
+func newDownloadSwarm(t *TorrentFile, cfg peerConfig, queue *workQueue, results chan<- *pieceResult, store *storage, sel *fileSelection) *downloadSwarm {
+	stats := cfg.stats
+	if stats == nil {
+		stats = new(transferStats)
+	}
+	return &downloadSwarm{
+		t:        t,
+		cfg:      cfg,
+		stats:    stats,
+		queue:    queue,
+		results:  results,
+		store:    store,
+		sel:      sel,
+		pieces:   t.pieceWorks(),
+		suspects: newSmartBan(cfg),
+		choker:   newChoker(cfg.uploadSlots, false),
+		sessions: make(map[*peerSession]bool),
+	}
+}
+
+// verified tells every peer about the pieces verified since it was last
+// told.
+func (sw *downloadSwarm) verified() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for s := range sw.sessions {
+		select {
+		case s.haves <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// peerSession is a connection to a peer during a download. One goroutine
+// reads everything the peer sends, serving its requests while the choker
+// has it unchoked; another tells it about the pieces we verify; and the
+// session's own goroutine downloads from it.
+type peerSession struct {
+	sw   *downloadSwarm
+	pc   *peerConn
+	conn net.Conn
+	// out carries every write, so whole messages don't interleave
+	out *syncWriter
+	log *slog.Logger
+	// blocks carries the pieces the peer sends to the downloading
+	// goroutine, and haves wakes the announcing one
+	blocks chan *Message
+	haves  chan struct{}
+
+	mu sync.Mutex
+	// bf is what the peer has; nil means we don't know
+	bf       Bitfield
+	unchoked bool
+	// err is why the connection stopped being read
+	err error
+	// changed is closed and replaced when any of the above changes
+	changed chan struct{}
+}
+
+// runPeer runs a session with the peer on conn, whose handshake is done,
+// until the download ends or the peer fails us.
+func (sw *downloadSwarm) runPeer(ctx context.Context, conn net.Conn, pc *peerConn, log *slog.Logger) error {
+	s := &peerSession{
+		sw:      sw,
+		pc:      pc,
+		conn:    conn,
+		out:     &syncWriter{w: conn},
+		log:     log,
+		blocks:  make(chan *Message, 4),
+		haves:   make(chan struct{}, 1),
+		changed: make(chan struct{}),
+	}
+
+	// Every peer starts out choking us
+	sw.stats.chokingUs.Add(1)
+	defer func() {
+		if !s.unchoked {
+			sw.stats.chokingUs.Add(-1)
+		}
+	}()
+
+	// 1. Tell the peer what we have, and that we want what it has
+	have := make(Bitfield, (len(sw.pieces)+7)/8)
+	copy(have, sw.sel.haveSnapshot())
+	for _, b := range have {
+		if b != 0 {
+			if err := s.send(&Message{ID: MsgBitfield, Payload: have}); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if err := s.send(&Message{ID: MsgInterested}); err != nil {
+		log.Debug("peer disconnected", "err", err)
+		return err
+	}
+	pc.update(func(p *peerConn) { p.amInterested = true })
+
+	// 2. Read and announce alongside the download, until it's over
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	sw.mu.Lock()
+	sw.sessions[s] = true
+	sw.mu.Unlock()
+	defer func() {
+		sw.mu.Lock()
+		delete(sw.sessions, s)
+		sw.mu.Unlock()
+	}()
+	defer sw.choker.add(pc, s.send)()
+
+	var wg sync.WaitGroup
+	wg.Go(func() { s.read() })
+	wg.Go(func() { s.announce(ctx, have) })
+	defer wg.Wait()
+	defer cancel()
+
+	// 3. Download what the peer has
+	return s.download(ctx)
+}
+
+// send writes msg to the peer.
+func (s *peerSession) send(msg *Message) error {
+	_, err := s.out.Write(msg.Serialize())
+	return err
+}
+
+// notifyLocked wakes everything waiting on the session's state. The caller
+// must hold s.mu.
+func (s *peerSession) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// gone reports whether the connection has stopped being read.
+func (s *peerSession) gone() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err != nil
+}
+
+// download fetches the pieces the peer has until there are none left, the
+// peer fails us or ctx is done.
+func (s *peerSession) download(ctx context.Context) error {
+	sw := s.sw
+	// Only take pieces this peer has, and not those it already sent bad
+	// data for
+	failed := make(map[int]bool)
+	has := func(index int) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return (s.bf == nil || s.bf.HasPiece(index)) && !failed[index]
+	}
+	for {
+		if sw.cfg.bans.isBanned(s.pc.addr) {
+			s.log.Debug("dropping banned peer")
+			return errBanned
+		}
+		if err := s.waitUnchoke(ctx); err != nil {
+			return err
+		}
+		pw, ok := sw.queue.popUnless(has, s.gone)
+		if !ok {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.err
+		}
+
+		buf, err := sw.t.attemptDownloadPiece(s.out, s.next, pw)
+		if errors.Is(err, errChoked) {
+			sw.queue.requeue(pw)
+			continue
+		}
+		if err != nil {
+			s.log.Debug("piece download failed", "piece", pw.index, "err", err)
+			sw.queue.requeue(pw)
+			return err
+		}
+
+		if err := sw.t.VerifyAndSave(pw, buf, sw.store); err != nil {
+			s.log.Warn("piece not saved", "piece", pw.index, "err", err)
+			if errors.Is(err, errHashMismatch) {
+				sw.cfg.hashFailed(pw.index, s.pc.addr)
+				sw.suspects.failed(pw.index, buf, s.pc.addr)
+				failed[pw.index] = true
+			}
+			sw.queue.requeue(pw)
+			continue
+		}
+		sw.suspects.verified(pw.index, buf)
+
+		select {
+		case sw.results <- &pieceResult{pw.index, buf}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// waitUnchoke waits for the peer to unchoke us. A peer that wants nothing
+// from us either is given up on after unchokeTimeout.
+func (s *peerSession) waitUnchoke(ctx context.Context) error {
+	timeout := time.NewTimer(unchokeTimeout)
+	defer timeout.Stop()
+	for {
+		s.mu.Lock()
+		unchoked, err, changed := s.unchoked, s.err, s.changed
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if unchoked {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			var interested bool
+			s.pc.update(func(p *peerConn) { interested = p.peerInterested })
+			if !interested {
+				s.log.Debug("no unchoke from peer")
+				return fmt.Errorf("no unchoke from peer")
+			}
+			timeout.Reset(unchokeTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// next returns the next block the peer sent, or a choke once it has
+// choked us.
+func (s *peerSession) next() (*Message, error) {
+	for {
+		s.mu.Lock()
+		unchoked, err, changed := s.unchoked, s.err, s.changed
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if !unchoked {
+			return &Message{ID: MsgChoke}, nil
+		}
+		select {
+		case msg := <-s.blocks:
+			return msg, nil
+		case <-changed:
+		}
+	}
+}
+
+// read handles what the peer sends until the connection fails or the peer
+// misbehaves.
+func (s *peerSession) read() {
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(peerIdleTimeout))
+		msg, err := ReadMessage(s.conn)
+		if err == nil && msg != nil {
+			err = s.handle(msg)
+		}
+		if err != nil {
+			s.log.Debug("peer disconnected", "err", err)
+			s.mu.Lock()
+			s.err = err
+			s.notifyLocked()
+			s.mu.Unlock()
+			// Let the download see the peer is gone
+			s.sw.queue.wake()
+			return
+		}
+	}
+}
+
+// handle acts on one message from the peer.
+func (s *peerSession) handle(msg *Message) error {
+	sw := s.sw
+	switch msg.ID {
+	case MsgChoke, MsgUnchoke:
+		unchoked := msg.ID == MsgUnchoke
+		s.mu.Lock()
+		if s.unchoked != unchoked {
+			s.unchoked = unchoked
+			if unchoked {
+				sw.stats.chokingUs.Add(-1)
+			} else {
+				sw.stats.chokingUs.Add(1)
+			}
+			s.notifyLocked()
+		}
+		s.mu.Unlock()
+		s.pc.update(func(p *peerConn) { p.peerChoking = !unchoked })
+	case MsgInterested, MsgNotInterested:
+		s.pc.update(func(p *peerConn) { p.peerInterested = msg.ID == MsgInterested })
+		sw.choker.poke()
+	case MsgBitfield:
+		s.mu.Lock()
+		s.bf = append(Bitfield(nil), msg.Payload...)
+		s.mu.Unlock()
+		sw.queue.wake()
+	case MsgHave:
+		// Super-seeds announce one piece at a time instead of a bitfield
+		if index, err := ParseHave(msg); err == nil {
+			s.mu.Lock()
+			if s.bf == nil {
+				s.bf = make(Bitfield, (len(sw.pieces)+7)/8)
+			}
+			s.bf.SetPiece(index)
+			s.mu.Unlock()
+			sw.queue.wake()
+		}
+	case MsgPiece:
+		// The download has at most one block requested, so a full queue
+		// means the peer sent blocks we didn't ask for
+		select {
+		case s.blocks <- msg:
+		default:
+		}
+	case MsgRequest:
+		return s.serve(msg)
+	case MsgHashRequest:
+		return sw.t.handleHashRequest(s.out, msg)
+	}
+	return nil
+}
+
+// serve answers a request for a block of a piece we have, unless we're
+// choking the peer.
+func (s *peerSession) serve(msg *Message) error {
+	var choked bool
+	s.pc.update(func(p *peerConn) { choked = p.amChoking })
+	if choked {
+		// Requests that crossed a choke on the wire are dropped
+		return nil
+	}
+	sw := s.sw
+	index, begin, length, err := ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if index >= len(sw.pieces) || length <= 0 || length > maxRequestLength || begin+length > sw.pieces[index].length {
+		return fmt.Errorf("bad request for piece %d, begin %d, length %d", index, begin, length)
+	}
+	if have, _ := sw.sel.pieceState(index); !have {
+		return fmt.Errorf("request for piece %d, which we don't have", index)
+	}
+	block := make([]byte, length)
+	if _, err := sw.store.ReadAt(block, int64(index*sw.t.PieceLength+begin)); err != nil {
+		s.log.Warn("failed to read block", "piece", index, "err", err)
+		return err
+	}
+	return s.send(FormatPiece(index, begin, block))
+}
+
+// announce sends the peer a have for each piece we verify after sent, and
+// keep-alives while there's nothing to tell, until ctx is done.
+func (s *peerSession) announce(ctx context.Context, sent Bitfield) {
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-s.haves:
+			have := s.sw.sel.haveSnapshot()
+			for i := range s.sw.pieces {
+				if have.HasPiece(i) && !sent.HasPiece(i) {
+					if err := s.send(FormatHave(i)); err != nil {
+						return
+					}
+				}
+			}
+			sent = have
+		case <-keepAlive.C:
+			if err := s.send(nil); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torrent/bencode"
+)
+
+// TestDownloadUploadsToPeers downloads from a peer that holds back the
+// rest of the torrent until we've uploaded it the first piece we got, so
+// the download only finishes if our choker unchokes it and we serve its
+// request.
+func TestDownloadUploadsToPeers(t *testing.T) {
+	const pieceLength = 16384
+	data := append(bytes.Repeat([]byte("a"), pieceLength), bytes.Repeat([]byte("b"), pieceLength)...)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	uploaded := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			uploaded <- err
+			return
+		}
+		defer conn.Close()
+		hs, err := ReadHandshake(conn)
+		if err != nil {
+			uploaded <- err
+			return
+		}
+		conn.Write(NewHandshake(hs.InfoHash, [20]byte{1}).Serialize())
+		for _, msg := range []*Message{{ID: MsgBitfield, Payload: Bitfield{0xc0}}, {ID: MsgUnchoke}, {ID: MsgInterested}} {
+			conn.Write(msg.Serialize())
+		}
+
+		// Serve the first piece asked for, and hold back requests for
+		// the other until we've been sent it back
+		served, wanted := -1, -1
+		unchoked := false
+		var held []*Message
+		serve := func(msg *Message) {
+			index, begin, length, _ := ParseRequest(msg)
+			start := index*pieceLength + begin
+			conn.Write(FormatPiece(index, begin, data[start:start+length]).Serialize())
+		}
+		request := func() {
+			if unchoked && wanted >= 0 {
+				conn.Write(FormatRequest(wanted, 0, pieceLength).Serialize())
+				wanted = -1
+			}
+		}
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				uploaded <- fmt.Errorf("connection closed before we were uploaded to: %v", err)
+				return
+			}
+			if msg == nil {
+				continue
+			}
+			switch msg.ID {
+			case MsgUnchoke:
+				unchoked = true
+				request()
+			case MsgHave:
+				wanted, _ = ParseHave(msg)
+				request()
+			case MsgRequest:
+				if index, _, _, _ := ParseRequest(msg); served < 0 || index == served {
+					served = index
+					serve(msg)
+				} else {
+					held = append(held, msg)
+				}
+			case MsgPiece:
+				index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+				begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+				start := index*pieceLength + begin
+				if index != served || !bytes.Equal(msg.Payload[8:], data[start:start+len(msg.Payload)-8]) {
+					uploaded <- fmt.Errorf("uploaded the wrong block of piece %d at %d", index, begin)
+					return
+				}
+				uploaded <- nil
+				for _, req := range held {
+					serve(req)
+				}
+				// Stay connected until the download is done with us
+				for {
+					if _, err := ReadMessage(conn); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	peer := make([]byte, 6)
+	copy(peer, net.IPv4(127, 0, 0, 1).To4())
+	binary.BigEndian.PutUint16(peer[4:], uint16(ln.Addr().(*net.TCPAddr).Port))
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := bencode.Marshal(bencodeTrackerResponse{Interval: 1800, Peers: string(peer)})
+		w.Write(resp)
+	}))
+	defer tracker.Close()
+
+	name := filepath.Join(t.TempDir(), "file.bin")
+	tf := &TorrentFile{
+		Announce:    tracker.URL,
+		Name:        name,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		PieceHashes: [][20]byte{sha1.Sum(data[:pieceLength]), sha1.Sum(data[pieceLength:])},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tf.Download(ctx, nil); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if err := <-uploaded; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(name); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded file doesn't match, err = %v", err)
+	}
+}
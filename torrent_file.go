@@ -1,14 +1,16 @@
-package main
+package torrent
 
 import (
-	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
-	"github.com/jackpal/bencode-go"
+	"torrent/bencode"
 )
 
 type TorrentFile struct {
@@ -18,34 +20,161 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Files       []File
+	// WebSeeds are BEP 19 web seed URLs from the metainfo's url-list
+	WebSeeds []string
+	// InfoHashV2 is the SHA-256 infohash of v2 and hybrid torrents
+	InfoHashV2 [32]byte
+
+	// piecesV2 holds the merkle hash each piece is verified against in v2
+	// torrents, and pieceLayers the piece layers by pieces root
+	piecesV2    []*pieceHashV2
+	pieceLayers map[[32]byte][][32]byte
+
+	sel *fileSelection
+}
+
+// File is one file of a torrent. Files are laid out back to back in the
+// order they appear in the metainfo, so Offset is the position of the
+// file's first byte within the concatenated torrent data.
+type File struct {
+	Path   string
+	Length int
+	Offset int
+	// PiecesRoot is the root of the file's v2 merkle tree, zero for v1
+	// torrents and empty files
+	PiecesRoot [32]byte
+
+	// BEP 47 attributes. Padding files only exist to align the next file
+	// to a piece boundary; their bytes are zeros and are never written.
+	Padding    bool
+	Executable bool
+	Hidden     bool
+	// Symlink is the target of a symbolic link, rooted like Path
+	Symlink string
+	// SHA1 is the optional hash of the whole file, zero when absent
+	SHA1 [20]byte
+}
+
+// setAttributes applies a file's BEP 47 attr string, symlink path and
+// sha1. Symlink targets are relative to root, the torrent directory.
+func (f *File) setAttributes(attr string, symlink []string, sha1 string, root string) error {
+	f.Padding = strings.ContainsRune(attr, 'p')
+	f.Executable = strings.ContainsRune(attr, 'x')
+	f.Hidden = strings.ContainsRune(attr, 'h')
+
+	if strings.ContainsRune(attr, 'l') {
+		if len(symlink) == 0 {
+			return fmt.Errorf("symlink %q has no target", f.Path)
+		}
+		for _, elem := range symlink {
+			if err := validatePathElement(elem); err != nil {
+				return err
+			}
+		}
+		f.Symlink = filepath.Join(append([]string{root}, symlink...)...)
+	}
+
+	if sha1 != "" {
+		if len(sha1) != len(f.SHA1) {
+			return fmt.Errorf("file %q has an invalid sha1", f.Path)
+		}
+		copy(f.SHA1[:], sha1)
+	}
+	return nil
+}
+
+// IsV2 reports whether the torrent has v2 metadata, either alone or as
+// part of a hybrid torrent.
+func (t *TorrentFile) IsV2() bool {
+	return t.InfoHashV2 != [32]byte{}
+}
+
+// IsHybrid reports whether the torrent carries both v1 and v2 metadata.
+func (t *TorrentFile) IsHybrid() bool {
+	return t.IsV2() && len(t.PieceHashes) > 0
+}
+
+// NumPieces returns the number of pieces, which v2-only torrents don't
+// have v1 hashes for.
+func (t *TorrentFile) NumPieces() int {
+	if len(t.PieceHashes) > 0 {
+		return len(t.PieceHashes)
+	}
+	return len(t.piecesV2)
+}
+
+// swarmHashes returns the 20-byte infohashes the torrent is known by on
+// trackers and in handshakes. Hybrid torrents join both swarms; v2
+// infohashes are truncated to 20 bytes.
+func (t *TorrentFile) swarmHashes() [][20]byte {
+	var v2 [20]byte
+	copy(v2[:], t.InfoHashV2[:])
+	switch {
+	case t.IsHybrid():
+		return [][20]byte{t.InfoHash, v2}
+	case t.IsV2():
+		return [][20]byte{v2}
+	}
+	return [][20]byte{t.InfoHash}
 }
 
 func (t *TorrentFile) TrackerUrl(peerID [20]byte, port uint16) (string, error) {
+	return t.trackerURL(announceRequest{infoHash: t.InfoHash, peerID: peerID, port: port, left: t.Length})
+}
+
+// Tracker announce events
+const (
+	eventStarted   = "started"
+	eventCompleted = "completed"
+	eventStopped   = "stopped"
+)
+
+// announceRequest is one announce to the tracker for one of the torrent's
+// swarms.
+type announceRequest struct {
+	infoHash [20]byte
+	peerID   [20]byte
+	port     uint16
+	// left is how many bytes are still missing
+	left int
+	// event is empty for regular announces
+	event string
+}
+
+// trackerURL builds the announce URL for req.
+func (t *TorrentFile) trackerURL(req announceRequest) (string, error) {
 	base, err := url.Parse(t.Announce)
 	if err != nil {
 		return "", err
 	}
 
 	params := url.Values{}
-	params.Set("info_hash", string(t.InfoHash[:]))
-	params.Set("peer_id", string(peerID[:]))
-	params.Set("port", strconv.Itoa(int(port)))
+	params.Set("info_hash", string(req.infoHash[:]))
+	params.Set("peer_id", string(req.peerID[:]))
+	params.Set("port", strconv.Itoa(int(req.port)))
 	params.Set("uploaded", "0")
 	params.Set("downloaded", "0")
 	params.Set("compact", "1")
-	params.Set("left", strconv.Itoa(t.Length))
+	params.Set("left", strconv.Itoa(req.left))
+	if req.event != "" {
+		params.Set("event", req.event)
+	}
 
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-func (b *bencodeTorrent) ToTorrentFile() (TorrentFile, error) {
+func (b *MetaInfo) ToTorrentFile() (TorrentFile, error) {
 	const hashLen = 20
 	piecesBinary := []byte(b.Info.Pieces)
 
 	if len(piecesBinary)%hashLen != 0 {
 		return TorrentFile{}, fmt.Errorf("invalid pieces length")
 	}
+	if b.Info.PieceLength <= 0 {
+		return TorrentFile{}, fmt.Errorf("invalid piece length %d", b.Info.PieceLength)
+	}
 
 	numPieces := len(piecesBinary) / hashLen
 
@@ -55,49 +184,232 @@ func (b *bencodeTorrent) ToTorrentFile() (TorrentFile, error) {
 		copy(hashes[i][:], piecesBinary[i*hashLen:(i+1)*hashLen])
 	}
 
-	// Generate InfoHash
-	var infoBuffer bytes.Buffer
-	err := bencode.Marshal(&infoBuffer, b.Info)
-	if err != nil {
-		return TorrentFile{}, err
+	// Generate InfoHash from the info dictionary exactly as it appeared in
+	// the source; re-encoding would drop keys InfoDict doesn't model
+	infoBytes := []byte(b.Info.raw)
+	if infoBytes == nil {
+		var err error
+		infoBytes, err = bencode.Marshal(b.Info)
+		if err != nil {
+			return TorrentFile{}, err
+		}
 	}
-	infoHash := sha1.Sum(infoBuffer.Bytes())
+	infoHash := sha1.Sum(infoBytes)
 
-	return TorrentFile{
+	var files []File
+	length := 0
+	if numPieces > 0 || b.Info.MetaVersion != 2 {
+		var err error
+		files, length, err = b.Info.files()
+		if err != nil {
+			return TorrentFile{}, err
+		}
+		// Every piece but the last is full, so a short or long hash list
+		// would leave pieces we can't check or read past the end
+		if want := (length + b.Info.PieceLength - 1) / b.Info.PieceLength; numPieces != want {
+			return TorrentFile{}, fmt.Errorf("torrent has %d pieces but %d bytes need %d", numPieces, length, want)
+		}
+	}
+
+	t := TorrentFile{
 		Announce:    b.Announce,
 		InfoHash:    infoHash,
 		PieceHashes: hashes,
 		PieceLength: b.Info.PieceLength,
-		Length:      b.Info.Length,
+		Length:      length,
 		Name:        b.Info.Name,
-	}, nil
+		Files:       files,
+		WebSeeds:    b.URLList,
+	}
+
+	if b.Info.MetaVersion == 2 {
+		t.InfoHashV2 = sha256.Sum256(infoBytes)
+		if err := b.setupV2(&t); err != nil {
+			return TorrentFile{}, err
+		}
+		if !t.IsHybrid() {
+			// v2-only torrents go by the truncated v2 infohash
+			copy(t.InfoHash[:], t.InfoHashV2[:])
+		}
+	}
+
+	t.sel = newFileSelection(len(t.Files))
+	return t, nil
+}
+
+// files flattens the single-file and multi-file layouts into one list.
+// Multi-file paths are rooted at the torrent name, mirroring how clients
+// lay the torrent out on disk.
+func (i *InfoDict) files() ([]File, int, error) {
+	if err := validatePathElement(i.Name); err != nil {
+		return nil, 0, err
+	}
+
+	if len(i.Files) == 0 {
+		if i.Length < 0 {
+			return nil, 0, fmt.Errorf("file has negative length")
+		}
+		f := File{Path: i.Name, Length: i.Length}
+		if err := f.setAttributes(i.Attr, nil, i.SHA1, filepath.Dir(i.Name)); err != nil {
+			return nil, 0, err
+		}
+		return []File{f}, i.Length, nil
+	}
+
+	files := make([]File, len(i.Files))
+	offset := 0
+	for idx, f := range i.Files {
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("file %d has an empty path", idx)
+		}
+		for _, elem := range f.Path {
+			if err := validatePathElement(elem); err != nil {
+				return nil, 0, err
+			}
+		}
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("file %d has negative length", idx)
+		}
+		files[idx] = File{
+			Path:   filepath.Join(append([]string{i.Name}, f.Path...)...),
+			Length: f.Length,
+			Offset: offset,
+		}
+		if err := files[idx].setAttributes(f.Attr, f.SymlinkPath, f.SHA1, i.Name); err != nil {
+			return nil, 0, err
+		}
+		offset += f.Length
+	}
+	return files, offset, nil
+}
+
+// validatePathElement rejects path components that would let a torrent
+// write outside of its own directory.
+func validatePathElement(elem string) error {
+	if elem == "" || elem == "." || elem == ".." {
+		return fmt.Errorf("invalid path element %q", elem)
+	}
+	if filepath.Base(elem) != elem || filepath.IsAbs(elem) {
+		return fmt.Errorf("invalid path element %q", elem)
+	}
+	return nil
+}
+
+// rootAt moves the torrent's files under dir.
+func (t *TorrentFile) rootAt(dir string) {
+	if dir == "" {
+		return
+	}
+	t.Name = filepath.Join(dir, t.Name)
+	for i := range t.Files {
+		f := &t.Files[i]
+		f.Path = filepath.Join(dir, f.Path)
+		if f.Symlink != "" {
+			f.Symlink = filepath.Join(dir, f.Symlink)
+		}
+	}
 }
 
-type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+// files returns the torrent's file list, synthesising a single file for
+// TorrentFiles that were built by hand without one.
+func (t *TorrentFile) files() []File {
+	if len(t.Files) > 0 {
+		return t.Files
+	}
+	return []File{{Path: t.Name, Length: t.Length}}
 }
 
-type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+// FileDict is one entry of a multi-file info dictionary.
+type FileDict struct {
+	Length      int      `bencode:"length"`
+	Path        []string `bencode:"path"`
+	Attr        string   `bencode:"attr,omitempty"`
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
+	SHA1        string   `bencode:"sha1,omitempty"`
 }
 
-func Open(path string) (*bencodeTorrent, error) {
-	file, err := os.Open(path)
+// InfoDict is the info dictionary of a metainfo file, the part the
+// infohash is computed over.
+type InfoDict struct {
+	Pieces      string     `bencode:"pieces"`
+	PieceLength int        `bencode:"piece length"`
+	Length      int        `bencode:"length,omitempty"`
+	Files       []FileDict `bencode:"files,omitempty"`
+	Name        string     `bencode:"name"`
+	Private     int        `bencode:"private,omitempty"`
+	Attr        string     `bencode:"attr,omitempty"`
+	SHA1        string     `bencode:"sha1,omitempty"`
+	MetaVersion int        `bencode:"meta version,omitempty"`
+	// FileTree is decoded on demand by parseFileTree
+	FileTree bencode.RawMessage `bencode:"file tree,omitempty"`
+
+	// raw is the info dictionary exactly as it was decoded
+	raw bencode.RawMessage
+}
+
+// UnmarshalBencode decodes the info dictionary and keeps its raw bytes.
+func (i *InfoDict) UnmarshalBencode(data []byte) error {
+	type plain InfoDict
+	if err := bencode.Unmarshal(data, (*plain)(i)); err != nil {
+		return err
+	}
+	i.raw = append(bencode.RawMessage(nil), data...)
+	return nil
+}
+
+// urlList is a list of URLs that metainfo files may also encode as a
+// single string.
+type urlList []string
+
+func (l *urlList) UnmarshalBencode(data []byte) error {
+	var single string
+	if err := bencode.Unmarshal(data, &single); err == nil {
+		*l = nil
+		if single != "" {
+			*l = urlList{single}
+		}
+		return nil
+	}
+	var list []string
+	if err := bencode.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// MetaInfo is a decoded .torrent file.
+type MetaInfo struct {
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	URLList      urlList    `bencode:"url-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	Info         InfoDict   `bencode:"info"`
+	// PieceLayers maps each v2 pieces root to its concatenated piece layer
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
+}
+
+func Open(path string) (*MetaInfo, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-
-	bt := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bt)
+	return Parse(data)
+}
 
+// Parse decodes a bencoded metainfo file, keeping the raw info dictionary
+// so the infohash can be computed over the original bytes.
+func Parse(data []byte) (*MetaInfo, error) {
+	bt := MetaInfo{}
+	err := bencode.Unmarshal(data, &bt)
 	if err != nil {
 		return nil, err
 	}
+	if bt.Info.raw == nil {
+		return nil, fmt.Errorf("metainfo has no info dictionary")
+	}
 
 	return &bt, nil
 }
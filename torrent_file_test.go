@@ -1,9 +1,12 @@
-package main
+package torrent
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -88,9 +91,9 @@ func TestToTorrentFile(t *testing.T) {
 	copy(pieces[0:20], []byte("piece1-hash--------"))
 	copy(pieces[20:40], []byte("piece2-hash--------"))
 
-	bt := &bencodeTorrent{
+	bt := &MetaInfo{
 		Announce: "http://tracker.example.com/announce",
-		Info: bencodeInfo{
+		Info: InfoDict{
 			Pieces:      string(pieces),
 			PieceLength: 16384,
 			Length:      32768,
@@ -146,8 +149,8 @@ func TestToTorrentFile_InvalidPieces(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			bt := &bencodeTorrent{
-				Info: bencodeInfo{
+			bt := &MetaInfo{
+				Info: InfoDict{
 					Pieces:      tt.pieces,
 					PieceLength: 16384,
 					Length:      1000,
@@ -192,8 +195,8 @@ func TestInfoHashCalculation(t *testing.T) {
 	pieces := make([]byte, 20)
 	copy(pieces, []byte("test-piece-hash----"))
 
-	bt := &bencodeTorrent{
-		Info: bencodeInfo{
+	bt := &MetaInfo{
+		Info: InfoDict{
 			Pieces:      string(pieces),
 			PieceLength: 16384,
 			Length:      16384,
@@ -216,3 +219,244 @@ func TestInfoHashCalculation(t *testing.T) {
 		t.Errorf("InfoHash should be deterministic, got different hashes")
 	}
 }
+
+func TestToTorrentFile_MultiFile(t *testing.T) {
+	bt := &MetaInfo{
+		Info: InfoDict{
+			Pieces:      string(make([]byte, 40)),
+			PieceLength: 16384,
+			Name:        "album",
+			Files: []FileDict{
+				{Length: 20000, Path: []string{"cd1", "track1.flac"}},
+				{Length: 12768, Path: []string{"cover.jpg"}},
+			},
+		},
+	}
+
+	got, err := bt.ToTorrentFile()
+	if err != nil {
+		t.Fatalf("ToTorrentFile() error = %v", err)
+	}
+
+	if got.Length != 32768 {
+		t.Errorf("ToTorrentFile() Length = %d, want 32768", got.Length)
+	}
+	want := []File{
+		{Path: filepath.Join("album", "cd1", "track1.flac"), Length: 20000, Offset: 0},
+		{Path: filepath.Join("album", "cover.jpg"), Length: 12768, Offset: 20000},
+	}
+	if !reflect.DeepEqual(got.Files, want) {
+		t.Errorf("ToTorrentFile() Files = %v, want %v", got.Files, want)
+	}
+}
+
+func TestToTorrentFile_Attributes(t *testing.T) {
+	bt := &MetaInfo{
+		Info: InfoDict{
+			Pieces:      string(make([]byte, 40)),
+			PieceLength: 16384,
+			Name:        "pkg",
+			Files: []FileDict{
+				{Length: 100, Path: []string{"bin", "run"}, Attr: "x", SHA1: string(bytes.Repeat([]byte{9}, 20))},
+				{Length: 16284, Path: []string{".pad", "16284"}, Attr: "p"},
+				{Length: 0, Path: []string{"run"}, Attr: "l", SymlinkPath: []string{"bin", "run"}},
+				{Length: 10, Path: []string{".config"}, Attr: "h"},
+			},
+		},
+	}
+
+	got, err := bt.ToTorrentFile()
+	if err != nil {
+		t.Fatalf("ToTorrentFile() error = %v", err)
+	}
+
+	var sum [20]byte
+	copy(sum[:], bytes.Repeat([]byte{9}, 20))
+	want := []File{
+		{Path: filepath.Join("pkg", "bin", "run"), Length: 100, Executable: true, SHA1: sum},
+		{Path: filepath.Join("pkg", ".pad", "16284"), Length: 16284, Offset: 100, Padding: true},
+		{Path: filepath.Join("pkg", "run"), Offset: 16384, Symlink: filepath.Join("pkg", "bin", "run")},
+		{Path: filepath.Join("pkg", ".config"), Length: 10, Offset: 16384, Hidden: true},
+	}
+	if !reflect.DeepEqual(got.Files, want) {
+		t.Errorf("ToTorrentFile() Files = %+v, want %+v", got.Files, want)
+	}
+
+	invalid := []FileDict{
+		{Length: 0, Path: []string{"link"}, Attr: "l"},
+		{Length: 0, Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"..", "etc"}},
+		{Length: 1, Path: []string{"f"}, SHA1: "short"},
+	}
+	for _, f := range invalid {
+		bt.Info.Files = []FileDict{f}
+		if _, err := bt.ToTorrentFile(); err == nil {
+			t.Errorf("ToTorrentFile() should reject file %+v", f)
+		}
+	}
+}
+
+func TestToTorrentFile_UnsafePaths(t *testing.T) {
+	tests := []struct {
+		name string
+		path []string
+	}{
+		{"parent directory", []string{"..", "etc", "passwd"}},
+		{"empty element", []string{""}},
+		{"embedded separator", []string{"a/../../b"}},
+		{"empty path", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bt := &MetaInfo{
+				Info: InfoDict{
+					PieceLength: 16384,
+					Name:        "test",
+					Files:       []FileDict{{Length: 1, Path: tt.path}},
+				},
+			}
+
+			if _, err := bt.ToTorrentFile(); err == nil {
+				t.Errorf("ToTorrentFile() should reject path %q", tt.path)
+			}
+		})
+	}
+}
+
+func TestToTorrentFile_UnsafeSingleFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		length int
+	}{
+		{"parent directory", "../../evil", 1},
+		{"separator", "dir/evil", 1},
+		{"dot dot", "..", 1},
+		{"empty name", "", 1},
+		{"negative length", "test", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bt := &MetaInfo{
+				Info: InfoDict{
+					PieceLength: 16384,
+					Pieces:      string(make([]byte, 20)),
+					Name:        tt.file,
+					Length:      tt.length,
+				},
+			}
+
+			if _, err := bt.ToTorrentFile(); err == nil {
+				t.Errorf("ToTorrentFile() should reject file %q of length %d", tt.file, tt.length)
+			}
+		})
+	}
+}
+
+func TestToTorrentFile_PieceGeometry(t *testing.T) {
+	hash := string(make([]byte, 20))
+	tests := []struct {
+		name   string
+		hybrid bool
+		mutate func(bt *MetaInfo)
+	}{
+		{"zero piece length", false, func(bt *MetaInfo) { bt.Info.PieceLength = 0 }},
+		{"negative piece length", false, func(bt *MetaInfo) { bt.Info.PieceLength = -16384 }},
+		{"too few pieces", false, func(bt *MetaInfo) { bt.Info.Pieces = hash }},
+		{"too many pieces", false, func(bt *MetaInfo) { bt.Info.Pieces += hash }},
+		{"hybrid zero piece length", true, func(bt *MetaInfo) { bt.Info.PieceLength = 0 }},
+		{"hybrid negative piece length", true, func(bt *MetaInfo) { bt.Info.PieceLength = -32768 }},
+		{"hybrid too few pieces", true, func(bt *MetaInfo) { bt.Info.Pieces = bt.Info.Pieces[20:] }},
+		{"hybrid too many pieces", true, func(bt *MetaInfo) { bt.Info.Pieces += hash }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bt := &MetaInfo{
+				Info: InfoDict{
+					PieceLength: 16384,
+					Pieces:      hash + hash,
+					Name:        "test",
+					Length:      20000,
+				},
+			}
+			if tt.hybrid {
+				data, _ := buildV2Torrent(t, v2TestFiles(), 32768, true)
+				var err error
+				if bt, err = Parse(data); err != nil {
+					t.Fatalf("Parse() error = %v", err)
+				}
+			}
+			if _, err := bt.ToTorrentFile(); err != nil {
+				t.Fatalf("ToTorrentFile() error = %v before mutating", err)
+			}
+
+			tt.mutate(bt)
+			if _, err := bt.ToTorrentFile(); err == nil {
+				t.Errorf("ToTorrentFile() should return error")
+			}
+		})
+	}
+}
+
+func TestParse_InfoHashUsesRawBytes(t *testing.T) {
+	// The info dict carries keys InfoDict doesn't model; they must still
+	// count towards the infohash.
+	info := "d6:lengthi16384e6:md5sum32:0123456789abcdef0123456789abcdef" +
+		"4:name4:test12:piece lengthi16384e6:pieces20:" + string(make([]byte, 20)) +
+		"6:source7:privatee"
+	data := []byte("d8:announce27:http://tracker.example/annc4:info" + info + "e")
+
+	bt, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	got, err := bt.ToTorrentFile()
+	if err != nil {
+		t.Fatalf("ToTorrentFile() error = %v", err)
+	}
+
+	if want := sha1.Sum([]byte(info)); got.InfoHash != want {
+		t.Errorf("ToTorrentFile() InfoHash = %x, want %x", got.InfoHash, want)
+	}
+	if got.Name != "test" || got.Length != 16384 {
+		t.Errorf("ToTorrentFile() Name = %q, Length = %d", got.Name, got.Length)
+	}
+}
+
+func TestParse_URLList(t *testing.T) {
+	info := "d6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces20:" + string(make([]byte, 20)) + "e"
+	tests := []struct {
+		name    string
+		urlList string
+		want    []string
+	}{
+		{"single string", "8:url-list16:http://seed/dir/", []string{"http://seed/dir/"}},
+		{"list", "8:url-listl8:http://a8:http://be", []string{"http://a", "http://b"}},
+		{"empty string", "8:url-list0:", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bt, err := Parse([]byte("d4:info" + info + tt.urlList + "e"))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual([]string(bt.URLList), tt.want) {
+				t.Errorf("Parse() URLList = %q, want %q", bt.URLList, tt.want)
+			}
+			tf, err := bt.ToTorrentFile()
+			if err != nil {
+				t.Fatalf("ToTorrentFile() error = %v", err)
+			}
+			if !reflect.DeepEqual(tf.WebSeeds, tt.want) {
+				t.Errorf("ToTorrentFile() WebSeeds = %q, want %q", tf.WebSeeds, tt.want)
+			}
+		})
+	}
+
+	if _, err := Parse([]byte("d8:announce1:xe")); err == nil {
+		t.Errorf("Parse() should return error without an info dictionary")
+	}
+}
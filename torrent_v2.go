@@ -0,0 +1,272 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"torrent/bencode"
+)
+
+// fileTreeEntry is the leaf of a v2 file tree, stored under the "" key.
+type fileTreeEntry struct {
+	Length      int      `bencode:"length"`
+	PiecesRoot  []byte   `bencode:"pieces root,omitempty"`
+	Attr        string   `bencode:"attr,omitempty"`
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
+}
+
+// v2File is a file from a v2 file tree.
+type v2File struct {
+	path       []string
+	length     int
+	piecesRoot [32]byte
+	attr       string
+	symlink    []string
+}
+
+// parseFileTree flattens a v2 file tree in key order, which is the order
+// the files are laid out in.
+func parseFileTree(raw bencode.RawMessage, prefix []string, depth int) ([]v2File, error) {
+	if depth > maxPathDepth {
+		return nil, fmt.Errorf("file tree nested too deeply")
+	}
+
+	var node map[string]bencode.RawMessage
+	if err := bencode.Unmarshal(raw, &node); err != nil {
+		return nil, fmt.Errorf("invalid file tree: %v", err)
+	}
+
+	if leaf, ok := node[""]; ok {
+		if len(node) != 1 || len(prefix) == 0 {
+			return nil, fmt.Errorf("invalid file tree entry at %q", filepath.Join(prefix...))
+		}
+		var entry fileTreeEntry
+		if err := bencode.Unmarshal(leaf, &entry); err != nil {
+			return nil, fmt.Errorf("invalid file tree entry: %v", err)
+		}
+		f := v2File{
+			path:    append([]string(nil), prefix...),
+			length:  entry.Length,
+			attr:    entry.Attr,
+			symlink: entry.SymlinkPath,
+		}
+		if entry.Length < 0 {
+			return nil, fmt.Errorf("file %q has negative length", filepath.Join(prefix...))
+		}
+		if entry.Length > 0 {
+			if len(entry.PiecesRoot) != 32 {
+				return nil, fmt.Errorf("file %q has an invalid pieces root", filepath.Join(prefix...))
+			}
+			copy(f.piecesRoot[:], entry.PiecesRoot)
+		}
+		return []v2File{f}, nil
+	}
+
+	keys := make([]string, 0, len(node))
+	for k := range node {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var files []v2File
+	for _, k := range keys {
+		if err := validatePathElement(k); err != nil {
+			return nil, err
+		}
+		sub, err := parseFileTree(node[k], append(prefix, k), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// maxPathDepth bounds how deep a v2 file tree may nest
+const maxPathDepth = 64
+
+// setupV2 fills in the v2 parts of t from the metainfo: the file layout for
+// pure v2 torrents, each file's pieces root, and the per-piece merkle
+// hashes used for verification.
+func (b *MetaInfo) setupV2(t *TorrentFile) error {
+	pl := b.Info.PieceLength
+	if pl < merkleBlockSize || nextPowerOfTwo(pl) != pl {
+		return fmt.Errorf("v2 piece length %d is not a power of two of at least 16KB", pl)
+	}
+	if b.Info.FileTree == nil {
+		return fmt.Errorf("v2 metainfo has no file tree")
+	}
+	tree, err := parseFileTree(b.Info.FileTree, nil, 0)
+	if err != nil {
+		return err
+	}
+	if len(tree) == 0 {
+		return fmt.Errorf("v2 file tree is empty")
+	}
+
+	if len(t.PieceHashes) == 0 {
+		// Pure v2: every file starts on a piece boundary
+		t.PieceHashes = nil
+		if t.Files, t.Length, err = alignedFiles(b.Info.Name, tree, pl); err != nil {
+			return err
+		}
+	} else if err := matchHybridFiles(t.Files, b.Info.Name, tree); err != nil {
+		return err
+	}
+
+	t.pieceLayers = make(map[[32]byte][][32]byte)
+	numPieces := (t.Length + pl - 1) / pl
+	if len(t.PieceHashes) > 0 && numPieces != len(t.PieceHashes) {
+		return fmt.Errorf("hybrid torrent has %d v1 pieces but %d v2 pieces", len(t.PieceHashes), numPieces)
+	}
+	t.piecesV2 = make([]*pieceHashV2, numPieces)
+
+	for _, f := range t.Files {
+		if f.Length == 0 || f.PiecesRoot == ([32]byte{}) {
+			continue
+		}
+		if f.Offset%pl != 0 {
+			return fmt.Errorf("file %q is not aligned to a piece boundary", f.Path)
+		}
+		first := f.Offset / pl
+		count := (f.Length + pl - 1) / pl
+
+		if count == 1 {
+			// Files of one piece have no piece layer; the pieces root is
+			// the root of just their blocks
+			blocks := (f.Length + merkleBlockSize - 1) / merkleBlockSize
+			t.piecesV2[first] = &pieceHashV2{root: f.PiecesRoot, leaves: nextPowerOfTwo(blocks), length: f.Length}
+			continue
+		}
+
+		raw, ok := b.PieceLayers[string(f.PiecesRoot[:])]
+		if !ok {
+			return fmt.Errorf("missing piece layer for %q", f.Path)
+		}
+		if len(raw) != count*32 {
+			return fmt.Errorf("piece layer for %q has %d bytes, want %d", f.Path, len(raw), count*32)
+		}
+		layer := make([][32]byte, count)
+		for i := range layer {
+			copy(layer[i][:], raw[i*32:(i+1)*32])
+		}
+		if piecesRootFromLayer(layer, pl) != f.PiecesRoot {
+			return fmt.Errorf("piece layer for %q does not match its pieces root", f.Path)
+		}
+		t.pieceLayers[f.PiecesRoot] = layer
+
+		for i, root := range layer {
+			t.piecesV2[first+i] = &pieceHashV2{
+				root:   root,
+				leaves: pl / merkleBlockSize,
+				length: min(pl, f.Length-i*pl),
+			}
+		}
+	}
+	return nil
+}
+
+// v2Path returns where a v2 file lives on disk. A tree holding a single
+// file named after the torrent is a single-file torrent.
+func v2Path(name string, tree []v2File, f v2File) string {
+	if len(tree) == 1 && len(f.path) == 1 && f.path[0] == name {
+		return name
+	}
+	return filepath.Join(append([]string{name}, f.path...)...)
+}
+
+// alignedFiles lays out a pure v2 torrent, starting each non-empty file on
+// a piece boundary. The gaps between files are never transferred.
+func alignedFiles(name string, tree []v2File, pieceLength int) ([]File, int, error) {
+	if err := validatePathElement(name); err != nil {
+		return nil, 0, err
+	}
+	files := make([]File, len(tree))
+	offset := 0
+	for i, f := range tree {
+		if f.length > 0 && offset%pieceLength != 0 {
+			offset += pieceLength - offset%pieceLength
+		}
+		files[i] = File{
+			Path:       v2Path(name, tree, f),
+			Length:     f.length,
+			Offset:     offset,
+			PiecesRoot: f.piecesRoot,
+		}
+		if err := files[i].setAttributes(f.attr, f.symlink, "", name); err != nil {
+			return nil, 0, err
+		}
+		offset += f.length
+	}
+	return files, offset, nil
+}
+
+// matchHybridFiles attaches the v2 pieces roots to the v1 file list of a
+// hybrid torrent, checking that both describe the same files.
+func matchHybridFiles(files []File, name string, tree []v2File) error {
+	byPath := make(map[string]v2File, len(tree))
+	for _, f := range tree {
+		byPath[v2Path(name, tree, f)] = f
+	}
+
+	matched := 0
+	for i := range files {
+		f, ok := byPath[files[i].Path]
+		if !ok {
+			continue
+		}
+		if f.length != files[i].Length {
+			return fmt.Errorf("hybrid torrent lists %q with different lengths", files[i].Path)
+		}
+		files[i].PiecesRoot = f.piecesRoot
+		matched++
+	}
+	if matched != len(tree) {
+		return fmt.Errorf("hybrid torrent v1 and v2 file lists disagree")
+	}
+	return nil
+}
+
+// hashesFor answers a hash request from the piece layers we hold: the
+// requested hashes followed by the uncle hashes proving them.
+func (t *TorrentFile) hashesFor(r HashRequest) ([][32]byte, error) {
+	layer, ok := t.pieceLayers[r.PiecesRoot]
+	if !ok {
+		return nil, fmt.Errorf("unknown pieces root")
+	}
+	pieceHeight := log2(t.PieceLength / merkleBlockSize)
+	if r.BaseLayer != pieceHeight {
+		return nil, fmt.Errorf("only the piece layer is available")
+	}
+	width := nextPowerOfTwo(len(layer))
+	if r.Length <= 0 || nextPowerOfTwo(r.Length) != r.Length || r.Index < 0 || r.Index%r.Length != 0 || r.Index+r.Length > width {
+		return nil, fmt.Errorf("invalid hash range %d+%d", r.Index, r.Length)
+	}
+
+	pad := padHash(pieceHeight)
+	hashes := make([][32]byte, 0, r.Length)
+	for i := r.Index; i < r.Index+r.Length; i++ {
+		if i < len(layer) {
+			hashes = append(hashes, layer[i])
+		} else {
+			hashes = append(hashes, pad)
+		}
+	}
+	return append(hashes, uncleHashes(layer, width, pieceHeight, r.Index, r.Length, r.ProofLayers)...), nil
+}
+
+// handleHashRequest answers a peer's hash request with hashes or a reject.
+func (t *TorrentFile) handleHashRequest(conn io.Writer, msg *Message) error {
+	r, _, err := ParseHashRequest(msg)
+	if err != nil {
+		return err
+	}
+	reply := FormatHashReject(r)
+	if hashes, err := t.hashesFor(r); err == nil {
+		reply = FormatHashes(r, hashes)
+	}
+	_, err = conn.Write(reply.Serialize())
+	return err
+}
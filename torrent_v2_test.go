@@ -0,0 +1,351 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"strconv"
+	"strings"
+	"testing"
+
+	"torrent/bencode"
+)
+
+type v2TestFile struct {
+	path string
+	data []byte
+}
+
+// buildV2Torrent bencodes a v2 torrent named "t" holding files, with v1
+// metadata and pad files as well when hybrid is set. It returns the
+// metainfo and the piece layers it contains by pieces root.
+func buildV2Torrent(t *testing.T, files []v2TestFile, pieceLength int, hybrid bool) ([]byte, map[string]string) {
+	t.Helper()
+
+	tree := map[string]any{}
+	layers := map[string]string{}
+	var v1Files []any
+	var stream []byte
+	for i, f := range files {
+		entry := map[string]any{"length": len(f.data)}
+		if len(f.data) > 0 {
+			var root [32]byte
+			if len(f.data) <= pieceLength {
+				blocks := blockHashes(f.data)
+				root = merkleRoot(blocks, nextPowerOfTwo(len(blocks)), 0)
+			} else {
+				var layer [][32]byte
+				var raw []byte
+				for off := 0; off < len(f.data); off += pieceLength {
+					piece := f.data[off:min(off+pieceLength, len(f.data))]
+					h := merkleRoot(blockHashes(piece), pieceLength/merkleBlockSize, 0)
+					layer = append(layer, h)
+					raw = append(raw, h[:]...)
+				}
+				root = piecesRootFromLayer(layer, pieceLength)
+				layers[string(root[:])] = string(raw)
+			}
+			entry["pieces root"] = root[:]
+		}
+
+		node := tree
+		elems := strings.Split(f.path, "/")
+		for _, elem := range elems[:len(elems)-1] {
+			if node[elem] == nil {
+				node[elem] = map[string]any{}
+			}
+			node = node[elem].(map[string]any)
+		}
+		node[elems[len(elems)-1]] = map[string]any{"": entry}
+
+		stream = append(stream, f.data...)
+		v1Files = append(v1Files, map[string]any{"length": len(f.data), "path": elems})
+		if pad := (pieceLength - len(stream)%pieceLength) % pieceLength; pad > 0 && i < len(files)-1 {
+			stream = append(stream, make([]byte, pad)...)
+			v1Files = append(v1Files, map[string]any{"attr": "p", "length": pad, "path": []string{".pad", strconv.Itoa(pad)}})
+		}
+	}
+
+	info := map[string]any{
+		"file tree":    tree,
+		"meta version": 2,
+		"name":         "t",
+		"piece length": pieceLength,
+	}
+	if hybrid {
+		var pieces []byte
+		for off := 0; off < len(stream); off += pieceLength {
+			h := sha1.Sum(stream[off:min(off+pieceLength, len(stream))])
+			pieces = append(pieces, h[:]...)
+		}
+		info["pieces"] = string(pieces)
+		info["files"] = v1Files
+	}
+
+	data, err := bencode.Marshal(map[string]any{
+		"announce":     "http://tracker/announce",
+		"info":         info,
+		"piece layers": layers,
+	})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	return data, layers
+}
+
+func v2TestFiles() []v2TestFile {
+	data := func(n int, seed byte) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = seed + byte(i%97)
+		}
+		return b
+	}
+	return []v2TestFile{
+		{"a", data(20000, 1)},
+		{"dir/b", data(70000, 2)},
+		{"dir/empty", nil},
+	}
+}
+
+// memWriter is an in-memory io.WriterAt.
+type memWriter struct{ buf []byte }
+
+func (m *memWriter) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func parseTorrent(t *testing.T, data []byte) TorrentFile {
+	t.Helper()
+	bt, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	tf, err := bt.ToTorrentFile()
+	if err != nil {
+		t.Fatalf("ToTorrentFile() error = %v", err)
+	}
+	return tf
+}
+
+func TestToTorrentFile_V2(t *testing.T) {
+	const pieceLength = 32768
+	files := v2TestFiles()
+	data, _ := buildV2Torrent(t, files, pieceLength, false)
+	tf := parseTorrent(t, data)
+
+	if !tf.IsV2() || tf.IsHybrid() {
+		t.Errorf("IsV2() = %v, IsHybrid() = %v, want true, false", tf.IsV2(), tf.IsHybrid())
+	}
+	bt, _ := Parse(data)
+	if want := sha256.Sum256(bt.Info.raw); tf.InfoHashV2 != want {
+		t.Errorf("InfoHashV2 = %x, want %x", tf.InfoHashV2, want)
+	}
+	if !bytes.Equal(tf.InfoHash[:], tf.InfoHashV2[:20]) {
+		t.Errorf("InfoHash = %x, want truncated v2 infohash", tf.InfoHash)
+	}
+	if hashes := tf.swarmHashes(); len(hashes) != 1 || hashes[0] != tf.InfoHash {
+		t.Errorf("swarmHashes() = %x, want just the truncated v2 infohash", hashes)
+	}
+
+	wantFiles := []struct {
+		path           string
+		length, offset int
+	}{
+		{"t/a", 20000, 0},
+		{"t/dir/b", 70000, 32768},
+		{"t/dir/empty", 0, 102768},
+	}
+	if len(tf.Files) != len(wantFiles) {
+		t.Fatalf("ToTorrentFile() has %d files, want %d", len(tf.Files), len(wantFiles))
+	}
+	for i, want := range wantFiles {
+		f := tf.Files[i]
+		if f.Path != want.path || f.Length != want.length || f.Offset != want.offset {
+			t.Errorf("Files[%d] = %+v, want %+v", i, f, want)
+		}
+	}
+	if tf.Length != 102768 {
+		t.Errorf("Length = %d, want 102768", tf.Length)
+	}
+
+	// Pieces stop at the end of their file
+	pieces := tf.pieceWorks()
+	wantLengths := []int{20000, 32768, 32768, 4464}
+	if len(pieces) != len(wantLengths) {
+		t.Fatalf("pieceWorks() returned %d pieces, want %d", len(pieces), len(wantLengths))
+	}
+	stream := [][]byte{
+		files[0].data,
+		files[1].data[:32768],
+		files[1].data[32768:65536],
+		files[1].data[65536:],
+	}
+	w := &memWriter{}
+	for i, pw := range pieces {
+		if pw.length != wantLengths[i] {
+			t.Errorf("piece %d length = %d, want %d", i, pw.length, wantLengths[i])
+		}
+		if err := tf.VerifyAndSave(pw, stream[i], w); err != nil {
+			t.Errorf("VerifyAndSave(piece %d) error = %v", i, err)
+		}
+	}
+	if !bytes.Equal(w.buf[32768:], files[1].data) {
+		t.Errorf("VerifyAndSave() did not write b at its aligned offset")
+	}
+
+	corrupt := append([]byte(nil), stream[2]...)
+	corrupt[100] ^= 1
+	if err := tf.VerifyAndSave(pieces[2], corrupt, w); err == nil {
+		t.Errorf("VerifyAndSave() should reject a corrupt v2 piece")
+	}
+}
+
+func TestToTorrentFile_Hybrid(t *testing.T) {
+	const pieceLength = 32768
+	files := v2TestFiles()
+	data, _ := buildV2Torrent(t, files, pieceLength, true)
+	tf := parseTorrent(t, data)
+
+	if !tf.IsHybrid() {
+		t.Fatalf("IsHybrid() = false")
+	}
+	bt, _ := Parse(data)
+	if want := sha1.Sum(bt.Info.raw); tf.InfoHash != want {
+		t.Errorf("InfoHash = %x, want the v1 infohash %x", tf.InfoHash, want)
+	}
+	if hashes := tf.swarmHashes(); len(hashes) != 2 || hashes[0] != tf.InfoHash || !bytes.Equal(hashes[1][:], tf.InfoHashV2[:20]) {
+		t.Errorf("swarmHashes() = %x, want the v1 and truncated v2 infohashes", hashes)
+	}
+	if tf.Files[2].Path != "t/dir/b" || tf.Files[2].PiecesRoot == ([32]byte{}) {
+		t.Errorf("Files[2] = %+v, want t/dir/b with a pieces root", tf.Files[2])
+	}
+
+	// Hybrid pieces span pad files and are checked against both hashes
+	piece0 := append(append([]byte(nil), files[0].data...), make([]byte, pieceLength-len(files[0].data))...)
+	pieces := tf.pieceWorks()
+	if pieces[0].length != pieceLength {
+		t.Errorf("piece 0 length = %d, want %d", pieces[0].length, pieceLength)
+	}
+	w := &memWriter{}
+	if err := tf.VerifyAndSave(pieces[0], piece0, w); err != nil {
+		t.Errorf("VerifyAndSave() error = %v", err)
+	}
+
+	// Garbage in the padding passes v2 but must fail v1
+	piece0[len(piece0)-1] = 1
+	if err := tf.VerifyAndSave(pieces[0], piece0, w); err == nil {
+		t.Errorf("VerifyAndSave() should reject bad padding in a hybrid piece")
+	}
+}
+
+func TestToTorrentFile_V2Invalid(t *testing.T) {
+	const pieceLength = 32768
+	files := v2TestFiles()
+
+	tests := []struct {
+		name   string
+		mutate func(bt *MetaInfo)
+	}{
+		{"missing piece layer", func(bt *MetaInfo) { bt.PieceLayers = nil }},
+		{"corrupt piece layer", func(bt *MetaInfo) {
+			for k, v := range bt.PieceLayers {
+				bt.PieceLayers[k] = "x" + v[1:]
+			}
+		}},
+		{"short piece layer", func(bt *MetaInfo) {
+			for k, v := range bt.PieceLayers {
+				bt.PieceLayers[k] = v[32:]
+			}
+		}},
+		{"piece length", func(bt *MetaInfo) { bt.Info.PieceLength = 20000 }},
+		{"no file tree", func(bt *MetaInfo) { bt.Info.FileTree = nil }},
+		{"unsafe path", func(bt *MetaInfo) {
+			bt.Info.FileTree = bencode.RawMessage("d2:..d0:d6:lengthi0eeee")
+		}},
+		{"unsafe name", func(bt *MetaInfo) { bt.Info.Name = "../evil" }},
+		{"file at root", func(bt *MetaInfo) {
+			bt.Info.FileTree = bencode.RawMessage("d0:d6:lengthi0eee")
+		}},
+		{"bad pieces root", func(bt *MetaInfo) {
+			bt.Info.FileTree = bencode.RawMessage("d1:ad0:d6:lengthi5e11:pieces root3:abceee")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := buildV2Torrent(t, files, pieceLength, false)
+			bt, err := Parse(data)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			tt.mutate(bt)
+			if _, err := bt.ToTorrentFile(); err == nil {
+				t.Errorf("ToTorrentFile() should return error")
+			}
+		})
+	}
+}
+
+func TestHashesFor(t *testing.T) {
+	const pieceLength = 32768
+	data, layers := buildV2Torrent(t, v2TestFiles(), pieceLength, false)
+	tf := parseTorrent(t, data)
+
+	b := tf.Files[1]
+	layer := tf.pieceLayers[b.PiecesRoot]
+	if len(layers) != 1 || len(layer) != 3 {
+		t.Fatalf("torrent has %d piece layers, b's has %d hashes", len(layers), len(layer))
+	}
+	pieceHeight := log2(pieceLength / merkleBlockSize)
+
+	tests := []struct {
+		name    string
+		req     HashRequest
+		wantErr bool
+	}{
+		{"whole layer", HashRequest{PiecesRoot: b.PiecesRoot, BaseLayer: pieceHeight, Index: 0, Length: 4}, false},
+		{"one hash with proof", HashRequest{PiecesRoot: b.PiecesRoot, BaseLayer: pieceHeight, Index: 2, Length: 1, ProofLayers: 2}, false},
+		{"pair with proof", HashRequest{PiecesRoot: b.PiecesRoot, BaseLayer: pieceHeight, Index: 2, Length: 2, ProofLayers: 5}, false},
+		{"unknown root", HashRequest{BaseLayer: pieceHeight, Index: 0, Length: 1}, true},
+		{"block layer", HashRequest{PiecesRoot: b.PiecesRoot, BaseLayer: 0, Index: 0, Length: 1}, true},
+		{"unaligned", HashRequest{PiecesRoot: b.PiecesRoot, BaseLayer: pieceHeight, Index: 1, Length: 2}, true},
+		{"past end", HashRequest{PiecesRoot: b.PiecesRoot, BaseLayer: pieceHeight, Index: 4, Length: 1}, true},
+		{"not a power of two", HashRequest{PiecesRoot: b.PiecesRoot, BaseLayer: pieceHeight, Index: 0, Length: 3}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conn bytes.Buffer
+			if err := tf.handleHashRequest(&conn, FormatHashRequest(tt.req)); err != nil {
+				t.Fatalf("handleHashRequest() error = %v", err)
+			}
+			msg, err := ReadMessage(&conn)
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if tt.wantErr {
+				if msg.ID != MsgHashReject {
+					t.Errorf("handleHashRequest() replied with ID %d, want reject", msg.ID)
+				}
+				return
+			}
+			if msg.ID != MsgHashes {
+				t.Fatalf("handleHashRequest() replied with ID %d, want hashes", msg.ID)
+			}
+			req, hashes, err := ParseHashRequest(msg)
+			if err != nil {
+				t.Fatalf("ParseHashRequest() error = %v", err)
+			}
+			if req != tt.req {
+				t.Errorf("reply echoes %+v, want %+v", req, tt.req)
+			}
+			if err := verifyProof(b.PiecesRoot, hashes[:tt.req.Length], tt.req.Index, hashes[tt.req.Length:]); err != nil {
+				t.Errorf("verifyProof() error = %v", err)
+			}
+		})
+	}
+}
@@ -1,27 +1,42 @@
-package main
+package torrent
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
-	"github.com/jackpal/bencode-go"
+	"torrent/bencode"
 )
 
+// maxTrackerResponseSize bounds how much of a tracker response we decode
+const maxTrackerResponseSize = 1024 * 1024 // 1MB
+
 type bencodeTrackerResponse struct {
 	Interval int    `bencode:"interval"`
 	Peers    string `bencode:"peers"`
 }
 
 func (t *TorrentFile) RequestPeers(peerID [20]byte, port uint16) ([]Peer, error) {
-	url, err := t.TrackerUrl(peerID, port)
+	return t.requestPeers(context.Background(), announceRequest{infoHash: t.InfoHash, peerID: peerID, port: port, left: t.Length})
+}
+
+// requestPeers announces to the tracker, giving up when ctx is done.
+func (t *TorrentFile) requestPeers(ctx context.Context, ar announceRequest) ([]Peer, error) {
+	url, err := t.trackerURL(ar)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -34,7 +49,9 @@ func (t *TorrentFile) RequestPeers(peerID [20]byte, port uint16) ([]Peer, error)
 	}
 
 	trackerResp := bencodeTrackerResponse{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
+	dec := bencode.NewDecoder(resp.Body)
+	dec.SetMaxSize(maxTrackerResponseSize)
+	err = dec.Decode(&trackerResp)
 	if err != nil {
 		return nil, err
 	}
@@ -51,3 +68,73 @@ func GeneratePeerID() ([20]byte, error) {
 	_, err := rand.Read(id[len(prefix):])
 	return id, err
 }
+
+// ScrapeResult is a tracker's statistics for one swarm.
+type ScrapeResult struct {
+	// Complete is the number of seeders
+	Complete int `bencode:"complete"`
+	// Downloaded is how many times the torrent has been completed
+	Downloaded int `bencode:"downloaded"`
+	// Incomplete is the number of leechers
+	Incomplete int `bencode:"incomplete"`
+}
+
+type bencodeScrapeResponse struct {
+	Files map[string]ScrapeResult `bencode:"files"`
+}
+
+// Scrape asks the tracker with the given announce URL for the statistics
+// of each infohash. Swarms the tracker doesn't know are left out.
+func Scrape(announce string, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	base, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	base.RawQuery = params.Encode()
+
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Get(base.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker returned status code %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	scrapeResp := bencodeScrapeResponse{}
+	dec := bencode.NewDecoder(resp.Body)
+	dec.SetMaxSize(maxTrackerResponseSize)
+	if err := dec.Decode(&scrapeResp); err != nil {
+		return nil, err
+	}
+
+	results := make(map[[20]byte]ScrapeResult)
+	for key, res := range scrapeResp.Files {
+		if len(key) == 20 {
+			results[[20]byte([]byte(key))] = res
+		}
+	}
+	return results, nil
+}
+
+// scrapeURL derives a tracker's scrape URL from its announce URL by the
+// usual convention: the last path element must start with "announce",
+// which is replaced by "scrape".
+func scrapeURL(announce string) (*url.URL, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		return nil, fmt.Errorf("tracker %q does not support scrape", announce)
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(u.Path[slash+1:], "announce")
+	return u, nil
+}
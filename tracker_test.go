@@ -1,4 +1,4 @@
-package main
+package torrent
 
 import (
 	"bytes"
@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"torrent/bencode"
 )
 
 func TestGeneratePeerID(t *testing.T) {
@@ -179,3 +181,53 @@ func TestRequestPeers_ValidBencodeResponse(t *testing.T) {
 		t.Errorf("RequestPeers() peer Port = %v, want %v", peers[0].Port, expectedPort)
 	}
 }
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		want     string
+		wantErr  bool
+	}{
+		{"http://example.com/announce", "http://example.com/scrape", false},
+		{"http://example.com/x/announce.php?passkey=1", "http://example.com/x/scrape.php?passkey=1", false},
+		{"http://example.com/announce?a=b", "http://example.com/scrape?a=b", false},
+		{"http://example.com/a", "", true},
+		{"http://example.com/announce/x", "", true},
+	}
+	for _, tt := range tests {
+		got, err := scrapeURL(tt.announce)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("scrapeURL(%q) error = %v, wantErr %v", tt.announce, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("scrapeURL(%q) = %q, want %q", tt.announce, got, tt.want)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	known := [20]byte{1, 2, 3}
+	unknown := [20]byte{4, 5, 6}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			t.Errorf("Scrape() requested %s", r.URL.Path)
+		}
+		if got := r.URL.Query()["info_hash"]; len(got) != 2 || got[0] != string(known[:]) {
+			t.Errorf("Scrape() info_hash = %q", got)
+		}
+		resp, _ := bencode.Marshal(bencodeScrapeResponse{Files: map[string]ScrapeResult{
+			string(known[:]): {Complete: 5, Downloaded: 20, Incomplete: 3},
+		}})
+		w.Write(resp)
+	}))
+	defer server.Close()
+
+	got, err := Scrape(server.URL+"/announce", known, unknown)
+	if err != nil {
+		t.Fatalf("Scrape() error = %v", err)
+	}
+	if len(got) != 1 || got[known] != (ScrapeResult{Complete: 5, Downloaded: 20, Incomplete: 3}) {
+		t.Errorf("Scrape() = %+v", got)
+	}
+}
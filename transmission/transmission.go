@@ -0,0 +1,531 @@
+// Package transmission serves the core of the Transmission RPC protocol
+// for a torrent.Client, so web UIs, scripts and other tools written for
+// Transmission can drive it.
+//
+// Requests are POSTed as JSON to the handler, usually mounted at
+// /transmission/rpc. The supported methods are torrent-add, torrent-get,
+// torrent-start, torrent-start-now, torrent-stop, torrent-remove,
+// session-get and session-stats. As in Transmission, a request without the
+// current X-Transmission-Session-Id header is refused with 409 Conflict and
+// told the ID to retry with, which stops other sites from forging
+// requests.
+package transmission
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"torrent"
+)
+
+// SessionIDHeader carries the CSRF token of the RPC handshake
+const SessionIDHeader = "X-Transmission-Session-Id"
+
+// rpcVersion is the RPC protocol version reported by session-get
+const (
+	rpcVersion        = 17
+	rpcVersionMinimum = 14
+)
+
+// maxRequestSize bounds request bodies, which can carry base64 metainfo
+const maxRequestSize = 16 << 20 // 16MB
+
+// Torrent status codes of torrent-get
+const (
+	statusStopped      = 0
+	statusCheckWait    = 1
+	statusCheck        = 2
+	statusDownloadWait = 3
+	statusDownload     = 4
+	statusSeedWait     = 5
+	statusSeed         = 6
+)
+
+// Server answers Transmission RPC requests for one client.
+type Server struct {
+	client    *torrent.Client
+	sessionID string
+	// username and password, if set, are required as HTTP basic auth
+	username, password string
+	started            time.Time
+
+	mu sync.Mutex
+	// Transmission names torrents by small integers; ids are handed out in
+	// the order torrents are first seen and never reused
+	ids    map[[20]byte]int
+	hashes map[int][20]byte
+	nextID int
+}
+
+// New returns a Transmission RPC handler for client. A non-empty username
+// and password are required as HTTP basic auth.
+func New(client *torrent.Client, username, password string) *Server {
+	var id [24]byte
+	rand.Read(id[:])
+	return &Server{
+		client:    client,
+		sessionID: base64.RawURLEncoding.EncodeToString(id[:]),
+		username:  username,
+		password:  password,
+		started:   time.Now(),
+		ids:       make(map[[20]byte]int),
+		hashes:    make(map[int][20]byte),
+		nextID:    1,
+	}
+}
+
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       *int            `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string `json:"result"`
+	Arguments any    `json:"arguments"`
+	Tag       *int   `json:"tag,omitempty"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.username != "" || s.password != "" {
+		user, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(s.username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(s.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Transmission"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.Header.Get(SessionIDHeader) != s.sessionID {
+		w.Header().Set(SessionIDHeader, s.sessionID)
+		http.Error(w, "invalid session ID; retry with the "+SessionIDHeader+" header", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	args, err := s.call(req.Method, req.Arguments)
+	resp := response{Result: "success", Arguments: args, Tag: req.Tag}
+	if err != nil {
+		resp.Result = err.Error()
+	}
+	if resp.Arguments == nil {
+		resp.Arguments = struct{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) call(method string, raw json.RawMessage) (any, error) {
+	if len(raw) == 0 {
+		raw = json.RawMessage("{}")
+	}
+	switch method {
+	case "torrent-add":
+		return s.torrentAdd(raw)
+	case "torrent-get":
+		return s.torrentGet(raw)
+	case "torrent-start", "torrent-start-now":
+		return nil, s.forEach(raw, start)
+	case "torrent-stop":
+		return nil, s.forEach(raw, func(t *torrent.Torrent) error {
+			t.Pause()
+			return nil
+		})
+	case "torrent-remove":
+		return nil, s.torrentRemove(raw)
+	case "session-get":
+		return s.sessionGet(), nil
+	case "session-stats":
+		return s.sessionStats(), nil
+	}
+	return nil, fmt.Errorf("method %q not supported", method)
+}
+
+// start runs a torrent the way Transmission does: downloading until
+// complete and seeding after.
+func start(t *torrent.Torrent) error {
+	if t.Status().State == torrent.StateComplete {
+		return t.Seed()
+	}
+	return t.Resume()
+}
+
+// idLocked returns the RPC id of the torrent with hash, assigning one if needed.
+// The caller must hold s.mu.
+func (s *Server) idLocked(hash [20]byte) int {
+	id, ok := s.ids[hash]
+	if !ok {
+		id = s.nextID
+		s.nextID++
+		s.ids[hash] = id
+		s.hashes[id] = hash
+	}
+	return id
+}
+
+// torrents returns the client's torrents in id order, with their ids.
+func (s *Server) torrents() ([]*torrent.Torrent, []int) {
+	list := s.client.Torrents()
+	// New torrents get ids in a stable order
+	slices.SortFunc(list, func(a, b *torrent.Torrent) int {
+		ha, hb := a.InfoHash(), b.InfoHash()
+		return bytes.Compare(ha[:], hb[:])
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range list {
+		s.idLocked(t.InfoHash())
+	}
+	slices.SortFunc(list, func(a, b *torrent.Torrent) int { return s.ids[a.InfoHash()] - s.ids[b.InfoHash()] })
+	ids := make([]int, len(list))
+	for i, t := range list {
+		ids[i] = s.ids[t.InfoHash()]
+	}
+	return list, ids
+}
+
+// selectIDs returns the torrents, with their ids, named by an "ids"
+// argument: absent for every torrent, or a number, hash string or list of
+// them. "recently-active" selects the torrents that are running.
+func (s *Server) selectIDs(raw json.RawMessage) ([]*torrent.Torrent, []int, error) {
+	var args struct {
+		IDs json.RawMessage `json:"ids"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, nil, err
+	}
+	list, ids := s.torrents()
+	if len(args.IDs) == 0 {
+		return list, ids, nil
+	}
+
+	var wanted []any
+	var one any
+	if err := json.Unmarshal(args.IDs, &one); err != nil {
+		return nil, nil, fmt.Errorf("invalid ids: %v", err)
+	}
+	switch v := one.(type) {
+	case []any:
+		wanted = v
+	case string:
+		if v == "recently-active" {
+			var active []*torrent.Torrent
+			var activeIDs []int
+			for i, t := range list {
+				if statusCode(t.Status()) != statusStopped {
+					active = append(active, t)
+					activeIDs = append(activeIDs, ids[i])
+				}
+			}
+			return active, activeIDs, nil
+		}
+		wanted = []any{v}
+	default:
+		wanted = []any{v}
+	}
+
+	var outList []*torrent.Torrent
+	var outIDs []int
+	for i, t := range list {
+		hash := t.InfoHash()
+		hashString := hex.EncodeToString(hash[:])
+		for _, w := range wanted {
+			match := false
+			switch w := w.(type) {
+			case float64:
+				match = int(w) == ids[i]
+			case string:
+				match = strings.EqualFold(w, hashString)
+			}
+			if match {
+				outList = append(outList, t)
+				outIDs = append(outIDs, ids[i])
+				break
+			}
+		}
+	}
+	return outList, outIDs, nil
+}
+
+func (s *Server) forEach(raw json.RawMessage, fn func(*torrent.Torrent) error) error {
+	list, _, err := s.selectIDs(raw)
+	if err != nil {
+		return err
+	}
+	for _, t := range list {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) torrentAdd(raw json.RawMessage) (any, error) {
+	var args struct {
+		Filename string `json:"filename"`
+		Metainfo string `json:"metainfo"`
+		Paused   bool   `json:"paused"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	var infoHash [20]byte
+	var add func() (*torrent.Torrent, error)
+	switch {
+	case args.Metainfo != "":
+		data, err := base64.StdEncoding.DecodeString(args.Metainfo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metainfo: %v", err)
+		}
+		mi, err := torrent.Parse(data)
+		if err != nil {
+			return nil, err
+		}
+		tf, err := mi.ToTorrentFile()
+		if err != nil {
+			return nil, err
+		}
+		infoHash = tf.InfoHash
+		add = func() (*torrent.Torrent, error) { return s.client.AddMetaInfo(mi) }
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		m, err := torrent.ParseMagnet(args.Filename)
+		if err != nil {
+			return nil, err
+		}
+		infoHash = m.InfoHash
+		add = func() (*torrent.Torrent, error) { return s.client.AddMagnet(args.Filename) }
+	case args.Filename != "":
+		// Fetching .torrent URLs isn't supported; the caller must send
+		// the file itself
+		return nil, errors.New("filename must be a magnet link; send .torrent files as metainfo")
+	default:
+		return nil, errors.New("no filename or metainfo")
+	}
+
+	if t, ok := s.client.Torrent(infoHash); ok {
+		return map[string]any{"torrent-duplicate": s.summary(t)}, nil
+	}
+	t, err := add()
+	if err != nil {
+		return nil, err
+	}
+	if !args.Paused {
+		if err := t.Start(); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]any{"torrent-added": s.summary(t)}, nil
+}
+
+// summary is how torrent-add describes a torrent.
+func (s *Server) summary(t *torrent.Torrent) map[string]any {
+	hash := t.InfoHash()
+	s.mu.Lock()
+	id := s.idLocked(hash)
+	s.mu.Unlock()
+	return map[string]any{"id": id, "name": t.Name(), "hashString": hex.EncodeToString(hash[:])}
+}
+
+func (s *Server) torrentRemove(raw json.RawMessage) error {
+	var args struct {
+		DeleteLocalData bool `json:"delete-local-data"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+	if args.DeleteLocalData {
+		return errors.New("delete-local-data is not supported")
+	}
+	return s.forEach(raw, func(t *torrent.Torrent) error { return t.Remove() })
+}
+
+func statusCode(st torrent.Status) int {
+	switch st.State {
+	case torrent.StateChecking:
+		return statusCheck
+	case torrent.StateQueued:
+		if st.PiecesWanted > 0 && st.PiecesDone == st.PiecesWanted {
+			return statusSeedWait
+		}
+		return statusDownloadWait
+	case torrent.StateFetchingMetadata, torrent.StateDownloading:
+		return statusDownload
+	case torrent.StateSeeding:
+		return statusSeed
+	}
+	return statusStopped
+}
+
+func (s *Server) torrentGet(raw json.RawMessage) (any, error) {
+	var args struct {
+		Fields []string `json:"fields"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if len(args.Fields) == 0 {
+		return nil, errors.New("no fields requested")
+	}
+	list, ids, err := s.selectIDs(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]map[string]any, 0, len(list))
+	for i, t := range list {
+		info := torrentFields(t, ids[i], s.client.Config().DataDir)
+		entry := make(map[string]any, len(args.Fields))
+		for _, f := range args.Fields {
+			if v, ok := info[f]; ok {
+				entry[f] = v
+			}
+		}
+		out = append(out, entry)
+	}
+	return map[string]any{"torrents": out}, nil
+}
+
+// torrentFields returns every torrent-get field we support for t.
+func torrentFields(t *torrent.Torrent, id int, dataDir string) map[string]any {
+	hash := t.InfoHash()
+	st, stats := t.Status(), t.Stats()
+
+	pieceLength, metadataDone := 0, 0.0
+	if tf := t.Info(); tf != nil {
+		pieceLength, metadataDone = tf.PieceLength, 1
+	}
+	percentDone, sizeWhenDone, left := 0.0, 0, 0
+	if st.PiecesWanted > 0 {
+		percentDone = float64(st.PiecesDone) / float64(st.PiecesWanted)
+		sizeWhenDone = min(st.PiecesWanted*pieceLength, st.Length)
+		left = min((st.PiecesWanted-st.PiecesDone)*pieceLength, sizeWhenDone)
+	}
+	eta := -1
+	if stats.ETA > 0 {
+		eta = int(stats.ETA.Seconds())
+	}
+	ratio := -1.0
+	if stats.BytesDownloaded > 0 {
+		ratio = float64(stats.BytesUploaded) / float64(stats.BytesDownloaded)
+	}
+	errCode, errString := 0, ""
+	if st.Err != nil {
+		// 3 is a local error
+		errCode, errString = 3, st.Err.Error()
+	}
+	if dataDir == "" {
+		dataDir = "."
+	}
+
+	return map[string]any{
+		"id":                      id,
+		"hashString":              hex.EncodeToString(hash[:]),
+		"name":                    st.Name,
+		"status":                  statusCode(st),
+		"totalSize":               st.Length,
+		"sizeWhenDone":            sizeWhenDone,
+		"leftUntilDone":           left,
+		"percentDone":             percentDone,
+		"rateDownload":            int(stats.DownloadRate),
+		"rateUpload":              int(stats.UploadRate),
+		"downloadedEver":          stats.BytesDownloaded,
+		"uploadedEver":            stats.BytesUploaded,
+		"uploadRatio":             ratio,
+		"eta":                     eta,
+		"peersConnected":          stats.Peers,
+		"isFinished":              st.State == torrent.StateComplete,
+		"error":                   errCode,
+		"errorString":             errString,
+		"downloadDir":             dataDir,
+		"pieceCount":              st.PiecesTotal,
+		"pieceSize":               pieceLength,
+		"metadataPercentComplete": metadataDone,
+	}
+}
+
+func (s *Server) sessionGet() map[string]any {
+	cfg := s.client.Config()
+	down, up := s.client.RateLimits()
+	dataDir := cfg.DataDir
+	if dataDir == "" {
+		dataDir = "."
+	}
+	return map[string]any{
+		"version":                  "torrent-go",
+		"rpc-version":              rpcVersion,
+		"rpc-version-minimum":      rpcVersionMinimum,
+		"session-id":               s.sessionID,
+		"download-dir":             dataDir,
+		"peer-port":                cfg.ListenPort,
+		"peer-limit-global":        cfg.MaxConnections,
+		"peer-limit-per-torrent":   cfg.MaxPeers,
+		"speed-limit-down":         down / 1024,
+		"speed-limit-down-enabled": down > 0,
+		"speed-limit-up":           up / 1024,
+		"speed-limit-up-enabled":   up > 0,
+		"download-queue-size":      cfg.MaxActiveDownloads,
+		"download-queue-enabled":   cfg.MaxActiveDownloads > 0,
+		"seed-queue-size":          cfg.MaxActiveSeeds,
+		"seed-queue-enabled":       cfg.MaxActiveSeeds > 0,
+		"units": map[string]any{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  1024,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1024,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+}
+
+func (s *Server) sessionStats() map[string]any {
+	list := s.client.Torrents()
+	active, paused := 0, 0
+	for _, t := range list {
+		if statusCode(t.Status()) == statusStopped {
+			paused++
+		} else {
+			active++
+		}
+	}
+	stats := s.client.Stats()
+	// Only this session is known; nothing is persisted across runs
+	session := map[string]any{
+		"downloadedBytes": stats.BytesDownloaded,
+		"uploadedBytes":   stats.BytesUploaded,
+		"filesAdded":      len(list),
+		"sessionCount":    1,
+		"secondsActive":   int(time.Since(s.started).Seconds()),
+	}
+	return map[string]any{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(list),
+		"downloadSpeed":      int(stats.DownloadRate),
+		"uploadSpeed":        int(stats.UploadRate),
+		"cumulative-stats":   session,
+		"current-stats":      session,
+	}
+}
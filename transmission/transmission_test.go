@@ -0,0 +1,204 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"torrent"
+)
+
+// rpcClient speaks the RPC protocol the way Transmission clients do,
+// retrying once with the session ID a 409 hands out.
+type rpcClient struct {
+	t         *testing.T
+	url       string
+	sessionID string
+}
+
+func (c *rpcClient) call(method string, args any) (string, map[string]any) {
+	c.t.Helper()
+	body, _ := json.Marshal(map[string]any{"method": method, "arguments": args, "tag": 7})
+	for attempt := 0; attempt < 2; attempt++ {
+		req, _ := http.NewRequest("POST", c.url, bytes.NewReader(body))
+		req.SetBasicAuth("admin", "hunter2")
+		req.Header.Set(SessionIDHeader, c.sessionID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if resp.StatusCode == http.StatusConflict {
+			c.sessionID = resp.Header.Get(SessionIDHeader)
+			resp.Body.Close()
+			continue
+		}
+		defer resp.Body.Close()
+		var out struct {
+			Result    string         `json:"result"`
+			Arguments map[string]any `json:"arguments"`
+			Tag       int            `json:"tag"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			c.t.Fatalf("%s: decoding answer: %v", method, err)
+		}
+		if out.Tag != 7 {
+			c.t.Errorf("%s: tag = %d, want 7", method, out.Tag)
+		}
+		return out.Result, out.Arguments
+	}
+	c.t.Fatalf("%s: session ID refused twice", method)
+	return "", nil
+}
+
+func newTestRPC(t *testing.T) (*rpcClient, *httptest.Server, []byte) {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "release")
+	os.MkdirAll(root, 0755)
+	if err := os.WriteFile(filepath.Join(root, "a.bin"), bytes.Repeat([]byte("a"), 40000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mi, err := torrent.Create(root, torrent.CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	var buf bytes.Buffer
+	mi.Write(&buf)
+
+	client, _ := torrent.NewClient(torrent.ClientConfig{DataDir: t.TempDir(), UploadRateLimit: 2048})
+	t.Cleanup(func() { client.Close() })
+	srv := httptest.NewServer(New(client, "admin", "hunter2"))
+	t.Cleanup(srv.Close)
+	return &rpcClient{t: t, url: srv.URL}, srv, buf.Bytes()
+}
+
+func TestSessionHandshake(t *testing.T) {
+	_, srv, _ := newTestRPC(t)
+
+	req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(`{"method":"session-get"}`))
+	req.SetBasicAuth("admin", "hunter2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get(SessionIDHeader) == "" {
+		t.Errorf("request without session ID: status %d, header %q", resp.StatusCode, resp.Header.Get(SessionIDHeader))
+	}
+
+	req, _ = http.NewRequest("POST", srv.URL, strings.NewReader(`{"method":"session-get"}`))
+	req.SetBasicAuth("admin", "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad password status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestSession(t *testing.T) {
+	c, _, _ := newTestRPC(t)
+	result, args := c.call("session-get", nil)
+	if result != "success" {
+		t.Fatalf("session-get result = %q", result)
+	}
+	if args["rpc-version"] != float64(rpcVersion) || args["speed-limit-up"] != float64(2) || args["speed-limit-up-enabled"] != true {
+		t.Errorf("session-get = %v", args)
+	}
+	if args["session-id"] != c.sessionID {
+		t.Errorf("session-id = %v, want %q", args["session-id"], c.sessionID)
+	}
+
+	result, args = c.call("session-stats", nil)
+	if result != "success" || args["torrentCount"] != float64(0) {
+		t.Errorf("session-stats = %q %v", result, args)
+	}
+
+	if result, _ := c.call("port-test", nil); result == "success" {
+		t.Errorf("unsupported method succeeded")
+	}
+}
+
+func TestTorrentMethods(t *testing.T) {
+	c, _, data := newTestRPC(t)
+
+	result, args := c.call("torrent-add", map[string]any{
+		"metainfo": base64.StdEncoding.EncodeToString(data),
+		"paused":   true,
+	})
+	added, ok := args["torrent-added"].(map[string]any)
+	if result != "success" || !ok || added["id"] != float64(1) || added["name"] != "release" {
+		t.Fatalf("torrent-add = %q %v", result, args)
+	}
+	hash := added["hashString"].(string)
+
+	_, args = c.call("torrent-add", map[string]any{"metainfo": base64.StdEncoding.EncodeToString(data)})
+	if dup, ok := args["torrent-duplicate"].(map[string]any); !ok || dup["id"] != float64(1) {
+		t.Errorf("adding twice = %v, want torrent-duplicate", args)
+	}
+
+	magnet := "magnet:?xt=urn:btih:" + strings.Repeat("ab", 20) + "&dn=other"
+	_, args = c.call("torrent-add", map[string]any{"filename": magnet, "paused": true})
+	if other, ok := args["torrent-added"].(map[string]any); !ok || other["id"] != float64(2) {
+		t.Errorf("torrent-add magnet = %v", args)
+	}
+
+	get := func(ids any) []any {
+		t.Helper()
+		req := map[string]any{"fields": []string{"id", "name", "status", "totalSize", "percentDone", "hashString"}}
+		if ids != nil {
+			req["ids"] = ids
+		}
+		result, args := c.call("torrent-get", req)
+		if result != "success" {
+			t.Fatalf("torrent-get result = %q", result)
+		}
+		return args["torrents"].([]any)
+	}
+
+	if all := get(nil); len(all) != 2 {
+		t.Fatalf("torrent-get every torrent = %v", all)
+	}
+	for _, ids := range []any{1, []any{1}, hash, []any{strings.ToUpper(hash)}} {
+		got := get(ids)
+		if len(got) != 1 {
+			t.Errorf("torrent-get ids %v = %v", ids, got)
+			continue
+		}
+		tr := got[0].(map[string]any)
+		if tr["id"] != float64(1) || tr["totalSize"] != float64(40000) || tr["status"] != float64(statusStopped) {
+			t.Errorf("torrent-get ids %v = %v", ids, tr)
+		}
+		if _, ok := tr["rateUpload"]; ok {
+			t.Errorf("torrent-get returned a field that wasn't asked for")
+		}
+	}
+	if active := get("recently-active"); len(active) != 0 {
+		t.Errorf("recently-active = %v, want none", active)
+	}
+
+	// Starting without peers fails the download, which stops it again
+	if result, _ := c.call("torrent-start", map[string]any{"ids": []any{1}}); result != "success" {
+		t.Errorf("torrent-start result = %q", result)
+	}
+	if result, _ := c.call("torrent-stop", map[string]any{"ids": []any{1}}); result != "success" {
+		t.Errorf("torrent-stop result = %q", result)
+	}
+
+	if result, _ := c.call("torrent-remove", map[string]any{"ids": []any{2}, "delete-local-data": true}); result == "success" {
+		t.Errorf("torrent-remove with delete-local-data succeeded")
+	}
+	if result, _ := c.call("torrent-remove", map[string]any{"ids": []any{2}}); result != "success" {
+		t.Errorf("torrent-remove result = %q", result)
+	}
+	if rest := get(nil); len(rest) != 1 || rest[0].(map[string]any)["id"] != float64(1) {
+		t.Errorf("torrents after remove = %v", rest)
+	}
+}
@@ -0,0 +1,120 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Verify hashes the torrent's data on disk and returns the pieces that are
+// complete. The result is recorded so that a following download only
+// fetches the remaining pieces and a seed only offers verified ones.
+// Nothing is created or written; missing files make their pieces missing.
+func (t *TorrentFile) Verify() (Bitfield, error) {
+	return t.verify(context.Background(), nil)
+}
+
+// verify checks every piece, calling progress after each one.
+func (t *TorrentFile) verify(ctx context.Context, progress func(checked, total int)) (Bitfield, error) {
+	pieces := t.pieceWorks()
+	have := make(Bitfield, (len(pieces)+7)/8)
+
+	disk := newDiskReader(t)
+	defer disk.Close()
+
+	for i, pw := range pieces {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, pw.length)
+		if disk.ReadAt(buf, int64(pw.index*t.PieceLength)) == nil && t.checkPiece(pw, buf) == nil {
+			have.SetPiece(pw.index)
+		}
+		if progress != nil {
+			progress(i+1, len(pieces))
+		}
+	}
+
+	t.selection().setHave(have)
+	return have, nil
+}
+
+// diskReader reads torrent data that is already on disk without creating
+// any files. Bytes of files that don't exist are looked up in the part
+// file that storage keeps the edges of skipped files in.
+type diskReader struct {
+	files    []File
+	handles  map[int]*os.File
+	partPath string
+	part     *os.File
+}
+
+func newDiskReader(t *TorrentFile) *diskReader {
+	s := newStorage(t)
+	return &diskReader{
+		files:    s.files,
+		handles:  make(map[int]*os.File),
+		partPath: s.partPath,
+	}
+}
+
+// ReadAt fills p from the torrent-wide offset off, failing if any of it is
+// missing.
+func (d *diskReader) ReadAt(p []byte, off int64) error {
+	// Padding isn't stored anywhere
+	clear(p)
+
+	for _, sp := range fileSpans(d.files, off, len(p)) {
+		chunk := p[sp.bufOff : sp.bufOff+sp.length]
+		f, err := d.open(sp.file)
+		if os.IsNotExist(err) {
+			if err := d.readPart(chunk, off+int64(sp.bufOff)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := f.ReadAt(chunk, sp.fileOff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *diskReader) open(index int) (*os.File, error) {
+	if f, ok := d.handles[index]; ok {
+		return f, nil
+	}
+	f, err := os.Open(d.files[index].Path)
+	if err != nil {
+		return nil, err
+	}
+	d.handles[index] = f
+	return f, nil
+}
+
+func (d *diskReader) readPart(chunk []byte, off int64) error {
+	if d.part == nil {
+		part, err := os.Open(d.partPath)
+		if err != nil {
+			return err
+		}
+		d.part = part
+	}
+	if _, err := d.part.ReadAt(chunk, off); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (d *diskReader) Close() error {
+	for _, f := range d.handles {
+		f.Close()
+	}
+	if d.part != nil {
+		d.part.Close()
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "release")
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(root, "a.bin"), bytes.Repeat([]byte("a"), 40000), 0644)
+	os.WriteFile(filepath.Join(root, "b.bin"), bytes.Repeat([]byte("b"), 30000), 0644)
+
+	mi, err := Create(root, CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	tf, err := mi.ToTorrentFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.rootAt(dir)
+
+	count := func(have Bitfield) int {
+		n := 0
+		for i := 0; i < tf.NumPieces(); i++ {
+			if have.HasPiece(i) {
+				n++
+			}
+		}
+		return n
+	}
+
+	have, err := tf.Verify()
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if got := count(have); got != 5 {
+		t.Errorf("Verify() of intact data = %d pieces, want 5", got)
+	}
+
+	// Corrupt the first piece
+	f, _ := os.OpenFile(filepath.Join(root, "a.bin"), os.O_RDWR, 0)
+	f.WriteAt([]byte("x"), 10)
+	f.Close()
+	have, _ = tf.Verify()
+	if have.HasPiece(0) || count(have) != 4 {
+		t.Errorf("Verify() after corruption = %08b, want all but piece 0", have)
+	}
+	if sel := tf.selection().haveSnapshot(); !bytes.Equal(sel, have) {
+		t.Errorf("Verify() recorded %08b, want %08b", sel, have)
+	}
+
+	// Pieces of a missing file are missing and the file isn't created
+	os.Remove(filepath.Join(root, "b.bin"))
+	have, _ = tf.Verify()
+	if count(have) != 1 || !have.HasPiece(1) {
+		t.Errorf("Verify() without b.bin = %08b, want only piece 1", have)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b.bin")); !os.IsNotExist(err) {
+		t.Errorf("Verify() created the missing file")
+	}
+}
@@ -0,0 +1,164 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	webSeedMinBackoff  = time.Second
+	webSeedMaxBackoff  = 2 * time.Minute
+	webSeedMaxFailures = 8
+)
+
+// webSeed is a BEP 19 (GetRight style) web seed: a plain HTTP server
+// holding the torrent's files, which we treat as a peer that has every
+// piece and fetch byte ranges from.
+type webSeed struct {
+	url    string
+	client *http.Client
+	// After a failed piece the seed waits minBackoff, doubling up to
+	// maxBackoff, and is dropped after maxFailures failures in a row
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxFailures int
+	// cfg carries the download's rate limit, stats and event sink
+	cfg peerConfig
+}
+
+func newWebSeed(rawURL string) *webSeed {
+	return &webSeed{
+		url:         rawURL,
+		client:      &http.Client{Timeout: 60 * time.Second},
+		minBackoff:  webSeedMinBackoff,
+		maxBackoff:  webSeedMaxBackoff,
+		maxFailures: webSeedMaxFailures,
+	}
+}
+
+// fileURL returns the URL of f on the seed. A URL for a single-file torrent
+// names the file itself unless it ends in a slash; otherwise the file's
+// path, starting with the torrent name, is appended.
+func (ws *webSeed) fileURL(t *TorrentFile, f File) string {
+	if f.Path == t.Name && !strings.HasSuffix(ws.url, "/") {
+		return ws.url
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(t.Name), f.Path)
+	if err != nil {
+		rel = f.Path
+	}
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	for i, elem := range elems {
+		elems[i] = url.PathEscape(elem)
+	}
+
+	base := ws.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + strings.Join(elems, "/")
+}
+
+// fetchPiece downloads a piece with one range request per file it spans.
+func (ws *webSeed) fetchPiece(ctx context.Context, t *TorrentFile, pw *pieceWork) ([]byte, error) {
+	buf := make([]byte, pw.length)
+	files := t.files()
+	for _, sp := range fileSpans(files, int64(pw.index*t.PieceLength), pw.length) {
+		dst := buf[sp.bufOff : sp.bufOff+sp.length]
+		if err := ws.fetchRange(ctx, ws.fileURL(t, files[sp.file]), sp.fileOff, dst); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// fetchRange reads len(p) bytes at off from the file at fileURL.
+func (ws *webSeed) fetchRange(ctx context.Context, fileURL string, off int64, p []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body := io.Reader(resp.Body)
+	if down, _ := ws.cfg.meters(); len(ws.cfg.download) > 0 || down != nil {
+		body = &limitedReader{ctx: ctx, r: resp.Body, limit: ws.cfg.download, count: down}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", off)) {
+			return fmt.Errorf("web seed returned range %q", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// The server ignored the range; skip to the part we want
+		if _, err := io.CopyN(io.Discard, body, off); err != nil {
+			return fmt.Errorf("failed to read %s: %v", fileURL, err)
+		}
+	default:
+		return fmt.Errorf("web seed returned status code %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	if _, err := io.ReadFull(body, p); err != nil {
+		return fmt.Errorf("failed to read %s: %v", fileURL, err)
+	}
+	return nil
+}
+
+// startWebSeed downloads pieces from a web seed until the queue is closed
+// or the seed keeps failing.
+func (t *TorrentFile) startWebSeed(ctx context.Context, ws *webSeed, queue *workQueue, results chan *pieceResult, store io.WriterAt) {
+	backoff := ws.minBackoff
+	failures := 0
+	for {
+		pw, ok := queue.pop(func(int) bool { return true })
+		if !ok {
+			return
+		}
+
+		buf, err := ws.fetchPiece(ctx, t, pw)
+		if err == nil {
+			err = t.VerifyAndSave(pw, buf, store)
+		}
+		if errors.Is(err, errHashMismatch) {
+			ws.cfg.hashFailed(pw.index, ws.url)
+		}
+		if err != nil {
+			queue.requeue(pw)
+			failures++
+			if failures >= ws.maxFailures {
+				ws.cfg.logger().Warn("web seed dropped", "url", ws.url, "failures", failures, "err", err)
+				return
+			}
+			ws.cfg.logger().Debug("web seed piece failed", "url", ws.url, "piece", pw.index, "err", err, "retry_in", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, ws.maxBackoff)
+			continue
+		}
+
+		failures = 0
+		backoff = ws.minBackoff
+		select {
+		case results <- &pieceResult{pw.index, buf}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
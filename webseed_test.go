@@ -0,0 +1,191 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWebSeedTestTorrent creates "release" under a served directory and
+// returns the served directory, the torrent re-rooted under an empty
+// download directory, and the file contents by path.
+func newWebSeedTestTorrent(t *testing.T) (string, *TorrentFile, map[string][]byte) {
+	t.Helper()
+	served := t.TempDir()
+	root := filepath.Join(served, "release")
+	os.MkdirAll(filepath.Join(root, "my bin"), 0755)
+	contents := map[string][]byte{
+		"README":      bytes.Repeat([]byte("readme "), 3000),
+		"my bin/tool": bytes.Repeat([]byte("0123456789"), 5000),
+	}
+	for name, data := range contents {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bt, err := Create(root, CreateOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	tf, err := bt.ToTorrentFile()
+	if err != nil {
+		t.Fatalf("ToTorrentFile() error = %v", err)
+	}
+
+	dl := t.TempDir()
+	tf.Name = filepath.Join(dl, tf.Name)
+	for i := range tf.Files {
+		tf.Files[i].Path = filepath.Join(dl, tf.Files[i].Path)
+	}
+	return served, &tf, contents
+}
+
+// runWebSeed downloads every piece of tf from ws and reports whether it
+// finished before the seed gave up.
+func runWebSeed(t *testing.T, tf *TorrentFile, ws *webSeed) bool {
+	t.Helper()
+	queue := newWorkQueue(tf.pieceWorks(), tf.PiecePriorities())
+	store := newStorage(tf)
+	results := make(chan *pieceResult)
+	go func() {
+		tf.startWebSeed(context.Background(), ws, queue, results, store)
+		close(results)
+	}()
+
+	for res := range results {
+		queue.done(res.index)
+		if done, wanted, _ := queue.progress(); done == wanted {
+			queue.close()
+		}
+	}
+	store.Close()
+	done, wanted, _ := queue.progress()
+	return done == wanted
+}
+
+func fastWebSeed(url string) *webSeed {
+	ws := newWebSeed(url)
+	ws.minBackoff = time.Millisecond
+	ws.maxBackoff = 4 * time.Millisecond
+	return ws
+}
+
+func TestWebSeedFileURL(t *testing.T) {
+	single := &TorrentFile{Name: "/dl/file.iso", Length: 10}
+	multi := &TorrentFile{
+		Name: "/dl/release",
+		Files: []File{
+			{Path: "/dl/release/my bin/tool", Length: 5},
+			{Path: "/dl/release/README", Length: 5, Offset: 5},
+		},
+	}
+
+	tests := []struct {
+		name string
+		seed string
+		t    *TorrentFile
+		file File
+		want string
+	}{
+		{"single file URL", "http://seed/x/file.iso", single, single.files()[0], "http://seed/x/file.iso"},
+		{"single file directory", "http://seed/x/", single, single.files()[0], "http://seed/x/file.iso"},
+		{"multi file", "http://seed/x/", multi, multi.Files[1], "http://seed/x/release/README"},
+		{"multi file without slash", "http://seed/x", multi, multi.Files[1], "http://seed/x/release/README"},
+		{"escaped path", "http://seed/", multi, multi.Files[0], "http://seed/release/my%20bin/tool"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newWebSeed(tt.seed).fileURL(tt.t, tt.file); got != tt.want {
+				t.Errorf("fileURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	served, tf, contents := newWebSeedTestTorrent(t)
+	var ranged atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranged.Add(1)
+		}
+		http.FileServer(http.Dir(served)).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	if !runWebSeed(t, tf, fastWebSeed(server.URL+"/")) {
+		t.Fatalf("startWebSeed() gave up before finishing")
+	}
+	for name, want := range contents {
+		got, err := os.ReadFile(filepath.Join(tf.Name, name))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s does not match the seed's copy", name)
+		}
+	}
+	// One piece straddles README and tool, so there is a request per span
+	if want := int32(len(tf.PieceHashes) + 1); ranged.Load() != want {
+		t.Errorf("web seed made %d range requests, want %d", ranged.Load(), want)
+	}
+}
+
+func TestWebSeedBackoff(t *testing.T) {
+	served, tf, _ := newWebSeedTestTorrent(t)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1, 2:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		case 3:
+			// Ignore the range and send the whole file
+			r.Header.Del("Range")
+			http.ServeFile(w, r, filepath.Join(served, strings.TrimPrefix(r.URL.Path, "/")))
+		default:
+			http.FileServer(http.Dir(served)).ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+
+	if !runWebSeed(t, tf, fastWebSeed(server.URL)) {
+		t.Errorf("startWebSeed() should recover from transient errors")
+	}
+}
+
+func TestWebSeedGivesUp(t *testing.T) {
+	_, tf, _ := newWebSeedTestTorrent(t)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}},
+		{"corrupt data", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(bytes.Repeat([]byte{'x'}, 100000))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			ws := fastWebSeed(server.URL)
+			ws.maxFailures = 3
+			if runWebSeed(t, tf, ws) {
+				t.Errorf("startWebSeed() finished with a bad seed")
+			}
+		})
+	}
+}
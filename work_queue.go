@@ -0,0 +1,176 @@
+package torrent
+
+import "sync"
+
+type pieceState uint8
+
+const (
+	piecePending pieceState = iota
+	pieceActive
+	pieceDone
+)
+
+// workQueue hands pieces to workers in priority order. Unlike a plain
+// channel it lets priorities change while workers are running and only
+// hands a worker pieces its peer actually has.
+type workQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pieces   []*pieceWork
+	priority []Priority
+	// boost ranks pieces wanted by streaming readers above every file
+	// priority; larger values are needed sooner.
+	boost  []int
+	state  []pieceState
+	closed bool
+	// changed is closed and replaced whenever the queue's state changes.
+	changed chan struct{}
+}
+
+func newWorkQueue(pieces []*pieceWork, priorities []Priority) *workQueue {
+	q := &workQueue{
+		pieces:   pieces,
+		priority: priorities,
+		boost:    make([]int, len(pieces)),
+		state:    make([]pieceState, len(pieces)),
+		changed:  make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// notify wakes blocked workers and anyone watching changed. The caller must
+// hold q.mu.
+func (q *workQueue) notify() {
+	q.cond.Broadcast()
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// pop blocks until there is a wanted pending piece for which has returns
+// true and marks it active. It returns false once the queue is closed.
+func (q *workQueue) pop(has func(index int) bool) (*pieceWork, bool) {
+	return q.popUnless(has, func() bool { return false })
+}
+
+// popUnless is pop for a worker that can give up: it also returns false
+// once gone reports true, which it checks whenever the queue is woken.
+func (q *workQueue) popUnless(has func(index int) bool, gone func() bool) (*pieceWork, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed || gone() {
+			return nil, false
+		}
+
+		best := -1
+		for i, st := range q.state {
+			if st != piecePending || q.rank(i) == 0 || !has(i) {
+				continue
+			}
+			if best == -1 || q.rank(i) > q.rank(best) {
+				best = i
+			}
+		}
+		if best != -1 {
+			q.state[best] = pieceActive
+			q.notify()
+			return q.pieces[best], true
+		}
+		q.cond.Wait()
+	}
+}
+
+// requeue returns an active piece to the pending set, e.g. after its peer
+// failed. It is safe to call after close.
+func (q *workQueue) requeue(pw *pieceWork) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.state[pw.index] == pieceActive {
+		q.state[pw.index] = piecePending
+		q.notify()
+	}
+}
+
+// wake makes blocked workers look again, e.g. after their peer announced
+// more pieces.
+func (q *workQueue) wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// done marks a piece as verified and saved.
+func (q *workQueue) done(index int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.state[index] = pieceDone
+	q.notify()
+}
+
+func (q *workQueue) setPriorities(priorities []Priority) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	copy(q.priority, priorities)
+	q.notify()
+}
+
+// setBoost replaces the reader boost of every piece.
+func (q *workQueue) setBoost(boost []int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	copy(q.boost, boost)
+	q.notify()
+}
+
+// rank orders pieces for pop; zero means the piece isn't wanted. The caller
+// must hold q.mu.
+func (q *workQueue) rank(index int) int {
+	if q.boost[index] > 0 {
+		return int(PriorityHigh) + q.boost[index]
+	}
+	return int(q.priority[index])
+}
+
+// progress reports how many wanted pieces are done out of how many are
+// wanted, and returns a channel that is closed on the next change.
+func (q *workQueue) progress() (done, wanted int, changed <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, st := range q.state {
+		if st == pieceDone {
+			done++
+			wanted++
+		} else if q.rank(i) > 0 {
+			wanted++
+		}
+	}
+	return done, wanted, q.changed
+}
+
+// depth reports how many wanted pieces wait for a worker and how many are
+// being downloaded.
+func (q *workQueue) depth() (pending, active int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, st := range q.state {
+		switch {
+		case st == pieceActive:
+			active++
+		case st == piecePending && q.rank(i) > 0:
+			pending++
+		}
+	}
+	return pending, active
+}
+
+// close releases every worker blocked in pop.
+func (q *workQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		q.notify()
+	}
+}
@@ -0,0 +1,101 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestQueue(priorities ...Priority) *workQueue {
+	pieces := make([]*pieceWork, len(priorities))
+	for i := range pieces {
+		pieces[i] = &pieceWork{index: i, length: 10}
+	}
+	return newWorkQueue(pieces, priorities)
+}
+
+func hasAll(int) bool { return true }
+
+func TestWorkQueuePopOrder(t *testing.T) {
+	q := newTestQueue(PriorityLow, PrioritySkip, PriorityHigh, PriorityNormal)
+
+	want := []int{2, 3, 0}
+	for _, idx := range want {
+		pw, ok := q.pop(hasAll)
+		if !ok {
+			t.Fatalf("pop() returned closed queue")
+		}
+		if pw.index != idx {
+			t.Errorf("pop() index = %d, want %d", pw.index, idx)
+		}
+	}
+}
+
+func TestWorkQueuePopRespectsBitfield(t *testing.T) {
+	q := newTestQueue(PriorityNormal, PriorityNormal, PriorityNormal)
+	bf := Bitfield{0b00100000} // only piece 2
+
+	pw, ok := q.pop(bf.HasPiece)
+	if !ok || pw.index != 2 {
+		t.Errorf("pop() = %v, want piece 2", pw)
+	}
+}
+
+func TestWorkQueueRequeueAndDone(t *testing.T) {
+	q := newTestQueue(PriorityNormal, PriorityNormal)
+
+	pw, _ := q.pop(hasAll)
+	q.requeue(pw)
+	again, _ := q.pop(hasAll)
+	if again.index != pw.index {
+		t.Errorf("pop() after requeue index = %d, want %d", again.index, pw.index)
+	}
+
+	q.done(again.index)
+	done, wanted, _ := q.progress()
+	if done != 1 || wanted != 2 {
+		t.Errorf("progress() = %d/%d, want 1/2", done, wanted)
+	}
+}
+
+func TestWorkQueueCloseUnblocksPop(t *testing.T) {
+	q := newTestQueue(PrioritySkip)
+
+	result := make(chan bool)
+	go func() {
+		_, ok := q.pop(hasAll)
+		result <- ok
+	}()
+
+	q.close()
+	select {
+	case ok := <-result:
+		if ok {
+			t.Errorf("pop() on closed queue should return false")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("pop() did not return after close")
+	}
+
+	// Requeueing after close must not panic
+	q.requeue(&pieceWork{index: 0})
+}
+
+func TestWorkQueuePriorityChangeWakesPop(t *testing.T) {
+	q := newTestQueue(PrioritySkip)
+
+	result := make(chan int)
+	go func() {
+		pw, _ := q.pop(hasAll)
+		result <- pw.index
+	}()
+
+	q.setPriorities([]Priority{PriorityHigh})
+	select {
+	case idx := <-result:
+		if idx != 0 {
+			t.Errorf("pop() index = %d, want 0", idx)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("pop() did not wake after priority change")
+	}
+}